@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// usStates maps the USPS state and territory codes, including the military "states", to their names
+var usStates = map[string]string{
+	"AL": "ALABAMA", "AK": "ALASKA", "AZ": "ARIZONA", "AR": "ARKANSAS", "CA": "CALIFORNIA",
+	"CO": "COLORADO", "CT": "CONNECTICUT", "DE": "DELAWARE", "DC": "DISTRICT OF COLUMBIA",
+	"FL": "FLORIDA", "GA": "GEORGIA", "HI": "HAWAII", "ID": "IDAHO", "IL": "ILLINOIS",
+	"IN": "INDIANA", "IA": "IOWA", "KS": "KANSAS", "KY": "KENTUCKY", "LA": "LOUISIANA",
+	"ME": "MAINE", "MD": "MARYLAND", "MA": "MASSACHUSETTS", "MI": "MICHIGAN", "MN": "MINNESOTA",
+	"MS": "MISSISSIPPI", "MO": "MISSOURI", "MT": "MONTANA", "NE": "NEBRASKA", "NV": "NEVADA",
+	"NH": "NEW HAMPSHIRE", "NJ": "NEW JERSEY", "NM": "NEW MEXICO", "NY": "NEW YORK",
+	"NC": "NORTH CAROLINA", "ND": "NORTH DAKOTA", "OH": "OHIO", "OK": "OKLAHOMA", "OR": "OREGON",
+	"PA": "PENNSYLVANIA", "RI": "RHODE ISLAND", "SC": "SOUTH CAROLINA", "SD": "SOUTH DAKOTA",
+	"TN": "TENNESSEE", "TX": "TEXAS", "UT": "UTAH", "VT": "VERMONT", "VA": "VIRGINIA",
+	"WA": "WASHINGTON", "WV": "WEST VIRGINIA", "WI": "WISCONSIN", "WY": "WYOMING",
+	"AS": "AMERICAN SAMOA", "GU": "GUAM", "MP": "NORTHERN MARIANA ISLANDS", "PR": "PUERTO RICO",
+	"VI": "VIRGIN ISLANDS", "FM": "FEDERATED STATES OF MICRONESIA", "MH": "MARSHALL ISLANDS",
+	"PW": "PALAU", "AA": "ARMED FORCES AMERICAS", "AE": "ARMED FORCES EUROPE",
+	"AP": "ARMED FORCES PACIFIC",
+}
+
+// Street suffix abbreviations from USPS Publication 28, appendix C1. Only the common names and
+// misspellings are listed, the standard abbreviations are kept as they are.
+var streetSuffixes = map[string]string{
+	"ALLEY": "ALY", "ALLEE": "ALY", "ALLY": "ALY",
+	"AVENUE": "AVE", "AV": "AVE", "AVEN": "AVE", "AVENU": "AVE", "AVN": "AVE", "AVNUE": "AVE",
+	"BOULEVARD": "BLVD", "BOUL": "BLVD", "BOULV": "BLVD",
+	"CENTER": "CTR", "CENTRE": "CTR", "CENTR": "CTR", "CNTR": "CTR",
+	"CIRCLE": "CIR", "CIRC": "CIR", "CIRCL": "CIR", "CRCL": "CIR",
+	"COURT": "CT", "COVE": "CV", "CREEK": "CRK", "CROSSING": "XING", "CRSSNG": "XING",
+	"DRIVE": "DR", "DRIV": "DR", "DRV": "DR",
+	"ESTATES": "ESTS", "EXPRESSWAY": "EXPY", "EXPRESS": "EXPY", "EXPW": "EXPY",
+	"FREEWAY": "FWY", "FREEWY": "FWY", "FRWAY": "FWY",
+	"GARDENS": "GDNS", "HEIGHTS": "HTS", "HIGHWAY": "HWY", "HIGHWY": "HWY", "HIWAY": "HWY",
+	"HILL": "HL", "HOLLOW": "HOLW", "ISLAND": "IS", "JUNCTION": "JCT",
+	"LAKE": "LK", "LANDING": "LNDG", "LANE": "LN",
+	"MEADOWS": "MDWS", "MOUNT": "MT", "MOUNTAIN": "MTN", "ORCHARD": "ORCH",
+	"PARKWAY": "PKWY", "PARKWY": "PKWY", "PKWAY": "PKWY",
+	"PLACE": "PL", "PLAZA": "PLZ", "POINT": "PT", "RANCH": "RNCH", "RIDGE": "RDG", "ROAD": "RD",
+	"SPRINGS": "SPGS", "SQUARE": "SQ", "STATION": "STA",
+	"STREET": "ST", "STRT": "ST", "STR": "ST",
+	"TERRACE": "TER", "TRAIL": "TRL", "TURNPIKE": "TPKE",
+	"VALLEY": "VLY", "VIEW": "VW", "VILLAGE": "VLG", "VISTA": "VIS",
+}
+
+var directionals = map[string]string{
+	"NORTH": "N", "SOUTH": "S", "EAST": "E", "WEST": "W",
+	"NORTHEAST": "NE", "NORTHWEST": "NW", "SOUTHEAST": "SE", "SOUTHWEST": "SW",
+	"N": "N", "S": "S", "E": "E", "W": "W", "NE": "NE", "NW": "NW", "SE": "SE", "SW": "SW",
+}
+
+// Secondary unit designators from USPS Publication 28, appendix C2. These are followed by a number
+// or letter.
+var unitDesignators = map[string]string{
+	"APARTMENT": "APT", "APT": "APT", "BUILDING": "BLDG", "BLDG": "BLDG",
+	"DEPARTMENT": "DEPT", "DEPT": "DEPT", "FLOOR": "FL", "FL": "FL",
+	"HANGAR": "HNGR", "HNGR": "HNGR", "KEY": "KEY", "LOT": "LOT", "PIER": "PIER",
+	"ROOM": "RM", "RM": "RM", "SLIP": "SLIP", "SPACE": "SPC", "SPC": "SPC", "STOP": "STOP",
+	"SUITE": "STE", "STE": "STE", "TRAILER": "TRLR", "TRLR": "TRLR", "UNIT": "UNIT",
+}
+
+// Unit designators which do not take a number. They are only recognized at the end of a line, since
+// words like "FRONT" are also common in street names.
+var unitDesignatorsWithoutRange = map[string]string{
+	"BASEMENT": "BSMT", "BSMT": "BSMT", "FRONT": "FRNT", "FRNT": "FRNT", "LOBBY": "LBBY",
+	"LBBY": "LBBY", "LOWER": "LOWR", "LOWR": "LOWR", "OFFICE": "OFC", "OFC": "OFC",
+	"PENTHOUSE": "PH", "PH": "PH", "REAR": "REAR", "SIDE": "SIDE", "UPPER": "UPPR", "UPPR": "UPPR",
+}
+
+// ZIP or ZIP+4, with or without the hyphen
+var zipPattern = regexp.MustCompile(`^(\d{5})(?:-?(\d{4}))?$`)
+
+//go:embed zip-prefixes.txt
+var zipPrefixData []byte
+
+// zipPrefixStates maps each three-digit ZIP prefix to the states it is assigned to
+var zipPrefixStates [1000][]string
+
+func init() {
+	s := bufio.NewScanner(bytes.NewReader(zipPrefixData))
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			panic(fmt.Sprintf("invalid zip prefix line %q", line))
+		}
+		start, err := strconv.Atoi(fields[0])
+		if err != nil {
+			panic(err)
+		}
+		end, err := strconv.Atoi(fields[1])
+		if err != nil {
+			panic(err)
+		}
+		for p := start; p <= end; p++ {
+			zipPrefixStates[p] = fields[2:]
+		}
+	}
+}
+
+// AddressProblem describes why a field of an address cannot be mailed to
+type AddressProblem struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type AddressValidation struct {
+	Valid    bool             `json:"valid"`
+	Problems []AddressProblem `json:"problems"`
+	// The address normalized to USPS Publication 28 style. It is only a suggestion, letters are
+	// rendered with the address as it was entered.
+	Suggestion LetterAddress `json:"suggestion"`
+}
+
+// ValidateAddress checks that an address has all the lines required for mailing, a USPS state code
+// and a ZIP code assigned to that state. The checks are made on the normalized address, so "Ohio"
+// is as valid as "OH".
+func ValidateAddress(a LetterAddress) AddressValidation {
+	n := NormalizeAddress(a)
+	problems := []AddressProblem{}
+	problem := func(field, format string, args ...any) {
+		problems = append(problems, AddressProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n.Name == "" {
+		problem("name", "name is required")
+	}
+	if n.Line1 == "" {
+		problem("line1", "street address is required")
+	}
+	if n.City == "" {
+		problem("city", "city is required")
+	}
+
+	_, stateOk := usStates[n.State]
+	switch {
+	case n.State == "":
+		problem("state", "state is required")
+	case !stateOk:
+		problem("state", "%q is not a USPS state code", a.State)
+	}
+
+	m := zipPattern.FindStringSubmatch(n.Zip)
+	switch {
+	case n.Zip == "":
+		problem("zip", "zip code is required")
+	case m == nil:
+		problem("zip", "zip code must have 5 digits, or 9 digits for ZIP+4")
+	default:
+		prefix, _ := strconv.Atoi(m[1][:3])
+		states := zipPrefixStates[prefix]
+		if len(states) == 0 {
+			problem("zip", "zip code %s does not exist", m[1])
+		} else if stateOk && !slices.Contains(states, n.State) {
+			problem("zip", "zip code %s is in %s, not %s", m[1], strings.Join(states, "/"), n.State)
+		}
+	}
+
+	return AddressValidation{Valid: len(problems) == 0, Problems: problems, Suggestion: n}
+}
+
+// NormalizeAddress formats an address the way USPS Publication 28 recommends: uppercase, without
+// punctuation, with abbreviated street suffixes, directionals, unit designators and state names.
+// Phone and email are not part of the postal address and are left as they are.
+func NormalizeAddress(a LetterAddress) LetterAddress {
+	n := a
+	n.Name = strings.Join(addressWords(a.Name), " ")
+	n.Company = strings.Join(addressWords(a.Company), " ")
+	n.Line1 = normalizeStreetLine(a.Line1)
+	n.Line2 = normalizeUnitLine(a.Line2)
+	n.City = strings.Join(addressWords(a.City), " ")
+
+	n.State = strings.Join(addressWords(a.State), " ")
+	if _, ok := usStates[n.State]; !ok {
+		for code, name := range usStates {
+			if name == n.State {
+				n.State = code
+			}
+		}
+	}
+
+	n.Zip = strings.TrimSpace(a.Zip)
+	if m := zipPattern.FindStringSubmatch(n.Zip); m != nil {
+		n.Zip = m[1]
+		if m[2] != "" {
+			n.Zip += "-" + m[2]
+		}
+	}
+
+	return n
+}
+
+// addressWords uppercases a line and splits it into words, dropping periods and commas. A "#" is
+// split from the unit number that follows it.
+func addressWords(line string) []string {
+	line = strings.ToUpper(line)
+	line = strings.NewReplacer(".", "", ",", " ", "#", " # ").Replace(line)
+	return strings.Fields(line)
+}
+
+func normalizeStreetLine(line string) string {
+	words := dropUnitHash(addressWords(line))
+
+	// The street ends where the secondary unit starts. A unit is only recognized at the end of the
+	// line, after at least a house number and a street name.
+	street := len(words)
+	if l := len(words); l >= 4 {
+		if u, ok := unitDesignators[words[l-2]]; ok {
+			words[l-2] = u
+			street = l - 2
+		} else if words[l-2] == "#" {
+			street = l - 2
+		} else if u, ok := unitDesignatorsWithoutRange[words[l-1]]; ok {
+			words[l-1] = u
+			street = l - 1
+		}
+	}
+
+	if street >= 3 {
+		if d, ok := directionals[words[1]]; ok {
+			words[1] = d
+		}
+		suffix := street - 1
+		if d, ok := directionals[words[suffix]]; ok {
+			words[suffix] = d
+			suffix--
+		}
+		if s, ok := streetSuffixes[words[suffix]]; ok && suffix >= 2 {
+			words[suffix] = s
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// normalizeUnitLine normalizes a line holding only a secondary unit, such as "Apartment 4B"
+func normalizeUnitLine(line string) string {
+	words := dropUnitHash(addressWords(line))
+	if len(words) == 2 {
+		if u, ok := unitDesignators[words[0]]; ok {
+			words[0] = u
+		}
+	} else if len(words) == 1 {
+		if u, ok := unitDesignatorsWithoutRange[words[0]]; ok {
+			words[0] = u
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// dropUnitHash drops a "#" which follows a unit designator, since "APT # 4" is written "APT 4"
+func dropUnitHash(words []string) []string {
+	out := make([]string, 0, len(words))
+	for i, w := range words {
+		if w == "#" && i > 0 {
+			if _, ok := unitDesignators[words[i-1]]; ok {
+				continue
+			}
+		}
+		out = append(out, w)
+	}
+	return out
+}
+
+// firstAddressProblem returns the first problem preventing a letter from being mailed between the
+// sender and receiver, or an empty string if both addresses are valid.
+func firstAddressProblem(sender, receiver LetterAddress) string {
+	for _, a := range []struct {
+		role    string
+		address LetterAddress
+	}{{"sender", sender}, {"receiver", receiver}} {
+		if v := ValidateAddress(a.address); !v.Valid {
+			return fmt.Sprintf("invalid %s address: %s", a.role, v.Problems[0].Message)
+		}
+	}
+	return ""
+}
+
+type AddressValidationResponseSuccess struct {
+	Status string `json:"status"`
+	AddressValidation
+}
+
+type AddressValidationResponseError struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// Validates an address and suggests its normalized form. The response has a success status even
+// when the address is invalid, the problems are listed in the body.
+func validateAddress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var a LetterAddress
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&a)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(AddressValidationResponseError{Status: statusError, Message: "failed to decode body"})
+		slog.ErrorContext(r.Context(), "failed to decode body", "err", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(AddressValidationResponseSuccess{Status: statusSuccess, AddressValidation: ValidateAddress(a)})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func validTestAddress() LetterAddress {
+	return LetterAddress{Name: "Jane Doe", Line1: "123 Main St", City: "Columbus", State: "OH", Zip: "43215"}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		in   LetterAddress
+		want LetterAddress
+	}{
+		{
+			name: "suffix, directionals and unit",
+			in:   LetterAddress{Line1: "123 north Main Street, Apartment #4b", City: "Columbus", State: "ohio", Zip: "432151234"},
+			want: LetterAddress{Line1: "123 N MAIN ST APT 4B", City: "COLUMBUS", State: "OH", Zip: "43215-1234"},
+		},
+		{
+			name: "post directional",
+			in:   LetterAddress{Line1: "500 Pennsylvania Avenue Northwest", State: "dc"},
+			want: LetterAddress{Line1: "500 PENNSYLVANIA AVE NW", State: "DC"},
+		},
+		{
+			name: "suffix is only abbreviated at the end of the street",
+			in:   LetterAddress{Line1: "12 Court Street Suite 100", Line2: "Suite 200"},
+			want: LetterAddress{Line1: "12 COURT ST STE 100", Line2: "STE 200"},
+		},
+		{
+			name: "street named like a suffix",
+			in:   LetterAddress{Line1: "8 Avenue B"},
+			want: LetterAddress{Line1: "8 AVENUE B"},
+		},
+		{
+			name: "unit without number only at the end",
+			in:   LetterAddress{Line1: "9 Front St Rear", Line2: "Basement"},
+			want: LetterAddress{Line1: "9 FRONT ST REAR", Line2: "BSMT"},
+		},
+		{
+			name: "number sign unit",
+			in:   LetterAddress{Line1: "77 Elm Rd #12"},
+			want: LetterAddress{Line1: "77 ELM RD # 12"},
+		},
+		{
+			name: "contact details are unchanged",
+			in:   LetterAddress{Name: "J. Doe", Company: "Acme, Inc.", Phone: "(614) 555-0100", Email: "Jane@Example.com"},
+			want: LetterAddress{Name: "J DOE", Company: "ACME INC", Phone: "(614) 555-0100", Email: "Jane@Example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeAddress(tt.in); got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *LetterAddress)
+		field  string
+	}{
+		{"valid", func(a *LetterAddress) {}, ""},
+		{"state name", func(a *LetterAddress) { a.State = "Ohio" }, ""},
+		{"zip plus four", func(a *LetterAddress) { a.Zip = "43215-0001" }, ""},
+		{"territory", func(a *LetterAddress) { a.State, a.Zip = "PR", "00901" }, ""},
+		{"military", func(a *LetterAddress) { a.State, a.Zip = "AE", "09001" }, ""},
+		{"shared prefix", func(a *LetterAddress) { a.State, a.Zip = "AS", "96799" }, ""},
+		{"missing name", func(a *LetterAddress) { a.Name = " " }, "name"},
+		{"missing street", func(a *LetterAddress) { a.Line1 = "" }, "line1"},
+		{"missing city", func(a *LetterAddress) { a.City = "" }, "city"},
+		{"unknown state", func(a *LetterAddress) { a.State = "XX" }, "state"},
+		{"short zip", func(a *LetterAddress) { a.Zip = "4321" }, "zip"},
+		{"unassigned zip", func(a *LetterAddress) { a.Zip = "00012" }, "zip"},
+		{"zip in another state", func(a *LetterAddress) { a.Zip = "90210" }, "zip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := validTestAddress()
+			tt.modify(&a)
+			v := ValidateAddress(a)
+
+			if tt.field == "" {
+				if !v.Valid {
+					t.Fatalf("expected valid address, got %+v", v.Problems)
+				}
+				return
+			}
+			if v.Valid || len(v.Problems) != 1 || v.Problems[0].Field != tt.field {
+				t.Fatalf("expected a single problem with %s, got %+v", tt.field, v.Problems)
+			}
+		})
+	}
+}
+
+func TestValidateAddressHandler(t *testing.T) {
+	a := validTestAddress()
+	a.State = "Ohio"
+	body, _ := json.Marshal(a)
+	req := httptest.NewRequest(http.MethodPost, "/api/address/validate", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	validateAddress(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var result AddressValidationResponseSuccess
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !result.Valid || result.Suggestion.State != "OH" || result.Suggestion.Line1 != "123 MAIN ST" {
+		t.Fatalf("unexpected validation %+v", result.AddressValidation)
+	}
+}
+
+func TestPdfHandlerRejectsInvalidAddress(t *testing.T) {
+	r := router{}
+
+	receiver := validTestAddress()
+	receiver.Zip = "90210"
+	body, _ := json.Marshal(PdfRequestV2{Sender: validTestAddress(), Receiver: receiver, Body: "Lorem ipsum"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/pdf", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	r.pdfV2(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	var result PdfResponseError
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if want := "invalid receiver address: zip code 90210 is in CA, not OH"; result.Message != want {
+		t.Fatalf("expected message %q, got %q", want, result.Message)
+	}
+}
@@ -9,7 +9,42 @@ type Analytics struct {
 	mu            sync.RWMutex
 	inferencesRun int64
 	pdfsGenerated int64
-	StartedAt     time.Time
+	// Requests to /api/text with answers which look like instructions to the model
+	injectionsDetected int64
+	// Outcomes of the letters of each prompt version, by name
+	promptVersions map[string]*PromptVersionStats
+	// Tokens and estimated cost of the inferences of each model, by provider/model
+	usage map[string]*UsageStats
+	// Inferences made by the budget fallback provider as the daily budget was spent
+	budgetFallbacks int64
+	StartedAt       time.Time
+}
+
+// PromptVersionStats are the outcomes of the letters written by a prompt version
+type PromptVersionStats struct {
+	Letters int64 `json:"letters"`
+	// Ratings sent to /api/text/feedback
+	Helpful   int64 `json:"helpful"`
+	Unhelpful int64 `json:"unhelpful"`
+	// Letters whose edits were sent to /api/text/feedback, and the sum of their edit distances
+	Edited            int64   `json:"edited"`
+	EditDistanceTotal float64 `json:"edit_distance_total"`
+}
+
+// MeanEditDistance returns the mean edit distance of the edited letters, see EditDistance
+func (s PromptVersionStats) MeanEditDistance() float64 {
+	if s.Edited == 0 {
+		return 0
+	}
+	return round2(s.EditDistanceTotal / float64(s.Edited))
+}
+
+// UsageStats are the tokens used by the inferences of a model and their estimated cost
+type UsageStats struct {
+	Inferences   int64   `json:"inferences"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	Cost         float64 `json:"cost_usd"`
 }
 
 var analytics = &Analytics{
@@ -28,19 +63,115 @@ func (a *Analytics) IncrementPDFs() {
 	a.pdfsGenerated++
 }
 
+func (a *Analytics) IncrementInjections() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.injectionsDetected++
+}
+
+// promptVersion returns the stats of a prompt version, the lock must be held
+func (a *Analytics) promptVersion(name string) *PromptVersionStats {
+	if a.promptVersions == nil {
+		a.promptVersions = make(map[string]*PromptVersionStats)
+	}
+	s, ok := a.promptVersions[name]
+	if !ok {
+		s = &PromptVersionStats{}
+		a.promptVersions[name] = s
+	}
+	return s
+}
+
+func (a *Analytics) RecordLetter(version string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.promptVersion(version).Letters++
+}
+
+// RecordFeedback records a rating and edit distance of a letter, either of which may be nil
+func (a *Analytics) RecordFeedback(version string, helpful *bool, editDistance *float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.promptVersion(version)
+	if helpful != nil {
+		if *helpful {
+			s.Helpful++
+		} else {
+			s.Unhelpful++
+		}
+	}
+	if editDistance != nil {
+		s.Edited++
+		s.EditDistanceTotal += *editDistance
+	}
+}
+
+// RecordUsage records an inference and its estimated cost in US dollars, see CostLedger
+func (a *Analytics) RecordUsage(u Usage, cost float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.usage == nil {
+		a.usage = make(map[string]*UsageStats)
+	}
+	name := u.Provider
+	if u.Model != "" {
+		name += "/" + u.Model
+	}
+	s, ok := a.usage[name]
+	if !ok {
+		s = &UsageStats{}
+		a.usage[name] = s
+	}
+	s.Inferences++
+	s.InputTokens += int64(u.InputTokens)
+	s.OutputTokens += int64(u.OutputTokens)
+	s.Cost += cost
+}
+
+func (a *Analytics) IncrementBudgetFallbacks() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.budgetFallbacks++
+}
+
 func (a *Analytics) GetStats() AnalyticsStats {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
 
+	versions := make(map[string]PromptVersionStats, len(a.promptVersions))
+	for name, s := range a.promptVersions {
+		versions[name] = *s
+	}
+	usage := make(map[string]UsageStats, len(a.usage))
+	for name, s := range a.usage {
+		usage[name] = *s
+	}
 	return AnalyticsStats{
-		InferencesRun: a.inferencesRun,
-		PDFsGenerated: a.pdfsGenerated,
-		StartedAt:     a.StartedAt,
+		InferencesRun:      a.inferencesRun,
+		PDFsGenerated:      a.pdfsGenerated,
+		InjectionsDetected: a.injectionsDetected,
+		PromptVersions:     versions,
+		Usage:              usage,
+		BudgetFallbacks:    a.budgetFallbacks,
+		StartedAt:          a.StartedAt,
+	}
+}
+
+// Cost returns the estimated cost of all inferences in US dollars
+func (s AnalyticsStats) Cost() float64 {
+	var cost float64
+	for _, u := range s.Usage {
+		cost += u.Cost
 	}
+	return cost
 }
 
 type AnalyticsStats struct {
-	InferencesRun int64     `json:"inferences_run"`
-	PDFsGenerated int64     `json:"pdfs_generated"`
-	StartedAt     time.Time `json:"started_at"`
+	InferencesRun      int64                         `json:"inferences_run"`
+	PDFsGenerated      int64                         `json:"pdfs_generated"`
+	InjectionsDetected int64                         `json:"injections_detected"`
+	PromptVersions     map[string]PromptVersionStats `json:"prompt_versions"`
+	Usage              map[string]UsageStats         `json:"usage"`
+	BudgetFallbacks    int64                         `json:"budget_fallbacks"`
+	StartedAt          time.Time                     `json:"started_at"`
 }
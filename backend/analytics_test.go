@@ -20,6 +20,7 @@ func TestAnalytics(t *testing.T) {
 	// Test increment
 	analytics.IncrementInferences()
 	analytics.IncrementPDFs()
+	analytics.IncrementInjections()
 
 	stats = analytics.GetStats()
 	if stats.InferencesRun != 1 {
@@ -28,4 +29,18 @@ func TestAnalytics(t *testing.T) {
 	if stats.PDFsGenerated != 1 {
 		t.Errorf("expected 1 PDF, got %d", stats.PDFsGenerated)
 	}
+	if stats.InjectionsDetected != 1 {
+		t.Errorf("expected 1 injection, got %d", stats.InjectionsDetected)
+	}
+
+	helpful := false
+	distance := 0.5
+	analytics.RecordLetter("baseline")
+	analytics.RecordFeedback("baseline", &helpful, nil)
+	analytics.RecordFeedback("baseline", nil, &distance)
+
+	version := analytics.GetStats().PromptVersions["baseline"]
+	if version.Letters != 1 || version.Unhelpful != 1 || version.Helpful != 0 || version.MeanEditDistance() != 0.5 {
+		t.Errorf("unexpected prompt version stats %+v", version)
+	}
 }
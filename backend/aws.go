@@ -77,27 +77,31 @@ func init() {
 	}
 }
 
-func (b *AWS) Infer(ctx context.Context, input string) (string, error) {
-	systemPrompt := RenderSystemPrompt()
-
+func (b *AWS) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
 	// Bedrock does not expose an API to count the number of tokens that a particular model would
-	// tokenize to. Therefore we have to be conservative by assuming each character in the user
-	// input is one token. The system prompt however is trusted so we can use a simple heuristic
-	estimatedSystemPromptTokens := len(systemPrompt) / 3
-	if len(input)+estimatedSystemPromptTokens > b.maxInputTokens {
-		return "", ErrTooManyInputTokens
+	// tokenize to, see EstimateInputTokens
+	if EstimateInputTokens(messages) > b.maxInputTokens {
+		return "", nil, ErrTooManyInputTokens
 	}
 
-	response, err := b.brc.Converse(ctx, &bedrockruntime.ConverseInput{
-		ModelId: aws.String(b.modelId),
-		Messages: []types.Message{
-			{
-				Content: []types.ContentBlock{
-					&types.ContentBlockMemberText{Value: input},
-				},
-				Role: "user",
+	systemPrompt, conversation := SplitSystemPrompt(messages)
+	bedrockMessages := make([]types.Message, 0, len(conversation))
+	for _, m := range conversation {
+		role := types.ConversationRoleUser
+		if m.Role == RoleAssistant {
+			role = types.ConversationRoleAssistant
+		}
+		bedrockMessages = append(bedrockMessages, types.Message{
+			Content: []types.ContentBlock{
+				&types.ContentBlockMemberText{Value: m.Content},
 			},
-		},
+			Role: role,
+		})
+	}
+
+	response, err := b.brc.Converse(ctx, &bedrockruntime.ConverseInput{
+		ModelId:  aws.String(b.modelId),
+		Messages: bedrockMessages,
 		System: []types.SystemContentBlock{
 			&types.SystemContentBlockMemberText{Value: systemPrompt},
 		},
@@ -105,18 +109,24 @@ func (b *AWS) Infer(ctx context.Context, input string) (string, error) {
 			// The AWS inference provider never returns ErrTooOutputTokens. Instead, the Converse
 			// api allows us to set the maximum number of output tokens. It will simply be
 			// truncated if it is too long.
-			MaxTokens: b.maxOutputTokens,
+			MaxTokens: aws.Int32(int32(MaxOutputTokens(ctx, int(*b.maxOutputTokens)))),
 		},
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to converse with Bedrock: %v", err)
+		return "", nil, fmt.Errorf("failed to converse with Bedrock: %v", err)
 	}
 
 	slog.DebugContext(ctx, "AWS inference", "inputTokens", *response.Usage.InputTokens, "outputTokens", *response.Usage.OutputTokens)
+	usage := []Usage{{
+		Provider:     "aws",
+		Model:        b.modelId,
+		InputTokens:  int(aws.ToInt32(response.Usage.InputTokens)),
+		OutputTokens: int(aws.ToInt32(response.Usage.OutputTokens)),
+	}}
 
 	responseText, _ := response.Output.(*types.ConverseOutputMemberMessage)
 	responseContentBlock := responseText.Value.Content[0]
 	text, _ := responseContentBlock.(*types.ContentBlockMemberText)
 
-	return text.Value, nil
+	return text.Value, usage, nil
 }
@@ -95,7 +95,7 @@ func TestAWSInfer(t *testing.T) {
 	ctx := context.Background()
 	input := "test input"
 
-	result, err := aws.Infer(ctx, input)
+	result, _, err := aws.Infer(ctx, NewConversation(RenderSystemPrompt(), input))
 	if err != nil {
 		t.Skipf("AWS inference failed: %v", err)
 	}
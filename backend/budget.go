@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+var ErrOverBudget = errors.New("the daily inference budget is spent, try again tomorrow")
+
+// BudgetProvider records the usage of the inferences of a provider in a CostLedger. Each inference
+// reserves its estimated cost before it is made, and is settled with the usage the provider
+// returned. Once the spend of the day reaches the daily budget, inferences are made by the fallback
+// provider instead until the next day, such as a cheaper model. Without a fallback they fail with
+// ErrOverBudget, rather than returning text no model wrote as if it were a letter.
+type BudgetProvider struct {
+	provider InferenceProvider
+	fallback InferenceProvider
+	ledger   *CostLedger
+	// Output token limit of the provider to estimate the cost of inferences with, 0 is no limit
+	maxOutputTokens int
+}
+
+var _ InferenceProvider = (*BudgetProvider)(nil)
+
+func NewBudgetProvider(provider, fallback InferenceProvider, ledger *CostLedger, maxOutputTokens int) *BudgetProvider {
+	return &BudgetProvider{provider: provider, fallback: fallback, ledger: ledger, maxOutputTokens: maxOutputTokens}
+}
+
+func (b *BudgetProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	reservation, ok := b.ledger.Reserve(b.ledger.Estimate(messages, MaxOutputTokens(ctx, b.maxOutputTokens)))
+	if !ok {
+		analytics.IncrementBudgetFallbacks()
+		if b.fallback == nil {
+			return "", nil, ErrOverBudget
+		}
+		reply, usage, err := b.fallback.Infer(ctx, messages)
+		b.ledger.Record(ctx, usage)
+		return reply, usage, err
+	}
+	reply, usage, err := b.provider.Infer(ctx, messages)
+	b.ledger.Settle(ctx, reservation, usage)
+	return reply, usage, err
+}
+
+// budgetRetryAfter returns the seconds until the budget of the next day, which starts at midnight
+// UTC
+func budgetRetryAfter(now time.Time) int {
+	next := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	return int(math.Ceil(next.Sub(now).Seconds()))
+}
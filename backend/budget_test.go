@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pricedProvider replies with its name and a fixed usage
+type pricedProvider struct {
+	name  string
+	usage Usage
+	calls int
+}
+
+func (p *pricedProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	p.calls++
+	return p.name, []Usage{p.usage}, nil
+}
+
+func TestBudgetProvider(t *testing.T) {
+	analytics = &Analytics{}
+	ledger, err := NewCostLedger([]ModelPrice{{Provider: "aws", InputPerMillionTokens: 1_000_000}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each inference of the primary provider costs a dollar
+	primary := &pricedProvider{name: "primary", usage: Usage{Provider: "aws", InputTokens: 1}}
+	cheaper := &pricedProvider{name: "cheaper", usage: Usage{Provider: "ollama", InputTokens: 1}}
+	b := NewBudgetProvider(primary, cheaper, ledger, 0)
+
+	var replies []string
+	for range 4 {
+		reply, _, err := b.Infer(context.Background(), NewConversation("system", "no heat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, reply)
+	}
+	if replies[0] != "primary" || replies[1] != "primary" || replies[2] != "cheaper" || replies[3] != "cheaper" {
+		t.Fatalf("expected the fallback once the budget was spent, got %v", replies)
+	}
+
+	stats := analytics.GetStats()
+	if stats.BudgetFallbacks != 2 || stats.Usage["ollama"].Inferences != 2 || stats.Cost() != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// Without a budget the provider is always used
+	ledger, _ = NewCostLedger(nil, 0)
+	b = NewBudgetProvider(primary, nil, ledger, 0)
+	if reply, _, _ := b.Infer(context.Background(), NewConversation("system", "no heat")); reply != "primary" {
+		t.Fatalf("expected the provider, got %q", reply)
+	}
+}
+
+func TestBudgetProviderWithoutFallback(t *testing.T) {
+	analytics = &Analytics{}
+	ledger, err := NewCostLedger([]ModelPrice{{Provider: "aws", InputPerMillionTokens: 1_000_000}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &pricedProvider{name: "primary", usage: Usage{Provider: "aws", InputTokens: 1}}
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+	r := router{ip: NewBudgetProvider(primary, nil, ledger, 0), altcha: altchaService}
+
+	// The first letter and its translation spend the budget, the second letter is refused until the
+	// next day instead of being made up without a model
+	for i, want := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		altchaToken, err := createValidAltcha(altchaService.secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(map[string]any{
+			"altcha":         altchaToken,
+			"answers":        map[string]string{"mainProblem": "no heat"},
+			"tenantLanguage": "es",
+		})
+		w := httptest.NewRecorder()
+		r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+		if w.Code != want {
+			t.Fatalf("letter %d: expected %d, got %d: %s", i, want, w.Code, w.Body.String())
+		}
+		if want == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			t.Fatal("expected Retry-After with the refusal")
+		}
+	}
+	if _, _, err := NewBudgetProvider(primary, nil, ledger, 0).Infer(context.Background(), NewConversation("system", "no heat")); !errors.Is(err, ErrOverBudget) {
+		t.Fatalf("expected ErrOverBudget, got %v", err)
+	}
+}
+
+// blockingProvider waits for release before it replies, and spends a dollar per input token
+type blockingProvider struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (p *blockingProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	p.calls.Add(1)
+	<-p.release
+	return "primary", []Usage{{Provider: "aws", InputTokens: EstimateInputTokens(messages)}}, nil
+}
+
+// fallbackSignal replies at once and signals each inference it made
+type fallbackSignal chan struct{}
+
+func (s fallbackSignal) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	s <- struct{}{}
+	return "fallback", nil, nil
+}
+
+func TestBudgetProviderConcurrentInferences(t *testing.T) {
+	analytics = &Analytics{}
+	ledger, err := NewCostLedger([]ModelPrice{{Provider: "aws", InputPerMillionTokens: 1_000_000}}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &blockingProvider{release: make(chan struct{})}
+	fallback := make(fallbackSignal)
+	b := NewBudgetProvider(primary, fallback, ledger, 0)
+
+	// Each inference is estimated to cost a dollar, so only two of the concurrent inferences fit in
+	// the budget while none of them completed yet
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			if _, _, err := b.Infer(context.Background(), NewConversation("", "x")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	for range 8 {
+		select {
+		case <-fallback:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the inferences over the budget to fall back, %d reached the provider", primary.calls.Load())
+		}
+	}
+	close(primary.release)
+	wg.Wait()
+
+	if primary.calls.Load() != 2 || ledger.SpentToday() != 2 {
+		t.Fatalf("expected 2 inferences within the budget, got %d spending %v", primary.calls.Load(), ledger.SpentToday())
+	}
+}
+
+func TestBudgetRetryAfter(t *testing.T) {
+	if got := budgetRetryAfter(time.Date(2026, 1, 5, 23, 59, 30, 0, time.UTC)); got != 30 {
+		t.Fatalf("expected 30 seconds until midnight UTC, got %d", got)
+	}
+}
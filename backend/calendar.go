@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The notice period of a rule pack after which rent may be deposited with the court
+const rentDepositNoticePurpose = "rentDeposit"
+
+// Business days a letter is assumed to take to be delivered when the delivery date is not known,
+// as for certified mail
+const mailingAllowanceBusinessDays = 3
+
+const (
+	calendarProductID = "-//JusticeTech//Tenant Letter Reminders//EN"
+	// Domain part of event UIDs, which only has to be unique to this application
+	calendarUIDDomain = "tenant-letter.justicetech"
+	// RFC 5545 section 3.1: lines are folded after 75 octets
+	calendarLineLength = 75
+)
+
+// CalendarEvent is an all day event with reminders
+type CalendarEvent struct {
+	// Stable for the same letter, so importing the file again updates the events
+	UID         string
+	Date        time.Time
+	Summary     string
+	Description string
+	Alarms      []CalendarAlarm
+}
+
+// CalendarAlarm is a reminder, with a trigger relative to the start of the day of the event such
+// as "-P1D" for the day before
+type CalendarAlarm struct {
+	Trigger     string
+	Description string
+}
+
+type CalendarRequest struct {
+	// Date in YYYY-MM-DD format the landlord was asked to respond by, as returned by /api/text
+	Deadline string `json:"deadline"`
+	// Date in YYYY-MM-DD format the letter was sent
+	SentDate string `json:"sentDate"`
+	// Optional date in YYYY-MM-DD format the landlord received the letter, such as on the return
+	// receipt of certified mail
+	DeliveredDate string `json:"deliveredDate"`
+	// Select the rule pack of the jurisdiction, see SelectRulePack
+	ReceiverState string `json:"receiverState"`
+	ReceiverCity  string `json:"receiverCity"`
+}
+
+type CalendarResponseError struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// LetterReminders returns the follow up events of a sent letter: the date the landlord was asked to
+// respond by, and when the rule pack has a rent deposit period, the first business day rent may be
+// deposited with the court. The period runs from the day the landlord received the letter, which
+// without a delivery date is assumed to be mailingAllowanceBusinessDays after it was sent.
+func LetterReminders(req CalendarRequest) ([]CalendarEvent, error) {
+	deadline, err := time.Parse(deadlineDateLayout, req.Deadline)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deadline %q, expected YYYY-MM-DD", req.Deadline)
+	}
+	sent, err := time.Parse(deadlineDateLayout, req.SentDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentDate %q, expected YYYY-MM-DD", req.SentDate)
+	}
+	if deadline.Before(sent) {
+		return nil, errors.New("deadline is before sentDate")
+	}
+	var delivered time.Time
+	if req.DeliveredDate != "" {
+		if delivered, err = time.Parse(deadlineDateLayout, req.DeliveredDate); err != nil {
+			return nil, fmt.Errorf("invalid deliveredDate %q, expected YYYY-MM-DD", req.DeliveredDate)
+		}
+		if delivered.Before(sent) {
+			return nil, errors.New("deliveredDate is before sentDate")
+		}
+	}
+
+	events := []CalendarEvent{{
+		UID:     calendarUID("respond", req),
+		Date:    deadline,
+		Summary: "Landlord must respond by today",
+		Description: fmt.Sprintf("Your letter sent on %s asked your landlord to solve the problems by today. "+
+			"Write down whether they have responded and keep a copy of any reply.", sent.Format(deadlineTextLayout)),
+		Alarms: []CalendarAlarm{
+			{Trigger: "-P1D", Description: "Your landlord's response is due tomorrow"},
+			{Trigger: "PT9H", Description: "Your landlord's response is due today"},
+		},
+	}}
+
+	pack := SelectRulePack(rulePacks, req.ReceiverState, req.ReceiverCity)
+	if pack == nil {
+		return events, nil
+	}
+	notice := pack.NoticePeriod(rentDepositNoticePurpose)
+	if notice == nil {
+		return events, nil
+	}
+
+	cal := NewHolidayCalendar(pack.State)
+	received := fmt.Sprintf("on %s, the day your landlord received the letter", delivered.Format(deadlineTextLayout))
+	if delivered.IsZero() {
+		delivered = cal.AddBusinessDays(sent, mailingAllowanceBusinessDays)
+		received = fmt.Sprintf("on %s, assuming the letter took %d business days to be delivered. "+
+			"If your landlord received it later, so is this date", delivered.Format(deadlineTextLayout), mailingAllowanceBusinessDays)
+	}
+	eligible := cal.NextBusinessDay(noticePeriodEnd(cal, delivered, notice))
+	events = append(events, CalendarEvent{
+		UID:     calendarUID("rent-deposit", req),
+		Date:    eligible,
+		Summary: "Eligible to deposit rent with the court",
+		Description: fmt.Sprintf("%s See %s. This date is counted from %s. This is not legal advice.",
+			strings.TrimSpace(notice.Description), notice.Citation, received),
+		Alarms: []CalendarAlarm{
+			{Trigger: "PT9H", Description: "You may be eligible to deposit rent with the court from today"},
+		},
+	})
+
+	return events, nil
+}
+
+func calendarUID(kind string, req CalendarRequest) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{kind, req.Deadline, req.SentDate, req.ReceiverState, req.ReceiverCity}, "\x00")))
+	return hex.EncodeToString(sum[:16]) + "@" + calendarUIDDomain
+}
+
+// WriteICalendar writes the events as an RFC 5545 iCalendar file. now is the creation time of the
+// file, which is the same for every event.
+func WriteICalendar(w io.Writer, events []CalendarEvent, now time.Time) error {
+	stamp := now.UTC().Format("20060102T150405Z")
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:" + calendarProductID,
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+	}
+	for _, e := range events {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+e.UID,
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+e.Date.Format("20060102"),
+			"DTEND;VALUE=DATE:"+e.Date.AddDate(0, 0, 1).Format("20060102"),
+			"SUMMARY:"+escapeCalendarText(e.Summary),
+			"DESCRIPTION:"+escapeCalendarText(e.Description),
+			"TRANSP:TRANSPARENT",
+		)
+		for _, a := range e.Alarms {
+			lines = append(lines,
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				"TRIGGER:"+a.Trigger,
+				"DESCRIPTION:"+escapeCalendarText(a.Description),
+				"END:VALARM",
+			)
+		}
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, foldCalendarLine(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeCalendarText escapes a TEXT value, RFC 5545 section 3.3.11
+func escapeCalendarText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// foldCalendarLine splits a content line into lines of at most 75 octets ending in CRLF.
+// Continuation lines start with a space, and UTF-8 characters are never split.
+func foldCalendarLine(line string) string {
+	var b strings.Builder
+	limit := calendarLineLength
+	start := 0
+	for i, r := range line {
+		if i-start+utf8.RuneLen(r) > limit {
+			b.WriteString(line[start:i])
+			b.WriteString("\r\n ")
+			start = i
+			// The space counts towards the length of continuation lines
+			limit = calendarLineLength - 1
+		}
+	}
+	b.WriteString(line[start:])
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// Returns reminders for a sent letter as an iCalendar file. Nothing is stored on the server, the
+// events are computed from the request.
+func calendar(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req CalendarRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(CalendarResponseError{Status: statusError, Message: "failed to decode body"})
+		slog.ErrorContext(r.Context(), "failed to decode body", "err", err)
+		return
+	}
+
+	events, err := LetterReminders(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(CalendarResponseError{Status: statusError, Message: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="letter-reminders.ics"`)
+	if err := WriteICalendar(w, events, time.Now()); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write calendar", "err", err)
+	}
+}
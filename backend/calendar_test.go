@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLetterRemindersOhio(t *testing.T) {
+	events, err := LetterReminders(CalendarRequest{Deadline: "2026-11-19", SentDate: "2026-10-20", ReceiverState: "OH"})
+	if err != nil {
+		t.Fatalf("failed to create reminders: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	if got := events[0].Date.Format(deadlineDateLayout); got != "2026-11-19" {
+		t.Errorf("expected the response to be due on the deadline, got %s", got)
+	}
+	// Delivered 3 business days after sending on Friday, October 23, and 30 days later is Sunday,
+	// November 22
+	if got := events[1].Date.Format(deadlineDateLayout); got != "2026-11-23" {
+		t.Errorf("expected rent to be deposited from 2026-11-23, got %s", got)
+	}
+	if !strings.Contains(events[1].Description, "5321.07(B)(1)") {
+		t.Errorf("expected the citation in the description, got %q", events[1].Description)
+	}
+
+	again, _ := LetterReminders(CalendarRequest{Deadline: "2026-11-19", SentDate: "2026-10-20", ReceiverState: "OH"})
+	if again[0].UID != events[0].UID || events[0].UID == events[1].UID {
+		t.Error("expected UIDs to be stable and distinct")
+	}
+}
+
+func TestLetterRemindersDelivered(t *testing.T) {
+	events, err := LetterReminders(CalendarRequest{Deadline: "2026-11-19", SentDate: "2026-10-20", DeliveredDate: "2026-10-26", ReceiverState: "OH"})
+	if err != nil {
+		t.Fatalf("failed to create reminders: %v", err)
+	}
+	// 30 days after delivery is Wednesday, November 25
+	if got := events[1].Date.Format(deadlineDateLayout); got != "2026-11-25" {
+		t.Errorf("expected rent to be deposited from 2026-11-25, got %s", got)
+	}
+	if !strings.Contains(events[1].Description, "Monday, October 26, 2026") {
+		t.Errorf("expected the delivery date in the description, got %q", events[1].Description)
+	}
+}
+
+func TestLetterRemindersWithoutRulePack(t *testing.T) {
+	events, err := LetterReminders(CalendarRequest{Deadline: "2026-11-19", SentDate: "2026-10-20", ReceiverState: "CA"})
+	if err != nil {
+		t.Fatalf("failed to create reminders: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected only the response event, got %d", len(events))
+	}
+}
+
+func TestLetterRemindersRejectsInvalidDates(t *testing.T) {
+	tests := []CalendarRequest{
+		{Deadline: "", SentDate: "2026-10-20"},
+		{Deadline: "2026-11-19", SentDate: "October 20"},
+		{Deadline: "2026-10-01", SentDate: "2026-10-20"},
+		{Deadline: "2026-11-19", SentDate: "2026-10-20", DeliveredDate: "2026-10-19"},
+		{Deadline: "2026-11-19", SentDate: "2026-10-20", DeliveredDate: "tomorrow"},
+	}
+	for _, req := range tests {
+		if _, err := LetterReminders(req); err == nil {
+			t.Errorf("expected %+v to be rejected", req)
+		}
+	}
+}
+
+func TestWriteICalendar(t *testing.T) {
+	events := []CalendarEvent{{
+		UID:         "abc@example.com",
+		Date:        time.Date(2026, time.November, 19, 0, 0, 0, 0, time.UTC),
+		Summary:     "Rent, repairs; and\\ more",
+		Description: strings.Repeat("é", 60) + "\nsecond line",
+		Alarms:      []CalendarAlarm{{Trigger: "-P1D", Description: "Tomorrow"}},
+	}}
+
+	var buf bytes.Buffer
+	if err := WriteICalendar(&buf, events, time.Date(2026, time.October, 20, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\nVERSION:2.0\r\n",
+		"DTSTAMP:20261020T120000Z\r\n",
+		"DTSTART;VALUE=DATE:20261119\r\nDTEND;VALUE=DATE:20261120\r\n",
+		`SUMMARY:Rent\, repairs\; and\\ more` + "\r\n",
+		"BEGIN:VALARM\r\nACTION:DISPLAY\r\nTRIGGER:-P1D\r\n",
+		"END:VEVENT\r\nEND:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in\n%s", want, out)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	for _, line := range lines {
+		if len(line) > calendarLineLength {
+			t.Errorf("line longer than %d octets: %q", calendarLineLength, line)
+		}
+	}
+
+	// Unfolding restores the description, with the line break escaped
+	unfolded := strings.ReplaceAll(out, "\r\n ", "")
+	if !strings.Contains(unfolded, "DESCRIPTION:"+strings.Repeat("é", 60)+`\nsecond line`+"\r\n") {
+		t.Errorf("expected the folded description to unfold, got\n%s", unfolded)
+	}
+}
+
+func TestCalendarHandler(t *testing.T) {
+	body := `{"deadline": "2026-11-19", "sentDate": "2026-10-20", "receiverState": "OH"}`
+	w := httptest.NewRecorder()
+
+	calendar(w, httptest.NewRequest(http.MethodPost, "/api/calendar", strings.NewReader(body)))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	if got := strings.Count(w.Body.String(), "BEGIN:VEVENT"); got != 2 {
+		t.Fatalf("expected 2 events, got %d", got)
+	}
+}
+
+func TestCalendarHandlerBadRequest(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	calendar(w, httptest.NewRequest(http.MethodPost, "/api/calendar", strings.NewReader(`{"deadline": "soon"}`)))
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidContentPolicy = errors.New("invalid content policy")
+)
+
+// The error of responses refused by the content policy, so clients can tell them from other errors
+const policyViolationError = "policy_violation"
+
+// ContentPolicy holds the categories of text letters must not contain, see contentpolicy.yaml
+type ContentPolicy struct {
+	Categories []PolicyCategory `yaml:"categories"`
+}
+
+type PolicyCategory struct {
+	Name string `yaml:"name"`
+	// Completes "the letter ..." in error messages
+	Description string   `yaml:"description"`
+	Lexicon     []string `yaml:"lexicon"`
+	Patterns    []string `yaml:"patterns"`
+	Allow       []string `yaml:"allow"`
+
+	lexicon  *regexp.Regexp
+	patterns []*regexp.Regexp
+	allow    *regexp.Regexp
+}
+
+// PolicyViolation is the first category a text violates
+type PolicyViolation struct {
+	Category    string
+	Description string
+}
+
+//go:embed contentpolicy.yaml
+var contentPolicyFile []byte
+
+var contentPolicy *ContentPolicy
+
+func init() {
+	var err error
+	contentPolicy, err = LoadContentPolicy(contentPolicyFile)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// LoadContentPolicy parses a content policy and compiles its lexicons and patterns
+func LoadContentPolicy(data []byte) (*ContentPolicy, error) {
+	var policy ContentPolicy
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidContentPolicy, err)
+	}
+
+	for i := range policy.Categories {
+		c := &policy.Categories[i]
+		if c.Name == "" || c.Description == "" {
+			return nil, fmt.Errorf("%w: categories require a name and description", ErrInvalidContentPolicy)
+		}
+		if len(c.Lexicon) == 0 && len(c.Patterns) == 0 {
+			return nil, fmt.Errorf("%w: category %q has no lexicon or patterns", ErrInvalidContentPolicy, c.Name)
+		}
+		c.lexicon = phrasePattern(c.Lexicon)
+		c.allow = phrasePattern(c.Allow)
+		for _, p := range c.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("%w: category %q: %w", ErrInvalidContentPolicy, c.Name, err)
+			}
+			c.patterns = append(c.patterns, re)
+		}
+	}
+	return &policy, nil
+}
+
+// phrasePattern returns a regular expression matching any of the phrases as whole words, or nil
+func phrasePattern(phrases []string) *regexp.Regexp {
+	if len(phrases) == 0 {
+		return nil
+	}
+	alternatives := make([]string, len(phrases))
+	for i, phrase := range phrases {
+		words := strings.Fields(normalizePolicyText(phrase))
+		for j, word := range words {
+			words[j] = regexp.QuoteMeta(word)
+		}
+		alternatives[i] = strings.Join(words, `\s+`)
+	}
+	// Longest first, so a phrase is not cut short by one of its prefixes
+	slices.SortFunc(alternatives, func(a, b string) int { return len(b) - len(a) })
+	return regexp.MustCompile(`\b(?:` + strings.Join(alternatives, "|") + `)\b`)
+}
+
+// Undoes character substitutions used to get around word lists, such as "k1ll" or "b1tch"
+var policySubstitutions = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s",
+	"’", "'", "*", "",
+)
+
+func normalizePolicyText(text string) string {
+	return policySubstitutions.Replace(strings.ToLower(text))
+}
+
+// Check returns the first category of the policy the text violates, or nil
+func (p *ContentPolicy) Check(text string) *PolicyViolation {
+	normalized := normalizePolicyText(text)
+	for _, c := range p.Categories {
+		t := normalized
+		if c.allow != nil {
+			t = c.allow.ReplaceAllString(t, " ")
+		}
+		if c.lexicon != nil && c.lexicon.MatchString(t) {
+			return &PolicyViolation{Category: c.Name, Description: c.Description}
+		}
+		for _, re := range c.patterns {
+			if re.MatchString(t) {
+				return &PolicyViolation{Category: c.Name, Description: c.Description}
+			}
+		}
+	}
+	return nil
+}
+
+type PolicyViolationResponse struct {
+	Status string `json:"status"`
+	// Always policy_violation
+	Error string `json:"error"`
+	// The violated category, such as threat
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// checkContentPolicy checks the letter texts of a request against the content policy. It writes a
+// policy_violation response and returns false when one of them violates it. The text is not
+// logged, as it may contain slurs or personal information.
+func checkContentPolicy(w http.ResponseWriter, r *http.Request, texts ...string) bool {
+	for _, text := range texts {
+		v := contentPolicy.Check(text)
+		if v == nil {
+			continue
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(PolicyViolationResponse{
+			Status:   statusError,
+			Error:    policyViolationError,
+			Category: v.Category,
+			Message:  fmt.Sprintf("the letter %s, which the terms of service do not allow", v.Description),
+		})
+		slog.WarnContext(r.Context(), "content policy violation", "path", r.URL.Path, "category", v.Category)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentPolicyCheck(t *testing.T) {
+	tests := map[string]string{
+		"Fix the heat or else.":                               "threat",
+		"Fix the heat by Friday, or else!":                    "threat",
+		"If this is not fixed I will HURT you.":               "threat",
+		"I'm going to smash the windows of your car":          "threat",
+		"I'll k1ll you":                                       "threat",
+		"Just so you know, I know where\nyou live.":           "threat",
+		"The landlord is a worthless n1gger.":                 "slur",
+		"You are a stupid man who ignores his tenants":        "harassment",
+		"You're such an idiot.":                               "harassment",
+		"**Slumlord**, fix the sink.":                         "harassment",
+		"I will keep calling you every night until it's done": "harassment",
+		"We will post your address on every tenant forum.":    "harassment",
+	}
+	for text, category := range tests {
+		v := contentPolicy.Check(text)
+		if v == nil || v.Category != category {
+			t.Errorf("%q: expected %s, got %+v", text, category, v)
+		}
+	}
+
+	for _, text := range []string{
+		"I am writing to inform you that the heating has not worked since October 1.",
+		"The mold could hurt my children, please remove it by Friday.",
+		"I cleaned the floor with Spic and Span but the stain remains.",
+		"The stupid door will not close and the lock is broken.",
+		"Pest control said the spray will kill the roaches.",
+		"If the repair is not made within 30 days, I may deposit rent with the court as allowed by Ohio Revised Code 5321.07.",
+		"The fire retardant coating is peeling.",
+		"Please fix the furnace, or else the pipes will freeze.",
+	} {
+		if v := contentPolicy.Check(text); v != nil {
+			t.Errorf("%q: expected no violation, got %+v", text, v)
+		}
+	}
+}
+
+func TestLoadContentPolicyRejectsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":   "categories:\n  - name: threat\n    description: threatens\n    words: [kill]\n",
+		"no description":  "categories:\n  - name: threat\n    lexicon: [kill]\n",
+		"empty category":  "categories:\n  - name: threat\n    description: threatens\n",
+		"invalid pattern": "categories:\n  - name: threat\n    description: threatens\n    patterns: ['(kill']\n",
+	}
+	for name, data := range tests {
+		if _, err := LoadContentPolicy([]byte(data)); !errors.Is(err, ErrInvalidContentPolicy) {
+			t.Errorf("%s: expected ErrInvalidContentPolicy, got %v", name, err)
+		}
+	}
+}
+
+// threateningProvider writes the letter the Terms of Service forbid, whatever it is asked
+type threateningProvider struct{}
+
+func (threateningProvider) Infer(context.Context, []Message) (string, []Usage, error) {
+	return "Fix the furnace by Friday or else.", nil, nil
+}
+
+func TestTextHandlerPolicyViolation(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	r := router{ip: threateningProvider{}, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"altcha":  altchaToken,
+		"answers": map[string]string{"mainProblem": "no heat"},
+	})
+	w := httptest.NewRecorder()
+
+	r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+	if w.Result().StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected %d, got %d", http.StatusUnprocessableEntity, w.Result().StatusCode)
+	}
+	var result PolicyViolationResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Error != policyViolationError || result.Category != "threat" || strings.Contains(result.Message, "or else") {
+		t.Errorf("unexpected response %+v", result)
+	}
+}
+
+// threateningTranslationProvider writes a letter which is fine but translates it into one which
+// is not
+type threateningTranslationProvider struct{}
+
+func (threateningTranslationProvider) Infer(_ context.Context, messages []Message) (string, []Usage, error) {
+	if system, _ := SplitSystemPrompt(messages); system == RenderTranslationPrompt("Spanish") {
+		return "Arregle la calefacción antes del viernes, or else.", nil, nil
+	}
+	return "Please fix the furnace by Friday.", nil, nil
+}
+
+func TestTextHandlerPolicyViolationInTranslation(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	r := router{ip: threateningTranslationProvider{}, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"altcha":         altchaToken,
+		"answers":        map[string]string{"mainProblem": "no heat"},
+		"tenantLanguage": "es",
+	})
+	w := httptest.NewRecorder()
+
+	r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+	if w.Result().StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected %d, got %d", http.StatusUnprocessableEntity, w.Result().StatusCode)
+	}
+}
+
+func TestPdfHandlerPolicyViolation(t *testing.T) {
+	body, _ := json.Marshal(PdfRequestV2{
+		Sender:   LetterAddress{Name: "Tenant", Line1: "1 Main St", City: "Columbus", State: "OH", Zip: "43215"},
+		Receiver: LetterAddress{Name: "Landlord", Line1: "2 Main St", City: "Columbus", State: "OH", Zip: "43215"},
+		Body:     "The sink leaks.\n\nYou are a worthless idiot.",
+	})
+	w := httptest.NewRecorder()
+
+	(&router{}).pdfV2(w, httptest.NewRequest(http.MethodPost, "/api/v2/pdf", bytes.NewReader(body)))
+
+	if w.Result().StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected %d, got %d: %s", http.StatusUnprocessableEntity, w.Result().StatusCode, w.Body.String())
+	}
+	var result PolicyViolationResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Category != "harassment" {
+		t.Errorf("expected harassment, got %+v", result)
+	}
+}
+
+// The translation is printed on a page of its own, and is checked like the body
+func TestPdfHandlerPolicyViolationInTranslation(t *testing.T) {
+	const translation = "El fregadero gotea. I know where you live."
+	v1, _ := json.Marshal(PdfRequest{
+		SenderName: "Tenant", SenderAddress: "1 Main St", SenderCity: "Columbus", SenderState: "OH", SenderZip: "43215",
+		ReceiverName: "Landlord", ReceiverAddress: "2 Main St", ReceiverCity: "Columbus", ReceiverState: "OH", ReceiverZip: "43215",
+		Body: "The sink leaks.", TenantLanguage: "es", TenantTranslation: translation,
+	})
+	v2, _ := json.Marshal(PdfRequestV2{
+		Sender:   LetterAddress{Name: "Tenant", Line1: "1 Main St", City: "Columbus", State: "OH", Zip: "43215"},
+		Receiver: LetterAddress{Name: "Landlord", Line1: "2 Main St", City: "Columbus", State: "OH", Zip: "43215"},
+		Body:     "The sink leaks.", TenantLanguage: "es", TenantTranslation: translation,
+	})
+
+	rt := &router{}
+	for path, test := range map[string]struct {
+		handler http.HandlerFunc
+		body    []byte
+	}{
+		"/api/pdf":    {rt.pdf, v1},
+		"/api/v2/pdf": {rt.pdfV2, v2},
+	} {
+		w := httptest.NewRecorder()
+
+		test.handler(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(test.body)))
+
+		if w.Result().StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: expected %d, got %d: %s", path, http.StatusUnprocessableEntity, w.Result().StatusCode, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnresolvedDeadline = errors.New("deadline could not be resolved")
+)
+
+// The form question asking when the problem should be solved by
+const deadlineQuestion = "solutionDate"
+
+// The notice period of a rule pack which limits how long a landlord may take to make repairs
+const repairNoticePurpose = "repair"
+
+// The notice period of a rule pack which is the least time a landlord must be given to make
+// repairs once asked
+const minimumNoticePurpose = "minimumNotice"
+
+const (
+	deadlineDateLayout = "2006-01-02"
+	deadlineTextLayout = "Monday, January 2, 2006"
+)
+
+// DeadlineUnit is the unit of a relative deadline such as "two weeks"
+type DeadlineUnit int
+
+const (
+	DeadlineDays DeadlineUnit = iota
+	DeadlineBusinessDays
+	DeadlineWeeks
+	DeadlineMonths
+)
+
+// RequestedDeadline is the deadline a tenant asked for, parsed with ParseDeadline
+type RequestedDeadline struct {
+	// Set for expressions such as "as soon as possible", which resolve to the end of the minimum
+	// notice period of the jurisdiction
+	Soonest bool
+	// Set for absolute dates such as "December 1", at midnight UTC
+	Date time.Time
+	// Used for relative deadlines such as "10 business days"
+	Amount int
+	Unit   DeadlineUnit
+}
+
+// Deadline is a resolved deadline, as returned to the client and shown in the letter
+type Deadline struct {
+	// The date in YYYY-MM-DD format
+	Date string `json:"date"`
+	// The date as written in the letter, such as "Friday, November 20, 2026"
+	Text string `json:"text"`
+	// Set when the requested date was moved later to give the landlord the minimum notice
+	Extended bool `json:"extended"`
+	// Set when the requested date is later than the end of the repair notice period, which is the
+	// most time the law gives the landlord. The date is kept, as the tenant may give more time.
+	PastNoticePeriod bool `json:"pastNoticePeriod"`
+	// Reference of the law setting the notice period, when the date is the end of the minimum
+	// notice period or past the repair notice period
+	Citation string `json:"citation,omitempty"`
+}
+
+var (
+	soonestPattern  = regexp.MustCompile(`\b(as soon as possible|asap|immediately|right away|urgently|urgent)\b`)
+	isoDatePattern  = regexp.MustCompile(`\b(\d{4})-(\d{1,2})-(\d{1,2})\b`)
+	usDatePattern   = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})(?:/(\d{4}|\d{2}))?\b`)
+	namedDate       = regexp.MustCompile(`\b(jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|may|june?|july?|aug(?:ust)?|sep(?:t(?:ember)?)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?)\b\.?\s+(\d{1,2})(?:st|nd|rd|th)?(?:,?\s+(\d{4}))?\b`)
+	durationPattern = regexp.MustCompile(`\b(\d+|a couple of|a few|[a-z]+(?:[- ][a-z]+)??)\s+(?:(business|working|calendar)\s+)?(days?|weeks?|months?)\b`)
+	weekdayPattern  = regexp.MustCompile(`\b(sunday|monday|tuesday|wednesday|thursday|friday|saturday)\b`)
+)
+
+var deadlineMonths = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+	"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August, "sep": time.September,
+	"sept": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+var deadlineNumbers = map[string]int{
+	"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6, "seven": 7,
+	"eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12, "thirteen": 13, "fourteen": 14,
+	"fifteen": 15, "sixteen": 16, "seventeen": 17, "eighteen": 18, "nineteen": 19, "twenty": 20,
+	"thirty": 30, "forty": 40, "fifty": 50, "sixty": 60, "ninety": 90,
+	"a couple of": 2, "a few": 3,
+}
+
+var deadlineWeekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday,
+	"wednesday": time.Wednesday, "thursday": time.Thursday, "friday": time.Friday,
+	"saturday": time.Saturday,
+}
+
+// ParseDeadline reads the deadline from a free text answer such as "as soon as possible", "within
+// two weeks", "10 business days" or "by December 1". today is the tenant's current date, which
+// absolute dates without a year are resolved against.
+func ParseDeadline(text string, today time.Time) (RequestedDeadline, error) {
+	s := strings.ToLower(strings.Join(strings.Fields(text), " "))
+	today = civilDate(today)
+
+	switch {
+	case soonestPattern.MatchString(s):
+		return RequestedDeadline{Soonest: true}, nil
+	case strings.Contains(s, "tomorrow"):
+		return RequestedDeadline{Amount: 1, Unit: DeadlineDays}, nil
+	case strings.Contains(s, "fortnight"):
+		return RequestedDeadline{Amount: 2, Unit: DeadlineWeeks}, nil
+	case strings.Contains(s, "next week"):
+		return RequestedDeadline{Amount: 1, Unit: DeadlineWeeks}, nil
+	case strings.Contains(s, "next month"):
+		return RequestedDeadline{Amount: 1, Unit: DeadlineMonths}, nil
+	case strings.Contains(s, "end of the week") || strings.Contains(s, "end of week"):
+		days := (int(time.Friday) - int(today.Weekday()) + 7) % 7
+		return RequestedDeadline{Amount: days, Unit: DeadlineDays}, nil
+	case strings.Contains(s, "end of the month") || strings.Contains(s, "end of month"):
+		return RequestedDeadline{Date: time.Date(today.Year(), today.Month()+1, 0, 0, 0, 0, 0, time.UTC)}, nil
+	}
+
+	// Numbers which only look like dates, such as "24/7", are skipped so that a duration elsewhere
+	// in the answer is still found
+	for _, m := range isoDatePattern.FindAllStringSubmatch(s, -1) {
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		day, _ := strconv.Atoi(m[3])
+		if d, err := absoluteDeadline(year, time.Month(month), day, today); err == nil {
+			return d, nil
+		}
+	}
+	for _, m := range usDatePattern.FindAllStringSubmatch(s, -1) {
+		month, _ := strconv.Atoi(m[1])
+		day, _ := strconv.Atoi(m[2])
+		year, _ := strconv.Atoi(m[3])
+		if len(m[3]) == 2 {
+			year += 2000
+		}
+		if d, err := absoluteDeadline(year, time.Month(month), day, today); err == nil {
+			return d, nil
+		}
+	}
+	for _, m := range namedDate.FindAllStringSubmatch(s, -1) {
+		day, _ := strconv.Atoi(m[2])
+		year, _ := strconv.Atoi(m[3])
+		if d, err := absoluteDeadline(year, deadlineMonths[m[1][:3]], day, today); err == nil {
+			return d, nil
+		}
+	}
+
+	if d, ok := parseDuration(s); ok {
+		return d, nil
+	}
+
+	if m := weekdayPattern.FindStringSubmatch(s); m != nil {
+		// The next one, so "Friday" on a Friday is a week away
+		days := (int(deadlineWeekdays[m[1]])-int(today.Weekday())+6)%7 + 1
+		if strings.Contains(s, "next "+m[1]) && days < 7 {
+			days += 7
+		}
+		return RequestedDeadline{Amount: days, Unit: DeadlineDays}, nil
+	}
+
+	return RequestedDeadline{}, ErrUnresolvedDeadline
+}
+
+// parseDuration finds the first duration with a known amount, such as "10 days" or "twenty-one
+// days". The pattern also matches words before the unit, such as "of the week".
+func parseDuration(s string) (RequestedDeadline, bool) {
+	for _, m := range durationPattern.FindAllStringSubmatch(s, -1) {
+		amount, err := strconv.Atoi(m[1])
+		if err != nil {
+			amount = parseNumberWords(m[1])
+		}
+		if amount <= 0 || amount > 365 {
+			continue
+		}
+
+		d := RequestedDeadline{Amount: amount}
+		switch strings.TrimSuffix(m[3], "s") {
+		case "day":
+			d.Unit = DeadlineDays
+			if m[2] == "business" || m[2] == "working" {
+				d.Unit = DeadlineBusinessDays
+			}
+		case "week":
+			d.Unit = DeadlineWeeks
+		case "month":
+			d.Unit = DeadlineMonths
+		}
+		return d, true
+	}
+	return RequestedDeadline{}, false
+}
+
+// parseNumberWords adds up the number words at the end of a phrase, so "within twenty one" is 21
+func parseNumberWords(phrase string) int {
+	if n, ok := deadlineNumbers[phrase]; ok {
+		return n
+	}
+	words := strings.Fields(strings.ReplaceAll(phrase, "-", " "))
+	total := 0
+	for i := len(words) - 1; i >= 0; i-- {
+		n, ok := deadlineNumbers[words[i]]
+		if !ok {
+			break
+		}
+		total += n
+	}
+	return total
+}
+
+func absoluteDeadline(year int, month time.Month, day int, today time.Time) (RequestedDeadline, error) {
+	explicitYear := year != 0
+	if !explicitYear {
+		year = today.Year()
+	}
+	d := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	// time.Date normalizes dates such as February 30
+	if month < time.January || month > time.December || d.Day() != day {
+		return RequestedDeadline{}, ErrUnresolvedDeadline
+	}
+	if !explicitYear && d.Before(today) {
+		d = d.AddDate(1, 0, 0)
+	}
+	if d.Before(today) {
+		return RequestedDeadline{}, ErrUnresolvedDeadline
+	}
+	return RequestedDeadline{Date: d}, nil
+}
+
+// ResolveDeadline turns the tenant's answer into a date in the time zone of the state. Deadlines
+// which fall on a weekend or holiday move to the next business day, and deadlines sooner than the
+// minimum notice period of the rule pack move to the end of that period. The repair notice period
+// is the longest the landlord may take, so later dates are kept and only flagged. "As soon as
+// possible" is the end of the minimum notice period, and is only resolved when there is one.
+func ResolveDeadline(text string, now time.Time, state string, pack *RulePack) (Deadline, error) {
+	today := civilDate(now.In(stateLocation(state)))
+	cal := NewHolidayCalendar(state)
+
+	requested, err := ParseDeadline(text, today)
+	if err != nil {
+		return Deadline{}, err
+	}
+
+	var date time.Time
+	switch {
+	case requested.Soonest:
+		date = today
+	case !requested.Date.IsZero():
+		date = requested.Date
+	case requested.Unit == DeadlineBusinessDays:
+		date = cal.AddBusinessDays(today, requested.Amount)
+	case requested.Unit == DeadlineWeeks:
+		date = today.AddDate(0, 0, 7*requested.Amount)
+	case requested.Unit == DeadlineMonths:
+		date = today.AddDate(0, requested.Amount, 0)
+	default:
+		date = today.AddDate(0, 0, requested.Amount)
+	}
+
+	var deadline Deadline
+	var minimum, repair *NoticePeriod
+	if pack != nil {
+		minimum = pack.NoticePeriod(minimumNoticePurpose)
+		repair = pack.NoticePeriod(repairNoticePurpose)
+	}
+	if minimum == nil && requested.Soonest {
+		return Deadline{}, ErrUnresolvedDeadline
+	}
+
+	date = cal.NextBusinessDay(date)
+	if minimum != nil {
+		if earliest := cal.NextBusinessDay(noticePeriodEnd(cal, today, minimum)); date.Before(earliest) {
+			date = earliest
+			// Asking for repairs "as soon as possible" is not asking for less than the notice period
+			deadline.Extended = !requested.Soonest
+			deadline.Citation = minimum.Citation
+		}
+	}
+	if repair != nil && date.After(cal.NextBusinessDay(noticePeriodEnd(cal, today, repair))) {
+		deadline.PastNoticePeriod = true
+		deadline.Citation = repair.Citation
+	}
+
+	deadline.Date = date.Format(deadlineDateLayout)
+	deadline.Text = date.Format(deadlineTextLayout)
+	return deadline, nil
+}
+
+// noticePeriodEnd returns the first day a notice given today has run its course
+func noticePeriodEnd(cal HolidayCalendar, today time.Time, n *NoticePeriod) time.Time {
+	days := n.Days
+	if n.Hours > 0 {
+		days = (n.Hours + 23) / 24
+	}
+	if n.BusinessDays {
+		return cal.AddBusinessDays(today, days)
+	}
+	return today.AddDate(0, 0, days)
+}
+
+// ParseDeadlineDate reads a deadline date in YYYY-MM-DD format, as returned by ResolveDeadline, and
+// formats it for the letter
+func ParseDeadlineDate(date string) (string, error) {
+	d, err := time.Parse(deadlineDateLayout, date)
+	if err != nil {
+		return "", fmt.Errorf("invalid deadline %q, expected YYYY-MM-DD", date)
+	}
+	return d.Format(deadlineTextLayout), nil
+}
+
+// civilDate drops the time of day, keeping the date as seen in the time zone of t
+func civilDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Holiday is a public holiday on which the day off is observed
+type Holiday struct {
+	Name string
+	// The observed date, at midnight UTC
+	Date time.Time
+}
+
+// holidayRule is either a fixed date, or the nth weekday of a month counting from the end when
+// Week is negative
+type holidayRule struct {
+	Name    string
+	Month   time.Month
+	Day     int
+	Weekday time.Weekday
+	Week    int
+	// Days after the date of the rule, such as the day after Thanksgiving
+	Offset int
+}
+
+// 5 U.S.C. 6103. Fixed date holidays on a Saturday are observed on the Friday before, and on a
+// Sunday on the Monday after.
+var federalHolidays = []holidayRule{
+	{Name: "New Year's Day", Month: time.January, Day: 1},
+	{Name: "Birthday of Martin Luther King, Jr.", Month: time.January, Weekday: time.Monday, Week: 3},
+	{Name: "Washington's Birthday", Month: time.February, Weekday: time.Monday, Week: 3},
+	{Name: "Memorial Day", Month: time.May, Weekday: time.Monday, Week: -1},
+	{Name: "Juneteenth National Independence Day", Month: time.June, Day: 19},
+	{Name: "Independence Day", Month: time.July, Day: 4},
+	{Name: "Labor Day", Month: time.September, Weekday: time.Monday, Week: 1},
+	{Name: "Columbus Day", Month: time.October, Weekday: time.Monday, Week: 2},
+	{Name: "Veterans Day", Month: time.November, Day: 11},
+	{Name: "Thanksgiving Day", Month: time.November, Weekday: time.Thursday, Week: 4},
+	{Name: "Christmas Day", Month: time.December, Day: 25},
+}
+
+// State holidays in addition to the federal ones. Ohio's legal holidays (ORC 1.14) are the federal
+// holidays.
+var stateHolidays = map[string][]holidayRule{
+	"CA": {
+		{Name: "Cesar Chavez Day", Month: time.March, Day: 31},
+		{Name: "Day after Thanksgiving", Month: time.November, Weekday: time.Thursday, Week: 4, Offset: 1},
+	},
+	"MA": {
+		{Name: "Patriots' Day", Month: time.April, Weekday: time.Monday, Week: 3},
+	},
+	"ME": {
+		{Name: "Patriots' Day", Month: time.April, Weekday: time.Monday, Week: 3},
+	},
+	"IL": {
+		{Name: "Lincoln's Birthday", Month: time.February, Day: 12},
+	},
+	"TX": {
+		{Name: "Day after Thanksgiving", Month: time.November, Weekday: time.Thursday, Week: 4, Offset: 1},
+	},
+}
+
+// HolidayCalendar knows the business days of a state
+type HolidayCalendar struct {
+	rules []holidayRule
+}
+
+// NewHolidayCalendar returns the calendar of federal and state holidays of a state
+func NewHolidayCalendar(state string) HolidayCalendar {
+	state = NormalizeAddress(LetterAddress{State: state}).State
+	rules := append([]holidayRule{}, federalHolidays...)
+	return HolidayCalendar{rules: append(rules, stateHolidays[state]...)}
+}
+
+// Holidays returns the observed holidays of a year, in order of the rules
+func (c HolidayCalendar) Holidays(year int) []Holiday {
+	holidays := make([]Holiday, 0, len(c.rules))
+	for _, r := range c.rules {
+		var d time.Time
+		if r.Day != 0 {
+			d = time.Date(year, r.Month, r.Day, 0, 0, 0, 0, time.UTC)
+			switch d.Weekday() {
+			case time.Saturday:
+				d = d.AddDate(0, 0, -1)
+			case time.Sunday:
+				d = d.AddDate(0, 0, 1)
+			}
+		} else if r.Week > 0 {
+			first := time.Date(year, r.Month, 1, 0, 0, 0, 0, time.UTC)
+			d = first.AddDate(0, 0, (int(r.Weekday)-int(first.Weekday())+7)%7+7*(r.Week-1))
+		} else {
+			last := time.Date(year, r.Month+1, 0, 0, 0, 0, 0, time.UTC)
+			d = last.AddDate(0, 0, -((int(last.Weekday())-int(r.Weekday)+7)%7)+7*(r.Week+1))
+		}
+		holidays = append(holidays, Holiday{Name: r.Name, Date: d.AddDate(0, 0, r.Offset)})
+	}
+	return holidays
+}
+
+// IsHoliday reports whether a holiday is observed on the date
+func (c HolidayCalendar) IsHoliday(date time.Time) bool {
+	date = civilDate(date)
+	// New Year's Day on a Saturday is observed in the previous year
+	for _, year := range []int{date.Year(), date.Year() + 1} {
+		for _, h := range c.Holidays(year) {
+			if h.Date.Equal(date) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsBusinessDay reports whether the date is a weekday which is not a holiday
+func (c HolidayCalendar) IsBusinessDay(date time.Time) bool {
+	if wd := date.Weekday(); wd == time.Saturday || wd == time.Sunday {
+		return false
+	}
+	return !c.IsHoliday(date)
+}
+
+// NextBusinessDay returns the date, or the first business day after it
+func (c HolidayCalendar) NextBusinessDay(date time.Time) time.Time {
+	for !c.IsBusinessDay(date) {
+		date = date.AddDate(0, 0, 1)
+	}
+	return date
+}
+
+// AddBusinessDays returns the date n business days after the date
+func (c HolidayCalendar) AddBusinessDays(date time.Time, n int) time.Time {
+	for n > 0 {
+		date = date.AddDate(0, 0, 1)
+		if c.IsBusinessDay(date) {
+			n--
+		}
+	}
+	return date
+}
+
+// stateTimeZones maps states to the time zone most of their residents live in
+var stateTimeZones = map[string]string{
+	"AL": "America/Chicago", "AK": "America/Anchorage", "AZ": "America/Phoenix",
+	"AR": "America/Chicago", "CA": "America/Los_Angeles", "CO": "America/Denver",
+	"CT": "America/New_York", "DE": "America/New_York", "DC": "America/New_York",
+	"FL": "America/New_York", "GA": "America/New_York", "HI": "Pacific/Honolulu",
+	"ID": "America/Boise", "IL": "America/Chicago", "IN": "America/Indiana/Indianapolis",
+	"IA": "America/Chicago", "KS": "America/Chicago", "KY": "America/New_York",
+	"LA": "America/Chicago", "ME": "America/New_York", "MD": "America/New_York",
+	"MA": "America/New_York", "MI": "America/Detroit", "MN": "America/Chicago",
+	"MS": "America/Chicago", "MO": "America/Chicago", "MT": "America/Denver",
+	"NE": "America/Chicago", "NV": "America/Los_Angeles", "NH": "America/New_York",
+	"NJ": "America/New_York", "NM": "America/Denver", "NY": "America/New_York",
+	"NC": "America/New_York", "ND": "America/Chicago", "OH": "America/New_York",
+	"OK": "America/Chicago", "OR": "America/Los_Angeles", "PA": "America/New_York",
+	"RI": "America/New_York", "SC": "America/New_York", "SD": "America/Chicago",
+	"TN": "America/Chicago", "TX": "America/Chicago", "UT": "America/Denver",
+	"VT": "America/New_York", "VA": "America/New_York", "WA": "America/Los_Angeles",
+	"WV": "America/New_York", "WI": "America/Chicago", "WY": "America/Denver",
+	"PR": "America/Puerto_Rico", "VI": "America/St_Thomas", "GU": "Pacific/Guam",
+	"AS": "Pacific/Pago_Pago", "MP": "Pacific/Saipan",
+}
+
+// stateLocation returns the time zone of a state, or New York for unknown states
+func stateLocation(state string) *time.Location {
+	state = NormalizeAddress(LetterAddress{State: state}).State
+	name, ok := stateTimeZones[state]
+	if !ok {
+		name = "America/New_York"
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
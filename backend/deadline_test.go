@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParseDeadline(t *testing.T) {
+	// A Monday
+	today := testDate(2026, time.October, 19)
+
+	tests := []struct {
+		in   string
+		want RequestedDeadline
+	}{
+		{"I would like this fixed as soon as possible", RequestedDeadline{Soonest: true}},
+		{"ASAP!", RequestedDeadline{Soonest: true}},
+		{"two weeks", RequestedDeadline{Amount: 2, Unit: DeadlineWeeks}},
+		{"Within a couple of weeks please", RequestedDeadline{Amount: 2, Unit: DeadlineWeeks}},
+		{"in 10 business days", RequestedDeadline{Amount: 10, Unit: DeadlineBusinessDays}},
+		{"five working days", RequestedDeadline{Amount: 5, Unit: DeadlineBusinessDays}},
+		{"twenty-one days", RequestedDeadline{Amount: 21, Unit: DeadlineDays}},
+		{"within a month", RequestedDeadline{Amount: 1, Unit: DeadlineMonths}},
+		{"tomorrow", RequestedDeadline{Amount: 1, Unit: DeadlineDays}},
+		{"by the end of the week", RequestedDeadline{Amount: 4, Unit: DeadlineDays}},
+		{"by Friday", RequestedDeadline{Amount: 4, Unit: DeadlineDays}},
+		{"by Monday", RequestedDeadline{Amount: 7, Unit: DeadlineDays}},
+		{"next Friday", RequestedDeadline{Amount: 11, Unit: DeadlineDays}},
+		{"end of the month", RequestedDeadline{Date: testDate(2026, time.October, 31)}},
+		{"by November 20th", RequestedDeadline{Date: testDate(2026, time.November, 20)}},
+		{"Jan 5", RequestedDeadline{Date: testDate(2027, time.January, 5)}},
+		{"12/1/2026", RequestedDeadline{Date: testDate(2026, time.December, 1)}},
+		{"2026-11-02", RequestedDeadline{Date: testDate(2026, time.November, 2)}},
+		{"September 3rd", RequestedDeadline{Date: testDate(2027, time.September, 3)}},
+		{"Sept. 3", RequestedDeadline{Date: testDate(2027, time.September, 3)}},
+		// Not dates
+		{"no heat 24/7, fix within 14 days", RequestedDeadline{Amount: 14, Unit: DeadlineDays}},
+		{"please decide 15 days from now", RequestedDeadline{Amount: 15, Unit: DeadlineDays}},
+		{"I marked 3 spots, fix in 2 weeks", RequestedDeadline{Amount: 2, Unit: DeadlineWeeks}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseDeadline(tt.in, today)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseDeadlineUnresolved(t *testing.T) {
+	today := testDate(2026, time.October, 19)
+	for _, in := range []string{"", "whenever works for you", "February 30", "2025-01-01", "some days"} {
+		if _, err := ParseDeadline(in, today); !errors.Is(err, ErrUnresolvedDeadline) {
+			t.Errorf("%q: expected ErrUnresolvedDeadline, got %v", in, err)
+		}
+	}
+}
+
+func TestHolidayCalendar(t *testing.T) {
+	cal := NewHolidayCalendar("OH")
+
+	holidays := map[string]time.Time{}
+	for _, h := range cal.Holidays(2026) {
+		holidays[h.Name] = h.Date
+	}
+	tests := map[string]time.Time{
+		"Birthday of Martin Luther King, Jr.": testDate(2026, time.January, 19),
+		"Memorial Day":                        testDate(2026, time.May, 25),
+		// July 4th is a Saturday
+		"Independence Day": testDate(2026, time.July, 3),
+		"Labor Day":        testDate(2026, time.September, 7),
+		"Thanksgiving Day": testDate(2026, time.November, 26),
+	}
+	for name, want := range tests {
+		if !holidays[name].Equal(want) {
+			t.Errorf("expected %s on %s, got %s", name, want.Format(time.DateOnly), holidays[name].Format(time.DateOnly))
+		}
+	}
+
+	// New Year's Day 2028 is a Saturday, observed on Friday, December 31 2027
+	if !cal.IsHoliday(testDate(2027, time.December, 31)) {
+		t.Error("expected New Year's Day 2028 to be observed in 2027")
+	}
+
+	if cal.IsHoliday(testDate(2026, time.November, 27)) {
+		t.Error("expected the day after Thanksgiving to be a business day in Ohio")
+	}
+	if !NewHolidayCalendar("California").IsHoliday(testDate(2026, time.November, 27)) {
+		t.Error("expected the day after Thanksgiving to be a holiday in California")
+	}
+}
+
+func TestAddBusinessDays(t *testing.T) {
+	cal := NewHolidayCalendar("OH")
+
+	// Wednesday before Thanksgiving: skips Thursday and the weekend
+	got := cal.AddBusinessDays(testDate(2026, time.November, 25), 2)
+	if want := testDate(2026, time.November, 30); !got.Equal(want) {
+		t.Fatalf("expected %s, got %s", want.Format(time.DateOnly), got.Format(time.DateOnly))
+	}
+}
+
+func TestResolveDeadline(t *testing.T) {
+	ohio := SelectRulePack(rulePacks, "OH", "")
+	// 11pm in Los Angeles is already the next day in Ohio
+	now := time.Date(2026, time.October, 19, 23, 0, 0, 0, mustLoadLocation(t, "America/Los_Angeles"))
+
+	tests := []struct {
+		name  string
+		text  string
+		state string
+		pack  *RulePack
+		want  Deadline
+	}{
+		{
+			name:  "calendar days in the state's time zone",
+			text:  "in 10 days",
+			state: "CA",
+			want:  Deadline{Date: "2026-10-29", Text: "Thursday, October 29, 2026"},
+		},
+		{
+			name:  "deadline on a weekend moves to the next business day",
+			text:  "in 12 days",
+			state: "OH",
+			want:  Deadline{Date: "2026-11-02", Text: "Monday, November 2, 2026"},
+		},
+		{
+			name:  "business days skip holidays",
+			text:  "20 business days",
+			state: "OH",
+			want:  Deadline{Date: "2026-11-18", Text: "Wednesday, November 18, 2026"},
+		},
+		{
+			name:  "shorter than the notice period is kept",
+			text:  "two weeks",
+			state: "OH",
+			pack:  ohio,
+			want:  Deadline{Date: "2026-11-03", Text: "Tuesday, November 3, 2026"},
+		},
+		{
+			name:  "the end of the notice period",
+			text:  "30 days",
+			state: "OH",
+			pack:  ohio,
+			want:  Deadline{Date: "2026-11-19", Text: "Thursday, November 19, 2026"},
+		},
+		{
+			name:  "longer than the notice period is kept and flagged",
+			text:  "by December 1",
+			state: "OH",
+			pack:  ohio,
+			want:  Deadline{Date: "2026-12-01", Text: "Tuesday, December 1, 2026", PastNoticePeriod: true, Citation: "Ohio Revised Code 5321.07(B)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveDeadline(tt.text, now, tt.state, tt.pack)
+			if err != nil {
+				t.Fatalf("failed to resolve: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+
+	// Ohio has no minimum notice for repairs, so "as soon as possible" is not a date
+	for _, pack := range []*RulePack{nil, ohio} {
+		if _, err := ResolveDeadline("as soon as possible", now, "OH", pack); !errors.Is(err, ErrUnresolvedDeadline) {
+			t.Errorf("expected ErrUnresolvedDeadline without a minimum notice period, got %v", err)
+		}
+	}
+}
+
+func TestResolveDeadlineBusinessDayNoticePeriod(t *testing.T) {
+	pack := &RulePack{NoticePeriods: []NoticePeriod{
+		{Purpose: minimumNoticePurpose, Days: 3, BusinessDays: true, Citation: "minimum"},
+		{Purpose: repairNoticePurpose, Days: 7, Citation: "repair"},
+	}}
+
+	// Wednesday before Thanksgiving. The minimum ends on Tuesday, as Thanksgiving and the weekend
+	// are not counted.
+	now := time.Date(2026, time.November, 25, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		text string
+		want Deadline
+	}{
+		{"tomorrow", Deadline{Date: "2026-12-01", Text: "Tuesday, December 1, 2026", Extended: true, Citation: "minimum"}},
+		{"as soon as possible", Deadline{Date: "2026-12-01", Text: "Tuesday, December 1, 2026", Citation: "minimum"}},
+		{"December 2", Deadline{Date: "2026-12-02", Text: "Wednesday, December 2, 2026"}},
+		{"December 3", Deadline{Date: "2026-12-03", Text: "Thursday, December 3, 2026", PastNoticePeriod: true, Citation: "repair"}},
+	}
+	for _, tt := range tests {
+		got, err := ResolveDeadline(tt.text, now, "OH", pack)
+		if err != nil {
+			t.Fatalf("%s: failed to resolve: %v", tt.text, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.text, tt.want, got)
+		}
+	}
+}
+
+func TestTextHandlerResolvesDeadline(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	r := router{ip: &promptRecordingProvider{}, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"altcha":        altchaToken,
+		"answers":       map[string]string{"mainProblem": "no heat", "solutionDate": "in two weeks"},
+		"receiverState": "OH",
+	})
+	w := httptest.NewRecorder()
+
+	r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+	var result TextResponseSuccess
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Deadline == nil {
+		t.Fatal("expected a deadline")
+	}
+	if !strings.Contains(result.Text, "solved by: "+result.Deadline.Text) {
+		t.Errorf("expected the prompt to include the resolved date, got %q", result.Text)
+	}
+}
+
+func TestParseDeadlineDate(t *testing.T) {
+	if got, err := ParseDeadlineDate("2026-11-19"); err != nil || got != "Thursday, November 19, 2026" {
+		t.Fatalf("unexpected result %q, %v", got, err)
+	}
+	if _, err := ParseDeadlineDate("November 19"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestPdfV2HandlerRejectsInvalidDeadline(t *testing.T) {
+	address := validTestAddress()
+	body, _ := json.Marshal(PdfRequestV2{Sender: address, Receiver: address, Body: "b", Deadline: "next week"})
+	w := httptest.NewRecorder()
+
+	(&router{}).pdfV2(w, httptest.NewRequest(http.MethodPost, "/api/v2/pdf", bytes.NewReader(body)))
+
+	var result PdfResponseError
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if w.Result().StatusCode != http.StatusBadRequest || !strings.Contains(result.Message, "deadline") {
+		t.Fatalf("expected the deadline to be rejected, got %d %q", w.Result().StatusCode, result.Message)
+	}
+}
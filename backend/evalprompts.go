@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidEvalDataset = errors.New("invalid evaluation dataset")
+	ErrCassetteMiss       = errors.New("no recorded reply for this conversation")
+)
+
+// EvalCase is one line of an evaluation dataset, a JSONL file of answer sets
+type EvalCase struct {
+	ID string `json:"id"`
+	// What the case covers, for the report
+	Title   string            `json:"title"`
+	Answers map[string]string `json:"answers"`
+	// Set when the answers leave out details the letter needs, so it should use placeholders
+	MissingDetails bool `json:"missingDetails"`
+	// Optional, as in /api/text
+	ReceiverState string `json:"receiverState"`
+	ReceiverCity  string `json:"receiverCity"`
+	LetterStyle
+}
+
+// LoadEvalDataset reads a JSONL dataset. Blank lines are skipped.
+func LoadEvalDataset(r io.Reader) ([]EvalCase, error) {
+	var cases []EvalCase
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, MaxRequestBodySize)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var c EvalCase
+		d := json.NewDecoder(strings.NewReader(scanner.Text()))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&c); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrInvalidEvalDataset, line, err)
+		}
+		if c.ID == "" || c.Answers["mainProblem"] == "" {
+			return nil, fmt.Errorf("%w: line %d: id and a mainProblem answer are required", ErrInvalidEvalDataset, line)
+		}
+		if err := c.LetterStyle.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrInvalidEvalDataset, line, err)
+		}
+		if seen[c.ID] {
+			return nil, fmt.Errorf("%w: line %d: duplicate id %q", ErrInvalidEvalDataset, line, c.ID)
+		}
+		seen[c.ID] = true
+		cases = append(cases, c)
+	}
+	return cases, scanner.Err()
+}
+
+// LoadPromptVersion reads the prompts to evaluate from the inference section of a file like
+// app-config.yaml, other sections are ignored. A path ending in #name selects an entry of its
+// promptVersions.
+func LoadPromptVersion(path string) (PromptVersion, error) {
+	file, name, _ := strings.Cut(path, "#")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return PromptVersion{}, err
+	}
+	var config struct {
+		Inference struct {
+			SystemPrompt   string                `yaml:"systemPrompt"`
+			UserPrompt     string                `yaml:"userPrompt"`
+			PromptVersions []PromptVersionConfig `yaml:"promptVersions"`
+		} `yaml:"inference"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return PromptVersion{}, fmt.Errorf("%s: %w", file, err)
+	}
+	if config.Inference.SystemPrompt == "" || config.Inference.UserPrompt == "" {
+		return PromptVersion{}, fmt.Errorf("%s: inference.systemPrompt and inference.userPrompt are required", file)
+	}
+
+	if name == "" {
+		v, err := NewPromptVersion(path, config.Inference.SystemPrompt, config.Inference.UserPrompt)
+		if err != nil {
+			return PromptVersion{}, fmt.Errorf("%s: %w", file, err)
+		}
+		return v, nil
+	}
+	e, err := NewPromptExperiment(config.Inference.SystemPrompt, config.Inference.UserPrompt, config.Inference.PromptVersions)
+	if err != nil {
+		return PromptVersion{}, fmt.Errorf("%s: %w", file, err)
+	}
+	v, ok := e.Lookup(name)
+	if !ok {
+		return PromptVersion{}, fmt.Errorf("%s: %w: %q", file, ErrUnknownPromptVersion, name)
+	}
+	v.Name = path
+	return v, nil
+}
+
+// The answers of a case are delimited with fixed markers instead of a random nonce, so the
+// conversations, and so the replies recorded in a cassette, are the same between runs
+var evalAnswerBoundary = AnswerBoundary{Open: "<answer-eval>", Close: "</answer-eval>"}
+
+// Conversation renders the conversation of a case with PromptVersion.LetterConversation, as
+// /api/text does at the given time with the default injection action
+func (v PromptVersion) Conversation(c EvalCase, now time.Time) (LetterConversation, error) {
+	answers, flagged := ScreenAnswers(c.Answers, InjectionFlag)
+	return v.LetterConversation(LetterInput{
+		Answers:       answers,
+		Flagged:       len(flagged) > 0,
+		ReceiverState: c.ReceiverState,
+		ReceiverCity:  c.ReceiverCity,
+		Style:         c.LetterStyle,
+		Boundary:      evalAnswerBoundary,
+		Now:           now,
+	})
+}
+
+var (
+	salutationPattern = regexp.MustCompile(`(?im)^\W*(?:dear|to whom it may concern|hello|hi)\b|^\W*(?:sincerely|regards|best regards|kind regards|respectfully|yours truly|best),?\W*$`)
+	// The system prompt forbids interpreting the law or implying violation or liability
+	legalClaimPattern  = regexp.MustCompile(`(?i)\b(?:violat(?:e|es|ed|ing|ion)|liable|liability|negligen(?:t|ce)|breach(?:ed|es)?|lawsuit|sue|suing|legal action|attorney|lawyer|illegal|unlawful|required by law|legally (?:obligated|required)|my rights|entitled to)\b`)
+	placeholderPattern = regexp.MustCompile(`\[[^\[\]\n]+\]`)
+	// Placeholder styles other than the "[Landlord Name]" the letter template expects
+	malformedPlaceholderPattern = regexp.MustCompile(`\{\{?[^{}\n]*\}\}?|<[A-Za-z][A-Za-z _]*>|_{3,}|\bX{3,}\b`)
+)
+
+// Evaluator scores letters with deterministic checks
+type Evaluator struct {
+	// Letters outside this range fail the length check
+	MinWords int
+	MaxWords int
+	// The time prompts are rendered at. A fixed time keeps the conversations, and so the replies
+	// recorded in a cassette, the same between runs.
+	Now time.Time
+}
+
+type evalCheck struct {
+	Name string
+	// Returns why the letter fails, or an empty string
+	Check func(e *Evaluator, letter string, c EvalCase, conversation LetterConversation) string
+}
+
+var evalChecks = []evalCheck{
+	{"no-salutation", func(_ *Evaluator, letter string, _ EvalCase, _ LetterConversation) string {
+		if m := salutationPattern.FindString(letter); m != "" {
+			return fmt.Sprintf("%q", strings.TrimSpace(m))
+		}
+		return ""
+	}},
+	{"no-pii", func(_ *Evaluator, letter string, _ EvalCase, _ LetterConversation) string {
+		var kinds []string
+		for _, m := range DetectPII(letter) {
+			kinds = append(kinds, string(m.Kind))
+		}
+		return strings.Join(slices.Compact(kinds), ", ")
+	}},
+	{"no-legal-claims", func(_ *Evaluator, letter string, _ EvalCase, _ LetterConversation) string {
+		if m := legalClaimPattern.FindString(letter); m != "" {
+			return fmt.Sprintf("%q", m)
+		}
+		return ""
+	}},
+	{"placeholders", func(_ *Evaluator, letter string, c EvalCase, _ LetterConversation) string {
+		if m := malformedPlaceholderPattern.FindString(letter); m != "" {
+			return fmt.Sprintf("malformed placeholder %q", m)
+		}
+		if c.MissingDetails && !placeholderPattern.MatchString(letter) {
+			return "no placeholder for the missing details"
+		}
+		return ""
+	}},
+	{"length", func(e *Evaluator, letter string, _ EvalCase, _ LetterConversation) string {
+		if words := MeasureReadability(letter).Words; words < e.MinWords || words > e.MaxWords {
+			return fmt.Sprintf("%d words", words)
+		}
+		return ""
+	}},
+	{"grounded", func(e *Evaluator, letter string, c EvalCase, conversation LetterConversation) string {
+		var texts []string
+		for _, claim := range VerifyGrounding(letter, conversation.Messages, e.Now.In(stateLocation(c.ReceiverState)), conversation.Deadline, conversation.RulePack) {
+			texts = append(texts, fmt.Sprintf("%q", claim.Text))
+		}
+		return strings.Join(texts, ", ")
+	}},
+	{"content-policy", func(_ *Evaluator, letter string, _ EvalCase, conversation LetterConversation) string {
+		if v := contentPolicy.Check(conversation.PII.Restore(letter)); v != nil {
+			return v.Category
+		}
+		return ""
+	}},
+}
+
+// EvalResult is the outcome of one case for one prompt version
+type EvalResult struct {
+	Case EvalCase
+	// The letter as the model wrote it, with placeholders for the personal information of the
+	// answers
+	Letter string
+	// Inference failed, the case fails every check
+	Err error
+	// Why the letter failed each check, keyed by check name
+	Failures           map[string]string
+	FleschKincaidGrade float64
+}
+
+type EvalRun struct {
+	Version string
+	Results []EvalResult
+}
+
+// Run writes and scores the letter of every case with a prompt version
+func (e *Evaluator) Run(ctx context.Context, ip InferenceProvider, v PromptVersion, cases []EvalCase) EvalRun {
+	run := EvalRun{Version: v.Name}
+	for _, c := range cases {
+		result := EvalResult{Case: c, Failures: make(map[string]string)}
+		conversation, err := v.Conversation(c, e.Now)
+		if err == nil {
+			result.Letter, _, err = InferLetter(ctx, ip, conversation.Messages, c.LetterStyle)
+			result.Letter = evalAnswerBoundary.Strip(result.Letter)
+		}
+		if err != nil {
+			result.Err = err
+			for _, check := range evalChecks {
+				result.Failures[check.Name] = "inference failed"
+			}
+			run.Results = append(run.Results, result)
+			continue
+		}
+
+		for _, check := range evalChecks {
+			if problem := check.Check(e, result.Letter, c, conversation); problem != "" {
+				result.Failures[check.Name] = problem
+			}
+		}
+		result.FleschKincaidGrade = MeasureReadability(result.Letter).FleschKincaidGrade
+		run.Results = append(run.Results, result)
+	}
+	return run
+}
+
+// passes returns the number of letters passing a check
+func (r EvalRun) passes(check string) int {
+	n := 0
+	for _, result := range r.Results {
+		if _, failed := result.Failures[check]; !failed {
+			n++
+		}
+	}
+	return n
+}
+
+func (r EvalRun) meanGrade() float64 {
+	total, n := 0.0, 0
+	for _, result := range r.Results {
+		if result.Err == nil {
+			total += result.FleschKincaidGrade
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return round2(total / float64(n))
+}
+
+// Regressions returns the checks fewer candidate letters pass than baseline letters
+func Regressions(baseline, candidate EvalRun) []string {
+	var checks []string
+	for _, check := range evalChecks {
+		if candidate.passes(check.Name) < baseline.passes(check.Name) {
+			checks = append(checks, check.Name)
+		}
+	}
+	return checks
+}
+
+// WriteEvalReport writes a Markdown comparison of two runs over the same cases: the pass count of
+// each check, and the cases whose letters pass or fail differently
+func WriteEvalReport(w io.Writer, baseline, candidate EvalRun) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Prompt evaluation\n\n")
+	fmt.Fprintf(&b, "%d cases. Baseline: `%s`. Candidate: `%s`.\n\n", len(baseline.Results), baseline.Version, candidate.Version)
+	fmt.Fprintf(&b, "| Check | Baseline | Candidate | Change |\n|---|---|---|---|\n")
+	for _, check := range evalChecks {
+		before, after := baseline.passes(check.Name), candidate.passes(check.Name)
+		fmt.Fprintf(&b, "| %s | %d/%d | %d/%d | %+d |\n", check.Name, before, len(baseline.Results), after, len(candidate.Results), after-before)
+	}
+	fmt.Fprintf(&b, "| mean Flesch-Kincaid grade | %.2f | %.2f | %+.2f |\n", baseline.meanGrade(), candidate.meanGrade(), round2(candidate.meanGrade()-baseline.meanGrade()))
+
+	var changes []string
+	for i, before := range baseline.Results {
+		if i >= len(candidate.Results) {
+			break
+		}
+		after := candidate.Results[i]
+		var notes []string
+		for _, check := range evalChecks {
+			problemBefore, failedBefore := before.Failures[check.Name]
+			problemAfter, failedAfter := after.Failures[check.Name]
+			switch {
+			case failedBefore && !failedAfter:
+				notes = append(notes, fmt.Sprintf("fixed %s (was %s)", check.Name, problemBefore))
+			case !failedBefore && failedAfter:
+				notes = append(notes, fmt.Sprintf("**regressed %s** (%s)", check.Name, problemAfter))
+			}
+		}
+		if len(notes) > 0 {
+			changes = append(changes, fmt.Sprintf("- `%s` %s: %s", before.Case.ID, before.Case.Title, strings.Join(notes, "; ")))
+		}
+	}
+	if len(changes) > 0 {
+		fmt.Fprintf(&b, "\n## Changed cases\n\n%s\n", strings.Join(changes, "\n"))
+	} else {
+		fmt.Fprintf(&b, "\nNo case passes or fails differently.\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Cassette replays recorded replies of an inference provider, so evaluations can be repeated
+// without calling it. Replies are keyed by a hash of the conversation. Conversations which were not
+// recorded are passed to the next provider and recorded, or fail with ErrCassetteMiss when there is
+// none.
+type Cassette struct {
+	next    InferenceProvider
+	mu      sync.Mutex
+	replies map[string]string
+}
+
+var _ InferenceProvider = (*Cassette)(nil)
+
+type cassetteEntry struct {
+	Key   string `json:"key"`
+	Reply string `json:"reply"`
+}
+
+// LoadCassette reads a JSONL cassette. A missing file is an empty cassette when there is a next
+// provider to record from.
+func LoadCassette(path string, next InferenceProvider) (*Cassette, error) {
+	c := &Cassette{next: next, replies: make(map[string]string)}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && next != nil {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(f)
+	for {
+		var e cassetteEntry
+		if err := d.Decode(&e); errors.Is(err, io.EOF) {
+			return c, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		c.replies[e.Key] = e.Reply
+	}
+}
+
+func cassetteKey(messages []Message) string {
+	data, _ := json.Marshal(messages)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cassette) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	key := cassetteKey(messages)
+	c.mu.Lock()
+	reply, ok := c.replies[key]
+	c.mu.Unlock()
+	if ok {
+		// Replies played back used no tokens
+		return reply, nil, nil
+	}
+	if c.next == nil {
+		return "", nil, ErrCassetteMiss
+	}
+
+	reply, usage, err := c.next.Infer(ctx, messages)
+	if err != nil {
+		return "", usage, err
+	}
+	c.mu.Lock()
+	c.replies[key] = reply
+	c.mu.Unlock()
+	return reply, usage, nil
+}
+
+// Save writes the cassette, sorted by key so recordings diff well
+func (c *Cassette) Save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	for _, key := range slices.Sorted(maps.Keys(c.replies)) {
+		if err := e.Encode(cassetteEntry{Key: key, Reply: c.replies[key]}); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, b.Bytes(), 0o644)
+}
+
+// runEvalPrompts is the evalprompts command, run as `backend evalprompts -candidate new.yaml`. It
+// returns the exit code.
+func runEvalPrompts(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("evalprompts", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dataset := flags.String("dataset", "eval/dataset.jsonl", "JSONL file of answer sets")
+	baselinePath := flags.String("baseline", "app-config.yaml", "config file with the inference prompts to compare against")
+	candidatePath := flags.String("candidate", "", "config file with the inference prompts to evaluate")
+	providerName := flags.String("provider", "", "inference provider to run conversations which are not in the cassette")
+	cassettePath := flags.String("cassette", "", "JSONL file of recorded replies, updated with the replies of -provider")
+	maxInputTokens := flags.Uint64("max-input-tokens", 2000, "maximum input tokens of -provider")
+	maxOutputTokens := flags.Uint64("max-output-tokens", 800, "maximum output tokens of -provider")
+	now := flags.String("now", "2026-01-05T15:00:00Z", "time the prompts are rendered at, fixed so cassettes replay")
+	minWords := flags.Int("min-words", 60, "minimum words of a letter")
+	maxWords := flags.Int("max-words", 400, "maximum words of a letter")
+	out := flags.String("out", "", "file to write the report to instead of stdout")
+	strict := flags.Bool("strict", false, "exit with status 1 when the candidate passes a check less often than the baseline")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	fail := func(err error) int {
+		fmt.Fprintln(stderr, "evalprompts:", err)
+		return 1
+	}
+	if *candidatePath == "" {
+		return fail(errors.New("-candidate is required"))
+	}
+	if *providerName == "" && *cassettePath == "" {
+		return fail(errors.New("-provider or -cassette is required"))
+	}
+	evaluator := &Evaluator{MinWords: *minWords, MaxWords: *maxWords}
+	var err error
+	if evaluator.Now, err = time.Parse(time.RFC3339, *now); err != nil {
+		return fail(fmt.Errorf("-now: %w", err))
+	}
+
+	f, err := os.Open(*dataset)
+	if err != nil {
+		return fail(err)
+	}
+	cases, err := LoadEvalDataset(f)
+	f.Close()
+	if err != nil {
+		return fail(err)
+	}
+	baseline, err := LoadPromptVersion(*baselinePath)
+	if err != nil {
+		return fail(err)
+	}
+	candidate, err := LoadPromptVersion(*candidatePath)
+	if err != nil {
+		return fail(err)
+	}
+
+	var ip InferenceProvider
+	if *providerName != "" {
+		newProvider, ok := inferenceProviders[*providerName]
+		if !ok {
+			return fail(fmt.Errorf("inference provider %q does not exist", *providerName))
+		}
+		if ip, err = newProvider(*maxInputTokens, *maxOutputTokens); err != nil {
+			return fail(err)
+		}
+	}
+	var cassette *Cassette
+	if *cassettePath != "" {
+		if cassette, err = LoadCassette(*cassettePath, ip); err != nil {
+			return fail(err)
+		}
+		ip = cassette
+	}
+
+	ctx := context.Background()
+	baselineRun := evaluator.Run(ctx, ip, baseline, cases)
+	candidateRun := evaluator.Run(ctx, ip, candidate, cases)
+
+	if cassette != nil && cassette.next != nil {
+		if err := cassette.Save(*cassettePath); err != nil {
+			return fail(err)
+		}
+	}
+
+	w := stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return fail(err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := WriteEvalReport(w, baselineRun, candidateRun); err != nil {
+		return fail(err)
+	}
+
+	if regressions := Regressions(baselineRun, candidateRun); *strict && len(regressions) > 0 {
+		fmt.Fprintln(stderr, "evalprompts: the candidate regresses", strings.Join(regressions, ", "))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const evalTestLetter = "The heat in my apartment has not worked since December 28. My children are sleeping in coats, and I am worried the pipes will freeze. I called the office twice last week and have not heard back. Please repair the furnace by January 9, 2026. I am happy to give access to the unit so the work can be done, and I can be reached at the number on file. Thank you for your prompt attention to this matter, and I look forward to hearing from you soon about when the repair will happen."
+
+// The time cassettes of the tests are recorded at
+var evalTestNow = time.Date(2026, 1, 5, 15, 0, 0, 0, time.UTC)
+
+var evalTestCase = EvalCase{
+	ID: "no-heat",
+	Answers: map[string]string{
+		"mainProblem":       "The heat has not worked since December 28",
+		"problemAffect":     "my kids are sleeping in coats and the pipes could freeze",
+		"whatTheyTried":     "I called the office twice last week",
+		"solutionToProblem": "repair the furnace",
+		"solutionDate":      "January 9, 2026",
+	},
+}
+
+func TestLoadEvalDataset(t *testing.T) {
+	f, err := os.Open("eval/dataset.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cases, err := LoadEvalDataset(f)
+	if err != nil {
+		t.Fatalf("expected the shipped dataset to load, got %v", err)
+	}
+	if len(cases) < 10 {
+		t.Fatalf("expected at least 10 cases, got %d", len(cases))
+	}
+
+	cases, err = LoadEvalDataset(strings.NewReader("{\"id\": \"a\", \"answers\": {\"mainProblem\": \"leak\"}}\n\n{\"id\": \"b\", \"answers\": {\"mainProblem\": \"mold\"}, \"missingDetails\": true}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 2 || cases[1].ID != "b" || !cases[1].MissingDetails {
+		t.Fatalf("unexpected cases %+v", cases)
+	}
+
+	for _, dataset := range []string{
+		`{"id": "a", "answers": {"mainProblem": "leak"}`,
+		`{"id": "a", "answers": {"mainProblem": "leak"}, "extra": 1}`,
+		`{"answers": {"mainProblem": "leak"}}`,
+		`{"id": "a", "answers": {}}`,
+		"{\"id\": \"a\", \"answers\": {\"mainProblem\": \"leak\"}}\n{\"id\": \"a\", \"answers\": {\"mainProblem\": \"mold\"}}",
+	} {
+		if _, err := LoadEvalDataset(strings.NewReader(dataset)); !errors.Is(err, ErrInvalidEvalDataset) {
+			t.Errorf("%s: expected ErrInvalidEvalDataset, got %v", dataset, err)
+		}
+	}
+}
+
+func TestLoadPromptVersion(t *testing.T) {
+	v, err := LoadPromptVersion("app-config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := v.Conversation(evalTestCase, evalTestNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	system, conversation := SplitSystemPrompt(lc.Messages)
+	if !strings.Contains(system, PromptTime(evalTestNow, evalTestCase.ReceiverState)) || !strings.Contains(system, evalAnswerBoundary.PromptInstruction()) {
+		t.Fatalf("expected the system prompt to hold the time and the answer boundary, got %q", system)
+	}
+	if !strings.Contains(conversation[0].Content, evalAnswerBoundary.Wrap("repair the furnace")) {
+		t.Fatalf("expected the user prompt to hold the delimited answers, got %q", conversation[0].Content)
+	}
+
+	// The rule pack, style and personal information are handled as in /api/text
+	c := EvalCase{ID: "ohio", Answers: maps.Clone(evalTestCase.Answers), ReceiverState: "OH", LetterStyle: LetterStyle{Tone: "firm"}}
+	c.Answers["whatTheyTried"] = "I called the office at 614-555-0134"
+	if lc, err = v.Conversation(c, evalTestNow); err != nil {
+		t.Fatal(err)
+	}
+	system, conversation = SplitSystemPrompt(lc.Messages)
+	for _, want := range []string{SelectRulePack(rulePacks, "OH", "").PromptContext(), letterTones["firm"], piiPromptInstruction} {
+		if !strings.Contains(system, want) {
+			t.Errorf("expected the system prompt to contain %q, got %q", want, system)
+		}
+	}
+	if strings.Contains(conversation[0].Content, "614-555-0134") || lc.PII.Restore(conversation[0].Content) == conversation[0].Content {
+		t.Errorf("expected the phone number to be scrubbed, got %q", conversation[0].Content)
+	}
+	if lc.Deadline == nil || lc.Deadline.Date != "2026-01-09" {
+		t.Errorf("expected the deadline to be resolved, got %+v", lc.Deadline)
+	}
+
+	path := filepath.Join(t.TempDir(), "prompts.yaml")
+	if err := os.WriteFile(path, []byte("inference:\n  systemPrompt: only a system prompt\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPromptVersion(path); err == nil {
+		t.Fatal("expected an error for a missing user prompt")
+	}
+}
+
+func TestEvalChecks(t *testing.T) {
+	v, err := LoadPromptVersion("app-config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Evaluator{MinWords: 60, MaxWords: 400, Now: evalTestNow}
+
+	run := e.Run(context.Background(), &scriptedProvider{replies: []string{evalTestLetter}}, v, []EvalCase{evalTestCase})
+	if failures := run.Results[0].Failures; len(failures) != 0 {
+		t.Fatalf("expected the letter to pass every check, got %v", failures)
+	}
+
+	tests := []struct {
+		check  string
+		letter string
+		c      EvalCase
+	}{
+		{"no-salutation", "Dear Landlord,\n\n" + evalTestLetter, evalTestCase},
+		{"no-salutation", evalTestLetter + "\n\nSincerely,", evalTestCase},
+		{"no-pii", evalTestLetter + " Email me at tenant@example.com.", evalTestCase},
+		{"no-legal-claims", evalTestLetter + " You are liable for the damage.", evalTestCase},
+		{"placeholders", evalTestLetter + " My unit is {unit number}.", evalTestCase},
+		{"placeholders", evalTestLetter, EvalCase{ID: "vague", Answers: evalTestCase.Answers, MissingDetails: true}},
+		{"length", "Please fix the heat.", evalTestCase},
+		{"grounded", evalTestLetter + " The rent of $950 is paid.", evalTestCase},
+		{"content-policy", evalTestLetter + " Fix it or else.", evalTestCase},
+	}
+	for _, test := range tests {
+		run := e.Run(context.Background(), &scriptedProvider{replies: []string{test.letter}}, v, []EvalCase{test.c})
+		failures := run.Results[0].Failures
+		if _, failed := failures[test.check]; !failed || len(failures) != 1 {
+			t.Errorf("%q: expected only %s to fail, got %v", test.letter, test.check, failures)
+		}
+	}
+
+	withPlaceholder := strings.Replace(evalTestLetter, "the office", "[Landlord Name]", 1)
+	run = e.Run(context.Background(), &scriptedProvider{replies: []string{withPlaceholder}}, v, []EvalCase{{ID: "vague", Answers: evalTestCase.Answers, MissingDetails: true}})
+	if failures := run.Results[0].Failures; len(failures) != 0 {
+		t.Fatalf("expected a bracketed placeholder to pass, got %v", failures)
+	}
+}
+
+func TestCassette(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	conversation := NewConversation("system", "the heat is out")
+
+	recorder := &promptRecordingProvider{}
+	cassette, err := LoadCassette(path, recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if reply, _, err := cassette.Infer(context.Background(), conversation); err != nil || reply != "reply to: the heat is out" {
+			t.Fatalf("unexpected reply %q, %v", reply, err)
+		}
+	}
+	if len(recorder.conversations) != 1 {
+		t.Fatalf("expected the second reply to be replayed, got %d calls", len(recorder.conversations))
+	}
+	if err := cassette.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := LoadCassette(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, _, err := replay.Infer(context.Background(), conversation); err != nil || reply != "reply to: the heat is out" {
+		t.Fatalf("unexpected replayed reply %q, %v", reply, err)
+	}
+	if _, _, err := replay.Infer(context.Background(), NewConversation("system", "the sink leaks")); !errors.Is(err, ErrCassetteMiss) {
+		t.Fatalf("expected ErrCassetteMiss, got %v", err)
+	}
+	if _, err := LoadCassette(filepath.Join(t.TempDir(), "missing.jsonl"), nil); err == nil {
+		t.Fatal("expected an error for a missing cassette without a provider")
+	}
+}
+
+func TestRunEvalPrompts(t *testing.T) {
+	dir := t.TempDir()
+	dataset := filepath.Join(dir, "dataset.jsonl")
+	if err := os.WriteFile(dataset, []byte(`{"id": "no-heat", "title": "No heat", "answers": {"mainProblem": "The heat has not worked since December 28", "problemAffect": "my kids are sleeping in coats and the pipes could freeze", "whatTheyTried": "I called the office twice last week", "solutionToProblem": "repair the furnace", "solutionDate": "January 9, 2026"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	candidate := filepath.Join(dir, "candidate.yaml")
+	if err := os.WriteFile(candidate, []byte("inference:\n  systemPrompt: Write a letter. It is {{.CurrentTime}}.\n  userPrompt: \"{{.mainProblem}}\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Record a good baseline letter and a candidate letter with a salutation
+	now := evalTestNow
+	cassettePath := filepath.Join(dir, "cassette.jsonl")
+	cassette, err := LoadCassette(cassettePath, &scriptedProvider{replies: []string{evalTestLetter, "Dear Landlord,\n\n" + evalTestLetter}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"app-config.yaml", candidate} {
+		v, err := LoadPromptVersion(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc, err := v.Conversation(evalTestCase, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := cassette.Infer(context.Background(), lc.Messages); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cassette.Save(cassettePath); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"-dataset", dataset, "-candidate", candidate, "-cassette", cassettePath, "-now", now.Format(time.RFC3339)}
+	var stdout, stderr bytes.Buffer
+	if code := runEvalPrompts(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	report := stdout.String()
+	for _, want := range []string{"| no-salutation | 1/1 | 0/1 | -1 |", "| no-pii | 1/1 | 1/1 | +0 |", "`no-heat` No heat: **regressed no-salutation**"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("expected the report to contain %q, got:\n%s", want, report)
+		}
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := runEvalPrompts(append(args, "-strict"), &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "no-salutation") {
+		t.Fatalf("expected -strict to fail on the regression, got %d: %s", code, stderr.String())
+	}
+
+	if code := runEvalPrompts([]string{"-dataset", dataset, "-cassette", cassettePath}, &stdout, &stderr); code != 1 {
+		t.Fatalf("expected a missing -candidate to fail, got %d", code)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	_ "image/png"
+)
+
+var (
+	ErrTooManyExhibits    = errors.New("too many exhibits")
+	ErrExhibitTooLarge    = errors.New("exhibit is too large")
+	ErrExhibitsTooLarge   = errors.New("exhibits are too large in total")
+	ErrInvalidExhibit     = errors.New("exhibit is not a valid jpeg or png image")
+	ErrMissingPdfRequest  = errors.New("multipart body is missing the request part")
+	ErrUnexpectedFormPart = errors.New("unexpected multipart form part")
+)
+
+// Photo evidence is uploaded with the letter as multipart/form-data. These limits only apply to
+// that form of the pdf route, the JSON form keeps MaxRequestBodySize.
+const (
+	MaxExhibits          = 5
+	MaxExhibitSize       = 8 * 1024 * 1024
+	MaxExhibitsTotalSize = 20 * 1024 * 1024
+	// Decoding is refused above this many pixels so a small file cannot expand into a huge image.
+	// It fits the 12 and 16 megapixel photos taken by phones.
+	MaxExhibitPixels = 16_000_000
+	// Decoding is also refused when the decoded image would take more than this many bytes, as
+	// 16-bit PNGs take 8 bytes per pixel
+	MaxExhibitDecodedSize = 64 * 1024 * 1024
+	// Exhibits decoded at once across all requests, so decoding takes at most about
+	// MaxConcurrentExhibitDecodes * MaxExhibitDecodedSize of memory
+	MaxConcurrentExhibitDecodes = 2
+	// Exhibits are downscaled to fit within a square of this size, plenty for a printed page
+	MaxExhibitDimension = 1600
+	exhibitJpegQuality  = 85
+)
+
+// Holds a slot per exhibit being decoded, see MaxConcurrentExhibitDecodes
+var exhibitDecodes = make(chan struct{}, MaxConcurrentExhibitDecodes)
+
+// Exhibit is a processed photo ready to be appended to the letter.
+type Exhibit struct {
+	Caption string
+	// Re-encoded jpeg without any metadata
+	Image []byte
+}
+
+// readPdfMultipart reads a multipart pdf request. The JSON request in the "request" part is decoded
+// into req, followed by up to MaxExhibits "exhibits" file parts. Captions are given in "captions"
+// parts, in the same order as the files.
+func readPdfMultipart(w http.ResponseWriter, r *http.Request, req any) ([]Exhibit, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxExhibitsTotalSize+MaxRequestBodySize)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		haveRequest bool
+		exhibits    []Exhibit
+		captions    []string
+		total       int
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch part.FormName() {
+		case "request":
+			if err := json.NewDecoder(io.LimitReader(part, MaxRequestBodySize)).Decode(req); err != nil {
+				return nil, err
+			}
+			haveRequest = true
+		case "captions":
+			caption, err := readFormValue(part, 500)
+			if err != nil {
+				return nil, err
+			}
+			captions = append(captions, caption)
+		case "exhibits":
+			if len(exhibits) == MaxExhibits {
+				return nil, ErrTooManyExhibits
+			}
+			data, err := io.ReadAll(io.LimitReader(part, MaxExhibitSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > MaxExhibitSize {
+				return nil, ErrExhibitTooLarge
+			}
+			total += len(data)
+			if total > MaxExhibitsTotalSize {
+				return nil, ErrExhibitsTooLarge
+			}
+
+			// Waits for other requests to finish decoding their exhibits
+			select {
+			case exhibitDecodes <- struct{}{}:
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			}
+			img, err := ProcessExhibitImage(data)
+			<-exhibitDecodes
+			if err != nil {
+				return nil, err
+			}
+			exhibits = append(exhibits, Exhibit{Image: img})
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrUnexpectedFormPart, part.FormName())
+		}
+	}
+
+	if !haveRequest {
+		return nil, ErrMissingPdfRequest
+	}
+	for i := range exhibits {
+		if i < len(captions) {
+			exhibits[i].Caption = captions[i]
+		}
+	}
+
+	return exhibits, nil
+}
+
+func readFormValue(part *multipart.Part, maxLen int) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(part, int64(maxLen)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxLen {
+		return "", fmt.Errorf("form value %q is too long", part.FormName())
+	}
+	return string(b), nil
+}
+
+// exhibitLabel returns the letter used to refer to the i-th exhibit: A, B, C...
+func exhibitLabel(i int) string {
+	return string(rune('A' + i))
+}
+
+// ProcessExhibitImage decodes a jpeg or png photo, applies its EXIF orientation, downscales it to
+// fit MaxExhibitDimension and re-encodes it as a jpeg. Re-encoding drops all metadata, including
+// EXIF GPS coordinates.
+//
+// Unlike the letter, photos are decoded in the server process rather than in the landlock sandbox
+// of typst-wrapper. The Go decoders are memory safe and the size of the decoded image is checked
+// from the header before decoding, so only the re-encoded jpeg reaches typst.
+func ProcessExhibitImage(data []byte) ([]byte, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") {
+		return nil, ErrInvalidExhibit
+	}
+	if cfg.Width*cfg.Height > MaxExhibitPixels || cfg.Width*cfg.Height*decodedBytesPerPixel(cfg.ColorModel) > MaxExhibitDecodedSize {
+		return nil, ErrExhibitTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidExhibit
+	}
+
+	img := orientImage(downscaleImage(src, MaxExhibitDimension), jpegOrientation(data))
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: exhibitJpegQuality}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodedBytesPerPixel returns the most bytes a pixel of a color model takes once decoded
+func decodedBytesPerPixel(model color.Model) int {
+	switch model {
+	case color.GrayModel:
+		return 1
+	case color.Gray16Model:
+		return 2
+	case color.YCbCrModel:
+		// Without chroma subsampling
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := model.(color.Palette); ok {
+		return 1
+	}
+	return 4
+}
+
+// downscaleImage converts an image to RGBA and shrinks it by averaging boxes of pixels so its
+// largest side is at most maxDim. Large images are converted a strip of rows at a time, so only the
+// decoded image is held in memory at full size.
+func downscaleImage(src image.Image, maxDim int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw <= maxDim && sh <= maxDim {
+		// draw has fast paths converting the jpeg YCbCr output to RGBA
+		rgba := image.NewRGBA(image.Rect(0, 0, sw, sh))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+		return rgba
+	}
+
+	dw, dh := maxDim, sh*maxDim/sw
+	if sh > sw {
+		dw, dh = sw*maxDim/sh, maxDim
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	// The source rows averaged into a row of dst
+	strip := image.NewRGBA(image.Rect(0, 0, sw, sh/dh+1))
+	for y := range dh {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		draw.Draw(strip, image.Rect(0, 0, sw, y1-y0), src, image.Pt(b.Min.X, b.Min.Y+y0), draw.Src)
+		for x := range dw {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+
+			var sum [4]int
+			for sy := 0; sy < y1-y0; sy++ {
+				row := strip.Pix[sy*strip.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := range 4 {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+
+			n := (y1 - y0) * (x1 - x0)
+			i := y*dst.Stride + x*4
+			for c := range 4 {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	return dst
+}
+
+// orientImage applies an EXIF orientation (1-8) so the image displays upright once the EXIF data
+// has been stripped.
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range h {
+		for x := range w {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[y*src.Stride+x*4:y*src.Stride+x*4+4])
+		}
+	}
+
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a jpeg, or 1 when it has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	// Walk the marker segments until the start of the scan
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := range entries {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+
+	return 1
+}
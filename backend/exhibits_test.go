@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// encodeTestJpeg encodes a jpeg with a red left half so orientation changes are observable. When
+// orientation is non-zero an EXIF segment carrying it and GPS tags is inserted after the SOI marker.
+func encodeTestJpeg(t *testing.T, width, height int, orientation uint16) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			if x < width/2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("failed to encode jpeg: %v", err)
+	}
+	if orientation == 0 {
+		return buf.Bytes()
+	}
+
+	// Big endian TIFF with a single IFD holding the orientation and a GPS IFD pointer
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	tiff = append(tiff, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0x00, 0x00)
+	tiff = append(tiff, 0x88, 0x25, 0x00, 0x04, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00)
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00)
+	tiff = append(tiff, "GPSLatitude 39.96"...)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	out := append([]byte{0xFF, 0xD8}, app1...)
+	return append(out, buf.Bytes()[2:]...)
+}
+
+func TestJpegOrientation(t *testing.T) {
+	if o := jpegOrientation(encodeTestJpeg(t, 8, 4, 0)); o != 1 {
+		t.Errorf("expected orientation 1 without EXIF, got %d", o)
+	}
+	if o := jpegOrientation(encodeTestJpeg(t, 8, 4, 6)); o != 6 {
+		t.Errorf("expected orientation 6, got %d", o)
+	}
+	if o := jpegOrientation([]byte("not a jpeg")); o != 1 {
+		t.Errorf("expected orientation 1 for invalid data, got %d", o)
+	}
+}
+
+func TestProcessExhibitImageStripsExifAndRotates(t *testing.T) {
+	original := encodeTestJpeg(t, 80, 40, 6)
+	if !bytes.Contains(original, []byte("GPSLatitude")) {
+		t.Fatal("test jpeg should contain GPS data")
+	}
+
+	out, err := ProcessExhibitImage(original)
+	if err != nil {
+		t.Fatalf("failed to process exhibit: %v", err)
+	}
+	if bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte("GPSLatitude")) {
+		t.Fatal("expected EXIF data to be stripped")
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode processed exhibit: %v", err)
+	}
+	if img.Bounds().Dx() != 40 || img.Bounds().Dy() != 80 {
+		t.Fatalf("expected rotated 40x80 image, got %v", img.Bounds())
+	}
+	// Rotating clockwise moves the red left half to the top
+	if r, _, b, _ := img.At(20, 5).RGBA(); r < b {
+		t.Fatal("expected the top of the rotated image to be red")
+	}
+}
+
+func TestProcessExhibitImageDownscales(t *testing.T) {
+	out, err := ProcessExhibitImage(encodeTestJpeg(t, MaxExhibitDimension*2, 100, 0))
+	if err != nil {
+		t.Fatalf("failed to process exhibit: %v", err)
+	}
+
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode processed exhibit: %v", err)
+	}
+	if cfg.Width != MaxExhibitDimension || cfg.Height != 50 {
+		t.Fatalf("expected %dx50 image, got %dx%d", MaxExhibitDimension, cfg.Width, cfg.Height)
+	}
+}
+
+func TestProcessExhibitImageRejectsInvalid(t *testing.T) {
+	if _, err := ProcessExhibitImage([]byte("GIF89a")); !errors.Is(err, ErrInvalidExhibit) {
+		t.Fatalf("expected ErrInvalidExhibit, got %v", err)
+	}
+}
+
+// pngHeader returns the start of a png, enough for image.DecodeConfig to read its size and depth
+func pngHeader(width, height uint32, bitDepth, colorType byte) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, bitDepth, colorType, 0, 0, 0)
+
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = binary.BigEndian.AppendUint32(out, uint32(len(ihdr)-4))
+	out = append(out, ihdr...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestProcessExhibitImageRejectsLargeDecodedSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"too many pixels", pngHeader(5000, 4000, 8, 2)},
+		// 9 megapixels fit MaxExhibitPixels, but take 72 MiB at 8 bytes per pixel
+		{"16-bit rgba", pngHeader(3000, 3000, 16, 6)},
+	}
+	for _, test := range tests {
+		if _, err := ProcessExhibitImage(test.header); !errors.Is(err, ErrExhibitTooLarge) {
+			t.Errorf("%s: expected ErrExhibitTooLarge, got %v", test.name, err)
+		}
+	}
+}
+
+func newPdfMultipartRequest(t *testing.T, fields map[string]string, exhibits [][]byte, captions []string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	if fields == nil {
+		fields = map[string]string{"senderName": "someone", "body": "Lorem ipsum"}
+	}
+	reqJSON, _ := json.Marshal(fields)
+	if err := mw.WriteField("request", string(reqJSON)); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range captions {
+		if err := mw.WriteField("captions", c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range exhibits {
+		fw, err := mw.CreateFormFile("exhibits", "photo.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write(e)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/pdf", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestReadPdfMultipart(t *testing.T) {
+	photo := encodeTestJpeg(t, 16, 16, 0)
+	req := newPdfMultipartRequest(t, nil, [][]byte{photo, photo}, []string{"Mold in the bathroom", "Broken lock"})
+
+	var pdfReq PdfRequest
+	exhibits, err := readPdfMultipart(httptest.NewRecorder(), req, &pdfReq)
+	if err != nil {
+		t.Fatalf("failed to read multipart request: %v", err)
+	}
+	if pdfReq.SenderName != "someone" {
+		t.Errorf("expected sender name %q, got %q", "someone", pdfReq.SenderName)
+	}
+	if len(exhibits) != 2 {
+		t.Fatalf("expected 2 exhibits, got %d", len(exhibits))
+	}
+	if exhibits[1].Caption != "Broken lock" {
+		t.Errorf("expected caption %q, got %q", "Broken lock", exhibits[1].Caption)
+	}
+	if exhibitLabel(1) != "B" {
+		t.Errorf("expected label B, got %s", exhibitLabel(1))
+	}
+}
+
+func TestPdfHandlerTooManyExhibits(t *testing.T) {
+	photo := encodeTestJpeg(t, 16, 16, 0)
+	exhibits := make([][]byte, MaxExhibits+1)
+	for i := range exhibits {
+		exhibits[i] = photo
+	}
+
+	r := router{}
+	w := httptest.NewRecorder()
+
+	r.pdf(w, newPdfMultipartRequest(t, nil, exhibits, nil))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	var result PdfResponseError
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Message != ErrTooManyExhibits.Error() {
+		t.Fatalf("expected message %q, got %q", ErrTooManyExhibits.Error(), result.Message)
+	}
+}
+
+func TestPdfHandlerPolicyViolationInCaption(t *testing.T) {
+	photo := encodeTestJpeg(t, 16, 16, 0)
+	fields := map[string]string{
+		"senderName":      "someone",
+		"senderAddress":   "somewhere",
+		"senderCity":      "Columbus",
+		"senderState":     "OH",
+		"senderZip":       "43215",
+		"receiverName":    "someone else",
+		"receiverAddress": "somewhere else",
+		"receiverCity":    "Columbus",
+		"receiverState":   "OH",
+		"receiverZip":     "43215",
+		"body":            "Please fix the furnace.",
+	}
+
+	r := router{}
+	w := httptest.NewRecorder()
+	r.pdf(w, newPdfMultipartRequest(t, fields, [][]byte{photo, photo}, []string{"Broken furnace", "Fix it by Friday or else"}))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected %d, got %d", http.StatusUnprocessableEntity, resp.StatusCode)
+	}
+	var result PolicyViolationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Category != "threat" {
+		t.Errorf("expected a threat, got %+v", result)
+	}
+}
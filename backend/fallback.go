@@ -18,21 +18,25 @@ func NewFallbackProvider(providers ...InferenceProvider) *FallbackProvider {
 	return &FallbackProvider{providers: providers}
 }
 
-func (f *FallbackProvider) Infer(ctx context.Context, input string) (string, error) {
+// Infer returns the usage of every provider it tried, since a provider which failed may still have
+// used tokens, such as a refusal of OpenAI.
+func (f *FallbackProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
 	var lastErr error
+	var usage []Usage
 
 	for i, p := range f.providers {
-		resp, err := p.Infer(ctx, input)
+		resp, u, err := p.Infer(ctx, messages)
+		usage = append(usage, u...)
 		if err == nil {
 			if i > 0 {
 				slog.Warn("fallback provider used", "providerIndex", i)
 			}
-			return resp, nil
+			return resp, usage, nil
 		}
 
 		lastErr = err
 		slog.Error("inference provider failed", "providerIndex", i, "err", err)
 	}
 
-	return "", fmt.Errorf("all inference providers failed, last error: %w", lastErr)
+	return "", usage, fmt.Errorf("all inference providers failed, last error: %w", lastErr)
 }
@@ -8,13 +8,14 @@ import (
 
 type staticProvider struct {
 	resp  string
+	usage []Usage
 	err   error
 	calls int
 }
 
-func (s *staticProvider) Infer(ctx context.Context, input string) (string, error) {
+func (s *staticProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
 	s.calls++
-	return s.resp, s.err
+	return s.resp, s.usage, s.err
 }
 
 func TestFallbackProviderSucceedsOnSecond(t *testing.T) {
@@ -23,7 +24,7 @@ func TestFallbackProviderSucceedsOnSecond(t *testing.T) {
 
 	fp := NewFallbackProvider(first, second)
 
-	resp, err := fp.Infer(context.Background(), "input")
+	resp, _, err := fp.Infer(context.Background(), NewConversation("system", "input"))
 	if err != nil {
 		t.Fatalf("expected success, got error: %v", err)
 	}
@@ -44,7 +45,7 @@ func TestFallbackProviderAllFail(t *testing.T) {
 
 	fp := NewFallbackProvider(first, second)
 
-	_, err := fp.Infer(context.Background(), "input")
+	_, _, err := fp.Infer(context.Background(), NewConversation("system", "input"))
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -55,3 +56,40 @@ func TestFallbackProviderAllFail(t *testing.T) {
 		t.Fatalf("expected second provider to be called once, got %d", second.calls)
 	}
 }
+
+func TestFallbackProviderUsageOfFailedAttempts(t *testing.T) {
+	analytics = &Analytics{}
+	// The first provider refuses after it was billed, like OpenAI
+	first := &staticProvider{usage: []Usage{{Provider: "openai", Model: "gpt", InputTokens: 100, OutputTokens: 10}}, err: errors.New("model refused")}
+	second := &staticProvider{resp: "ok", usage: []Usage{{Provider: "aws", InputTokens: 200, OutputTokens: 20}}}
+	fp := NewFallbackProvider(first, second)
+
+	_, usage, err := fp.Infer(context.Background(), NewConversation("system", "input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage[0] != first.usage[0] || usage[1] != second.usage[0] {
+		t.Fatalf("expected the usage of both attempts, got %+v", usage)
+	}
+
+	second.err = errors.New("second failed")
+	if _, usage, err := fp.Infer(context.Background(), NewConversation("system", "input")); err == nil || len(usage) != 2 {
+		t.Fatalf("expected the usage of both attempts with the error, got %+v, %v", usage, err)
+	}
+
+	// The budget settles the failed attempts too
+	ledger, err := NewCostLedger([]ModelPrice{
+		{Provider: "openai", InputPerMillionTokens: 1_000_000},
+		{Provider: "aws", InputPerMillionTokens: 1_000_000},
+	}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _ = NewBudgetProvider(fp, nil, ledger, 0).Infer(context.Background(), NewConversation("system", "input"))
+	if ledger.SpentToday() != 300 {
+		t.Fatalf("expected both attempts to be spent, got %v", ledger.SpentToday())
+	}
+	if stats := analytics.GetStats(); stats.Usage["openai/gpt"].Inferences != 1 || stats.Usage["aws"].Inferences != 1 {
+		t.Fatalf("expected both attempts in the analytics, got %+v", stats.Usage)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type FollowUpRequest struct {
+	Altcha string `json:"altcha"`
+	// Body of the earlier letter, as it was sent
+	OriginalLetter string `json:"originalLetter"`
+	// Date in YYYY-MM-DD format the earlier letter was sent
+	OriginalDate string `json:"originalDate"`
+	// What happened since the earlier letter, such as the landlord not replying
+	SinceThen string `json:"sinceThen"`
+	// Optional free text deadline of the second notice, resolved like the solutionDate answer
+	SolutionDate string `json:"solutionDate"`
+	// Optional code of a language to also translate the letter into for the tenant, such as "es"
+	TenantLanguage string `json:"tenantLanguage"`
+	// Select the rule pack of the jurisdiction, see SelectRulePack
+	ReceiverState string `json:"receiverState"`
+	ReceiverCity  string `json:"receiverCity"`
+}
+
+// parseSentDate reads the date of a letter which was already sent, so can not be in the future.
+// field names the date in errors.
+func parseSentDate(field, date string, now time.Time) (time.Time, error) {
+	d, err := time.Parse(deadlineDateLayout, date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s, expected YYYY-MM-DD", field)
+	}
+	// Allow for the sender being a day ahead of the server
+	if d.After(civilDate(now).AddDate(0, 0, 1)) {
+		return time.Time{}, fmt.Errorf("%s is in the future", field)
+	}
+	return d, nil
+}
+
+// Writes the body of a second notice for when the landlord did not act on an earlier letter. The
+// notice references the earlier letter by its date and is firmer than the letter written by
+// /api/text. The response is the same as /api/text.
+func (rt *router) followUp(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req FollowUpRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to decode body"})
+		slog.ErrorContext(r.Context(), "failed to decode body", "err", err)
+		return
+	}
+	if strings.TrimSpace(req.OriginalLetter) == "" || strings.TrimSpace(req.SinceThen) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "originalLetter and sinceThen are required"})
+		return
+	}
+	originalDate, err := parseSentDate("originalDate", req.OriginalDate, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+		return
+	}
+	var lang TenantLanguage
+	if req.TenantLanguage != "" {
+		lang, err = LookupTenantLanguage(req.TenantLanguage)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+			return
+		}
+	}
+	ok, err := rt.altcha.Verify(req.Altcha)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to verify altcha"})
+		slog.ErrorContext(r.Context(), "failed to verify altcha", "err", err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "invalid altcha"})
+		return
+	}
+
+	pack := SelectRulePack(rulePacks, req.ReceiverState, req.ReceiverCity)
+
+	fields, flagged, ok := rt.screenAnswers(w, r, map[string]string{
+		"OriginalLetter": req.OriginalLetter,
+		"SinceThen":      req.SinceThen,
+		"SolutionDate":   req.SolutionDate,
+	})
+	if !ok {
+		return
+	}
+
+	// Personal information in the earlier letter and the update is not sent to the inference provider
+	pii := NewPseudonymizer()
+	for k, v := range fields {
+		fields[k] = pii.Scrub(v)
+	}
+
+	var deadline *Deadline
+	if req.SolutionDate != "" {
+		if d, err := ResolveDeadline(req.SolutionDate, time.Now(), req.ReceiverState, pack); err == nil {
+			deadline = &d
+			fields["SolutionDate"] = d.Text
+		}
+	}
+
+	boundary, err := NewAnswerBoundary()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to template follow-up"})
+		slog.ErrorContext(r.Context(), "failed to create answer boundary", "err", err)
+		return
+	}
+	for k, v := range fields {
+		fields[k] = boundary.Wrap(v)
+	}
+	fields["OriginalDate"] = originalDate.Format(deadlineTextLayout)
+
+	var buff bytes.Buffer
+	err = followUpUserPromptTemplate.Execute(&buff, fields)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to template follow-up"})
+		slog.ErrorContext(r.Context(), "failed to template follow-up", "err", err)
+		return
+	}
+
+	prompt := RenderFollowUpSystemPrompt(originalDate.Format(deadlineTextLayout), req.ReceiverState)
+	if pack != nil {
+		prompt += "\n" + pack.PromptContext()
+	}
+	prompt += "\n" + boundary.PromptInstruction()
+	if len(flagged) > 0 && rt.injectionAction != InjectionStrip {
+		prompt += "\n" + injectionFlagInstruction
+	}
+	if pii.Len() > 0 {
+		prompt += "\n" + piiPromptInstruction
+	}
+
+	resp, _, err := rt.ip.Infer(r.Context(), NewConversation(prompt, buff.String()))
+	if errors.Is(err, ErrTooManyInputTokens) {
+		// The earlier letter makes this input much longer than the answers of /api/text
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "originalLetter and sinceThen are too long"})
+		return
+	}
+	if writeRateLimited(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to run inference"})
+		slog.ErrorContext(r.Context(), "failed to run inference", "err", err)
+		return
+	}
+	result, ok := rt.finishLetter(w, r, pii, boundary.Strip(resp), lang)
+	if !ok {
+		return
+	}
+
+	analytics.IncrementInferences()
+
+	result.Deadline = deadline
+	_ = json.NewEncoder(w).Encode(result)
+}
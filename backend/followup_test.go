@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSentDate(t *testing.T) {
+	now := time.Date(2026, time.October, 19, 12, 0, 0, 0, time.UTC)
+
+	if d, err := parseSentDate("originalDate", "2026-10-01", now); err != nil || d.Day() != 1 {
+		t.Fatalf("unexpected result %v, %v", d, err)
+	}
+	// The sender's time zone may already be on the next day
+	if _, err := parseSentDate("originalDate", "2026-10-20", now); err != nil {
+		t.Fatalf("expected tomorrow to be accepted, got %v", err)
+	}
+	if _, err := parseSentDate("originalDate", "2026-10-25", now); err == nil || !strings.Contains(err.Error(), "originalDate is in the future") {
+		t.Fatalf("expected a future date to be rejected, got %v", err)
+	}
+	if _, err := parseSentDate("previousLetterDate", "10/01/2026", now); err == nil || !strings.Contains(err.Error(), "previousLetterDate") {
+		t.Fatalf("expected the field to be named in the error, got %v", err)
+	}
+}
+
+func TestFollowUpHandler(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	ip := &promptRecordingProvider{}
+	r := router{ip: ip, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(FollowUpRequest{
+		Altcha:         altchaToken,
+		OriginalLetter: "The furnace has not worked since October 1.",
+		OriginalDate:   "2026-10-05",
+		SinceThen:      "The landlord has not replied",
+		ReceiverState:  "OH",
+	})
+	w := httptest.NewRecorder()
+
+	r.followUp(w, httptest.NewRequest(http.MethodPost, "/api/text/followup", bytes.NewReader(body)))
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Result().StatusCode, w.Body.String())
+	}
+	var result TextResponseSuccess
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	if !strings.Contains(result.Text, "The furnace has not worked since October 1.") || !strings.Contains(result.Text, "The landlord has not replied") {
+		t.Errorf("expected the earlier letter and the update in the input, got %q", result.Text)
+	}
+	if !strings.Contains(result.Text, "Monday, October 5, 2026") || !strings.Contains(ip.prompts[0], "Monday, October 5, 2026") {
+		t.Error("expected the earlier letter to be referenced by its date")
+	}
+	if !strings.Contains(ip.prompts[0], "second notice") || !strings.Contains(ip.prompts[0], "5321.04") {
+		t.Errorf("expected the follow-up prompt with the Ohio rule pack, got %q", ip.prompts[0])
+	}
+}
+
+func TestFollowUpHandlerBadRequest(t *testing.T) {
+	tests := map[string]FollowUpRequest{
+		"missing letter":     {OriginalDate: "2026-10-05", SinceThen: "No reply"},
+		"missing update":     {OriginalLetter: "letter", OriginalDate: "2026-10-05"},
+		"invalid date":       {OriginalLetter: "letter", OriginalDate: "October 5", SinceThen: "No reply"},
+		"unknown language":   {OriginalLetter: "letter", OriginalDate: "2026-10-05", SinceThen: "No reply", TenantLanguage: "xx"},
+		"date in the future": {OriginalLetter: "letter", OriginalDate: time.Now().AddDate(0, 0, 7).Format(time.DateOnly), SinceThen: "No reply"},
+	}
+
+	for name, req := range tests {
+		t.Run(name, func(t *testing.T) {
+			body, _ := json.Marshal(req)
+			w := httptest.NewRecorder()
+
+			(&router{}).followUp(w, httptest.NewRequest(http.MethodPost, "/api/text/followup", bytes.NewReader(body)))
+
+			if w.Result().StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Result().StatusCode)
+			}
+		})
+	}
+}
+
+func TestFollowUpHandlerInputTooLong(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	r := router{ip: &MockInferenceProvider{shouldError: true}, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(FollowUpRequest{Altcha: altchaToken, OriginalLetter: "letter", OriginalDate: "2026-10-05", SinceThen: "No reply"})
+	w := httptest.NewRecorder()
+
+	r.followUp(w, httptest.NewRequest(http.MethodPost, "/api/text/followup", bytes.NewReader(body)))
+
+	if w.Result().StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d, got %d", http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+	}
+}
@@ -3,15 +3,16 @@ module backend
 go 1.25.0
 
 require (
+	github.com/altcha-org/altcha-lib-go v0.2.2
 	github.com/aws/aws-sdk-go-v2 v1.39.2
 	github.com/aws/aws-sdk-go-v2/config v1.31.12
 	github.com/aws/aws-sdk-go-v2/credentials v1.18.16
 	github.com/aws/aws-sdk-go-v2/service/bedrockruntime v1.41.0
 	github.com/aws/aws-sdk-go-v2/service/sts v1.38.6
 	github.com/ollama/ollama v0.12.5
-	github.com/altcha-org/altcha-lib-go v0.2.2
-	gopkg.in/yaml.v3 v3.0.1
 	github.com/openai/openai-go v1.12.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
@@ -32,5 +33,5 @@ require (
 	github.com/tidwall/sjson v1.2.5 // indirect
 	golang.org/x/crypto v0.43.0 // indirect
 	golang.org/x/sys v0.37.0 // indirect
-	golang.org/x/time v0.14.0 // indirect
+	golang.org/x/time v0.14.0
 )
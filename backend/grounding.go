@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The kinds of claims checked by VerifyGrounding
+const (
+	ClaimDate    = "date"
+	ClaimAmount  = "amount"
+	ClaimNumber  = "number"
+	ClaimFixture = "fixture"
+)
+
+// Claim is a detail of a letter which was not in anything the model was given
+type Claim struct {
+	Kind string `json:"kind"`
+	// As written in the letter
+	Text string `json:"text"`
+}
+
+// Grounding is the result of GroundLetter, returned by /api/text
+type Grounding struct {
+	UnsupportedClaims []Claim `json:"unsupportedClaims"`
+	// Set when the first letter had unsupported claims and the letter returned is the one written
+	// again
+	Regenerated bool `json:"regenerated"`
+}
+
+// Fixtures and appliances letters commonly mention. A fixture in the letter is supported when the
+// tenant's input mentions any term of its group, so "heating" is supported by "no heat".
+var fixtureGroups = [][]string{
+	{"furnace", "heater", "heating", "heat", "boiler", "radiator", "thermostat"},
+	{"air conditioner", "air conditioning", "ac", "a/c", "cooling"},
+	{"water heater", "hot water"},
+	{"sink", "faucet", "tap"},
+	{"pipe", "plumbing", "drain"},
+	{"toilet"},
+	{"shower", "bathtub", "tub"},
+	{"refrigerator", "fridge", "freezer"},
+	{"stove", "oven", "cooktop"},
+	{"dishwasher"},
+	{"washing machine", "washer"},
+	{"dryer"},
+	{"garbage disposal", "disposal"},
+	{"window"},
+	{"door"},
+	{"lock", "deadbolt"},
+	{"smoke detector", "smoke alarm"},
+	{"carbon monoxide detector", "carbon monoxide alarm"},
+	{"outlet", "socket", "wiring", "electrical"},
+	{"light fixture", "lights"},
+	{"ceiling"},
+	{"roof"},
+	{"flooring", "carpet"},
+	{"wall"},
+	{"elevator"},
+	{"stairs", "stairway", "staircase", "railing"},
+	{"mold", "mould", "mildew"},
+	{"cockroach", "roach", "mice", "mouse", "rat", "rodent", "bed bug", "bedbug", "pest"},
+}
+
+var (
+	fixturePattern = regexp.MustCompile(`\b(` + fixtureAlternation() + `)(?:e?s)?\b`)
+	// Currency amounts such as "$1,200.50" or "1200 dollars"
+	amountPattern = regexp.MustCompile(`\$\s?(\d+(?:,\d{3})*(?:\.\d{1,2})?)|\b(\d+(?:,\d{3})*(?:\.\d{1,2})?)\s+dollars?\b`)
+	// Numbers may be followed by a unit or ordinal suffix, as in "9am" or "2nd"
+	numberPattern = regexp.MustCompile(`\b(\d+(?:,\d{3})*(?:\.\d+)?)`)
+	// Number words the letter may use for an amount in the input, "one" and "a" are left out as they
+	// are rarely a claim
+	numberWordPattern  = regexp.MustCompile(`\b(?:(?:twenty|thirty|forty|fifty|sixty|ninety)[- ])?(?:two|three|four|five|six|seven|eight|nine|ten|eleven|twelve|thirteen|fourteen|fifteen|sixteen|seventeen|eighteen|nineteen|twenty|thirty|forty|fifty|sixty|ninety)\b`)
+	relativeAgoPattern = regexp.MustCompile(`\b(\d+|a couple of|a few|[a-z]+(?:[- ][a-z]+)??)\s+(days?|weeks?|months?|years?)\s+ago\b`)
+	// Placeholders of Pseudonymizer, whose numbers are not claims
+	piiPlaceholderPattern = regexp.MustCompile(`\[[A-Z]+_\d+\]`)
+	monthNamePattern      = regexp.MustCompile(`\b(?:january|february|march|april|may|june|july|august|september|october|november|december|jan|feb|mar|apr|jun|jul|aug|sep|sept|oct|nov|dec)\b`)
+)
+
+var ordinalWords = map[string]int{
+	"first": 1, "second": 2, "third": 3, "fourth": 4, "fifth": 5, "sixth": 6, "seventh": 7,
+	"eighth": 8, "ninth": 9, "tenth": 10,
+}
+
+func fixtureAlternation() string {
+	var terms []string
+	for _, group := range fixtureGroups {
+		for _, term := range group {
+			terms = append(terms, strings.ReplaceAll(regexp.QuoteMeta(term), " ", `\s+`))
+		}
+	}
+	// Longest first, so "water heater" is not read as "water" and "heater"
+	slices.SortFunc(terms, func(a, b string) int { return len(b) - len(a) })
+	return strings.Join(terms, "|")
+}
+
+// mentionedFixtures returns the indexes in fixtureGroups of the fixtures of a lowercased text
+func mentionedFixtures(s string) map[int]string {
+	groups := make(map[int]string)
+	for _, m := range fixturePattern.FindAllStringSubmatch(s, -1) {
+		term := strings.Join(strings.Fields(m[1]), " ")
+		for i, group := range fixtureGroups {
+			if slices.Contains(group, term) {
+				if _, ok := groups[i]; !ok {
+					groups[i] = m[0]
+				}
+			}
+		}
+	}
+	return groups
+}
+
+// dateMention is a date written in a text. Year is zero when it was left out.
+type dateMention struct {
+	Text  string
+	Year  int
+	Month time.Month
+	Day   int
+	Start int
+	End   int
+}
+
+// findDates returns the absolute dates of a lowercased text
+func findDates(s string) []dateMention {
+	var dates []dateMention
+	add := func(loc []int, year int, month time.Month, day int) {
+		if month < time.January || month > time.December || day < 1 || day > 31 {
+			return
+		}
+		dates = append(dates, dateMention{Text: s[loc[0]:loc[1]], Year: year, Month: month, Day: day, Start: loc[0], End: loc[1]})
+	}
+	for _, m := range isoDatePattern.FindAllStringSubmatchIndex(s, -1) {
+		year, _ := strconv.Atoi(s[m[2]:m[3]])
+		month, _ := strconv.Atoi(s[m[4]:m[5]])
+		day, _ := strconv.Atoi(s[m[6]:m[7]])
+		add(m, year, time.Month(month), day)
+	}
+	for _, m := range usDatePattern.FindAllStringSubmatchIndex(s, -1) {
+		month, _ := strconv.Atoi(s[m[2]:m[3]])
+		day, _ := strconv.Atoi(s[m[4]:m[5]])
+		year := 0
+		if m[6] >= 0 {
+			year, _ = strconv.Atoi(s[m[6]:m[7]])
+			if m[7]-m[6] == 2 {
+				year += 2000
+			}
+		}
+		add(m, year, time.Month(month), day)
+	}
+	for _, m := range namedDate.FindAllStringSubmatchIndex(s, -1) {
+		day, _ := strconv.Atoi(s[m[4]:m[5]])
+		year := 0
+		if m[6] >= 0 {
+			year, _ = strconv.Atoi(s[m[6]:m[7]])
+		}
+		add(m, year, deadlineMonths[s[m[2]:m[2]+3]], day)
+	}
+	return dates
+}
+
+// dateRange is a span of days a relative date in the input may refer to
+type dateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+func (r dateRange) contains(d dateMention) bool {
+	if d.Year == 0 {
+		for year := r.From.Year(); year <= r.To.Year(); year++ {
+			if date := time.Date(year, d.Month, d.Day, 0, 0, 0, 0, time.UTC); !date.Before(r.From) && !date.After(r.To) {
+				return true
+			}
+		}
+		return false
+	}
+	date := time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, time.UTC)
+	return !date.Before(r.From) && !date.After(r.To)
+}
+
+// relativeDates returns the days the relative dates of a lowercased text may refer to, such as
+// "yesterday", "last week", "two months ago" or "on Monday". The model is asked to resolve them to
+// absolute dates, and cannot know them more precisely than this.
+func relativeDates(s string, today time.Time) []dateRange {
+	day := func(offset int) time.Time { return today.AddDate(0, 0, offset) }
+	// Today is always included, letters may refer to "as of today"
+	ranges := []dateRange{{today, today}}
+
+	if strings.Contains(s, "yesterday") {
+		ranges = append(ranges, dateRange{day(-1), day(-1)})
+	}
+	if strings.Contains(s, "last week") || strings.Contains(s, "this week") {
+		ranges = append(ranges, dateRange{day(-14), day(7)})
+	}
+	if strings.Contains(s, "last month") || strings.Contains(s, "this month") {
+		first := time.Date(today.Year(), today.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+		ranges = append(ranges, dateRange{first, today})
+	}
+	if weekdayPattern.MatchString(s) {
+		ranges = append(ranges, dateRange{day(-14), day(14)})
+	}
+	for _, m := range relativeAgoPattern.FindAllStringSubmatch(s, -1) {
+		amount, err := strconv.Atoi(m[1])
+		if err != nil {
+			amount = parseNumberWords(m[1])
+		}
+		if amount <= 0 {
+			continue
+		}
+		// "Two weeks ago" is rarely exactly 14 days
+		switch strings.TrimSuffix(m[2], "s") {
+		case "day":
+			ranges = append(ranges, dateRange{day(-amount - 1), day(-amount + 1)})
+		case "week":
+			ranges = append(ranges, dateRange{day(-7*amount - 4), day(-7*amount + 4)})
+		case "month":
+			ranges = append(ranges, dateRange{today.AddDate(0, -amount, -16), today.AddDate(0, -amount, 16)})
+		case "year":
+			ranges = append(ranges, dateRange{today.AddDate(-amount, -6, 0), today.AddDate(-amount, 6, 0)})
+		}
+	}
+	return ranges
+}
+
+// inputNumbers returns the numbers of a lowercased text, written as digits, number words or ordinals
+func inputNumbers(s string) map[float64]bool {
+	numbers := make(map[float64]bool)
+	for _, m := range numberPattern.FindAllStringSubmatch(s, -1) {
+		if n, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64); err == nil {
+			numbers[n] = true
+		}
+	}
+	words := strings.FieldsFunc(s, func(c rune) bool { return !unicode.IsLetter(c) })
+	for i, word := range words {
+		if n, ok := ordinalWords[word]; ok {
+			numbers[float64(n)] = true
+		}
+		n, ok := deadlineNumbers[word]
+		if !ok {
+			continue
+		}
+		numbers[float64(n)] = true
+		// "twenty one" and "twenty-one"
+		if i+1 < len(words) && n >= 20 {
+			if next, ok := deadlineNumbers[words[i+1]]; ok && next < 10 {
+				numbers[float64(n+next)] = true
+			}
+		}
+	}
+	for phrase, n := range map[string]int{"a couple of": 2, "a few": 3} {
+		if strings.Contains(s, phrase) {
+			numbers[float64(n)] = true
+		}
+	}
+	return numbers
+}
+
+// VerifyGrounding returns the dates, amounts, numbers and fixtures of a letter which are not in the
+// tenant's input, that is the user messages of the conversation the model was given. The resolved
+// deadline and the laws of the rule pack the model may quote, when there are, are also supported.
+// Other numbers of the system prompt, such as those of its examples, are not: the model is only
+// told about them.
+func VerifyGrounding(letter string, messages []Message, now time.Time, deadline *Deadline, pack *RulePack) []Claim {
+	today := civilDate(now)
+	var inputText strings.Builder
+	for _, m := range messages {
+		if m.Role == RoleUser {
+			inputText.WriteString(m.Content + "\n")
+		}
+	}
+	input := strings.ToLower(inputText.String())
+	if deadline != nil {
+		inputText.WriteString(deadline.Date + "\n" + deadline.Text + "\n")
+	}
+	if pack != nil {
+		inputText.WriteString(pack.GroundingText())
+	}
+	source := strings.ToLower(piiPlaceholderPattern.ReplaceAllString(inputText.String(), " "))
+
+	sourceDates := findDates(source)
+	ranges := relativeDates(input, today)
+	numbers := inputNumbers(source)
+	numbers[float64(today.Year())] = true
+	// Times such as "3:00" have a zero
+	numbers[0] = true
+	mentionedMonths := map[time.Month]bool{today.Month(): true}
+	for _, m := range monthNamePattern.FindAllString(source, -1) {
+		mentionedMonths[deadlineMonths[m[:3]]] = true
+	}
+
+	s := strings.ToLower(piiPlaceholderPattern.ReplaceAllString(letter, " "))
+	claims := []Claim{}
+	seen := make(map[Claim]bool)
+	claim := func(kind, text string) {
+		c := Claim{Kind: kind, Text: strings.Join(strings.Fields(text), " ")}
+		if !seen[c] {
+			seen[c] = true
+			claims = append(claims, c)
+		}
+	}
+	// Spans already checked as a date or amount, so their numbers are not checked again
+	var checked [][2]int
+	inChecked := func(start, end int) bool {
+		for _, c := range checked {
+			if start < c[1] && c[0] < end {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, d := range findDates(s) {
+		checked = append(checked, [2]int{d.Start, d.End})
+		if !dateSupported(d, sourceDates, ranges) {
+			claim(ClaimDate, d.Text)
+		}
+	}
+	for _, m := range monthNamePattern.FindAllStringIndex(s, -1) {
+		// Months without a day, such as "since October". "May" and "march" are usually not months,
+		// and abbreviations are only used with a day.
+		month := s[m[0]:m[1]]
+		_, abbreviation := deadlineMonths[month]
+		if inChecked(m[0], m[1]) || abbreviation || month == "march" || mentionedMonths[deadlineMonths[month[:3]]] {
+			continue
+		}
+		claim(ClaimDate, month)
+	}
+	for _, m := range amountPattern.FindAllStringSubmatchIndex(s, -1) {
+		checked = append(checked, [2]int{m[0], m[1]})
+		var value string
+		if m[2] >= 0 {
+			value = s[m[2]:m[3]]
+		} else {
+			value = s[m[4]:m[5]]
+		}
+		if n, err := strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64); err == nil && !numbers[n] {
+			claim(ClaimAmount, s[m[0]:m[1]])
+		}
+	}
+	for _, m := range numberPattern.FindAllStringSubmatchIndex(s, -1) {
+		if inChecked(m[0], m[1]) {
+			continue
+		}
+		if n, err := strconv.ParseFloat(strings.ReplaceAll(s[m[2]:m[3]], ",", ""), 64); err == nil && !numbers[n] {
+			claim(ClaimNumber, s[m[0]:m[1]])
+		}
+	}
+	for _, m := range numberWordPattern.FindAllStringIndex(s, -1) {
+		if n := parseNumberWords(s[m[0]:m[1]]); n > 0 && !numbers[float64(n)] {
+			claim(ClaimNumber, s[m[0]:m[1]])
+		}
+	}
+	supportedFixtures := mentionedFixtures(input)
+	fixtures := mentionedFixtures(s)
+	for _, group := range slices.Sorted(maps.Keys(fixtures)) {
+		if _, ok := supportedFixtures[group]; !ok {
+			claim(ClaimFixture, fixtures[group])
+		}
+	}
+	return claims
+}
+
+func dateSupported(d dateMention, sourceDates []dateMention, ranges []dateRange) bool {
+	for _, s := range sourceDates {
+		if s.Month == d.Month && s.Day == d.Day && (s.Year == 0 || d.Year == 0 || s.Year == d.Year) {
+			return true
+		}
+	}
+	for _, r := range ranges {
+		if r.contains(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// GroundLetter checks the letter written for a conversation with VerifyGrounding. With regenerate
+// set, a letter with unsupported claims is written once more with the claims pointed out, in the
+// same style as the first with InferLetter, and the version with fewer unsupported claims is kept.
+func GroundLetter(ctx context.Context, ip InferenceProvider, messages []Message, letter string, style LetterStyle, deadline *Deadline, pack *RulePack, now time.Time, regenerate bool) (string, Grounding) {
+	claims := VerifyGrounding(letter, messages, now, deadline, pack)
+	result := Grounding{UnsupportedClaims: claims}
+	if len(claims) == 0 || !regenerate {
+		return letter, result
+	}
+
+	texts := make([]string, len(claims))
+	for i, c := range claims {
+		texts[i] = fmt.Sprintf("%q", c.Text)
+	}
+	retry := append(messages[:len(messages):len(messages)],
+		Message{Role: RoleAssistant, Content: letter},
+		Message{Role: RoleUser, Content: fmt.Sprintf(
+			"The letter mentions details which are not in my answers: %s. Rewrite it without them, using a placeholder where a detail is needed but missing. Keep everything else and follow all of the instructions above.",
+			strings.Join(texts, ", "))},
+	)
+	regenerated, _, err := InferLetter(ctx, ip, retry, style)
+	if err != nil {
+		// The first letter is still usable
+		return letter, result
+	}
+	// The first letter is kept when the retry is no better
+	if retryClaims := VerifyGrounding(regenerated, messages, now, deadline, pack); len(retryClaims) < len(claims) {
+		letter, result.UnsupportedClaims, result.Regenerated = regenerated, retryClaims, true
+	}
+	return letter, result
+}
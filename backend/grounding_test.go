@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var groundingNow = time.Date(2026, time.October, 19, 12, 0, 0, 0, time.UTC)
+
+func TestVerifyGroundingSupported(t *testing.T) {
+	messages := NewConversation(
+		"The current time is Monday, October 19 12:00:00 EDT 2026.\nOhio Revised Code 5321.07(B): within thirty days.",
+		"The tenant's main problems are: the furnace stopped working on October 5 and I paid $1,200 rent for 3 weeks without heat, call [PHONE_1].",
+	)
+	letter := "Since October 5, 2026, the heating has not worked. I have paid 1200 dollars in rent for three weeks. " +
+		"Please make the repair by November 19, 2026. As of October 19, it is still cold. Call me at [PHONE_1]."
+	deadline := &Deadline{Date: "2026-11-19", Text: "Thursday, November 19, 2026"}
+
+	if claims := VerifyGrounding(letter, messages, groundingNow, deadline, nil); len(claims) != 0 {
+		t.Errorf("expected no unsupported claims, got %+v", claims)
+	}
+}
+
+// The laws of the rule pack the model may quote are supported, but other numbers of the system
+// prompt, such as those of its examples, are not the tenant's input
+func TestVerifyGroundingRulePack(t *testing.T) {
+	pack := SelectRulePack(rulePacks, "OH", "")
+	messages := NewConversation(
+		pack.PromptContext()+"\nFor example, write \"the rent of $950\" or \"for 11 weeks\".",
+		"The tenant's main problems are: the furnace stopped working.",
+	)
+	letter := "The furnace stopped working. Under Ohio Revised Code 5321.04(A)(6) and 5321.07(B), please make the repair within 30 days. " +
+		"The rent is $950 and it has been 11 weeks."
+
+	got := fmt.Sprint(VerifyGrounding(letter, messages, groundingNow, nil, pack))
+	want := fmt.Sprint([]Claim{
+		{Kind: ClaimAmount, Text: "$950"},
+		{Kind: ClaimNumber, Text: "11"},
+	})
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	// Without the pack the citations are not supported
+	if claims := VerifyGrounding(letter, messages, groundingNow, nil, nil); len(claims) != 6 {
+		t.Errorf("expected the citations to be unsupported without the pack, got %+v", claims)
+	}
+}
+
+func TestVerifyGroundingUnsupported(t *testing.T) {
+	messages := NewConversation("system", "The tenant's main problems are: the sink leaks.")
+	letter := "On September 30 the plumber repaired the sink and the dishwasher, which cost $350. Two technicians came in August, and I may call 3 times."
+
+	got := fmt.Sprint(VerifyGrounding(letter, messages, groundingNow, nil, nil))
+	want := fmt.Sprint([]Claim{
+		{Kind: ClaimDate, Text: "september 30"},
+		{Kind: ClaimDate, Text: "august"},
+		{Kind: ClaimAmount, Text: "$350"},
+		{Kind: ClaimNumber, Text: "3"},
+		{Kind: ClaimNumber, Text: "two"},
+		{Kind: ClaimFixture, Text: "dishwasher"},
+	})
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestVerifyGroundingRelativeDates(t *testing.T) {
+	tests := map[string]string{
+		"the leak started two weeks ago": "October 5",
+		"the leak started yesterday":     "10/18/2026",
+		"it broke last Tuesday":          "October 13",
+		"the heat went out last month":   "September 2",
+	}
+	for input, date := range tests {
+		messages := NewConversation("system", input)
+		if claims := VerifyGrounding("The problem began on "+date+".", messages, groundingNow, nil, nil); len(claims) != 0 {
+			t.Errorf("%q: expected %s to be supported, got %+v", input, date, claims)
+		}
+	}
+
+	messages := NewConversation("system", "the leak started two weeks ago")
+	if claims := VerifyGrounding("The problem began on October 15.", messages, groundingNow, nil, nil); len(claims) != 1 {
+		t.Errorf("expected a date far from two weeks ago to be unsupported, got %+v", claims)
+	}
+}
+
+func TestGroundLetter(t *testing.T) {
+	messages := NewConversation("system", "The tenant's main problems are: the sink leaks.")
+	invented := "The sink and the toilet have leaked since September 30."
+
+	letter, grounding := GroundLetter(context.Background(), &scriptedProvider{}, messages, invented, LetterStyle{}, nil, nil, groundingNow, false)
+	if letter != invented || grounding.Regenerated || len(grounding.UnsupportedClaims) != 2 {
+		t.Fatalf("expected the claims without regenerating, got %q %+v", letter, grounding)
+	}
+
+	ip := &scriptedProvider{replies: []string{"The sink leaks."}}
+	letter, grounding = GroundLetter(context.Background(), ip, messages, invented, LetterStyle{}, nil, nil, groundingNow, true)
+	if letter != "The sink leaks." || !grounding.Regenerated || len(grounding.UnsupportedClaims) != 0 {
+		t.Fatalf("expected the regenerated letter, got %q %+v", letter, grounding)
+	}
+	correction := ip.conversations[0][3].Content
+	if ip.conversations[0][2].Content != invented || !bytes.Contains([]byte(correction), []byte(`"september 30", "toilet"`)) {
+		t.Errorf("expected the claims to be pointed out, got %q", correction)
+	}
+
+	// A regenerated letter which is no better is not kept
+	ip = &scriptedProvider{replies: []string{"The sink, the toilet and the shower leak since September 30."}}
+	if letter, grounding = GroundLetter(context.Background(), ip, messages, invented, LetterStyle{}, nil, nil, groundingNow, true); letter != invented || grounding.Regenerated || len(grounding.UnsupportedClaims) != 2 {
+		t.Errorf("expected the first letter to be kept, got %q %+v", letter, grounding)
+	}
+}
+
+// The regenerated letter is written in the style of the first, with its length and reading level
+func TestGroundLetterKeepsStyle(t *testing.T) {
+	messages := NewConversation("system", "The tenant's main problems are: the sink leaks.")
+	style := LetterStyle{Length: "short", ReadingLevel: "simple"}
+	complex := "Notwithstanding considerable deliberation, the deteriorating plumbing infrastructure necessitates immediate professional intervention regarding the sink."
+
+	ip := &scriptedProvider{replies: []string{complex, "The sink leaks."}}
+	letter, grounding := GroundLetter(context.Background(), ip, messages, "The sink and the toilet leak.", style, nil, nil, groundingNow, true)
+
+	if letter != "The sink leaks." || !grounding.Regenerated {
+		t.Fatalf("expected the regenerated letter to be simplified, got %q %+v", letter, grounding)
+	}
+	if len(ip.maxOutputTokens) != 2 || ip.maxOutputTokens[0] != style.MaxOutputTokens() {
+		t.Errorf("expected the output limit of the style, got %v", ip.maxOutputTokens)
+	}
+}
+
+func TestTextHandlerGrounding(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	ip := &scriptedProvider{replies: []string{"The sink and the dishwasher leak.", "The sink leaks."}}
+	r := router{ip: ip, altcha: altchaService, regenerateUngrounded: true}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"altcha":  altchaToken,
+		"answers": map[string]string{"mainProblem": "the sink leaks"},
+	})
+	w := httptest.NewRecorder()
+
+	r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+	var result TextResponseSuccess
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Text != "The sink leaks." || result.Grounding == nil || !result.Grounding.Regenerated || len(result.Grounding.UnsupportedClaims) != 0 {
+		t.Errorf("expected the regenerated letter, got %q %+v", result.Text, result.Grounding)
+	}
+	if result.Readability.Words != 3 {
+		t.Errorf("expected the readability of the regenerated letter, got %+v", result.Readability)
+	}
+}
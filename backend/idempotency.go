@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader names a request, so a client can send it again after a dropped connection
+// without running it twice
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Set on responses replayed from the IdempotencyStore
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// Longest Idempotency-Key accepted, a UUID is 36 characters
+const maxIdempotencyKeyLength = 255
+
+// Responses are no longer stored once they take this many bytes in total, letters with exhibits
+// can be several megabytes. A response which does not fit is still sent, but not kept, so a retry
+// runs the request again and needs a new altcha. Stored responses are freed as they expire.
+const maxIdempotencyStoreSize = 64 * 1024 * 1024
+
+// IdempotencyStore replays the response of a request to requests sent again with the same
+// Idempotency-Key and body, without verifying another altcha or running inference again. Requests
+// arriving while the first is running wait for its response.
+//
+// Responses hold letters and personal details, so they are kept encrypted with a random key which
+// never leaves the store, and the keys are kept hashed. Only successful responses are stored, a
+// failed request runs again when it is retried.
+type IdempotencyStore struct {
+	lifetime time.Duration
+	aead     cipher.AEAD
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	// Bytes of the stored responses
+	size int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type idempotencyEntry struct {
+	// Hash of the request body, the key may not be reused for a different request
+	fingerprint [sha256.Size]byte
+	// Closed when the first request has completed
+	done chan struct{}
+	// The encrypted response, nil while the first request is running
+	sealed  []byte
+	expires time.Time
+}
+
+// The response stored for an Idempotency-Key
+type idempotentResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+func NewIdempotencyStore(lifetime time.Duration) (*IdempotencyStore, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &IdempotencyStore{
+		lifetime: lifetime,
+		aead:     aead,
+		entries:  make(map[string]*idempotencyEntry),
+		stop:     make(chan struct{}),
+	}
+	go s.cleanupRoutine()
+	return s, nil
+}
+
+func (s *IdempotencyStore) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// validIdempotencyKey reports whether a key is 1 to 255 printable ASCII characters
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// entryID identifies the entry of a key. The key itself is not kept, as it may be guessable.
+func entryID(path, key string) string {
+	sum := sha256.Sum256([]byte(path + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Wrap handles requests with an Idempotency-Key header. Requests without one are passed on. The body
+// of a request may take up to maxBodySize bytes, the limit of the route.
+func (s *IdempotencyStore) Wrap(maxBodySize int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: fmt.Sprintf("%s must be 1 to %d printable ASCII characters", IdempotencyKeyHeader, maxIdempotencyKeyLength)})
+			return
+		}
+
+		// The body is read to tell a retry from another request reusing the key
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to read body"})
+			slog.ErrorContext(r.Context(), "failed to read body", "err", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		id := entryID(r.URL.Path, key)
+		fingerprint := sha256.Sum256(body)
+
+		for {
+			s.mu.Lock()
+			e, ok := s.entries[id]
+			if ok && e.sealed != nil && time.Now().After(e.expires) {
+				s.remove(id)
+				ok = false
+			}
+			if !ok {
+				e = &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+				s.entries[id] = e
+				s.mu.Unlock()
+				s.run(w, r, id, e, next)
+				return
+			}
+			s.mu.Unlock()
+
+			if e.fingerprint != fingerprint {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: fmt.Sprintf("%s was already used for a different request", IdempotencyKeyHeader)})
+				return
+			}
+
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				return
+			}
+			if e.sealed == nil {
+				// The first request failed and was not stored, try again
+				continue
+			}
+			if err := s.replay(w, id, e.sealed); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to replay response"})
+				slog.ErrorContext(r.Context(), "failed to replay response", "err", err)
+			}
+			return
+		}
+	}
+}
+
+// run handles the first request of a key and stores its response if it succeeded
+func (s *IdempotencyStore) run(w http.ResponseWriter, r *http.Request, id string, e *idempotencyEntry, next http.HandlerFunc) {
+	rec := &responseRecorder{header: make(http.Header)}
+	stored := false
+	defer func() {
+		s.mu.Lock()
+		if !stored {
+			delete(s.entries, id)
+		}
+		close(e.done)
+		s.mu.Unlock()
+	}()
+
+	next(rec, r)
+
+	if rec.status >= 200 && rec.status < 300 {
+		if sealed, err := s.seal(id, rec); err != nil {
+			slog.ErrorContext(r.Context(), "failed to store response", "err", err)
+		} else {
+			s.mu.Lock()
+			if s.size+len(sealed) <= maxIdempotencyStoreSize {
+				e.sealed = sealed
+				e.expires = time.Now().Add(s.lifetime)
+				s.size += len(sealed)
+				stored = true
+			}
+			s.mu.Unlock()
+		}
+	}
+
+	rec.copyTo(w)
+}
+
+func (s *IdempotencyStore) seal(id string, rec *responseRecorder) ([]byte, error) {
+	plaintext, err := json.Marshal(idempotentResponse{Status: rec.status, Header: rec.header, Body: rec.body.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The id is authenticated so a response can not be replayed for another key
+	return s.aead.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+func (s *IdempotencyStore) replay(w http.ResponseWriter, id string, sealed []byte) error {
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return errors.New("stored response is too short")
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(id))
+	if err != nil {
+		return err
+	}
+	var resp idempotentResponse
+	if err := json.Unmarshal(plaintext, &resp); err != nil {
+		return err
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(resp.Status)
+	_, _ = w.Write(resp.Body)
+	return nil
+}
+
+// remove deletes an entry, the lock must be held
+func (s *IdempotencyStore) remove(id string) {
+	s.size -= len(s.entries[id].sealed)
+	delete(s.entries, id)
+}
+
+func (s *IdempotencyStore) cleanupRoutine() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			s.mu.Lock()
+			for id, e := range s.entries {
+				if e.sealed != nil && now.After(e.expires) {
+					s.remove(id)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// responseRecorder holds the response of a handler so it can be stored before it is written
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) copyTo(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+	r.WriteHeader(http.StatusOK)
+	w.WriteHeader(r.status)
+	_, _ = w.Write(r.body.Bytes())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler answers with the request body and the number of requests it handled
+func countingHandler(calls *atomic.Int64, status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, "%s %d", body, n)
+	}
+}
+
+func idempotentRequest(path, key, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(IdempotencyKeyHeader, key)
+	}
+	return r
+}
+
+func newTestIdempotencyStore(t *testing.T, lifetime time.Duration) *IdempotencyStore {
+	s, err := NewIdempotencyStore(lifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func TestIdempotencyStoreReplay(t *testing.T) {
+	s := newTestIdempotencyStore(t, time.Minute)
+	var calls atomic.Int64
+	handler := s.Wrap(MaxRequestBodySize, countingHandler(&calls, http.StatusOK))
+
+	first := httptest.NewRecorder()
+	handler(first, idempotentRequest("/api/text", "key-1", "no heat"))
+	second := httptest.NewRecorder()
+	handler(second, idempotentRequest("/api/text", "key-1", "no heat"))
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected the handler to run once, ran %d times", calls.Load())
+	}
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() || second.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("expected the first response to be replayed, got %d %q", second.Code, second.Body.String())
+	}
+	if first.Header().Get(idempotentReplayedHeader) != "" || second.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Fatal("expected only the replayed response to be marked")
+	}
+
+	// Other keys, routes and requests without a key run again
+	for _, r := range []*http.Request{
+		idempotentRequest("/api/text", "key-2", "no heat"),
+		idempotentRequest("/api/pdf", "key-1", "no heat"),
+		idempotentRequest("/api/text", "", "no heat"),
+		idempotentRequest("/api/text", "", "no heat"),
+	} {
+		handler(httptest.NewRecorder(), r)
+	}
+	if calls.Load() != 5 {
+		t.Fatalf("expected the handler to run 5 times, ran %d times", calls.Load())
+	}
+
+	// The response is not stored in the clear
+	s.mu.Lock()
+	sealed := s.entries[entryID("/api/text", "key-1")].sealed
+	s.mu.Unlock()
+	if bytes.Contains(sealed, []byte("no heat")) {
+		t.Fatal("expected the stored response to be encrypted")
+	}
+}
+
+func TestIdempotencyStoreRejects(t *testing.T) {
+	s := newTestIdempotencyStore(t, time.Minute)
+	var calls atomic.Int64
+	handler := s.Wrap(MaxRequestBodySize, countingHandler(&calls, http.StatusOK))
+
+	w := httptest.NewRecorder()
+	handler(w, idempotentRequest("/api/text", strings.Repeat("k", maxIdempotencyKeyLength+1), "no heat"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d for a long key, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	handler(httptest.NewRecorder(), idempotentRequest("/api/text", "key", "no heat"))
+	w = httptest.NewRecorder()
+	handler(w, idempotentRequest("/api/text", "key", "leaking sink"))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected %d for a reused key, got %d", http.StatusConflict, w.Code)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected the handler to run once, ran %d times", calls.Load())
+	}
+}
+
+func TestIdempotencyStoreDoesNotStoreFailures(t *testing.T) {
+	s := newTestIdempotencyStore(t, time.Minute)
+	var calls atomic.Int64
+	handler := s.Wrap(MaxRequestBodySize, countingHandler(&calls, http.StatusInternalServerError))
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		handler(w, idempotentRequest("/api/text", "key", "no heat"))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected %d, got %d", http.StatusInternalServerError, w.Code)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected failed requests to run again, ran %d times", calls.Load())
+	}
+}
+
+func TestIdempotencyStoreExpires(t *testing.T) {
+	s := newTestIdempotencyStore(t, 10*time.Millisecond)
+	var calls atomic.Int64
+	handler := s.Wrap(MaxRequestBodySize, countingHandler(&calls, http.StatusOK))
+
+	handler(httptest.NewRecorder(), idempotentRequest("/api/text", "key", "no heat"))
+	time.Sleep(20 * time.Millisecond)
+	handler(httptest.NewRecorder(), idempotentRequest("/api/text", "key", "no heat"))
+	if calls.Load() != 2 {
+		t.Fatalf("expected the expired response to run again, ran %d times", calls.Load())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) != 1 || s.size != len(s.entries[entryID("/api/text", "key")].sealed) {
+		t.Fatalf("expected only the new response to be stored, got %d entries of %d bytes", len(s.entries), s.size)
+	}
+}
+
+func TestIdempotencyStoreLimits(t *testing.T) {
+	s := newTestIdempotencyStore(t, time.Minute)
+	var calls atomic.Int64
+
+	// Each route reads the body up to its own limit, pdf requests with exhibits are over 10MiB
+	large := strings.Repeat("x", MaxPdfUploadSize+1)
+	w := httptest.NewRecorder()
+	s.Wrap(MaxExhibitsTotalSize+MaxRequestBodySize, countingHandler(&calls, http.StatusOK))(w, idempotentRequest("/api/pdf", "key", large))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a body within the limit of the route to be accepted, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.Wrap(MaxRequestBodySize, countingHandler(&calls, http.StatusOK))(w, idempotentRequest("/api/text", "key", large))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a body over the limit of the route to be refused, got %d", w.Code)
+	}
+
+	// Once the store is full responses are still sent, but retries run again
+	s.mu.Lock()
+	s.size = maxIdempotencyStoreSize
+	s.mu.Unlock()
+	calls.Store(0)
+	handler := s.Wrap(MaxRequestBodySize, countingHandler(&calls, http.StatusOK))
+	for range 2 {
+		w = httptest.NewRecorder()
+		handler(w, idempotentRequest("/api/text", "full", "no heat"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected the response to be sent, got %d", w.Code)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected the request to run again when its response was not stored, ran %d times", calls.Load())
+	}
+}
+
+func TestIdempotencyStoreCoalesces(t *testing.T) {
+	s := newTestIdempotencyStore(t, time.Minute)
+	var calls atomic.Int64
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := s.Wrap(MaxRequestBodySize, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		_, _ = w.Write([]byte("letter"))
+	})
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 5)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler(responses[i], idempotentRequest("/api/text", "key", "no heat"))
+		}()
+		if i == 0 {
+			<-started
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected concurrent duplicates to wait for the first request, ran %d times", calls.Load())
+	}
+	for i, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != "letter" {
+			t.Errorf("response %d: unexpected %d %q", i, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestTextHandlerIdempotencyKey(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+	ip := &promptRecordingProvider{}
+	r := router{ip: ip, altcha: altchaService}
+	handler := newTestIdempotencyStore(t, time.Minute).Wrap(MaxRequestBodySize, r.text)
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"altcha":  altchaToken,
+		"answers": map[string]string{"mainProblem": "no heat"},
+	})
+
+	// The retry would fail the altcha check, which only allows a payload once
+	for range 2 {
+		w := httptest.NewRecorder()
+		handler(w, idempotentRequest("/api/text", "retry", string(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	if len(ip.prompts) != 1 {
+		t.Fatalf("expected one inference, got %d", len(ip.prompts))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"os"
+	"strings"
 	"text/template"
 	"time"
 
@@ -20,9 +21,81 @@ import (
 //   - RATE_LIMIT_REQUESTS_PER_SECOND: Number of requests per second (default: 1.0)
 //   - RATE_LIMIT_BURST: Maximum burst size (default: 3)
 type InferenceProvider interface {
-	// Runs user context input through inference provider.
-	// A system prompt may be included on creation of the inference provider.
-	Infer(ctx context.Context, input string) (string, error)
+	// Runs a conversation through the inference provider and returns the reply of the assistant.
+	// The conversation starts with a system message, followed by user and assistant messages
+	// taking turns and ending with a user message. The tokens used are returned with the reply, and
+	// with an error when they are known, one Usage for each model the provider ran.
+	Infer(ctx context.Context, messages []Message) (string, []Usage, error)
+}
+
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Message is one message of a conversation with an inference provider
+type Message struct {
+	Role    Role
+	Content string
+}
+
+// NewConversation returns the conversation of a single user input
+func NewConversation(systemPrompt, input string) []Message {
+	return []Message{
+		{Role: RoleSystem, Content: systemPrompt},
+		{Role: RoleUser, Content: input},
+	}
+}
+
+// SplitSystemPrompt separates the system prompt from the rest of a conversation, for providers
+// which take it separately
+func SplitSystemPrompt(messages []Message) (string, []Message) {
+	var system []string
+	var rest []Message
+	for _, m := range messages {
+		if m.Role == RoleSystem {
+			system = append(system, m.Content)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	return strings.Join(system, "\n"), rest
+}
+
+// EstimateInputTokens estimates the number of input tokens of a conversation for providers which
+// can not count them. We have to be conservative by assuming each character of the user and
+// assistant messages is one token, since they hold user input. The system prompt however is
+// trusted so we can use a simple heuristic.
+func EstimateInputTokens(messages []Message) int {
+	tokens := 0
+	for _, m := range messages {
+		if m.Role == RoleSystem {
+			tokens += len(m.Content) / 3
+		} else {
+			tokens += len(m.Content)
+		}
+	}
+	return tokens
+}
+
+type maxOutputTokensKey struct{}
+
+// WithMaxOutputTokens lowers the maximum number of output tokens of inferences made with the
+// returned context, for requests asking for short letters.
+func WithMaxOutputTokens(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, maxOutputTokensKey{}, n)
+}
+
+// MaxOutputTokens returns the maximum number of output tokens providers should use for an
+// inference: their own limit, lowered by WithMaxOutputTokens. A limit of zero is no limit.
+func MaxOutputTokens(ctx context.Context, limit int) int {
+	if n, ok := ctx.Value(maxOutputTokensKey{}).(int); ok && (limit <= 0 || n < limit) {
+		return n
+	}
+	return limit
 }
 
 var (
@@ -45,12 +118,17 @@ func NewMockInferenceProvider() *MockInferenceProvider {
 	}
 }
 
-func (m *MockInferenceProvider) Infer(ctx context.Context, input string) (string, error) {
+func (m *MockInferenceProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
 	time.Sleep(m.sleepDuration)
 	if m.shouldError {
-		return "", ErrTooManyInputTokens
+		return "", nil, ErrTooManyInputTokens
 	}
-	return "MOCKED INFERENCE PROVIDER\n\n" + input + "\n\nMOCKED INFERENCE PROVIDER", nil
+	reply := "MOCKED INFERENCE PROVIDER\n\n" + messages[len(messages)-1].Content + "\n\nMOCKED INFERENCE PROVIDER"
+	return reply, []Usage{{
+		Provider:     "mock",
+		InputTokens:  EstimateInputTokens(messages),
+		OutputTokens: EstimateInputTokens([]Message{{Role: RoleAssistant, Content: reply}}),
+	}}, nil
 }
 
 func init() {
@@ -60,10 +138,15 @@ func init() {
 }
 
 var systemPromptTemplate *template.Template
-var userPromptTemplate *template.Template
+var translationPromptTemplate *template.Template
+var followUpSystemPromptTemplate *template.Template
+var followUpUserPromptTemplate *template.Template
 
 var form Form
 
+// The prompt versions of /api/text
+var promptExperiment *PromptExperiment
+
 func init() {
 	f, err := os.Open("app-config.yaml")
 	if err != nil {
@@ -75,16 +158,53 @@ func init() {
 		panic(err)
 	}
 	systemPromptTemplate = template.Must(template.New("prompt.txt").Parse(form.Inference.SystemPrompt))
-	userPromptTemplate = template.Must(template.New("user-prompt.txt").Parse(form.Inference.UserPrompt))
+	translationPromptTemplate = template.Must(template.New("translation-prompt.txt").Parse(form.Inference.TranslationPrompt))
+	followUpSystemPromptTemplate = template.Must(template.New("follow-up-prompt.txt").Parse(form.Inference.FollowUpSystemPrompt))
+	followUpUserPromptTemplate = template.Must(template.New("follow-up-user-prompt.txt").Parse(form.Inference.FollowUpUserPrompt))
+	promptExperiment, err = NewPromptExperiment(form.Inference.SystemPrompt, form.Inference.UserPrompt, form.Inference.PromptVersions)
+	if err != nil {
+		panic(err)
+	}
 }
 
-func RenderSystemPrompt() string {
-	loc, _ := time.LoadLocation("America/New_York")
-	now := time.Now().In(loc).Format("Monday, January 2 15:04:05 MST 2006")
+// PromptTime formats the {{.CurrentTime}} of system prompts in the time zone of the receiver's
+// state, which deadlines are resolved in, or New York when the state is not known
+func PromptTime(now time.Time, state string) string {
+	return now.In(stateLocation(state)).Format("Monday, January 2 15:04:05 MST 2006")
+}
 
+func RenderSystemPrompt() string {
 	var buf bytes.Buffer
 	err := systemPromptTemplate.Execute(&buf, map[any]any{
-		"CurrentTime": now,
+		"CurrentTime": PromptTime(time.Now(), ""),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.String()
+}
+
+// Renders the system prompt used to translate a letter into the language of the tenant
+func RenderTranslationPrompt(language string) string {
+	var buf bytes.Buffer
+	err := translationPromptTemplate.Execute(&buf, map[any]any{
+		"Language": language,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.String()
+}
+
+// Renders the system prompt used to write a second notice referencing a letter sent on originalDate
+// to a receiver in state
+func RenderFollowUpSystemPrompt(originalDate, state string) string {
+	var buf bytes.Buffer
+	err := followUpSystemPromptTemplate.Execute(&buf, map[any]any{
+		"CurrentTime":  PromptTime(time.Now(), state),
+		"OriginalDate": originalDate,
 	})
 	if err != nil {
 		panic(err)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"testing"
 	"testing/synctest"
+	"time"
 )
 
 func TestMockInferenceProviderInfer(t *testing.T) {
@@ -13,7 +14,7 @@ func TestMockInferenceProviderInfer(t *testing.T) {
 		ctx := context.Background()
 		input := "test input"
 
-		result, err := provider.Infer(ctx, input)
+		result, _, err := provider.Infer(ctx, NewConversation(RenderSystemPrompt(), input))
 
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
@@ -32,3 +33,45 @@ func TestRenderSystemPrompt(t *testing.T) {
 		t.Fatal("RenderSystemPrompt should not return empty string")
 	}
 }
+
+func TestPromptTimeUsesReceiverTimeZone(t *testing.T) {
+	// 2am in New York is still the previous day in California
+	now := time.Date(2026, time.October, 20, 6, 0, 0, 0, time.UTC)
+
+	if got := PromptTime(now, "CA"); got != "Monday, October 19 23:00:00 PDT 2026" {
+		t.Errorf("expected California time, got %q", got)
+	}
+	if got := PromptTime(now, ""); got != "Tuesday, October 20 02:00:00 EDT 2026" {
+		t.Errorf("expected New York time for an unknown state, got %q", got)
+	}
+}
+
+func TestSplitSystemPrompt(t *testing.T) {
+	messages := []Message{
+		{Role: RoleSystem, Content: "be formal"},
+		{Role: RoleUser, Content: "write"},
+		{Role: RoleAssistant, Content: "draft"},
+		{Role: RoleUser, Content: "shorter"},
+	}
+
+	system, rest := SplitSystemPrompt(messages)
+	if system != "be formal" {
+		t.Fatalf("unexpected system prompt %q", system)
+	}
+	if len(rest) != 3 || rest[0].Content != "write" || rest[2].Role != RoleUser {
+		t.Fatalf("unexpected conversation %+v", rest)
+	}
+}
+
+func TestEstimateInputTokens(t *testing.T) {
+	messages := []Message{
+		{Role: RoleSystem, Content: "123456789"},
+		{Role: RoleUser, Content: "1234"},
+		{Role: RoleAssistant, Content: "12"},
+	}
+
+	// The system prompt counts as a token per three characters, user input as a token per character
+	if got := EstimateInputTokens(messages); got != 9 {
+		t.Fatalf("expected 9 tokens, got %d", got)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrJobQueueFull = errors.New("too many jobs are waiting, try again later")
+)
+
+// JobState is where a job is in its life
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCanceled  JobState = "canceled"
+)
+
+// Jobs waiting for a worker beyond this are refused
+const maxQueuedJobs = 100
+
+// A job is canceled when it runs for longer than this
+const jobTimeout = 10 * time.Minute
+
+// Finished jobs are kept this long for clients to fetch their result
+const jobLifetime = 30 * time.Minute
+
+// JobRunner runs slow requests in the background so they are not cut off by ServerTimeout. A
+// bounded number of workers run the jobs in the order they were submitted, and clients poll
+// GET /api/jobs/{id} for the result.
+type JobRunner struct {
+	queue chan *job
+
+	mu   sync.Mutex
+	jobs map[string]*job
+	// Counts the submitted jobs, to order the queued ones
+	submitted uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type job struct {
+	id     string
+	seq    uint64
+	client string
+	state  JobState
+	run    func(ctx context.Context, w http.ResponseWriter)
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Place of the job in the queue of the RateLimitedProvider while it is running
+	position atomic.Int64
+	// The response written by run, once the job finished
+	resultStatus int
+	result       []byte
+	// When a finished job is removed
+	expires time.Time
+}
+
+// NewJobRunner starts the workers of a runner
+func NewJobRunner(workers int) *JobRunner {
+	j := &JobRunner{
+		queue: make(chan *job, maxQueuedJobs),
+		jobs:  make(map[string]*job),
+		stop:  make(chan struct{}),
+	}
+	for range workers {
+		go j.worker()
+	}
+	go j.cleanupRoutine()
+	return j
+}
+
+// Stop stops the workers once they finish their current job, and cancels the jobs still queued
+func (j *JobRunner) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		for _, jb := range j.jobs {
+			if jb.state == JobQueued {
+				jb.cancel()
+				j.finish(jb, JobCanceled, 0, nil)
+			}
+		}
+	})
+}
+
+// Submit queues a job. run writes the response of the job, which is the result returned by Get.
+// The context of run is canceled by Cancel or after jobTimeout, and keeps the values of ctx. A
+// client named with WithQueueClient may only have one job queued or running.
+func (j *JobRunner) Submit(ctx context.Context, run func(ctx context.Context, w http.ResponseWriter)) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	jobCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jobTimeout)
+	jb := &job{id: hex.EncodeToString(id), client: queueClient(ctx), state: JobQueued, run: run, cancel: cancel}
+	jb.ctx = WithQueuePosition(jobCtx, &jb.position)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if jb.client != "" {
+		for _, other := range j.jobs {
+			if other.client == jb.client && (other.state == JobQueued || other.state == JobRunning) {
+				cancel()
+				return "", ErrAlreadyQueued
+			}
+		}
+	}
+	j.submitted++
+	jb.seq = j.submitted
+	select {
+	case j.queue <- jb:
+	default:
+		cancel()
+		return "", ErrJobQueueFull
+	}
+	j.jobs[jb.id] = jb
+	return jb.id, nil
+}
+
+// JobStatus is the state of a job and the response it wrote once it finished
+type JobStatus struct {
+	ID    string   `json:"id"`
+	State JobState `json:"state"`
+	// Place of the job in line, 1 being next. While the job is queued it is its place among the
+	// queued jobs, while it is running it is its place in the queue of the rate limit. It is
+	// omitted when the job is not waiting.
+	QueuePosition int `json:"queuePosition,omitempty"`
+	// HTTP status of the response of the job, set once it succeeded or failed
+	ResultStatus int `json:"resultStatus,omitempty"`
+	// The response of the job, as it would have been returned by the synchronous route
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+func (j *JobRunner) Get(id string) (JobStatus, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jb, ok := j.jobs[id]
+	if !ok {
+		return JobStatus{}, false
+	}
+	status := JobStatus{ID: jb.id, State: jb.state, ResultStatus: jb.resultStatus, Result: jb.result}
+	switch jb.state {
+	case JobQueued:
+		for _, other := range j.jobs {
+			if other.state == JobQueued && other.seq <= jb.seq {
+				status.QueuePosition++
+			}
+		}
+	case JobRunning:
+		status.QueuePosition = int(jb.position.Load())
+	}
+	return status, true
+}
+
+// Cancel stops a queued or running job. It returns false if there is no such job.
+func (j *JobRunner) Cancel(id string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jb, ok := j.jobs[id]
+	if !ok {
+		return false
+	}
+	jb.cancel()
+	if jb.state == JobQueued || jb.state == JobRunning {
+		j.finish(jb, JobCanceled, 0, nil)
+	}
+	return true
+}
+
+// finish records the outcome of a job, the lock must be held
+func (j *JobRunner) finish(jb *job, state JobState, status int, result []byte) {
+	jb.state = state
+	jb.resultStatus = status
+	jb.result = result
+	jb.expires = time.Now().Add(jobLifetime)
+}
+
+func (j *JobRunner) worker() {
+	for {
+		select {
+		case <-j.stop:
+			return
+		case jb := <-j.queue:
+			j.mu.Lock()
+			if jb.state != JobQueued {
+				// Canceled while it was queued
+				j.mu.Unlock()
+				continue
+			}
+			jb.state = JobRunning
+			j.mu.Unlock()
+
+			rec := runJob(jb)
+			timedOut := errors.Is(jb.ctx.Err(), context.DeadlineExceeded)
+			jb.cancel()
+
+			j.mu.Lock()
+			switch {
+			case jb.state != JobRunning:
+				// Canceled while it was running, the result is discarded
+			case timedOut:
+				result, _ := json.Marshal(TextResponseError{Status: statusError, Message: "job timed out"})
+				j.finish(jb, JobFailed, http.StatusGatewayTimeout, result)
+				slog.WarnContext(jb.ctx, "job timed out", "job", jb.id)
+			case rec.status >= 200 && rec.status < 300:
+				j.finish(jb, JobSucceeded, rec.status, rec.body.Bytes())
+			default:
+				j.finish(jb, JobFailed, rec.status, rec.body.Bytes())
+			}
+			j.mu.Unlock()
+		}
+	}
+}
+
+// runJob runs a job and returns its response. A panic fails the job rather than the server, as
+// net/http only recovers the panics of handlers.
+func runJob(jb *job) (rec *responseRecorder) {
+	rec = &responseRecorder{header: make(http.Header)}
+	defer func() {
+		if err := recover(); err != nil {
+			slog.ErrorContext(jb.ctx, "job panicked", "job", jb.id, "err", err)
+			rec = &responseRecorder{header: make(http.Header)}
+			rec.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(rec).Encode(TextResponseError{Status: statusError, Message: "job failed"})
+		}
+	}()
+	jb.run(jb.ctx, rec)
+	rec.WriteHeader(http.StatusOK)
+	return rec
+}
+
+func (j *JobRunner) cleanupRoutine() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			j.mu.Lock()
+			for id, jb := range j.jobs {
+				if !jb.expires.IsZero() && now.After(jb.expires) {
+					delete(j.jobs, id)
+				}
+			}
+			j.mu.Unlock()
+		}
+	}
+}
+
+type JobResponseSuccess struct {
+	Status string `json:"status"`
+	JobStatus
+}
+
+// Queues a /api/text request as a job. The request is checked, and its altcha verified, before it
+// is queued. The response is the id of the job to poll.
+func (rt *router) submitTextJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req, lang, ok := rt.decodeTextRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// The job outlives the request, it keeps a copy
+	jobRequest := r.Clone(context.WithoutCancel(r.Context()))
+	id, err := rt.jobs.Submit(r.Context(), func(ctx context.Context, w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		rt.writeLetter(w, jobRequest.WithContext(ctx), req, lang)
+	})
+	if writeRateLimited(w, err) {
+		return
+	}
+	if errors.Is(err, ErrJobQueueFull) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to queue job"})
+		slog.ErrorContext(r.Context(), "failed to queue job", "err", err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/jobs/"+id)
+	w.WriteHeader(http.StatusAccepted)
+	status, _ := rt.jobs.Get(id)
+	_ = json.NewEncoder(w).Encode(JobResponseSuccess{Status: statusSuccess, JobStatus: status})
+}
+
+// Returns the state of a job, and its result once it finished
+func (rt *router) jobStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	status, ok := rt.jobs.Get(r.PathValue("id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "job not found"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(JobResponseSuccess{Status: statusSuccess, JobStatus: status})
+}
+
+// Cancels a queued or running job
+func (rt *router) cancelJob(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id := r.PathValue("id")
+	if !rt.jobs.Cancel(id) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "job not found"})
+		return
+	}
+	status, _ := rt.jobs.Get(id)
+	_ = json.NewEncoder(w).Encode(JobResponseSuccess{Status: statusSuccess, JobStatus: status})
+}
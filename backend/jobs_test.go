@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitForJob polls a job until it is no longer queued or running
+func waitForJob(t *testing.T, j *JobRunner, id string) JobStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, ok := j.Get(id)
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if status.State != JobQueued && status.State != JobRunning {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return JobStatus{}
+}
+
+func newTestJobRunner(t *testing.T, workers int) *JobRunner {
+	j := NewJobRunner(workers)
+	t.Cleanup(j.Stop)
+	return j
+}
+
+func TestJobRunnerResults(t *testing.T) {
+	j := newTestJobRunner(t, 2)
+
+	tests := []struct {
+		run    func(ctx context.Context, w http.ResponseWriter)
+		state  JobState
+		status int
+		result string
+	}{
+		{func(ctx context.Context, w http.ResponseWriter) { _, _ = w.Write([]byte(`{"content":"letter"}`)) }, JobSucceeded, http.StatusOK, `{"content":"letter"}`},
+		{func(ctx context.Context, w http.ResponseWriter) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"message":"invalid altcha"}`))
+		}, JobFailed, http.StatusForbidden, `{"message":"invalid altcha"}`},
+		{func(ctx context.Context, w http.ResponseWriter) { panic("boom") }, JobFailed, http.StatusInternalServerError, `{"status":"error","message":"job failed"}` + "\n"},
+	}
+	for _, test := range tests {
+		id, err := j.Submit(context.Background(), test.run)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := waitForJob(t, j, id)
+		if status.State != test.state || status.ResultStatus != test.status || string(status.Result) != test.result {
+			t.Errorf("expected %s %d %s, got %+v", test.state, test.status, test.result, status)
+		}
+	}
+
+	if _, ok := j.Get("missing"); ok {
+		t.Fatal("expected no job")
+	}
+}
+
+func TestJobRunnerCancel(t *testing.T) {
+	j := newTestJobRunner(t, 1)
+
+	started := make(chan struct{})
+	running, err := j.Submit(context.Background(), func(ctx context.Context, w http.ResponseWriter) {
+		close(started)
+		<-ctx.Done()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := false
+	queued, err := j.Submit(context.Background(), func(ctx context.Context, w http.ResponseWriter) { ran = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	if status, _ := j.Get(queued); status.State != JobQueued {
+		t.Fatalf("expected the second job to wait for the only worker, got %s", status.State)
+	}
+	if !j.Cancel(queued) || !j.Cancel(running) {
+		t.Fatal("expected the jobs to be canceled")
+	}
+	if j.Cancel("missing") {
+		t.Fatal("expected no job to cancel")
+	}
+
+	// A job submitted after them runs once the canceled job returned
+	done, err := j.Submit(context.Background(), func(ctx context.Context, w http.ResponseWriter) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, j, done)
+	for _, id := range []string{queued, running} {
+		if status, _ := j.Get(id); status.State != JobCanceled || status.Result != nil {
+			t.Errorf("expected job %s to stay canceled, got %+v", id, status)
+		}
+	}
+	if ran {
+		t.Fatal("expected the canceled queued job not to run")
+	}
+}
+
+func TestJobRunnerQueueFull(t *testing.T) {
+	// Without workers every job stays queued
+	j := newTestJobRunner(t, 0)
+	for range maxQueuedJobs {
+		if _, err := j.Submit(context.Background(), func(ctx context.Context, w http.ResponseWriter) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := j.Submit(context.Background(), func(ctx context.Context, w http.ResponseWriter) {}); !errors.Is(err, ErrJobQueueFull) {
+		t.Fatalf("expected ErrJobQueueFull, got %v", err)
+	}
+}
+
+func TestTextJobHandlers(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+	r := router{ip: &promptRecordingProvider{}, altcha: altchaService, jobs: newTestJobRunner(t, 1)}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"altcha":  altchaToken,
+		"answers": map[string]string{"mainProblem": "no heat"},
+	})
+	w := httptest.NewRecorder()
+	r.submitTextJob(w, httptest.NewRequest(http.MethodPost, "/api/jobs/text", bytes.NewReader(body)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	var submitted JobResponseSuccess
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if submitted.ID == "" || w.Header().Get("Location") != "/api/jobs/"+submitted.ID {
+		t.Fatalf("unexpected job %+v", submitted)
+	}
+	waitForJob(t, r.jobs, submitted.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/jobs/"+submitted.ID, nil)
+	req.SetPathValue("id", submitted.ID)
+	w = httptest.NewRecorder()
+	r.jobStatus(w, req)
+	var status JobResponseSuccess
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	var letter TextResponseSuccess
+	if err := json.Unmarshal(status.Result, &letter); err != nil {
+		t.Fatalf("decode of result failed: %v", err)
+	}
+	if status.State != JobSucceeded || status.ResultStatus != http.StatusOK || letter.Text == "" {
+		t.Fatalf("expected the letter, got %+v", status)
+	}
+
+	// The altcha is checked before the job is queued, and can not be used twice
+	w = httptest.NewRecorder()
+	r.submitTextJob(w, httptest.NewRequest(http.MethodPost, "/api/jobs/text", bytes.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	for _, handler := range []http.HandlerFunc{r.jobStatus, r.cancelJob} {
+		req := httptest.NewRequest(http.MethodGet, "/api/jobs/missing", nil)
+		req.SetPathValue("id", "missing")
+		w = httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected %d, got %d", http.StatusNotFound, w.Code)
+		}
+	}
+}
+
+func TestJobRunnerQueuePosition(t *testing.T) {
+	// Without workers every job stays queued
+	j := newTestJobRunner(t, 0)
+	var ids []string
+	for _, client := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		id, err := j.Submit(WithQueueClient(context.Background(), client), func(ctx context.Context, w http.ResponseWriter) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		if status, _ := j.Get(id); status.QueuePosition != i+1 {
+			t.Fatalf("expected job %d at %d, got %d", i, i+1, status.QueuePosition)
+		}
+	}
+
+	// A client may only have one job waiting
+	if _, err := j.Submit(WithQueueClient(context.Background(), "192.0.2.1"), func(ctx context.Context, w http.ResponseWriter) {}); !errors.Is(err, ErrAlreadyQueued) {
+		t.Fatalf("expected ErrAlreadyQueued, got %v", err)
+	}
+
+	j.Cancel(ids[0])
+	if status, _ := j.Get(ids[2]); status.QueuePosition != 2 {
+		t.Fatalf("expected the queue to move up, got %d", status.QueuePosition)
+	}
+	if status, _ := j.Get(ids[0]); status.QueuePosition != 0 {
+		t.Fatalf("expected no position for a canceled job, got %d", status.QueuePosition)
+	}
+	if _, err := j.Submit(WithQueueClient(context.Background(), "192.0.2.1"), func(ctx context.Context, w http.ResponseWriter) {}); err != nil {
+		t.Fatalf("expected the client to queue again once its job was canceled, got %v", err)
+	}
+}
@@ -6,35 +6,104 @@ import (
 	_ "embed"
 	"encoding/json"
 	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
 )
 
 type LetterParams struct {
-	SenderName       string `json:"sender_name"`
-	SenderAddress    string `json:"sender_address"`
-	SenderCity       string `json:"sender_city"`
-	SenderState      string `json:"sender_state"`
-	SenderZip        string `json:"sender_zip"`
-	ReceiverName     string `json:"receiver_name"`
-	ReceiverAddress  string `json:"receiver_address"`
-	ReceiverCity     string `json:"receiver_city"`
-	ReceiverState    string `json:"receiver_state"`
-	ReceiverZip      string `json:"receiver_zip"`
-	ComplaintSummary string `json:"complaint_summary"`
-	LetterContent    string `json:"letter_content"`
-	Date             string `json:"date"`
+	Sender           LetterAddress `json:"sender"`
+	Receiver         LetterAddress `json:"receiver"`
+	ComplaintSummary string        `json:"complaint_summary"`
+	// Letter body parsed with ParseRichText
+	LetterContent []RichBlock `json:"letter_content"`
+	Date          string      `json:"date"`
+	// Path of the signature image within the assets directory
+	SignatureImage string `json:"signature_image,omitempty"`
+	// Date of the earlier letter a second notice follows up on, printed as "Re: my letter dated"
+	PreviousLetterDate string `json:"previous_letter_date,omitempty"`
+	// Date the problem should be solved by, formatted by ParseDeadlineDate
+	Deadline string `json:"deadline,omitempty"`
+	// Wording and citations of the rule pack of the receiver's jurisdiction
+	Jurisdiction *LetterJurisdiction `json:"jurisdiction,omitempty"`
+	// Photos appended after the letter
+	Exhibits []LetterExhibit `json:"exhibits,omitempty"`
+	// Copy of the letter in the tenant's language, appended after the exhibits
+	Translation *LetterTranslation `json:"translation,omitempty"`
+}
+
+// LetterTranslation is the translated copy of a letter. It is labelled as being for the tenant's
+// records and not sent to the landlord.
+type LetterTranslation struct {
+	// ISO 639-1 code of the language
+	Lang string `json:"lang"`
+	// English name of the language
+	Language string `json:"language"`
+	// Label of the page in the language itself
+	Notice  string      `json:"notice"`
+	Content []RichBlock `json:"content"`
+}
+
+// LetterAddress is the name and postal address of the sender or receiver of a letter. Optional
+// lines are left out of the letter when empty.
+type LetterAddress struct {
+	Name    string `json:"name"`
+	Company string `json:"company,omitempty"`
+	Line1   string `json:"line1"`
+	// Apartment, unit or suite
+	Line2 string `json:"line2,omitempty"`
+	City  string `json:"city"`
+	State string `json:"state"`
+	Zip   string `json:"zip"`
+	Phone string `json:"phone,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+type LetterExhibit struct {
+	Label   string `json:"label"`
+	Caption string `json:"caption"`
+	// Path of the image within the assets directory
+	Image string `json:"image"`
+}
+
+// LetterAsset is a file made available to the template, such as a signature image. Assets are
+// written to a private directory which typst is only allowed to read from.
+type LetterAsset struct {
+	Name string
+	Data []byte
 }
 
 //go:embed letter-template.typst
 var letterTemplate []byte
 
-func RenderPdf(ctx context.Context, params LetterParams) ([]byte, error) {
+func RenderPdf(ctx context.Context, params LetterParams, assets ...LetterAsset) ([]byte, error) {
 	p, err := json.Marshal(params)
 	if err != nil {
 		return nil, err
 	}
 
-	cmd := exec.CommandContext(ctx, "typst-wrapper", string(p))
+	args := []string{string(p)}
+	if len(assets) > 0 {
+		dir, err := os.MkdirTemp("", "letter-assets-")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := os.RemoveAll(dir); err != nil {
+				slog.ErrorContext(ctx, "failed to remove letter assets", "err", err)
+			}
+		}()
+
+		for _, a := range assets {
+			// Asset names are chosen by the backend, never by the user
+			if err := os.WriteFile(filepath.Join(dir, filepath.Base(a.Name)), a.Data, 0o600); err != nil {
+				return nil, err
+			}
+		}
+		args = append(args, dir)
+	}
+
+	cmd := exec.CommandContext(ctx, "typst-wrapper", args...)
 
 	in, err := cmd.StdinPipe()
 	if err != nil {
@@ -63,12 +63,16 @@ func TestRenderPdfWithDirectiveLikeContentDoesNotExecute(t *testing.T) {
 
 	for i, payload := range malicious {
 		params := LetterParams{
-			SenderName:       "Alice #set text(72pt) " + payload,
-			SenderAddress:    `123 Fake St [#link("https://evil")[x]] ` + payload,
-			ReceiverName:     "Bob #show: something " + payload,
-			ReceiverAddress:  `456 Real Rd ] #set page(paper: "a0") [ ` + payload,
+			Sender: LetterAddress{
+				Name:  "Alice #set text(72pt) " + payload,
+				Line1: `123 Fake St [#link("https://evil")[x]] ` + payload,
+			},
+			Receiver: LetterAddress{
+				Name:  "Bob #show: something " + payload,
+				Line1: `456 Real Rd ] #set page(paper: "a0") [ ` + payload,
+			},
 			ComplaintSummary: `Notice: ` + payload,
-			LetterContent:    `Body start: ` + payload + ` :Body end.`,
+			LetterContent:    ParseRichText(`Body start: ` + payload + ` :Body end.`),
 			Date:             `2025-09-30 #set text(200pt) ` + payload,
 		}
 
@@ -153,12 +157,19 @@ func TestRenderPdfWithSpecialCharsQuotingAndEscaping(t *testing.T) {
 	ctx := context.Background()
 
 	params := LetterParams{
-		SenderName:       `Alice "O'Connor" \ # { } [ ] ( ) < > &`,
-		SenderAddress:    "123 \"Quote\" Lane\nApt #5\nCity, ST 12345",
-		ReceiverName:     `Bob "The Builder"`,
-		ReceiverAddress:  "456 'Apostrophe' Rd",
+		Sender: LetterAddress{
+			Name:  `Alice "O'Connor" \ # { } [ ] ( ) < > &`,
+			Line1: "123 \"Quote\" Lane\nApt #5\nCity, ST 12345",
+			Line2: "Unit [#5]",
+			Email: "alice+#tag@example.com",
+		},
+		Receiver: LetterAddress{
+			Name:    `Bob "The Builder"`,
+			Company: `Builder & "Sons" LLC`,
+			Line1:   "456 'Apostrophe' Rd",
+		},
 		ComplaintSummary: `Subject: <bold>& "weird" #stuff`,
-		LetterContent:    "Hello,\n\nThis line has JSON-breaking chars: \" \\ / # [ ] { } < > &\n\nThanks,\nAlice",
+		LetterContent:    ParseRichText("Hello,\n\nThis line has JSON-breaking chars: \" \\ / # [ ] { } < > &\n\nThanks,\nAlice"),
 		Date:             "2025-09-30",
 	}
 
@@ -224,3 +235,22 @@ func TestRenderPdfWithSpecialCharsQuotingAndEscaping(t *testing.T) {
 	}
 
 }
+
+// Paragraphs without text and lists numbered from 0 used to leave out fields the template reads
+func TestRenderPdfWithEmptyParagraphAndZeroStartList(t *testing.T) {
+	for _, body := range []string{"****", "0. First\n1. Second"} {
+		params := LetterParams{
+			Sender:        LetterAddress{Name: "Alice"},
+			Receiver:      LetterAddress{Name: "Bob"},
+			LetterContent: ParseRichText(body),
+			Date:          "2025-09-30",
+		}
+		pdf, err := RenderPdf(context.Background(), params)
+		if err != nil {
+			t.Fatalf("%q: failed to render: %v", body, err)
+		}
+		if len(pdf) == 0 {
+			t.Fatalf("%q: returned empty PDF", body)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrLobApiKeyNotDefined     = errors.New("environment variable LOB_API_KEY is not defined")
+	ErrLobBasePriceNotDefined  = errors.New("environment variable LOB_BASE_PRICE_CENTS is not defined")
+	ErrLobPagePriceNotDefined  = errors.New("environment variable LOB_PAGE_PRICE_CENTS is not defined")
+	ErrLobUnexpectedStatusCode = errors.New("unexpected status code from Lob")
+)
+
+// Ids of Lob letters. Ids are checked before being put in a request made with the API key.
+var lobLetterIDPattern = regexp.MustCompile(`^ltr_[A-Za-z0-9]+$`)
+
+// Lob sends letters through the Lob print and mail API.
+type Lob struct {
+	client  *http.Client
+	baseUrl string
+	apiKey  string
+	// Lob does not expose prices through its API, they depend on the account's contract
+	basePriceCents int64
+	pagePriceCents int64
+}
+
+var _ MailProvider = (*Lob)(nil)
+
+// NewLob creates a Lob mail provider. Configure it using environment variables:
+//   - LOB_API_KEY: Secret API key of the Lob account
+//   - LOB_BASE_PRICE_CENTS: Price of a certified letter, in cents
+//   - LOB_PAGE_PRICE_CENTS: Price of each page, in cents
+//   - LOB_BASE_URL: Base URL of the API (default: https://api.lob.com)
+func NewLob() (*Lob, error) {
+	apiKey := os.Getenv("LOB_API_KEY")
+	if apiKey == "" {
+		return nil, ErrLobApiKeyNotDefined
+	}
+
+	basePrice, err := strconv.ParseInt(os.Getenv("LOB_BASE_PRICE_CENTS"), 10, 64)
+	if err != nil {
+		return nil, ErrLobBasePriceNotDefined
+	}
+
+	pagePrice, err := strconv.ParseInt(os.Getenv("LOB_PAGE_PRICE_CENTS"), 10, 64)
+	if err != nil {
+		return nil, ErrLobPagePriceNotDefined
+	}
+
+	baseUrl := os.Getenv("LOB_BASE_URL")
+	if baseUrl == "" {
+		baseUrl = "https://api.lob.com"
+	}
+
+	return &Lob{
+		client:         &http.Client{Timeout: 30 * time.Second},
+		baseUrl:        baseUrl,
+		apiKey:         apiKey,
+		basePriceCents: basePrice,
+		pagePriceCents: pagePrice,
+	}, nil
+}
+
+func init() {
+	mailProviders["lob"] = func() (MailProvider, error) {
+		return NewLob()
+	}
+}
+
+type lobLetter struct {
+	ID                   string `json:"id"`
+	TrackingNumber       string `json:"tracking_number"`
+	ExpectedDeliveryDate string `json:"expected_delivery_date"`
+	TrackingEvents       []struct {
+		Name     string    `json:"name"`
+		Time     time.Time `json:"time"`
+		Location string    `json:"location"`
+	} `json:"tracking_events"`
+}
+
+func (l *Lob) Quote(ctx context.Context, m Mailing) (MailQuote, error) {
+	pages := countPdfPages(m.Pdf)
+	sheets := pages
+	if m.Duplex {
+		sheets = (pages + 1) / 2
+	}
+
+	return MailQuote{PriceCents: l.basePriceCents + l.pagePriceCents*int64(sheets), Pages: pages}, nil
+}
+
+func (l *Lob) CreateMailing(ctx context.Context, m Mailing) (MailReceipt, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	fields := [][2]string{
+		{"description", m.LetterName},
+		{"color", "false"},
+		{"double_sided", strconv.FormatBool(m.Duplex)},
+		{"extra_service", "certified"},
+		{"use_type", "operational"},
+		// The letter is not laid out for a windowed envelope, so Lob adds an address page
+		{"address_placement", "insert_blank_page"},
+	}
+	for prefix, a := range map[string]LetterAddress{"to": m.Destination, "from": m.Sender} {
+		fields = append(fields,
+			[2]string{prefix + "[name]", a.Name},
+			[2]string{prefix + "[address_line1]", a.Line1},
+			[2]string{prefix + "[address_city]", a.City},
+			[2]string{prefix + "[address_state]", a.State},
+			[2]string{prefix + "[address_zip]", a.Zip},
+		)
+		if a.Line2 != "" {
+			fields = append(fields, [2]string{prefix + "[address_line2]", a.Line2})
+		}
+		if a.Company != "" {
+			fields = append(fields, [2]string{prefix + "[company]", a.Company})
+		}
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return MailReceipt{}, err
+		}
+	}
+
+	fw, err := mw.CreateFormFile("file", "letter.pdf")
+	if err != nil {
+		return MailReceipt{}, err
+	}
+	if _, err := fw.Write(m.Pdf); err != nil {
+		return MailReceipt{}, err
+	}
+	if err := mw.Close(); err != nil {
+		return MailReceipt{}, err
+	}
+
+	var letter lobLetter
+	if err := l.do(ctx, http.MethodPost, "/v1/letters", mw.FormDataContentType(), &body, &letter); err != nil {
+		return MailReceipt{}, fmt.Errorf("failed to create Lob letter: %w", err)
+	}
+
+	return MailReceipt{
+		ID:               letter.ID,
+		TrackingNumber:   letter.TrackingNumber,
+		ExpectedDelivery: letter.ExpectedDeliveryDate,
+	}, nil
+}
+
+func (l *Lob) TrackingStatus(ctx context.Context, id string) (MailTracking, error) {
+	if !lobLetterIDPattern.MatchString(id) {
+		return MailTracking{}, ErrMailingNotFound
+	}
+
+	var letter lobLetter
+	if err := l.do(ctx, http.MethodGet, "/v1/letters/"+url.PathEscape(id), "", nil, &letter); err != nil {
+		return MailTracking{}, err
+	}
+
+	tracking := MailTracking{
+		ID:             letter.ID,
+		TrackingNumber: letter.TrackingNumber,
+		Events:         make([]MailTrackingEvent, 0, len(letter.TrackingEvents)),
+	}
+	for _, e := range letter.TrackingEvents {
+		tracking.Events = append(tracking.Events, MailTrackingEvent{Name: e.Name, Time: e.Time, Location: e.Location})
+	}
+
+	return tracking, nil
+}
+
+func (l *Lob) do(ctx context.Context, method, path, contentType string, body io.Reader, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, l.baseUrl+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(l.apiKey, "")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			slog.ErrorContext(ctx, "Failed to close response body", "err", closeErr)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrMailingNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w %d: %s", ErrLobUnexpectedStatusCode, resp.StatusCode, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestLob(t *testing.T, handler http.HandlerFunc) *Lob {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	t.Setenv("LOB_API_KEY", "test_key")
+	t.Setenv("LOB_BASE_PRICE_CENTS", "700")
+	t.Setenv("LOB_PAGE_PRICE_CENTS", "60")
+	t.Setenv("LOB_BASE_URL", server.URL)
+
+	lob, err := NewLob()
+	if err != nil {
+		t.Fatalf("failed to create Lob provider: %v", err)
+	}
+	return lob
+}
+
+func TestNewLobMissingApiKey(t *testing.T) {
+	t.Setenv("LOB_API_KEY", "")
+
+	if _, err := NewLob(); !errors.Is(err, ErrLobApiKeyNotDefined) {
+		t.Fatalf("expected ErrLobApiKeyNotDefined, got %v", err)
+	}
+}
+
+func TestLobCreateMailing(t *testing.T) {
+	lob := newTestLob(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/letters" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if user, _, _ := r.BasicAuth(); user != "test_key" {
+			t.Errorf("expected api key as basic auth user, got %q", user)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatalf("failed to parse form: %v", err)
+		}
+		for field, want := range map[string]string{
+			"extra_service":       "certified",
+			"to[name]":            "Landlord",
+			"to[company]":         "Property LLC",
+			"from[address_zip]":   "43210",
+			"from[address_city]":  "Columbus",
+			"from[address_line2]": "Apt 2",
+		} {
+			if got := r.FormValue(field); got != want {
+				t.Errorf("expected %s to be %q, got %q", field, want, got)
+			}
+		}
+		if _, _, err := r.FormFile("file"); err != nil {
+			t.Errorf("expected pdf file: %v", err)
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"id":                     "ltr_123",
+			"tracking_number":        "9407",
+			"expected_delivery_date": "2025-10-08",
+		})
+	})
+
+	receipt, err := lob.CreateMailing(context.Background(), Mailing{
+		LetterName:  "Repair request",
+		Pdf:         minimalPdf(),
+		Sender:      LetterAddress{Name: "Tenant", Line1: "123 Main St", Line2: "Apt 2", City: "Columbus", State: "OH", Zip: "43210"},
+		Destination: LetterAddress{Name: "Landlord", Company: "Property LLC", Line1: "456 High St", City: "Columbus", State: "OH", Zip: "43215"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create mailing: %v", err)
+	}
+	if receipt.ID != "ltr_123" || receipt.TrackingNumber != "9407" || receipt.ExpectedDelivery != "2025-10-08" {
+		t.Fatalf("unexpected receipt %+v", receipt)
+	}
+}
+
+func TestLobTrackingStatus(t *testing.T) {
+	lob := newTestLob(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/letters/ltr_missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"ltr_123","tracking_number":"9407","tracking_events":[{"name":"In Transit","time":"2025-10-06T10:00:00Z","location":"COLUMBUS, OH"}]}`))
+	})
+
+	tracking, err := lob.TrackingStatus(context.Background(), "ltr_123")
+	if err != nil {
+		t.Fatalf("failed to get tracking: %v", err)
+	}
+	if len(tracking.Events) != 1 || tracking.Events[0].Name != "In Transit" {
+		t.Fatalf("unexpected tracking %+v", tracking)
+	}
+
+	if _, err := lob.TrackingStatus(context.Background(), "ltr_missing"); !errors.Is(err, ErrMailingNotFound) {
+		t.Fatalf("expected ErrMailingNotFound, got %v", err)
+	}
+}
+
+func TestLobTrackingStatusRejectsInvalidID(t *testing.T) {
+	lob := newTestLob(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("invalid ids should not call the API, got %s", r.URL)
+	})
+
+	for _, id := range []string{"", "ltr_", "../v1/addresses", "ltr_123/../../v1/account", "ltr_123?limit=100", "psc_123"} {
+		if _, err := lob.TrackingStatus(context.Background(), id); !errors.Is(err, ErrMailingNotFound) {
+			t.Fatalf("%q: expected ErrMailingNotFound, got %v", id, err)
+		}
+	}
+}
+
+func TestLobQuote(t *testing.T) {
+	lob := newTestLob(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("quotes should not call the API")
+	})
+
+	quote, err := lob.Quote(context.Background(), Mailing{Pdf: minimalPdf()})
+	if err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	if quote.PriceCents != 760 {
+		t.Fatalf("expected 760 cents, got %d", quote.PriceCents)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidLocaleConfig = errors.New("invalid locale config")
+)
+
+// The sections of app-config.yaml holding user facing copy. Only these are served by /api/config,
+// the inference prompts stay on the server.
+var uiConfigSections = []string{"app", "introPage", "termsOfServicePage", "formPages", "common", "submittedPage"}
+
+// The top level sections are written in English, which every other locale falls back to
+const defaultLocale = "en"
+
+// Keys every locale has to translate. Users agree to the legal text, so it must never silently fall
+// back to English.
+var requiredLocaleKeys = []string{"app.legalDisclaimers", "termsOfServicePage.terms"}
+
+// Keys which are part of the form's wire contract rather than copy: the names answers are sent
+// under, which questions are required and how pages are ordered and styled. They are the same in
+// every locale.
+var structuralConfigKeys = map[string]bool{"name": true, "required": true, "pageNumber": true, "tipType": true}
+
+// BCP 47 style tags such as "es" or "pt-BR"
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// LocalizedConfig holds the user facing copy of every locale, with untranslated keys filled in from
+// English.
+type LocalizedConfig struct {
+	locales map[string]map[string]any
+}
+
+var localizedConfig *LocalizedConfig
+
+func init() {
+	data, err := os.ReadFile("app-config.yaml")
+	if err != nil {
+		panic(err)
+	}
+	localizedConfig, err = ParseLocalizedConfig(data)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ParseLocalizedConfig reads the English copy and the "locales" tables of app-config.yaml. Each
+// locale table has the same structure as the English sections but only needs the keys it
+// translates. A key which does not exist in English, or a missing required key, is an error.
+func ParseLocalizedConfig(data []byte) (*LocalizedConfig, error) {
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	english := make(map[string]any)
+	for _, section := range uiConfigSections {
+		if v, ok := raw[section]; ok {
+			english[section] = v
+		}
+	}
+
+	c := &LocalizedConfig{locales: map[string]map[string]any{defaultLocale: english}}
+
+	tables, _ := raw["locales"].(map[string]any)
+	for locale, table := range tables {
+		if !localePattern.MatchString(locale) {
+			return nil, fmt.Errorf("%w: %q is not a locale", ErrInvalidLocaleConfig, locale)
+		}
+		locale = strings.ToLower(locale)
+		if _, ok := c.locales[locale]; ok {
+			return nil, fmt.Errorf("%w: locale %q is defined twice", ErrInvalidLocaleConfig, locale)
+		}
+
+		if err := validateLocaleTable(english, table, ""); err != nil {
+			return nil, fmt.Errorf("%w: locale %q: %w", ErrInvalidLocaleConfig, locale, err)
+		}
+		for _, key := range requiredLocaleKeys {
+			if v, ok := lookupConfigKey(table, key); !ok || v == nil {
+				return nil, fmt.Errorf("%w: locale %q is missing the required key %s", ErrInvalidLocaleConfig, locale, key)
+			}
+		}
+
+		c.locales[locale] = mergeLocaleTable(english, table).(map[string]any)
+	}
+
+	return c, nil
+}
+
+// validateLocaleTable checks that every key of a locale table exists in English with the same
+// kind of value, and that only display copy is translated: text which is not one of the
+// structuralConfigKeys.
+func validateLocaleTable(english, table any, path string) error {
+	switch t := table.(type) {
+	case nil:
+		// Left empty, so the English value is used
+	case map[string]any:
+		e, ok := english.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s should not be a mapping", path)
+		}
+		for key, v := range t {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			ev, ok := e[key]
+			if !ok {
+				return fmt.Errorf("%s does not exist in the English config", keyPath)
+			}
+			if structuralConfigKeys[key] && v != nil {
+				return fmt.Errorf("%s is not display copy and cannot be translated", keyPath)
+			}
+			if err := validateLocaleTable(ev, v, keyPath); err != nil {
+				return err
+			}
+		}
+	case []any:
+		e, ok := english.([]any)
+		if !ok {
+			return fmt.Errorf("%s should not be a list", path)
+		}
+		if len(t) > len(e) {
+			return fmt.Errorf("%s has more items than the English config", path)
+		}
+		for i, v := range t {
+			if err := validateLocaleTable(e[i], v, path+"."+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		switch english.(type) {
+		case map[string]any:
+			return fmt.Errorf("%s should be a mapping", path)
+		case []any:
+			return fmt.Errorf("%s should be a list", path)
+		case string:
+			if _, ok := t.(string); !ok {
+				return fmt.Errorf("%s should be text", path)
+			}
+		default:
+			return fmt.Errorf("%s is not display copy and cannot be translated", path)
+		}
+	}
+	return nil
+}
+
+// mergeLocaleTable returns a copy of the English config with the translated values of a locale
+// table. Lists are merged item by item, so a translation can follow the English form pages.
+func mergeLocaleTable(english, table any) any {
+	switch e := english.(type) {
+	case map[string]any:
+		t, _ := table.(map[string]any)
+		out := make(map[string]any, len(e))
+		for key, v := range e {
+			if tv, ok := t[key]; ok {
+				out[key] = mergeLocaleTable(v, tv)
+			} else {
+				out[key] = v
+			}
+		}
+		return out
+	case []any:
+		t, _ := table.([]any)
+		out := make([]any, len(e))
+		for i, v := range e {
+			if i < len(t) && t[i] != nil {
+				out[i] = mergeLocaleTable(v, t[i])
+			} else {
+				out[i] = v
+			}
+		}
+		return out
+	default:
+		if table == nil {
+			return english
+		}
+		return table
+	}
+}
+
+// lookupConfigKey finds a dotted key such as "termsOfServicePage.terms"
+func lookupConfigKey(table any, key string) (any, bool) {
+	for part := range strings.SplitSeq(key, ".") {
+		m, ok := table.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if table, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return table, true
+}
+
+// Locales returns the supported locales, sorted
+func (c *LocalizedConfig) Locales() []string {
+	locales := make([]string, 0, len(c.locales))
+	for locale := range c.locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Get returns the user facing config of a supported locale
+func (c *LocalizedConfig) Get(locale string) map[string]any {
+	return c.locales[locale]
+}
+
+// Negotiate picks the locale to serve. An explicitly requested locale is preferred, then the
+// languages of an Accept-Language header in order of preference, and finally English. A regional
+// locale such as "es-MX" falls back to its language when only "es" is supported.
+func (c *LocalizedConfig) Negotiate(requested, acceptLanguage string) string {
+	if locale, ok := c.match(requested); ok {
+		return locale
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var prefs []weighted
+	for part := range strings.SplitSeq(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if tag != "" && q > 0 {
+			prefs = append(prefs, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	for _, p := range prefs {
+		if p.tag == "*" {
+			return defaultLocale
+		}
+		if locale, ok := c.match(p.tag); ok {
+			return locale
+		}
+	}
+
+	return defaultLocale
+}
+
+func (c *LocalizedConfig) match(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", false
+	}
+	if _, ok := c.locales[tag]; ok {
+		return tag, true
+	}
+	// "es-mx" matches "es", and "pt" matches "pt-br"
+	base, _, _ := strings.Cut(tag, "-")
+	locales := c.Locales()
+	if slices.Contains(locales, base) {
+		return base, true
+	}
+	for _, locale := range locales {
+		if strings.HasPrefix(locale, base+"-") {
+			return locale, true
+		}
+	}
+	return "", false
+}
+
+type ConfigResponseSuccess struct {
+	Status string `json:"status"`
+	// The negotiated locale
+	Locale string `json:"locale"`
+	// All supported locales
+	Locales []string       `json:"locales"`
+	Config  map[string]any `json:"config"`
+}
+
+// Returns the user facing copy of app-config.yaml in the locale requested with ?locale= or
+// negotiated from the Accept-Language header
+func appConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept-Language")
+
+	locale := localizedConfig.Negotiate(r.URL.Query().Get("locale"), r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Language", locale)
+
+	_ = json.NewEncoder(w).Encode(ConfigResponseSuccess{
+		Status:  statusSuccess,
+		Locale:  locale,
+		Locales: localizedConfig.Locales(),
+		Config:  localizedConfig.Get(locale),
+	})
+}
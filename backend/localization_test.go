@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testLocaleConfig = `
+app:
+  title: Tenant Tool
+  legalDisclaimers:
+    - heading: Not Legal Advice
+      description: This is not legal advice.
+termsOfServicePage:
+  heading: Terms of Service
+  terms: The terms.
+formPages:
+  - title: First page
+    questions:
+      - name: mainProblem
+        label: What is wrong?
+        placeholder: Describe the problem
+        required: true
+  - title: Second page
+common:
+  backButton: Back
+inference:
+  systemPrompt: secret prompt
+locales:
+  es:
+    app:
+      legalDisclaimers:
+        - heading: No es asesoramiento legal
+          description: Esto no es asesoramiento legal.
+    termsOfServicePage:
+      terms: Los términos.
+    formPages:
+      - title: Primera página
+        questions:
+          - label: ¿Qué pasa?
+    common:
+      backButton: Atrás
+  pt-BR:
+    app:
+      legalDisclaimers: []
+    termsOfServicePage:
+      terms: Os termos.
+`
+
+func TestParseLocalizedConfigFallsBackToEnglish(t *testing.T) {
+	c, err := ParseLocalizedConfig([]byte(testLocaleConfig))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	if got := strings.Join(c.Locales(), ","); got != "en,es,pt-br" {
+		t.Fatalf("unexpected locales %s", got)
+	}
+
+	es := c.Get("es")
+	tests := map[string]any{
+		"app.title":                  "Tenant Tool",
+		"termsOfServicePage.terms":   "Los términos.",
+		"termsOfServicePage.heading": "Terms of Service",
+		"common.backButton":          "Atrás",
+	}
+	for key, want := range tests {
+		if got, _ := lookupConfigKey(es, key); got != want {
+			t.Errorf("expected %s to be %q, got %q", key, want, got)
+		}
+	}
+
+	pages := es["formPages"].([]any)
+	first := pages[0].(map[string]any)
+	question := first["questions"].([]any)[0].(map[string]any)
+	if first["title"] != "Primera página" || question["label"] != "¿Qué pasa?" || question["placeholder"] != "Describe the problem" {
+		t.Errorf("expected the first page to be merged with English, got %v", first)
+	}
+	if pages[1].(map[string]any)["title"] != "Second page" {
+		t.Errorf("expected the untranslated page to be English, got %v", pages[1])
+	}
+
+	if _, ok := es["inference"]; ok {
+		t.Error("expected the inference prompts not to be served")
+	}
+	if _, ok := c.Get("en")["inference"]; ok {
+		t.Error("expected the inference prompts not to be served")
+	}
+}
+
+func TestParseLocalizedConfigRejectsInvalidLocales(t *testing.T) {
+	base := strings.Split(testLocaleConfig, "locales:")[0]
+	tests := map[string]string{
+		"unknown key": `
+  es:
+    app:
+      legalDisclaimers: []
+      subtitle: Herramienta
+    termsOfServicePage:
+      terms: Los términos.`,
+		"missing required key": `
+  es:
+    common:
+      backButton: Atrás`,
+		"wrong kind": `
+  es:
+    app:
+      legalDisclaimers: No es asesoramiento legal
+    termsOfServicePage:
+      terms: Los términos.`,
+		"too many pages": `
+  es:
+    app:
+      legalDisclaimers: []
+    termsOfServicePage:
+      terms: Los términos.
+    formPages: [{}, {}, {}]`,
+		"renamed question": `
+  es:
+    app:
+      legalDisclaimers: []
+    termsOfServicePage:
+      terms: Los términos.
+    formPages:
+      - questions:
+          - name: problema`,
+		"required flag": `
+  es:
+    app:
+      legalDisclaimers: []
+    termsOfServicePage:
+      terms: Los términos.
+    formPages:
+      - questions:
+          - required: false`,
+		"invalid tag": `
+  spanish_language:
+    app:
+      legalDisclaimers: []
+    termsOfServicePage:
+      terms: Los términos.`,
+	}
+
+	for name, locales := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseLocalizedConfig([]byte(base + "locales:" + locales))
+			if !errors.Is(err, ErrInvalidLocaleConfig) {
+				t.Fatalf("expected ErrInvalidLocaleConfig, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	c, err := ParseLocalizedConfig([]byte(testLocaleConfig))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	tests := []struct {
+		requested      string
+		acceptLanguage string
+		want           string
+	}{
+		{"", "", "en"},
+		{"es", "pt-BR", "es"},
+		{"fr", "es-MX,es;q=0.9", "es"},
+		{"", "fr-FR, pt;q=0.8, es;q=0.5", "pt-br"},
+		{"", "es;q=0.2, en;q=0.9", "en"},
+		{"", "es;q=0, fr", "en"},
+		{"", "*", "en"},
+		{"", "es;q=bad", "en"},
+	}
+
+	for _, tt := range tests {
+		if got := c.Negotiate(tt.requested, tt.acceptLanguage); got != tt.want {
+			t.Errorf("Negotiate(%q, %q): expected %q, got %q", tt.requested, tt.acceptLanguage, tt.want, got)
+		}
+	}
+}
+
+func TestAppConfigHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+	req.Header.Set("Accept-Language", "so, en;q=0.5")
+	w := httptest.NewRecorder()
+
+	appConfig(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Language") != "en" || resp.Header.Get("Vary") != "Accept-Language" {
+		t.Fatalf("unexpected headers %v", resp.Header)
+	}
+
+	var result ConfigResponseSuccess
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Locale != "en" || result.Config["introPage"] == nil || result.Config["inference"] != nil {
+		t.Fatalf("unexpected config for locale %q", result.Locale)
+	}
+}
+
+// The Spanish fixture is served with the English copy of app-config.yaml, keeping the names of the
+// questions the answers are sent under
+func TestAppConfigHandlerServesLocale(t *testing.T) {
+	config, err := os.ReadFile("app-config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := os.ReadFile(filepath.Join("testdata", "locale-es.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(config, []byte("\nlocales: {}\n")) {
+		t.Fatal("expected app-config.yaml to have an empty locales table")
+	}
+	c, err := ParseLocalizedConfig(bytes.Replace(config, []byte("\nlocales: {}\n"), append([]byte("\n"), fixture...), 1))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+
+	english := localizedConfig
+	localizedConfig = c
+	defer func() { localizedConfig = english }()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+	req.Header.Set("Accept-Language", "es-MX, en;q=0.5")
+	w := httptest.NewRecorder()
+
+	appConfig(w, req)
+
+	resp := w.Result()
+	if resp.Header.Get("Content-Language") != "es" {
+		t.Fatalf("expected Spanish, got %q", resp.Header.Get("Content-Language"))
+	}
+	var result ConfigResponseSuccess
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if strings.Join(result.Locales, ",") != "en,es" {
+		t.Errorf("unexpected locales %v", result.Locales)
+	}
+
+	pages := result.Config["formPages"].([]any)
+	question := pages[0].(map[string]any)["questions"].([]any)[0].(map[string]any)
+	if question["name"] != "mainProblem" || question["required"] != true || question["label"] != "¿Qué problemas hay en su casa o apartamento?" {
+		t.Errorf("expected the translated question with its English name, got %v", question)
+	}
+	if backButton, _ := lookupConfigKey(result.Config, "submittedPage.backButton"); backButton != "Back" {
+		t.Errorf("expected untranslated copy to fall back to English, got %v", backButton)
+	}
+}
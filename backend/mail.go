@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMailingNotFound = errors.New("mailing not found")
+)
+
+// MailProvider defines the interface for any certified mail vendor. Providers are selected with the
+// MAIL_PROVIDER environment variable. The mail routes are disabled when it is not defined.
+type MailProvider interface {
+	// Returns the price of sending a letter without creating a mailing.
+	Quote(ctx context.Context, m Mailing) (MailQuote, error)
+	// Sends a letter by certified mail.
+	CreateMailing(ctx context.Context, m Mailing) (MailReceipt, error)
+	// Returns the delivery status of a mailing created with CreateMailing.
+	TrackingStatus(ctx context.Context, id string) (MailTracking, error)
+}
+
+var mailProviders map[string]func() (MailProvider, error) = make(map[string]func() (MailProvider, error))
+
+// Mailing is a rendered letter and the addresses to send it between.
+type Mailing struct {
+	LetterName  string
+	Pdf         []byte
+	Duplex      bool
+	Sender      LetterAddress
+	Destination LetterAddress
+}
+
+type MailQuote struct {
+	// Price in cents of US dollars
+	PriceCents int64 `json:"priceCents"`
+	Pages      int   `json:"pages"`
+}
+
+type MailReceipt struct {
+	ID             string `json:"id"`
+	TrackingNumber string `json:"trackingNumber,omitempty"`
+	// Date formatted as YYYY-MM-DD
+	ExpectedDelivery string `json:"expectedDelivery,omitempty"`
+}
+
+type MailTrackingEvent struct {
+	Name     string    `json:"name"`
+	Time     time.Time `json:"time"`
+	Location string    `json:"location,omitempty"`
+}
+
+type MailTracking struct {
+	ID             string              `json:"id"`
+	TrackingNumber string              `json:"trackingNumber,omitempty"`
+	Events         []MailTrackingEvent `json:"events"`
+}
+
+// mailingDigest identifies the addresses of a letter. Addresses are normalized first so that a
+// mailing only differing in case or abbreviations from the rendered letter is accepted.
+func mailingDigest(sender, receiver LetterAddress) string {
+	h := sha256.New()
+	for _, a := range []LetterAddress{sender, receiver} {
+		n := NormalizeAddress(a)
+		for _, line := range []string{n.Name, n.Company, n.Line1, n.Line2, n.City, n.State, n.Zip} {
+			h.Write([]byte(line))
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Counts the pages of a pdf to price a mailing. Only uncompressed page objects are counted,
+// which is how typst writes them.
+func countPdfPages(pdf []byte) int {
+	return len(pageTypePattern.FindAllIndex(pdf, -1))
+}
+
+// FakeMailProvider keeps mailings in memory. It is used for tests and local development.
+//
+// Mailings can be tracked by anyone knowing their id, so ids are random like those of real
+// providers rather than sequential.
+type FakeMailProvider struct {
+	mu       sync.Mutex
+	mailings map[string]fakeMailing
+}
+
+type fakeMailing struct {
+	Mailing
+	trackingNumber string
+	created        time.Time
+}
+
+var _ MailProvider = (*FakeMailProvider)(nil)
+
+func NewFakeMailProvider() *FakeMailProvider {
+	return &FakeMailProvider{mailings: make(map[string]fakeMailing)}
+}
+
+func (f *FakeMailProvider) Quote(ctx context.Context, m Mailing) (MailQuote, error) {
+	pages := countPdfPages(m.Pdf)
+	return MailQuote{PriceCents: 800 + 50*int64(pages), Pages: pages}, nil
+}
+
+func (f *FakeMailProvider) CreateMailing(ctx context.Context, m Mailing) (MailReceipt, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return MailReceipt{}, err
+	}
+	id := "fake_" + hex.EncodeToString(b)
+	// USPS tracking numbers are 22 digits
+	trackingNumber := "9400"
+	for _, c := range b[:9] {
+		trackingNumber += fmt.Sprintf("%02d", c%100)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mailings[id] = fakeMailing{Mailing: m, trackingNumber: trackingNumber, created: time.Now()}
+
+	return MailReceipt{
+		ID:               id,
+		TrackingNumber:   trackingNumber,
+		ExpectedDelivery: time.Now().AddDate(0, 0, 5).Format(time.DateOnly),
+	}, nil
+}
+
+func (f *FakeMailProvider) TrackingStatus(ctx context.Context, id string) (MailTracking, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mailing, ok := f.mailings[id]
+	if !ok {
+		return MailTracking{}, ErrMailingNotFound
+	}
+
+	return MailTracking{
+		ID:             id,
+		TrackingNumber: mailing.trackingNumber,
+		Events:         []MailTrackingEvent{{Name: "Mailed", Time: mailing.created}},
+	}, nil
+}
+
+func init() {
+	mailProviders["fake"] = func() (MailProvider, error) {
+		return NewFakeMailProvider(), nil
+	}
+}
+
+// The rendered pdf is sent base64 encoded along with the addresses, so these routes accept any pdf
+// which can be uploaded for verification
+const MaxMailRequestBodySize = (MaxPdfUploadSize+2)/3*4 + MaxRequestBodySize
+
+type MailRequest struct {
+	Altcha string `json:"altcha"`
+	// Base64 encoded content of the PDF file returned by /api/pdf
+	Pdf         string        `json:"pdf"`
+	LetterName  string        `json:"letterName"`
+	Duplex      bool          `json:"duplex"`
+	Sender      LetterAddress `json:"sender"`
+	Destination LetterAddress `json:"destination"`
+}
+
+type MailQuoteResponseSuccess struct {
+	Status string    `json:"status"`
+	Quote  MailQuote `json:"quote"`
+}
+
+type MailResponseSuccess struct {
+	Status  string      `json:"status"`
+	Mailing MailReceipt `json:"mailing"`
+}
+
+type MailTrackingResponseSuccess struct {
+	Status   string       `json:"status"`
+	Tracking MailTracking `json:"tracking"`
+}
+
+type MailResponseError struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// decodeMailing reads a MailRequest, writing an error response and returning false if it is invalid
+func (rt *router) decodeMailing(w http.ResponseWriter, r *http.Request) (MailRequest, Mailing, bool) {
+	if rt.mail == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "certified mail is not configured"})
+		return MailRequest{}, Mailing{}, false
+	}
+
+	var req MailRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxMailRequestBodySize)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "failed to decode body"})
+		slog.ErrorContext(r.Context(), "failed to decode body", "err", err)
+		return req, Mailing{}, false
+	}
+
+	pdf, err := base64.StdEncoding.DecodeString(req.Pdf)
+	if err != nil || !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "pdf is not a valid base64 encoded pdf"})
+		return req, Mailing{}, false
+	}
+
+	for _, a := range []LetterAddress{req.Sender, req.Destination} {
+		if a.Name == "" || a.Line1 == "" || a.City == "" || a.State == "" || a.Zip == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "sender and destination require a name, line1, city, state and zip"})
+			return req, Mailing{}, false
+		}
+	}
+
+	letterName := req.LetterName
+	if letterName == "" {
+		letterName = "Letter"
+	}
+
+	return req, Mailing{
+		LetterName:  letterName,
+		Pdf:         pdf,
+		Duplex:      req.Duplex,
+		Sender:      req.Sender,
+		Destination: req.Destination,
+	}, true
+}
+
+// Prices a certified mailing of a rendered letter
+func (rt *router) mailQuote(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, m, ok := rt.decodeMailing(w, r)
+	if !ok {
+		return
+	}
+
+	quote, err := rt.mail.Quote(r.Context(), m)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "failed to get quote"})
+		slog.ErrorContext(r.Context(), "failed to get quote", "err", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(MailQuoteResponseSuccess{Status: statusSuccess, Quote: quote})
+}
+
+// Sends a rendered letter by certified mail
+func (rt *router) createMailing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req, m, ok := rt.decodeMailing(w, r)
+	if !ok {
+		return
+	}
+
+	// Only letters signed by this server for these addresses are mailed, so that the mail account can
+	// not be used to send any document
+	if rt.signer == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "certified mail requires pdf signing to be configured"})
+		return
+	}
+	info, err := VerifyPdfSignature(m.Pdf, rt.signer.Roots())
+	if err != nil || !info.Valid || !info.CoversWholeDocument || !info.Trusted {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "pdf is not signed by this server"})
+		return
+	}
+	// Otherwise a letter signed for one landlord could be mailed to anyone
+	if info.MailingDigest != mailingDigest(m.Sender, m.Destination) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "sender and destination do not match the addresses of the signed letter"})
+		return
+	}
+
+	// Mailings cost money, so they are protected the same way as inference
+	ok, err = rt.altcha.Verify(req.Altcha)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "failed to verify altcha"})
+		slog.ErrorContext(r.Context(), "failed to verify altcha", "err", err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "invalid altcha"})
+		return
+	}
+
+	receipt, err := rt.mail.CreateMailing(r.Context(), m)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "failed to create mailing"})
+		slog.ErrorContext(r.Context(), "failed to create mailing", "err", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(MailResponseSuccess{Status: statusSuccess, Mailing: receipt})
+}
+
+// Returns the delivery status of a mailing
+func (rt *router) mailTracking(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if rt.mail == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "certified mail is not configured"})
+		return
+	}
+
+	tracking, err := rt.mail.TrackingStatus(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrMailingNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "mailing not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(MailResponseError{Status: statusError, Message: "failed to get tracking status"})
+		slog.ErrorContext(r.Context(), "failed to get tracking status", "err", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(MailTrackingResponseSuccess{Status: statusSuccess, Tracking: tracking})
+}
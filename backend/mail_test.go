@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	testMailSender = LetterAddress{
+		Name: "Tenant", Line1: "123 Main St", Line2: "Apt 2", City: "Columbus", State: "OH", Zip: "43210",
+	}
+	testMailDestination = LetterAddress{
+		Name: "Landlord", Company: "Property LLC", Line1: "456 High St", City: "Columbus", State: "OH", Zip: "43215",
+	}
+)
+
+func newMailRequestBody(t *testing.T, altchaToken string, pdf []byte) []byte {
+	t.Helper()
+
+	body, err := json.Marshal(MailRequest{
+		Altcha:      altchaToken,
+		Pdf:         base64.StdEncoding.EncodeToString(pdf),
+		LetterName:  "Repair request",
+		Sender:      testMailSender,
+		Destination: testMailDestination,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestMailQuoteHandler(t *testing.T) {
+	r := router{mail: NewFakeMailProvider()}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/mail/quote", bytes.NewReader(newMailRequestBody(t, "", minimalPdf())))
+	w := httptest.NewRecorder()
+
+	r.mailQuote(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var result MailQuoteResponseSuccess
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Quote.Pages != 1 || result.Quote.PriceCents != 850 {
+		t.Fatalf("expected 1 page for 850 cents, got %+v", result.Quote)
+	}
+}
+
+// newSignedMailRouter returns a router mailing with the fake provider and a letter signed by its
+// signer for the addresses of newMailRequestBody
+func newSignedMailRouter(t *testing.T) (router, []byte) {
+	t.Helper()
+
+	signer := newTestSigner(t)
+	signed, err := signer.SignLetter(minimalPdf(), time.Now(), testMailSender, testMailDestination)
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	return router{mail: NewFakeMailProvider(), altcha: NewAltchaService(), signer: signer}, signed
+}
+
+func TestCreateMailingAndTrack(t *testing.T) {
+	r, signed := newSignedMailRouter(t)
+
+	altchaToken, err := createValidAltcha(r.altcha.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/mail", bytes.NewReader(newMailRequestBody(t, altchaToken, signed)))
+	w := httptest.NewRecorder()
+
+	r.createMailing(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var created MailResponseSuccess
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if created.Mailing.ID == "" {
+		t.Fatal("expected a mailing id")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/mail/{id}", r.mailTracking)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/mail/"+created.Mailing.ID, nil))
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, w.Result().StatusCode)
+	}
+	var tracking MailTrackingResponseSuccess
+	if err := json.NewDecoder(w.Result().Body).Decode(&tracking); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if tracking.Tracking.TrackingNumber != created.Mailing.TrackingNumber {
+		t.Fatalf("expected tracking number %q, got %q", created.Mailing.TrackingNumber, tracking.Tracking.TrackingNumber)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/mail/unknown", nil))
+
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Fatalf("expected %d, got %d", http.StatusNotFound, w.Result().StatusCode)
+	}
+}
+
+func TestCreateMailingInvalidAltcha(t *testing.T) {
+	r, signed := newSignedMailRouter(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/mail", bytes.NewReader(newMailRequestBody(t, "invalid", signed)))
+	w := httptest.NewRecorder()
+
+	r.createMailing(w, req)
+
+	if w.Result().StatusCode == http.StatusOK {
+		t.Fatal("expected mailing with an invalid altcha to fail")
+	}
+}
+
+func TestCreateMailingRejectsPdfNotSignedByServer(t *testing.T) {
+	r, _ := newSignedMailRouter(t)
+	otherSigned, err := newTestSigner(t).SignLetter(minimalPdf(), time.Now(), testMailSender, testMailDestination)
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	otherDestination := testMailDestination
+	otherDestination.Line1 = "789 Broad St"
+	otherAddresses, err := r.signer.SignLetter(minimalPdf(), time.Now(), testMailSender, otherDestination)
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	withoutAddresses, err := r.signer.Sign(minimalPdf(), time.Now())
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+
+	for name, pdf := range map[string][]byte{
+		"unsigned":                 minimalPdf(),
+		"signed by another key":    otherSigned,
+		"signed for another":       otherAddresses,
+		"signed without addresses": withoutAddresses,
+	} {
+		altchaToken, err := createValidAltcha(r.altcha.secret)
+		if err != nil {
+			t.Fatalf("failed to create altcha token: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/mail", bytes.NewReader(newMailRequestBody(t, altchaToken, pdf)))
+		w := httptest.NewRecorder()
+
+		r.createMailing(w, req)
+
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected %d, got %d", name, http.StatusBadRequest, w.Result().StatusCode)
+		}
+	}
+
+	// Without a signer, no pdf can be checked
+	r.signer = nil
+	req := httptest.NewRequest(http.MethodPost, "/api/mail", bytes.NewReader(newMailRequestBody(t, "", otherSigned)))
+	w := httptest.NewRecorder()
+	r.createMailing(w, req)
+	if w.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d without a signer, got %d", http.StatusServiceUnavailable, w.Result().StatusCode)
+	}
+}
+
+func TestFakeMailProviderRandomIDs(t *testing.T) {
+	f := NewFakeMailProvider()
+
+	seen := make(map[string]bool)
+	for range 10 {
+		receipt, err := f.CreateMailing(context.Background(), Mailing{Pdf: minimalPdf()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[receipt.ID] || len(receipt.ID) < 32 {
+			t.Fatalf("expected unique random ids, got %q", receipt.ID)
+		}
+		seen[receipt.ID] = true
+		if len(receipt.TrackingNumber) != 22 {
+			t.Fatalf("expected a 22 digit tracking number, got %q", receipt.TrackingNumber)
+		}
+	}
+}
+
+func TestMailHandlersDisabled(t *testing.T) {
+	r := router{}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/mail/quote", bytes.NewReader(newMailRequestBody(t, "", minimalPdf())))
+	w := httptest.NewRecorder()
+
+	r.mailQuote(w, req)
+
+	if w.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d, got %d", http.StatusServiceUnavailable, w.Result().StatusCode)
+	}
+}
+
+func TestMailQuoteRejectsMissingAddress(t *testing.T) {
+	r := router{mail: NewFakeMailProvider()}
+
+	body, _ := json.Marshal(MailRequest{Pdf: base64.StdEncoding.EncodeToString(minimalPdf())})
+	req := httptest.NewRequest(http.MethodPost, "/api/mail/quote", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	r.mailQuote(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
+
+func TestMailQuoteAcceptsPdfOfUploadSize(t *testing.T) {
+	r := router{mail: NewFakeMailProvider()}
+
+	// Letters with exhibits are much larger than the text of a letter
+	pdf := append(minimalPdf(), bytes.Repeat([]byte("%"), MaxPdfUploadSize-len(minimalPdf()))...)
+	req := httptest.NewRequest(http.MethodPost, "/api/mail/quote", bytes.NewReader(newMailRequestBody(t, "", pdf)))
+	w := httptest.NewRecorder()
+
+	r.mailQuote(w, req)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, w.Result().StatusCode)
+	}
+}
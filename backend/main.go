@@ -1,12 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"mime"
 	"net/http"
 	"os"
 	"path"
@@ -14,13 +17,29 @@ import (
 	"time"
 
 	_ "embed"
+
+	"golang.org/x/time/rate"
 )
 
 type router struct {
 	ip     InferenceProvider
 	altcha *AltchaService
+	// Optional server certificate used to sign letters
+	signer *PdfSigner
+	// Roots trusted when verifying uploaded letters
+	trustedCerts *x509.CertPool
+	// Optional certified mail vendor
+	mail MailProvider
+	// What to do with answers which look like instructions to the model, InjectionFlag when empty
+	injectionAction InjectionAction
+	// Write letters with unsupported claims once more, see GroundLetter
+	regenerateUngrounded bool
+	// Runs the requests of /api/jobs
+	jobs *JobRunner
 }
 
+// PdfRequest is the original flat request of /api/pdf. It is kept for compatibility and converted
+// to a PdfRequestV2 before rendering.
 type PdfRequest struct {
 	SenderName       string `json:"senderName"`
 	SenderAddress    string `json:"senderAddress"`
@@ -34,6 +53,76 @@ type PdfRequest struct {
 	ReceiverZip      string `json:"ReceiverZip"`
 	ComplaintSummary string `json:"complaintSummary"`
 	Body             string `json:"body"`
+	// Base64 encoded png of the sender's handwritten signature, optionally as a data URL
+	SignatureImage string `json:"signatureImage"`
+	// Sign the pdf with the server certificate
+	Sign bool `json:"sign"`
+	// Base64 encoded PKCS#12 bundle used to sign the pdf instead of the server certificate
+	SigningCertificate string `json:"signingCertificate"`
+	SigningPassword    string `json:"signingPassword"`
+	// Translation of the body returned by /api/text, appended as a page for the tenant's records
+	TenantLanguage    string `json:"tenantLanguage"`
+	TenantTranslation string `json:"tenantTranslation"`
+	// Print the wording and citations of the rule pack of the receiver's jurisdiction
+	IncludeJurisdiction bool `json:"includeJurisdiction"`
+	// Date in YYYY-MM-DD format the problem should be solved by, as returned by /api/text
+	Deadline string `json:"deadline"`
+	// Date in YYYY-MM-DD format of the earlier letter a second notice follows up on
+	PreviousLetterDate string `json:"previousLetterDate"`
+}
+
+// V2 converts a v1 request to the structured schema of /api/v2/pdf.
+func (req PdfRequest) V2() PdfRequestV2 {
+	return PdfRequestV2{
+		Sender: LetterAddress{
+			Name:  req.SenderName,
+			Line1: req.SenderAddress,
+			City:  req.SenderCity,
+			State: req.SenderState,
+			Zip:   req.SenderZip,
+		},
+		Receiver: LetterAddress{
+			Name:  req.ReceiverName,
+			Line1: req.ReceiverAddress,
+			City:  req.ReceiverCity,
+			State: req.ReceiverState,
+			Zip:   req.ReceiverZip,
+		},
+		ComplaintSummary:    req.ComplaintSummary,
+		Body:                req.Body,
+		SignatureImage:      req.SignatureImage,
+		Sign:                req.Sign,
+		SigningCertificate:  req.SigningCertificate,
+		SigningPassword:     req.SigningPassword,
+		TenantLanguage:      req.TenantLanguage,
+		TenantTranslation:   req.TenantTranslation,
+		IncludeJurisdiction: req.IncludeJurisdiction,
+		Deadline:            req.Deadline,
+		PreviousLetterDate:  req.PreviousLetterDate,
+	}
+}
+
+type PdfRequestV2 struct {
+	Sender           LetterAddress `json:"sender"`
+	Receiver         LetterAddress `json:"receiver"`
+	ComplaintSummary string        `json:"complaintSummary"`
+	Body             string        `json:"body"`
+	// Base64 encoded png of the sender's handwritten signature, optionally as a data URL
+	SignatureImage string `json:"signatureImage"`
+	// Sign the pdf with the server certificate
+	Sign bool `json:"sign"`
+	// Base64 encoded PKCS#12 bundle used to sign the pdf instead of the server certificate
+	SigningCertificate string `json:"signingCertificate"`
+	SigningPassword    string `json:"signingPassword"`
+	// Translation of the body returned by /api/text, appended as a page for the tenant's records
+	TenantLanguage    string `json:"tenantLanguage"`
+	TenantTranslation string `json:"tenantTranslation"`
+	// Print the wording and citations of the rule pack of the receiver's jurisdiction
+	IncludeJurisdiction bool `json:"includeJurisdiction"`
+	// Date in YYYY-MM-DD format the problem should be solved by, as returned by /api/text
+	Deadline string `json:"deadline"`
+	// Date in YYYY-MM-DD format of the earlier letter a second notice follows up on
+	PreviousLetterDate string `json:"previousLetterDate"`
 }
 
 type PdfResponseSuccess struct {
@@ -47,15 +136,42 @@ type PdfResponseError struct {
 	Message string `json:"message"`
 }
 
+type PdfVerifyResponseSuccess struct {
+	Status string `json:"status"`
+	PdfSignatureInfo
+}
+
 type TextRequest struct {
 	Altcha  string            `json:"altcha"`
 	Answers map[string]string `json:"answers"`
+	// Optional code of a language to also translate the letter into for the tenant, such as "es"
+	TenantLanguage string `json:"tenantLanguage"`
+	// Select the rule pack of the jurisdiction, see SelectRulePack
+	ReceiverState string `json:"receiverState"`
+	ReceiverCity  string `json:"receiverCity"`
+	// Optional tone, length and readingLevel
+	LetterStyle
+	// Optional id of the client, so it is assigned the same prompt version on every request
+	ClientID string `json:"clientId"`
+	// Optional prompt version to use instead of assigning one. Versions with a weight of zero are
+	// refused.
+	PromptVersion string `json:"promptVersion"`
 }
 
 type TextResponseSuccess struct {
 	Status string `json:"status"`
 	// The body of the letter
 	Text string `json:"content"`
+	// The body of the letter in the tenant's language, when requested
+	Translation string `json:"translation,omitempty"`
+	// The date the tenant asked for the problem to be solved by, when it could be resolved
+	Deadline *Deadline `json:"deadline,omitempty"`
+	// Readability of the body of the letter, returned by /api/text
+	Readability *LetterReadability `json:"readability,omitempty"`
+	// Details of the letter which are not in the answers, returned by /api/text
+	Grounding *Grounding `json:"grounding,omitempty"`
+	// The prompt version which wrote the letter, to pass to /api/text/feedback
+	PromptVersion string `json:"promptVersion,omitempty"`
 }
 
 type TextResponseError struct {
@@ -72,6 +188,19 @@ type Form struct {
 	Inference struct {
 		SystemPrompt string `yaml:"systemPrompt"`
 		UserPrompt   string `yaml:"userPrompt"`
+		// Optional versions of the prompts assigned to shares of /api/text requests, see
+		// NewPromptExperiment
+		PromptVersions []PromptVersionConfig `yaml:"promptVersions"`
+		// Template of the system prompt used to translate letters. {{.Language}} is the name of the
+		// tenant's language in English
+		TranslationPrompt string `yaml:"translationPrompt"`
+		// Appended to the system prompt when revising a letter
+		RevisionPrompt string `yaml:"revisionPrompt"`
+		// Templates of the prompts used to write a second notice, see RenderFollowUpSystemPrompt
+		FollowUpSystemPrompt string `yaml:"followUpSystemPrompt"`
+		FollowUpUserPrompt   string `yaml:"followUpUserPrompt"`
+		// Prices of the models to estimate the cost of inference, see CostLedger
+		Prices []ModelPrice `yaml:"prices"`
 	}
 }
 
@@ -79,6 +208,16 @@ type Form struct {
 func (rt *router) text(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	req, lang, ok := rt.decodeTextRequest(w, r)
+	if !ok {
+		return
+	}
+	rt.writeLetter(w, r, req, lang)
+}
+
+// decodeTextRequest reads and checks a /api/text request, including its altcha. It writes an error
+// response and returns false if the request is invalid.
+func (rt *router) decodeTextRequest(w http.ResponseWriter, r *http.Request) (TextRequest, TenantLanguage, bool) {
 	var req TextRequest
 	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&req)
 
@@ -86,48 +225,157 @@ func (rt *router) text(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to decode body"})
 		slog.ErrorContext(r.Context(), "failed to decode body", "err", err)
-		return
+		return TextRequest{}, TenantLanguage{}, false
+	}
+	if err := req.LetterStyle.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+		return TextRequest{}, TenantLanguage{}, false
+	}
+	var lang TenantLanguage
+	if req.TenantLanguage != "" {
+		lang, err = LookupTenantLanguage(req.TenantLanguage)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+			return TextRequest{}, TenantLanguage{}, false
+		}
 	}
 	ok, err := rt.altcha.Verify(req.Altcha)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to verify altcha"})
 		slog.ErrorContext(r.Context(), "failed to verify altcha", "err", err)
-		return
+		return TextRequest{}, TenantLanguage{}, false
 	}
 	if !ok {
 		w.WriteHeader(http.StatusForbidden)
 		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "invalid altcha"})
+		return TextRequest{}, TenantLanguage{}, false
+	}
+	return req, lang, true
+}
+
+// writeLetter writes the letter of a decoded /api/text request and its response
+func (rt *router) writeLetter(w http.ResponseWriter, r *http.Request, req TextRequest, lang TenantLanguage) {
+	version, err := promptExperiment.Select(r, req.PromptVersion, req.ClientID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+		return
+	}
+
+	answers, flagged, ok := rt.screenAnswers(w, r, req.Answers)
+	if !ok {
 		return
 	}
 
-	var buff bytes.Buffer
-	err = userPromptTemplate.Execute(&buff, req.Answers)
+	boundary, err := NewAnswerBoundary()
 	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to template answers"})
+		slog.ErrorContext(r.Context(), "failed to create answer boundary", "err", err)
+		return
+	}
+
+	lc, err := version.LetterConversation(LetterInput{
+		Answers:       answers,
+		Flagged:       len(flagged) > 0 && rt.injectionAction != InjectionStrip,
+		ReceiverState: req.ReceiverState,
+		ReceiverCity:  req.ReceiverCity,
+		Style:         req.LetterStyle,
+		Boundary:      boundary,
+		Now:           time.Now(),
+	})
+	if errors.Is(err, ErrInvalidAnswers) {
 		w.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to template answers"})
 		slog.ErrorContext(r.Context(), "failed to template answers", "err", err)
 		return
 	}
-
-	resp, err := rt.ip.Infer(r.Context(), buff.String())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to template system prompt"})
+		slog.ErrorContext(r.Context(), "failed to template system prompt", "err", err, "promptVersion", version.Name)
+		return
+	}
+	conversation, pii, deadline := lc.Messages, lc.PII, lc.Deadline
+	resp, readability, err := InferLetter(r.Context(), rt.ip, conversation, req.LetterStyle)
+	if writeRateLimited(w, err) {
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to run inference"})
 		slog.ErrorContext(r.Context(), "failed to run inference", "err", err)
 		return
 	}
+	resp = boundary.Strip(resp)
+
+	// Dates, amounts and fixtures the tenant did not mention are pointed out so they can be removed
+	resp, grounding := GroundLetter(r.Context(), rt.ip, conversation, resp, req.LetterStyle, deadline, lc.RulePack, time.Now().In(stateLocation(req.ReceiverState)), rt.regenerateUngrounded)
+	if grounding.Regenerated {
+		resp = boundary.Strip(resp)
+		readability.Readability = MeasureReadability(resp)
+	}
+	result, ok := rt.finishLetter(w, r, pii, resp, lang)
+	if !ok {
+		return
+	}
 
 	// Track successful inference
 	analytics.IncrementInferences()
+	analytics.RecordLetter(version.Name)
+	slog.InfoContext(r.Context(), "wrote letter", "promptVersion", version.Name)
+
+	result.Deadline = deadline
+	result.Readability = &readability
+	result.Grounding = &grounding
+	result.PromptVersion = version.Name
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// finishLetter checks a letter written by the model against the content policy, and translates it
+// into the tenant's language when one was asked for. It returns the response with the personal
+// information put back, or false once an error response was written.
+func (rt *router) finishLetter(w http.ResponseWriter, r *http.Request, pii *Pseudonymizer, letter string, lang TenantLanguage) (TextResponseSuccess, bool) {
+	if !checkContentPolicy(w, r, pii.Restore(letter)) {
+		return TextResponseSuccess{}, false
+	}
+
+	var translation string
+	if lang.Code != "" {
+		var err error
+		translation, err = TranslateLetter(r.Context(), rt.ip, lang, letter)
+		if writeRateLimited(w, err) {
+			return TextResponseSuccess{}, false
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to translate letter"})
+			slog.ErrorContext(r.Context(), "failed to translate letter", "err", err)
+			return TextResponseSuccess{}, false
+		}
+		// The translation is checked too, as the model may not translate the letter faithfully
+		if !checkContentPolicy(w, r, pii.Restore(translation)) {
+			return TextResponseSuccess{}, false
+		}
+	}
 
-	_ = json.NewEncoder(w).Encode(TextResponseSuccess{Status: statusSuccess, Text: resp})
+	return TextResponseSuccess{
+		Status:      statusSuccess,
+		Text:        pii.Restore(letter),
+		Translation: pii.Restore(translation),
+	}, true
 }
 
 // This should be set on any route which attempts to read the request body. Golang's net/http
 // server does not set a maximum limit. We are only passing around small JSON so this can be small
 const MaxRequestBodySize = 64 * 1024
 
+// Routes accepting a whole pdf file need a larger limit than the JSON routes
+const MaxPdfUploadSize = 10 * 1024 * 1024
+
 // Golang's net/http server adds an extra 4096 bytes to this value as a buffer. The total buffer
 // includes the request line, as well as all headers. The default value is 1MB which is clearly too
 // large for the kinds of requests we need to handle
@@ -142,31 +390,165 @@ func (rt *router) pdf(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var req PdfRequest
-	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&req)
+	exhibits, ok := decodePdfRequest(w, r, &req)
+	if !ok {
+		return
+	}
+
+	rt.renderLetter(w, r, req.V2(), exhibits)
+}
+
+// Renders a pdf from a `PdfRequestV2` object
+func (rt *router) pdfV2(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req PdfRequestV2
+	exhibits, ok := decodePdfRequest(w, r, &req)
+	if !ok {
+		return
+	}
+
+	rt.renderLetter(w, r, req, exhibits)
+}
+
+// decodePdfRequest reads a pdf request of either version into req, as JSON or as multipart with
+// exhibits. It writes an error response and returns false if the body is invalid.
+func decodePdfRequest(w http.ResponseWriter, r *http.Request, req any) ([]Exhibit, bool) {
+	var exhibits []Exhibit
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		exhibits, err = readPdfMultipart(w, r, req)
+	} else {
+		err = json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(req)
+	}
 	if err != nil {
+		message := "failed to decode body"
+		for _, e := range []error{ErrTooManyExhibits, ErrExhibitTooLarge, ErrExhibitsTooLarge, ErrInvalidExhibit} {
+			if errors.Is(err, e) {
+				message = e.Error()
+			}
+		}
 		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to decode body"})
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: message})
 		slog.ErrorContext(r.Context(), "failed to decode body", "err", err)
+		return nil, false
+	}
+
+	return exhibits, true
+}
+
+// renderLetter renders, and optionally signs, the letter of a pdf request
+func (rt *router) renderLetter(w http.ResponseWriter, r *http.Request, req PdfRequestV2, exhibits []Exhibit) {
+	// Invalid addresses would otherwise only be noticed when the carrier rejects the letter
+	if problem := firstAddressProblem(req.Sender, req.Receiver); problem != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: problem})
+		return
+	}
+
+	// Letters are edited by the tenant after generation, and exhibit captions are printed with them
+	texts := []string{req.ComplaintSummary, req.Body, req.TenantTranslation}
+	for _, e := range exhibits {
+		texts = append(texts, e.Caption)
+	}
+	if !checkContentPolicy(w, r, texts...) {
 		return
 	}
 
 	params := LetterParams{
-		SenderName:       req.SenderName,
-		SenderAddress:    req.SenderAddress,
-		SenderCity:       req.SenderCity,
-		SenderState:      req.SenderState,
-		SenderZip:        req.SenderZip,
-		ReceiverName:     req.ReceiverName,
-		ReceiverAddress:  req.ReceiverAddress,
-		ReceiverCity:     req.ReceiverCity,
-		ReceiverState:    req.ReceiverState,
-		ReceiverZip:      req.ReceiverZip,
+		Sender:           req.Sender,
+		Receiver:         req.Receiver,
 		ComplaintSummary: req.ComplaintSummary,
-		LetterContent:    req.Body,
+		LetterContent:    ParseRichText(req.Body),
 		Date:             time.Now().Format("Mon, 02 Jan 2006"),
 	}
 
-	pdf, err := RenderPdf(r.Context(), params)
+	// The law of a jurisdiction is only quoted when asked for, as the receiver's address may not be
+	// where the rental unit is
+	if pack := SelectRulePack(rulePacks, req.Receiver.State, req.Receiver.City); pack != nil && req.IncludeJurisdiction {
+		params.Jurisdiction = pack.Letter()
+	}
+
+	if req.Deadline != "" {
+		deadline, err := ParseDeadlineDate(req.Deadline)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: err.Error()})
+			return
+		}
+		params.Deadline = deadline
+	}
+
+	if req.PreviousLetterDate != "" {
+		previous, err := parseSentDate("previousLetterDate", req.PreviousLetterDate, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: err.Error()})
+			return
+		}
+		params.PreviousLetterDate = previous.Format(deadlineTextLayout)
+	}
+
+	if req.TenantTranslation != "" {
+		lang, err := LookupTenantLanguage(req.TenantLanguage)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: err.Error()})
+			return
+		}
+		params.Translation = &LetterTranslation{
+			Lang:     lang.Code,
+			Language: lang.Name,
+			Notice:   lang.Notice,
+			Content:  ParseRichText(req.TenantTranslation),
+		}
+	}
+
+	var assets []LetterAsset
+	if req.SignatureImage != "" {
+		img, err := DecodeSignatureImage(req.SignatureImage)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: err.Error()})
+			slog.ErrorContext(r.Context(), "invalid signature image", "err", err)
+			return
+		}
+		assets = append(assets, LetterAsset{Name: signatureImageAsset, Data: img})
+		params.SignatureImage = "/" + signatureImageAsset
+	}
+
+	for i, e := range exhibits {
+		name := fmt.Sprintf("exhibit-%d.jpg", i+1)
+		assets = append(assets, LetterAsset{Name: name, Data: e.Image})
+		params.Exhibits = append(params.Exhibits, LetterExhibit{
+			Label:   exhibitLabel(i),
+			Caption: e.Caption,
+			Image:   "/" + name,
+		})
+	}
+
+	signer := rt.signer
+	if req.SigningCertificate != "" {
+		p12, err := base64.StdEncoding.DecodeString(req.SigningCertificate)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: "failed to decode signing certificate"})
+			return
+		}
+		signer, err = NewPdfSignerFromPKCS12(p12, req.SigningPassword)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: "invalid signing certificate"})
+			slog.ErrorContext(r.Context(), "invalid signing certificate", "err", err)
+			return
+		}
+	} else if req.Sign && signer == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: "pdf signing is not configured"})
+		return
+	}
+
+	pdf, err := RenderPdf(r.Context(), params, assets...)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: "failed to generate pdf"})
@@ -174,6 +556,16 @@ func (rt *router) pdf(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.Sign || req.SigningCertificate != "" {
+		pdf, err = signer.SignLetter(pdf, time.Now(), req.Sender, req.Receiver)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: "failed to sign pdf"})
+			slog.ErrorContext(r.Context(), "failed to sign pdf", "err", err)
+			return
+		}
+	}
+
 	// Track successful PDF generation
 	analytics.IncrementPDFs()
 
@@ -182,6 +574,34 @@ func (rt *router) pdf(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(PdfResponseSuccess{Status: statusSuccess, PdfContent: pdfContent})
 }
 
+// Verifies the signature of an uploaded pdf. The request body is the raw pdf file
+func (rt *router) verifyPdf(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	pdf, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxPdfUploadSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: "failed to read body"})
+		slog.ErrorContext(r.Context(), "failed to read body", "err", err)
+		return
+	}
+
+	info, err := VerifyPdfSignature(pdf, rt.trustedCerts)
+	if errors.Is(err, ErrPdfNotSigned) || errors.Is(err, ErrMalformedPdfSignature) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(PdfResponseError{Status: statusError, Message: "failed to verify pdf"})
+		slog.ErrorContext(r.Context(), "failed to verify pdf", "err", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(PdfVerifyResponseSuccess{Status: statusSuccess, PdfSignatureInfo: *info})
+}
+
 func healthcheck(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	type Response struct {
@@ -192,6 +612,10 @@ func healthcheck(w http.ResponseWriter, _ *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "evalprompts" {
+		os.Exit(runEvalPrompts(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	maxInputTokens := uint64(2000)
 	if val := os.Getenv("MAX_INPUT_TOKENS"); val != "" {
 		if parsed, err := strconv.ParseUint(val, 10, 0); err != nil {
@@ -254,20 +678,162 @@ func main() {
 
 	ip := NewFallbackProvider(providers...)
 
+	dailyBudget := 0.0
+	if val := os.Getenv("DAILY_BUDGET"); val != "" {
+		if parsed, err := strconv.ParseFloat(val, 64); err != nil || parsed < 0 {
+			slog.Warn("Invalid DAILY_BUDGET. Using default value", "value", val)
+		} else {
+			dailyBudget = parsed
+		}
+	}
+	ledger, err := NewCostLedger(form.Inference.Prices, dailyBudget)
+	if err != nil {
+		slog.Error("Failed to load prices", "err", err)
+		os.Exit(1)
+	}
+
+	// Inferences over the daily budget are made by the budget fallback provider, or refused without
+	// one rather than returning text no model wrote as a letter
+	var budgetFallback InferenceProvider
+	if dailyBudget > 0 {
+		budgetFallbackName := os.Getenv("BUDGET_FALLBACK_PROVIDER")
+		if budgetFallbackName != "" && inferenceProviders[budgetFallbackName] == nil {
+			slog.Warn("Invalid BUDGET_FALLBACK_PROVIDER. Refusing inferences over the budget", "value", budgetFallbackName)
+			budgetFallbackName = ""
+		}
+		if budgetFallbackName != "" {
+			if budgetFallback, err = inferenceProviders[budgetFallbackName](maxInputTokens, maxOutputTokens); err != nil {
+				slog.Warn("Failed to initialize budget fallback provider. Refusing inferences over the budget", "name", budgetFallbackName, "err", err)
+				budgetFallback, budgetFallbackName = nil, ""
+			}
+		}
+		slog.Info("Using daily budget", "budget", dailyBudget, "fallback", budgetFallbackName)
+	}
+
 	// Wrapped provider with rate limiting
-	rateLimitedIP := NewRateLimitedProvider(ip)
+	rateLimitedIP := NewRateLimitedProvider(NewBudgetProvider(ip, budgetFallback, ledger, int(maxOutputTokens)))
+
+	signer, err := NewPdfSignerFromEnv()
+	if err != nil {
+		slog.Error("Failed to load pdf signing certificate", "err", err)
+		os.Exit(1)
+	}
+
+	trustedCerts, err := loadTrustedCerts(signer)
+	if err != nil {
+		slog.Error("Failed to load trusted certificates", "err", err)
+		os.Exit(1)
+	}
+
+	var mail MailProvider
+	if mailName := os.Getenv("MAIL_PROVIDER"); mailName == "" {
+		slog.Info("environment variable MAIL_PROVIDER is not defined. Certified mail is disabled")
+	} else if mailProviders[mailName] == nil {
+		slog.Error("Mail provider does not exist", "name", mailName)
+		os.Exit(1)
+	} else if mail, err = mailProviders[mailName](); err != nil {
+		slog.Error("Failed to initialize mail provider", "err", err)
+		os.Exit(1)
+	} else {
+		slog.Info("Using mail provider", "name", mailName)
+	}
+
+	injectionAction := InjectionFlag
+	if val := os.Getenv("INJECTION_ACTION"); val != "" {
+		if parsed, err := ParseInjectionAction(val); err != nil {
+			slog.Warn("Invalid INJECTION_ACTION. Using default value", "err", err)
+		} else {
+			injectionAction = parsed
+		}
+	} else {
+		slog.Info("environment variable INJECTION_ACTION is not defined. Using default value")
+	}
+	slog.Info("Using injection action", "action", injectionAction)
+
+	regenerateUngrounded := false
+	if val := os.Getenv("GROUNDING_REGENERATE"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err != nil {
+			slog.Warn("Invalid GROUNDING_REGENERATE. Using default value", "err", err)
+		} else {
+			regenerateUngrounded = parsed
+		}
+	}
+
+	idempotencyTTL := 10 * time.Minute
+	if val := os.Getenv("IDEMPOTENCY_TTL"); val != "" {
+		if parsed, err := time.ParseDuration(val); err != nil || parsed <= 0 {
+			slog.Warn("Invalid IDEMPOTENCY_TTL. Using default value", "value", val)
+		} else {
+			idempotencyTTL = parsed
+		}
+	}
+	idempotency, err := NewIdempotencyStore(idempotencyTTL)
+	if err != nil {
+		slog.Error("Failed to create idempotency store", "err", err)
+		os.Exit(1)
+	}
+
+	jobWorkers := 2
+	if val := os.Getenv("JOB_WORKERS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err != nil || parsed < 1 {
+			slog.Warn("Invalid JOB_WORKERS. Using default value", "value", val)
+		} else {
+			jobWorkers = parsed
+		}
+	}
+
+	if val := os.Getenv("TRUSTED_PROXIES"); val != "" {
+		if parsed, err := ParseTrustedProxies(val); err != nil {
+			slog.Warn("Invalid TRUSTED_PROXIES. Using the address of the connection", "err", err)
+		} else {
+			trustedProxies = parsed
+		}
+	} else {
+		slog.Info("environment variable TRUSTED_PROXIES is not defined. Using the address of the connection")
+	}
+
+	// Feedback does not run inference, its own limit keeps a client from flooding the analytics
+	feedbackPerMinute := 10
+	if val := os.Getenv("FEEDBACK_RATE_LIMIT_PER_MINUTE"); val != "" {
+		if parsed, err := strconv.Atoi(val); err != nil || parsed < 1 {
+			slog.Warn("Invalid FEEDBACK_RATE_LIMIT_PER_MINUTE. Using default value", "value", val)
+		} else {
+			feedbackPerMinute = parsed
+		}
+	}
+	feedbackLimiter := NewClientLimiter(rate.Limit(float64(feedbackPerMinute)/60), feedbackPerMinute)
 
 	rt := router{
-		altcha: altchaService,
-		ip:     rateLimitedIP,
+		altcha:               altchaService,
+		ip:                   rateLimitedIP,
+		signer:               signer,
+		trustedCerts:         trustedCerts,
+		mail:                 mail,
+		injectionAction:      injectionAction,
+		regenerateUngrounded: regenerateUngrounded,
+		jobs:                 NewJobRunner(jobWorkers),
 	}
 
 	// Start analytics webhook scheduler (sends stats every week)
 	StartAnalyticsWebhookScheduler(7 * 24 * time.Hour)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /api/pdf", rt.pdf)
-	mux.HandleFunc("POST /api/text", rt.text)
+	mux.HandleFunc("POST /api/pdf", idempotency.Wrap(MaxExhibitsTotalSize+MaxRequestBodySize, rt.pdf))
+	mux.HandleFunc("POST /api/v2/pdf", idempotency.Wrap(MaxExhibitsTotalSize+MaxRequestBodySize, rt.pdfV2))
+	mux.HandleFunc("POST /api/address/validate", validateAddress)
+	mux.HandleFunc("GET /api/config", appConfig)
+	mux.HandleFunc("POST /api/calendar", calendar)
+	mux.HandleFunc("POST /api/text", idempotency.Wrap(MaxRequestBodySize, queueByClient(rt.text)))
+	mux.HandleFunc("POST /api/text/followup", queueByClient(rt.followUp))
+	mux.HandleFunc("POST /api/text/revise", queueByClient(rt.revise))
+	mux.HandleFunc("POST /api/text/feedback", feedbackLimiter.Wrap(rt.feedback))
+	mux.HandleFunc("POST /api/jobs/text", idempotency.Wrap(MaxRequestBodySize, queueByClient(rt.submitTextJob)))
+	mux.HandleFunc("GET /api/jobs/{id}", rt.jobStatus)
+	mux.HandleFunc("DELETE /api/jobs/{id}", rt.cancelJob)
+	mux.HandleFunc("POST /api/pdf/verify", rt.verifyPdf)
+	mux.HandleFunc("POST /api/mail/quote", rt.mailQuote)
+	mux.HandleFunc("POST /api/mail", rt.createMailing)
+	mux.HandleFunc("GET /api/mail/{id}", rt.mailTracking)
 	mux.HandleFunc("GET /healthz", healthcheck)
 
 	mux.HandleFunc("GET /api/altcha/challenge", rt.altcha.altchaChallengeHandler)
@@ -96,8 +96,14 @@ func TestPdfHandlerSuccess(t *testing.T) {
 		reqJSON := map[string]string{
 			"senderName":       "someone",
 			"senderAddress":    "somewhere",
+			"senderCity":       "Columbus",
+			"senderState":      "OH",
+			"senderZip":        "43215",
 			"receiverName":     "someone else",
 			"receiverAddress":  "somewhere else",
+			"receiverCity":     "Columbus",
+			"receiverState":    "OH",
+			"receiverZip":      "43215",
 			"complaintSummary": "Something Has Gone Wrong",
 			"body":             "Lorem ipsum dolor sit amet.",
 		}
@@ -153,6 +159,50 @@ func TestPDFHandlerBadRequest(t *testing.T) {
 	}
 }
 
+func TestPdfV2HandlerBadRequest(t *testing.T) {
+	r := router{
+		ip:     NewMockInferenceProvider(),
+		altcha: NewAltchaService(),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/pdf", bytes.NewBufferString(`{"sender": "flat string"}`))
+	w := httptest.NewRecorder()
+
+	r.pdfV2(w, req)
+
+	resp := w.Result()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestPdfRequestV1Conversion(t *testing.T) {
+	// Both the documented camelCase and the historical PascalCase receiver fields are accepted
+	var req PdfRequest
+	body := `{"senderName": "a", "senderAddress": "1 Main St", "senderCity": "Columbus", "senderState": "OH",
+		"senderZip": "43215", "receiverName": "b", "receiverAddress": "2 High St", "receiverCity": "Dayton",
+		"ReceiverState": "OH", "receiverZip": "45402", "complaintSummary": "c", "body": "d", "includeJurisdiction": true,
+		"deadline": "2026-11-19", "previousLetterDate": "2026-10-05"}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	got := req.V2()
+	want := PdfRequestV2{
+		Sender:              LetterAddress{Name: "a", Line1: "1 Main St", City: "Columbus", State: "OH", Zip: "43215"},
+		Receiver:            LetterAddress{Name: "b", Line1: "2 High St", City: "Dayton", State: "OH", Zip: "45402"},
+		ComplaintSummary:    "c",
+		Body:                "d",
+		IncludeJurisdiction: true,
+		Deadline:            "2026-11-19",
+		PreviousLetterDate:  "2026-10-05",
+	}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
 func TestTextHandlerSuccess(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		altchaService := NewAltchaService()
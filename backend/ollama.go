@@ -48,34 +48,45 @@ func NewOllama() (*Ollama, error) {
 	}, nil
 }
 
-func (o *Ollama) Infer(ctx context.Context, input string) (string, error) {
-	systemPrompt := RenderSystemPrompt()
+func (o *Ollama) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	ollamaMessages := make([]api.Message, 0, len(messages))
+	for _, m := range messages {
+		ollamaMessages = append(ollamaMessages, api.Message{
+			Role:    string(m.Role),
+			Content: m.Content,
+		})
+	}
+
+	// Ollama has no limit unless one is set for the request
+	var options map[string]any
+	if n := MaxOutputTokens(ctx, 0); n > 0 {
+		options = map[string]any{"num_predict": n}
+	}
 
 	var message string
+	var metrics api.Metrics
 	err := o.client.Chat(ctx, &api.ChatRequest{
-		Model: o.modelId,
-		Messages: []api.Message{
-			{
-				Role:    "system",
-				Content: systemPrompt,
-			},
-			{
-				Role:    "user",
-				Content: input,
-			},
-		},
-		Stream: new(bool),
+		Model:    o.modelId,
+		Messages: ollamaMessages,
+		Stream:   new(bool),
+		Options:  options,
 	}, func(resp api.ChatResponse) error {
 		if resp.Done {
 			message = resp.Message.Content
+			metrics = resp.Metrics
 		}
 		return nil
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to chat with ollama: %v", err)
+		return "", nil, fmt.Errorf("failed to chat with ollama: %v", err)
 	}
 
-	return message, nil
+	return message, []Usage{{
+		Provider:     "ollama",
+		Model:        o.modelId,
+		InputTokens:  metrics.PromptEvalCount,
+		OutputTokens: metrics.EvalCount,
+	}}, nil
 }
 
 func init() {
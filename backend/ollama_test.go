@@ -42,7 +42,7 @@ func TestOllamaInfer(t *testing.T) {
 	ctx := context.Background()
 	input := "test input"
 
-	result, err := ollama.Infer(ctx, input)
+	result, _, err := ollama.Infer(ctx, NewConversation(RenderSystemPrompt(), input))
 	if err != nil {
 		t.Fatalf("Inference failed: %v", err)
 	}
@@ -54,33 +54,45 @@ func NewOpenAI(maxInputTokens int, maxOutputTokens int) (*OpenAi, error) {
 	}, nil
 }
 
-func (o *OpenAi) Infer(ctx context.Context, input string) (string, error) {
-	systemPrompt := RenderSystemPrompt()
-
+func (o *OpenAi) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
 	// See AWS
-	estimatedSystemPromptTokens := len(systemPrompt) / 3
-	if len(input)+estimatedSystemPromptTokens > o.maxInputTokens {
-		return "", ErrTooManyInputTokens
+	if EstimateInputTokens(messages) > o.maxInputTokens {
+		return "", nil, ErrTooManyInputTokens
+	}
+
+	params := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages))
+	for _, m := range messages {
+		switch m.Role {
+		case RoleSystem:
+			params = append(params, openai.SystemMessage(m.Content))
+		case RoleAssistant:
+			params = append(params, openai.AssistantMessage(m.Content))
+		default:
+			params = append(params, openai.UserMessage(m.Content))
+		}
 	}
 
 	// As of writing, nrp does not support the v3 API, the completion API, or the response API
 	res, err := o.client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage(systemPrompt),
-			openai.UserMessage(input),
-		},
+		Messages:  params,
 		Model:     o.modelId,
-		MaxTokens: param.NewOpt(int64(o.maxOutputTokens))})
+		MaxTokens: param.NewOpt(int64(MaxOutputTokens(ctx, o.maxOutputTokens)))})
 
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
+	usage := []Usage{{
+		Provider:     "openai",
+		Model:        o.modelId,
+		InputTokens:  int(res.Usage.PromptTokens),
+		OutputTokens: int(res.Usage.CompletionTokens),
+	}}
 
 	if res.Choices[0].Message.Refusal != "" {
-		return "", fmt.Errorf("model refused for reason: %v", res.Choices[0].Message.Refusal)
+		return "", usage, fmt.Errorf("model refused for reason: %v", res.Choices[0].Message.Refusal)
 	}
 
-	return res.Choices[0].Message.Content, nil
+	return res.Choices[0].Message.Content, usage, nil
 }
 
 func init() {
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// PIIKind is a kind of personal information found in the answers
+type PIIKind string
+
+const (
+	PIIEmail   PIIKind = "EMAIL"
+	PIISSN     PIIKind = "SSN"
+	PIIPhone   PIIKind = "PHONE"
+	PIIAddress PIIKind = "ADDRESS"
+	PIIUnit    PIIKind = "UNIT"
+	PIIName    PIIKind = "NAME"
+)
+
+// Added to the system prompt when answers were pseudonymized, so the model copies placeholders
+// instead of replacing them with its own "[Tenant Name]" style placeholders
+const piiPromptInstruction = "Values in square brackets such as [NAME_1] or [PHONE_1] stand for personal details of the tenant. Copy them exactly where they are needed."
+
+// PIIMatch is a value found by DetectPII, Start and End are byte offsets in the text
+type PIIMatch struct {
+	Kind  PIIKind
+	Value string
+	Start int
+	End   int
+}
+
+// Titles a person's name may follow
+var honorifics = []string{"Mr", "Mrs", "Ms", "Mx", "Miss", "Dr", "Prof"}
+
+// A capitalized name such as "Lee", "O'Neil", "McDonald" or "Smith-Jones"
+const nameWord = `[A-Z](?:[a-z]+|'[A-Z])[A-Za-z]*(?:-[A-Z][A-Za-z]+)?`
+
+type piiDetector struct {
+	Kind    PIIKind
+	Pattern *regexp.Regexp
+	// Index of the submatch holding the value, zero for the whole match. Names keep their title, as
+	// it tells the model how to address the person.
+	Group int
+}
+
+// Detectors are run in order, and a value overlapping one found by an earlier detector is skipped.
+// Social security numbers come before phone numbers, and addresses before names as "Dr" is also
+// a street suffix.
+var piiDetectors = []piiDetector{
+	{
+		Kind:    PIIEmail,
+		Pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	},
+	{
+		Kind:    PIISSN,
+		Pattern: regexp.MustCompile(`\b\d{3}[- ]\d{2}[- ]\d{4}\b`),
+	},
+	{
+		Kind:    PIIPhone,
+		Pattern: regexp.MustCompile(`(?:\+?1[\s.-]?)?(?:\(\d{3}\)\s?|\b\d{3}[\s.-])\d{3}[\s.-]\d{4}\b|\b\d{10}\b`),
+	},
+	{
+		Kind: PIIAddress,
+		Pattern: regexp.MustCompile(`\b\d{1,6}[A-Za-z]?\s+(?:[NSEW]\.?\s+)?(?:(?:\d+(?:st|nd|rd|th)|[A-Z][A-Za-z'-]*)\s+){1,4}(?i:` +
+			dictionaryPattern(streetSuffixes) + `)\b\.?`),
+	},
+	{
+		// Unit numbers need a digit, so "the unit is cold" is left alone
+		Kind:    PIIUnit,
+		Pattern: regexp.MustCompile(`(?i:\b(?:` + dictionaryPattern(unitDesignators) + `)\b)\.?\s*#?\s*(?:\d+[A-Za-z]?|[A-Za-z]-?\d+)\b|#\s?\d+[A-Za-z]?\b`),
+	},
+	{
+		// Titles are repeated so "Dr. Ms. Kim" at the end of "9 Oak Dr." finds Kim
+		Kind:    PIIName,
+		Pattern: regexp.MustCompile(`\b(?:(?:` + strings.Join(honorifics, "|") + `)\.?\s+)+(` + nameWord + `(?:\s+` + nameWord + `)?)`),
+		Group:   1,
+	},
+}
+
+// dictionaryPattern returns a regular expression alternation of the names and abbreviations of
+// one of the USPS dictionaries of address.go, longest first
+func dictionaryPattern(dictionary map[string]string) string {
+	var words []string
+	for name, abbreviation := range dictionary {
+		words = append(words, name, abbreviation)
+	}
+	slices.SortFunc(words, func(a, b string) int { return cmp.Or(len(b)-len(a), strings.Compare(a, b)) })
+	words = slices.Compact(words)
+	for i, word := range words {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	return strings.Join(words, "|")
+}
+
+// DetectPII returns the personal information found in a text, in order of appearance
+func DetectPII(text string) []PIIMatch {
+	var matches []PIIMatch
+	for _, d := range piiDetectors {
+		for _, loc := range d.Pattern.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[2*d.Group], loc[2*d.Group+1]
+			if !overlapsPII(matches, start, end) {
+				matches = append(matches, PIIMatch{Kind: d.Kind, Value: text[start:end], Start: start, End: end})
+			}
+		}
+	}
+	slices.SortFunc(matches, func(a, b PIIMatch) int { return a.Start - b.Start })
+	return matches
+}
+
+func overlapsPII(matches []PIIMatch, start, end int) bool {
+	for _, m := range matches {
+		if start < m.End && m.Start < end {
+			return true
+		}
+	}
+	return false
+}
+
+// Pseudonymizer replaces personal information with placeholders such as "[PHONE_1]" before text is
+// sent to the inference provider, and puts the values back in the reply. The same value gets the
+// same placeholder in every text scrubbed by a Pseudonymizer. A false positive only costs the model
+// some context, as the value is restored in the letter.
+type Pseudonymizer struct {
+	placeholders map[string]string
+	values       map[string]string
+	counts       map[PIIKind]int
+}
+
+func NewPseudonymizer() *Pseudonymizer {
+	return &Pseudonymizer{
+		placeholders: map[string]string{},
+		values:       map[string]string{},
+		counts:       map[PIIKind]int{},
+	}
+}
+
+// Scrub returns the text with its personal information replaced by placeholders
+func (p *Pseudonymizer) Scrub(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range DetectPII(text) {
+		b.WriteString(text[last:m.Start])
+		b.WriteString(p.placeholder(m.Kind, m.Value))
+		last = m.End
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func (p *Pseudonymizer) placeholder(kind PIIKind, value string) string {
+	key := string(kind) + "\x00" + value
+	if placeholder, ok := p.placeholders[key]; ok {
+		return placeholder
+	}
+	p.counts[kind]++
+	placeholder := fmt.Sprintf("[%s_%d]", kind, p.counts[kind])
+	p.placeholders[key] = placeholder
+	p.values[placeholder] = value
+	return placeholder
+}
+
+// Restore returns the text with the placeholders of this Pseudonymizer replaced by their values
+func (p *Pseudonymizer) Restore(text string) string {
+	if len(p.values) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, 2*len(p.values))
+	for placeholder, value := range p.values {
+		pairs = append(pairs, placeholder, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// Len returns the number of distinct values replaced so far
+func (p *Pseudonymizer) Len() int {
+	return len(p.values)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type piiCorpusEntry struct {
+	Text string `json:"text"`
+	PII  []struct {
+		Kind  PIIKind `json:"kind"`
+		Value string  `json:"value"`
+	} `json:"pii"`
+}
+
+// Checks the detectors against the answers in `backend/testdata/pii_corpus.json`. Each entry lists
+// all the personal information of its text in order, so false positives fail too.
+func TestDetectPIICorpus(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "pii_corpus.json"))
+	if err != nil {
+		t.Fatalf("failed to read corpus: %v", err)
+	}
+	var corpus []piiCorpusEntry
+	if err := json.Unmarshal(data, &corpus); err != nil {
+		t.Fatalf("failed to parse corpus: %v", err)
+	}
+
+	for _, entry := range corpus {
+		var want, got []string
+		for _, p := range entry.PII {
+			want = append(want, fmt.Sprintf("%s %q", p.Kind, p.Value))
+		}
+		for _, m := range DetectPII(entry.Text) {
+			got = append(got, fmt.Sprintf("%s %q", m.Kind, m.Value))
+			if entry.Text[m.Start:m.End] != m.Value {
+				t.Errorf("%q: offsets of %q do not match", entry.Text, m.Value)
+			}
+		}
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Errorf("%q:\nexpected %v\n     got %v", entry.Text, want, got)
+		}
+	}
+}
+
+func TestPseudonymizerRoundTrip(t *testing.T) {
+	p := NewPseudonymizer()
+
+	first := p.Scrub("Mr. Lee lives at 12 Elm St and his number is 614-555-0199.")
+	second := p.Scrub("Call 614-555-0199, or ask Mr. Lee or Ms. Park.")
+
+	if first != "Mr. [NAME_1] lives at [ADDRESS_1] and his number is [PHONE_1]." {
+		t.Errorf("unexpected scrubbed text %q", first)
+	}
+	if second != "Call [PHONE_1], or ask Mr. [NAME_1] or Ms. [NAME_2]." {
+		t.Errorf("expected repeated values to keep their placeholder, got %q", second)
+	}
+	if p.Len() != 4 {
+		t.Errorf("expected 4 values, got %d", p.Len())
+	}
+
+	letter := "Dear Mr. [NAME_1],\n\nThe heat at [ADDRESS_1] is out. [NAME_2] and [NAME_1] agree. Reach me at [PHONE_1]. [NAME_3]"
+	want := "Dear Mr. Lee,\n\nThe heat at 12 Elm St is out. Park and Lee agree. Reach me at 614-555-0199. [NAME_3]"
+	if got := p.Restore(letter); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestTextHandlerScrubsPII(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	ip := &promptRecordingProvider{}
+	r := router{ip: ip, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"altcha": altchaToken,
+		"answers": map[string]string{
+			"mainProblem":   "The toilet in apt 3C leaks",
+			"whatTheyTried": "I called Mrs. Alvarez at 614-555-0199 and emailed tenant@example.com",
+		},
+	})
+	w := httptest.NewRecorder()
+
+	r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Result().StatusCode, w.Body.String())
+	}
+
+	sent := fmt.Sprint(ip.conversations)
+	for _, value := range []string{"3C", "Alvarez", "614-555-0199", "tenant@example.com"} {
+		if strings.Contains(sent, value) {
+			t.Errorf("expected %q not to be sent to the inference provider", value)
+		}
+	}
+	if !strings.Contains(sent, "Mrs. [NAME_1] at [PHONE_1]") || !strings.Contains(ip.prompts[0], piiPromptInstruction) {
+		t.Errorf("expected placeholders and their instruction, got %s", sent)
+	}
+
+	var result TextResponseSuccess
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if !strings.Contains(result.Text, "Mrs. Alvarez at 614-555-0199 and emailed tenant@example.com") {
+		t.Errorf("expected the values to be restored in the letter, got %q", result.Text)
+	}
+}
+
+func TestReviseAndFollowUpScrubPII(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	ip := &promptRecordingProvider{}
+	r := router{ip: ip, altcha: altchaService}
+
+	newBody := func(req any) *bytes.Reader {
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.NewReader(b)
+	}
+	newAltcha := func() string {
+		altchaToken, err := createValidAltcha(altchaService.secret)
+		if err != nil {
+			t.Fatalf("failed to create altcha token: %v", err)
+		}
+		return altchaToken
+	}
+
+	routes := map[string]func(w http.ResponseWriter){
+		"revise": func(w http.ResponseWriter) {
+			r.revise(w, httptest.NewRequest(http.MethodPost, "/api/text/revise", newBody(ReviseRequest{
+				Altcha:         newAltcha(),
+				Draft:          "Please call Mrs. Alvarez about the leak.",
+				Instruction:    "add that my number is 614-555-0199",
+				History:        []RevisionTurn{{Draft: "Email me at tenant@example.com", Instruction: "be polite"}},
+				TenantLanguage: "es",
+			})))
+		},
+		"followup": func(w http.ResponseWriter) {
+			r.followUp(w, httptest.NewRequest(http.MethodPost, "/api/text/followup", newBody(FollowUpRequest{
+				Altcha:         newAltcha(),
+				OriginalLetter: "Please call Mrs. Alvarez about the leak. Email me at tenant@example.com",
+				OriginalDate:   "2026-10-05",
+				SinceThen:      "Nobody called 614-555-0199 back",
+				TenantLanguage: "es",
+			})))
+		},
+	}
+
+	for name, route := range routes {
+		t.Run(name, func(t *testing.T) {
+			ip.prompts, ip.conversations = nil, nil
+			w := httptest.NewRecorder()
+
+			route(w)
+
+			if w.Result().StatusCode != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Result().StatusCode, w.Body.String())
+			}
+			// The letter and its translation
+			if len(ip.conversations) != 2 {
+				t.Fatalf("expected 2 inferences, got %d", len(ip.conversations))
+			}
+			sent := fmt.Sprint(ip.conversations)
+			for _, value := range []string{"Alvarez", "614-555-0199", "tenant@example.com"} {
+				if strings.Contains(sent, value) {
+					t.Errorf("expected %q not to be sent to the inference provider", value)
+				}
+			}
+			if !strings.Contains(ip.prompts[0], piiPromptInstruction) {
+				t.Error("expected the placeholder instruction in the system prompt")
+			}
+
+			var result TextResponseSuccess
+			if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+			if !strings.Contains(result.Text, "614-555-0199") || !strings.Contains(result.Translation, "614-555-0199") {
+				t.Errorf("expected the values to be restored in the letter and its translation, got %q and %q", result.Text, result.Translation)
+			}
+		})
+	}
+}
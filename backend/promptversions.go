@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	ErrInvalidPromptVersions = errors.New("invalid prompt versions")
+	ErrUnknownPromptVersion  = errors.New("unknown prompt version")
+	ErrInvalidAnswers        = errors.New("failed to template answers")
+)
+
+// PromptVersionConfig is an entry of inference.promptVersions in app-config.yaml
+type PromptVersionConfig struct {
+	// Recorded with the letters the version writes
+	Name string `yaml:"name"`
+	// Share of /api/text requests assigned to the version, relative to the other weights. Versions
+	// with a weight of zero are only used when a request names them.
+	Weight uint `yaml:"weight"`
+	// Optional, inference.systemPrompt and inference.userPrompt when empty
+	SystemPrompt string `yaml:"systemPrompt"`
+	UserPrompt   string `yaml:"userPrompt"`
+}
+
+// PromptVersion is a named system and user prompt writing letters for /api/text
+type PromptVersion struct {
+	Name   string
+	system *template.Template
+	user   *template.Template
+}
+
+func NewPromptVersion(name, systemPrompt, userPrompt string) (PromptVersion, error) {
+	v := PromptVersion{Name: name}
+	var err error
+	if v.system, err = template.New("prompt.txt").Parse(systemPrompt); err != nil {
+		return PromptVersion{}, err
+	}
+	if v.user, err = template.New("user-prompt.txt").Parse(userPrompt); err != nil {
+		return PromptVersion{}, err
+	}
+	return v, nil
+}
+
+// SystemPrompt renders the system prompt at the given time, for a receiver in state
+func (v PromptVersion) SystemPrompt(now time.Time, state string) (string, error) {
+	var buf bytes.Buffer
+	err := v.system.Execute(&buf, map[any]any{"CurrentTime": PromptTime(now, state)})
+	return buf.String(), err
+}
+
+// UserPrompt renders the user prompt of the answers to the form questions
+func (v PromptVersion) UserPrompt(answers map[string]string) (string, error) {
+	var buf bytes.Buffer
+	err := v.user.Execute(&buf, answers)
+	return buf.String(), err
+}
+
+// LetterInput is what a letter is written from
+type LetterInput struct {
+	// The answers to the form questions, already screened by ScreenAnswers
+	Answers map[string]string
+	// Set when answers which look like instructions were left in for the model to disregard
+	Flagged bool
+	// Select the rule pack of the jurisdiction, see SelectRulePack
+	ReceiverState string
+	ReceiverCity  string
+	Style         LetterStyle
+	// Delimits the answers in the user prompt
+	Boundary AnswerBoundary
+	// The time the prompts are rendered and the deadline is resolved at
+	Now time.Time
+}
+
+// LetterConversation is the conversation a letter is inferred from
+type LetterConversation struct {
+	Messages []Message
+	// Puts back the personal information scrubbed from the answers
+	PII *Pseudonymizer
+	// The resolved date the tenant asked for, nil when it was not understood
+	Deadline *Deadline
+	// The rule pack of the jurisdiction the model may quote, nil when there is none
+	RulePack *RulePack
+}
+
+// LetterConversation renders the conversation /api/text writes a letter from. Personal information
+// is scrubbed from the answers, the deadline is resolved and the answers are delimited, and the
+// system prompt gets the instructions of the rule pack, style, boundary and personal information.
+// An error wrapping ErrInvalidAnswers means the answers do not fit the user prompt.
+func (v PromptVersion) LetterConversation(in LetterInput) (LetterConversation, error) {
+	pack := SelectRulePack(rulePacks, in.ReceiverState, in.ReceiverCity)
+
+	// Personal information the tenant typed into the answers is not sent to the inference provider
+	pii := NewPseudonymizer()
+	answers := make(map[string]string, len(in.Answers))
+	for k, v := range in.Answers {
+		answers[k] = pii.Scrub(v)
+	}
+
+	// The model is given the resolved date instead of guessing it. Answers which are not understood
+	// are passed on as written.
+	var deadline *Deadline
+	if text := in.Answers[deadlineQuestion]; text != "" {
+		if d, err := ResolveDeadline(text, in.Now, in.ReceiverState, pack); err == nil {
+			deadline = &d
+			answers[deadlineQuestion] = d.Text
+		}
+	}
+
+	for k, v := range answers {
+		answers[k] = in.Boundary.Wrap(v)
+	}
+	userPrompt, err := v.UserPrompt(answers)
+	if err != nil {
+		return LetterConversation{}, fmt.Errorf("%w: %w", ErrInvalidAnswers, err)
+	}
+
+	prompt, err := v.SystemPrompt(in.Now, in.ReceiverState)
+	if err != nil {
+		return LetterConversation{}, err
+	}
+	if pack != nil {
+		prompt += "\n" + pack.PromptContext()
+	}
+	if style := in.Style.PromptInstructions(); style != "" {
+		prompt += "\n" + style
+	}
+	prompt += "\n" + in.Boundary.PromptInstruction()
+	if in.Flagged {
+		prompt += "\n" + injectionFlagInstruction
+	}
+	if pii.Len() > 0 {
+		prompt += "\n" + piiPromptInstruction
+	}
+
+	return LetterConversation{Messages: NewConversation(prompt, userPrompt), PII: pii, Deadline: deadline, RulePack: pack}, nil
+}
+
+// PromptExperiment assigns requests to prompt versions in proportion to their weights. A client
+// is always assigned the same version while the versions and weights do not change.
+type PromptExperiment struct {
+	versions []PromptVersion
+	// Cumulative weights of the versions
+	bounds []uint64
+}
+
+// The version of the inference prompts when app-config.yaml does not list promptVersions
+const defaultPromptVersion = "default"
+
+// NewPromptExperiment returns the experiment of the prompt versions in app-config.yaml. Versions
+// without their own prompts use systemPrompt and userPrompt. Without versions, every request uses
+// systemPrompt and userPrompt as the version "default".
+func NewPromptExperiment(systemPrompt, userPrompt string, configs []PromptVersionConfig) (*PromptExperiment, error) {
+	if len(configs) == 0 {
+		configs = []PromptVersionConfig{{Name: defaultPromptVersion, Weight: 1}}
+	}
+
+	e := &PromptExperiment{}
+	var total uint64
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("%w: versions require a name", ErrInvalidPromptVersions)
+		}
+		if _, ok := e.Lookup(c.Name); ok {
+			return nil, fmt.Errorf("%w: duplicate version %q", ErrInvalidPromptVersions, c.Name)
+		}
+		v, err := NewPromptVersion(c.Name, cmp.Or(c.SystemPrompt, systemPrompt), cmp.Or(c.UserPrompt, userPrompt))
+		if err != nil {
+			return nil, fmt.Errorf("%w: version %q: %w", ErrInvalidPromptVersions, c.Name, err)
+		}
+		total += uint64(c.Weight)
+		e.versions = append(e.versions, v)
+		e.bounds = append(e.bounds, total)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%w: a version needs a weight above zero", ErrInvalidPromptVersions)
+	}
+	return e, nil
+}
+
+// Assign returns the version of a client. The client id is hashed onto the total weight, so
+// assignments are sticky without storing them.
+func (e *PromptExperiment) Assign(clientID string) PromptVersion {
+	sum := sha256.Sum256([]byte(clientID))
+	n := binary.BigEndian.Uint64(sum[:8]) % e.bounds[len(e.bounds)-1]
+	for i, bound := range e.bounds {
+		if n < bound {
+			return e.versions[i]
+		}
+	}
+	panic("unreachable")
+}
+
+// weight returns the weight of the i-th version
+func (e *PromptExperiment) weight(i int) uint64 {
+	if i == 0 {
+		return e.bounds[0]
+	}
+	return e.bounds[i] - e.bounds[i-1]
+}
+
+// Lookup returns the version with the name
+func (e *PromptExperiment) Lookup(name string) (PromptVersion, bool) {
+	for _, v := range e.versions {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return PromptVersion{}, false
+}
+
+// Select returns the version named by a request, or assigns one to the client of the request. The
+// client is identified by the clientId of the request, such as an id the frontend keeps in local
+// storage, or by its address. Only versions with a weight above zero may be named, so clients
+// cannot opt into a version which is not rolled out.
+func (e *PromptExperiment) Select(r *http.Request, name, clientID string) (PromptVersion, error) {
+	if name != "" {
+		for i, v := range e.versions {
+			if v.Name == name && e.weight(i) > 0 {
+				return v, nil
+			}
+		}
+		return PromptVersion{}, fmt.Errorf("%w: %q", ErrUnknownPromptVersion, name)
+	}
+	if clientID == "" {
+		clientID = clientAddress(r)
+	}
+	return e.Assign(clientID), nil
+}
+
+// The longest letters edit distances are measured for, the distance takes time quadratic in the
+// number of words
+const maxFeedbackWords = 2000
+
+// EditDistance returns the word level Levenshtein distance between the letter written by a prompt
+// version and the letter the tenant sent, divided by the number of words of the longer of the two.
+// It is 0 when the letter was not edited and 1 when it was rewritten.
+func EditDistance(letter, final string) float64 {
+	a, b := strings.Fields(letter), strings.Fields(final)
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+
+	// Distances between the prefixes of a and b, one row of the table at a time
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			substitution := prev[j-1]
+			if a[i-1] != b[j-1] {
+				substitution++
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, substitution)
+		}
+		prev, cur = cur, prev
+	}
+	return round2(float64(prev[len(b)]) / float64(max(len(a), len(b))))
+}
+
+type FeedbackRequest struct {
+	Altcha string `json:"altcha"`
+	// The promptVersion returned by /api/text
+	PromptVersion string `json:"promptVersion"`
+	// Optional rating of the letter by the tenant
+	Helpful *bool `json:"helpful"`
+	// Optional letter returned by /api/text and the letter the tenant sent, after their edits
+	Letter      string `json:"letter"`
+	FinalLetter string `json:"finalLetter"`
+}
+
+type FeedbackResponse struct {
+	Status string `json:"status"`
+	// Set when letter and finalLetter were given
+	EditDistance *float64 `json:"editDistance,omitempty"`
+}
+
+// Records the feedback of a tenant on a letter, aggregated per prompt version in the analytics
+func (rt *router) feedback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req FeedbackRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to decode body"})
+		slog.ErrorContext(r.Context(), "failed to decode body", "err", err)
+		return
+	}
+	ok, err := rt.altcha.Verify(req.Altcha)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to verify altcha"})
+		slog.ErrorContext(r.Context(), "failed to verify altcha", "err", err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "invalid altcha"})
+		return
+	}
+	if _, ok := promptExperiment.Lookup(req.PromptVersion); !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: fmt.Sprintf("%s: %q", ErrUnknownPromptVersion, req.PromptVersion)})
+		return
+	}
+	edited := strings.TrimSpace(req.Letter) != "" && strings.TrimSpace(req.FinalLetter) != ""
+	if req.Helpful == nil && !edited {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "helpful, or letter and finalLetter, are required"})
+		return
+	}
+
+	resp := FeedbackResponse{Status: statusSuccess}
+	if edited {
+		if len(strings.Fields(req.Letter)) > maxFeedbackWords || len(strings.Fields(req.FinalLetter)) > maxFeedbackWords {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: fmt.Sprintf("letters must have at most %d words", maxFeedbackWords)})
+			return
+		}
+		distance := EditDistance(req.Letter, req.FinalLetter)
+		resp.EditDistance = &distance
+	}
+
+	analytics.RecordFeedback(req.PromptVersion, req.Helpful, resp.EditDistance)
+	attrs := []any{"promptVersion", req.PromptVersion}
+	if req.Helpful != nil {
+		attrs = append(attrs, "helpful", *req.Helpful)
+	}
+	if resp.EditDistance != nil {
+		attrs = append(attrs, "editDistance", *resp.EditDistance)
+	}
+	slog.InfoContext(r.Context(), "letter feedback", attrs...)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestNewPromptExperiment(t *testing.T) {
+	e, err := NewPromptExperiment("system", "user", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := e.Assign("client"); v.Name != defaultPromptVersion {
+		t.Fatalf("expected the default version without versions, got %q", v.Name)
+	}
+
+	e, err = NewPromptExperiment("system {{.CurrentTime}}", "user {{.mainProblem}}", []PromptVersionConfig{
+		{Name: "baseline", Weight: 1},
+		{Name: "short", Weight: 1, SystemPrompt: "be brief"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, _ := e.Lookup("baseline")
+	short, _ := e.Lookup("short")
+	if prompt, _ := short.SystemPrompt(evalTestNow, ""); prompt != "be brief" {
+		t.Fatalf("expected the version's system prompt, got %q", prompt)
+	}
+	if prompt, _ := baseline.SystemPrompt(evalTestNow, ""); prompt != "system "+PromptTime(evalTestNow, "") {
+		t.Fatalf("expected the shared system prompt, got %q", prompt)
+	}
+	if prompt, _ := short.UserPrompt(map[string]string{"mainProblem": "leak"}); prompt != "user leak" {
+		t.Fatalf("expected the shared user prompt, got %q", prompt)
+	}
+
+	for _, configs := range [][]PromptVersionConfig{
+		{{Weight: 1}},
+		{{Name: "a", Weight: 1}, {Name: "a", Weight: 1}},
+		{{Name: "a"}, {Name: "b"}},
+		{{Name: "a", Weight: 1, SystemPrompt: "{{.CurrentTime"}},
+	} {
+		if _, err := NewPromptExperiment("system", "user", configs); !errors.Is(err, ErrInvalidPromptVersions) {
+			t.Errorf("%+v: expected ErrInvalidPromptVersions, got %v", configs, err)
+		}
+	}
+}
+
+func TestPromptExperimentAssign(t *testing.T) {
+	e, err := NewPromptExperiment("system", "user", []PromptVersionConfig{
+		{Name: "baseline", Weight: 90},
+		{Name: "candidate", Weight: 10},
+		{Name: "disabled", Weight: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for i := range 10000 {
+		client := fmt.Sprintf("client-%d", i)
+		v := e.Assign(client)
+		if again := e.Assign(client); again.Name != v.Name {
+			t.Fatalf("expected %s to keep %s, got %s", client, v.Name, again.Name)
+		}
+		counts[v.Name]++
+	}
+	if counts["candidate"] < 800 || counts["candidate"] > 1200 {
+		t.Fatalf("expected about 10%% of clients on the candidate, got %v", counts)
+	}
+	if counts["disabled"] != 0 {
+		t.Fatalf("expected no clients on a version with a weight of zero, got %v", counts)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/text", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if v, err := e.Select(r, "", ""); err != nil || v.Name != e.Assign("192.0.2.1").Name {
+		t.Fatalf("expected the version of the client address, got %q, %v", v.Name, err)
+	}
+	if v, err := e.Select(r, "candidate", ""); err != nil || v.Name != "candidate" {
+		t.Fatalf("expected the named version, got %q, %v", v.Name, err)
+	}
+	for _, name := range []string{"disabled", "missing"} {
+		if _, err := e.Select(r, name, ""); !errors.Is(err, ErrUnknownPromptVersion) {
+			t.Fatalf("%s: expected ErrUnknownPromptVersion, got %v", name, err)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		letter, final string
+		distance      float64
+	}{
+		{"", "", 0},
+		{"the heat is out", "the  heat is\nout", 0},
+		{"the heat is out", "the water is out", 0.25},
+		{"the heat is out", "the heat is out since Monday", 0.33},
+		{"the heat is out", "please fix my sink", 1},
+		{"", "please fix my sink", 1},
+	}
+	for _, test := range tests {
+		if got := EditDistance(test.letter, test.final); got != test.distance {
+			t.Errorf("%q, %q: expected %v, got %v", test.letter, test.final, test.distance, got)
+		}
+	}
+}
+
+func TestTextHandlerPromptVersion(t *testing.T) {
+	defer func(e *PromptExperiment) { promptExperiment = e }(promptExperiment)
+	var err error
+	promptExperiment, err = NewPromptExperiment(form.Inference.SystemPrompt, form.Inference.UserPrompt, []PromptVersionConfig{
+		{Name: "baseline", Weight: 1},
+		{Name: "short", Weight: 1, SystemPrompt: "Write a short letter."},
+		{Name: "disabled", Weight: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+	ip := &promptRecordingProvider{}
+	r := router{ip: ip, altcha: altchaService}
+
+	for _, test := range []struct {
+		version, want string
+		status        int
+	}{
+		{"", promptExperiment.Assign("client").Name, http.StatusOK},
+		{"short", "short", http.StatusOK},
+		{"disabled", "", http.StatusBadRequest},
+		{"missing", "", http.StatusBadRequest},
+	} {
+		altchaToken, err := createValidAltcha(altchaService.secret)
+		if err != nil {
+			t.Fatalf("failed to create altcha token: %v", err)
+		}
+		body, _ := json.Marshal(map[string]any{
+			"altcha":        altchaToken,
+			"answers":       map[string]string{"mainProblem": "no heat"},
+			"clientId":      "client",
+			"promptVersion": test.version,
+		})
+		w := httptest.NewRecorder()
+		r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+		if w.Code != test.status {
+			t.Fatalf("%q: expected %d, got %d", test.version, test.status, w.Code)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var result TextResponseSuccess
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("decode failed: %v", err)
+		}
+		if result.PromptVersion != test.want {
+			t.Fatalf("expected version %q, got %q", test.want, result.PromptVersion)
+		}
+	}
+	if !strings.HasPrefix(ip.prompts[len(ip.prompts)-1], "Write a short letter.") {
+		t.Fatalf("expected the system prompt of the named version, got %q", ip.prompts[len(ip.prompts)-1])
+	}
+}
+
+func TestFeedbackHandler(t *testing.T) {
+	analytics = &Analytics{}
+	version := promptExperiment.Assign("client").Name
+
+	tests := []struct {
+		body   map[string]any
+		status int
+	}{
+		{map[string]any{"promptVersion": version, "helpful": true}, http.StatusOK},
+		{map[string]any{"promptVersion": version, "letter": "the heat is out", "finalLetter": "the water is out"}, http.StatusOK},
+		{map[string]any{"promptVersion": "missing", "helpful": true}, http.StatusBadRequest},
+		{map[string]any{"promptVersion": version}, http.StatusBadRequest},
+		{map[string]any{"promptVersion": version, "letter": "the heat is out", "finalLetter": strings.Repeat("word ", maxFeedbackWords+1)}, http.StatusBadRequest},
+	}
+	rt := &router{altcha: NewAltchaService()}
+	defer rt.altcha.usedStore.Stop()
+	for _, test := range tests {
+		altcha, err := createValidAltcha(rt.altcha.secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.body["altcha"] = altcha
+		body, _ := json.Marshal(test.body)
+		w := httptest.NewRecorder()
+		rt.feedback(w, httptest.NewRequest(http.MethodPost, "/api/text/feedback", bytes.NewReader(body)))
+		if w.Code != test.status {
+			t.Errorf("%v: expected %d, got %d", test.body, test.status, w.Code)
+		}
+	}
+
+	altcha, err := createValidAltcha(rt.altcha.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]any{"promptVersion": version, "helpful": true, "altcha": altcha})
+	var w *httptest.ResponseRecorder
+	for range 2 {
+		w = httptest.NewRecorder()
+		rt.feedback(w, httptest.NewRequest(http.MethodPost, "/api/text/feedback", bytes.NewReader(body)))
+	}
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected a used altcha to be refused, got %d", w.Code)
+	}
+
+	// Each client has its own limit
+	limiter := NewClientLimiter(rate.Every(time.Minute), 2)
+	handler := limiter.Wrap(func(w http.ResponseWriter, _ *http.Request) {})
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/api/text/feedback", nil))
+		if w.Code != want || want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Fatalf("request %d: expected %d with Retry-After when limited, got %d", i, want, w.Code)
+		}
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/text/feedback", nil)
+	r.RemoteAddr = "198.51.100.7:1234"
+	w = httptest.NewRecorder()
+	if handler(w, r); w.Code != http.StatusOK {
+		t.Fatalf("expected another client to be allowed, got %d", w.Code)
+	}
+
+	stats := analytics.GetStats().PromptVersions[version]
+	if stats.Helpful != 2 || stats.Edited != 1 || stats.MeanEditDistance() != 0.25 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -2,21 +2,49 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
 var (
 	ErrRateLimitExceeded = errors.New("rate limit exceeded")
+	ErrAlreadyQueued     = errors.New("another request of this client is already waiting")
 )
 
 // RateLimitedProvider wraps an InferenceProvider with rate limiting functionality.
+//
+// Requests over the rate limit wait in a first in, first out queue rather than being refused, up
+// to a maximum wait. Each client may only have one request waiting, so a single address can not
+// take several places in the queue.
 type RateLimitedProvider struct {
 	provider InferenceProvider
 	limiter  *rate.Limiter
+	maxWait  time.Duration
+	maxQueue int
+
+	mu      sync.Mutex
+	waiters []*queueWaiter
+}
+
+// queueWaiter is a request waiting in the queue of a RateLimitedProvider
+type queueWaiter struct {
+	client string
+	// Reports the place of the request in the queue, nil if nobody is asking
+	position *atomic.Int64
+	// Closed when the request is first in line
+	turn chan struct{}
 }
 
 var _ InferenceProvider = (*RateLimitedProvider)(nil)
@@ -25,6 +53,8 @@ var _ InferenceProvider = (*RateLimitedProvider)(nil)
 // an existing provider. Rate limit configuration is read from environment variables:
 // - RATE_LIMIT_REQUESTS_PER_SECOND: Number of requests per second (default: 1)
 // - RATE_LIMIT_BURST: Maximum burst size (default: 3)
+// - RATE_LIMIT_MAX_WAIT: How long a request waits in the queue before it is refused (default: 20s)
+// - RATE_LIMIT_MAX_QUEUE: Number of requests which may wait in the queue (default: 50)
 func NewRateLimitedProvider(provider InferenceProvider) *RateLimitedProvider {
 	requestsPerSecond := 1.0
 	if val := os.Getenv("RATE_LIMIT_REQUESTS_PER_SECOND"); val != "" {
@@ -40,17 +70,283 @@ func NewRateLimitedProvider(provider InferenceProvider) *RateLimitedProvider {
 		}
 	}
 
+	// Requests to /api/text have to be answered within ServerTimeout, including the inference
+	maxWait := 20 * time.Second
+	if val := os.Getenv("RATE_LIMIT_MAX_WAIT"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil && parsed >= 0 {
+			maxWait = parsed
+		}
+	}
+
+	maxQueue := 50
+	if val := os.Getenv("RATE_LIMIT_MAX_QUEUE"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed >= 0 {
+			maxQueue = parsed
+		}
+	}
+
 	return &RateLimitedProvider{
 		provider: provider,
 		limiter:  rate.NewLimiter(rate.Limit(requestsPerSecond), burst),
+		maxWait:  maxWait,
+		maxQueue: maxQueue,
 	}
 }
 
 // Infer implements the InferenceProvider interface with rate limiting.
-func (r *RateLimitedProvider) Infer(ctx context.Context, input string) (string, error) {
-	if !r.limiter.Allow() {
-		return "", ErrRateLimitExceeded
+func (r *RateLimitedProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	if err := r.admit(ctx); err != nil {
+		return "", nil, err
+	}
+
+	return r.provider.Infer(ctx, messages)
+}
+
+// admit waits until the request is first in line and the rate limit allows it
+func (r *RateLimitedProvider) admit(ctx context.Context) error {
+	deadline := time.Now().Add(r.maxWait)
+	w, err := r.enqueue(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.leave(w)
+
+	select {
+	case <-w.turn:
+	default:
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		select {
+		case <-w.turn:
+		case <-timer.C:
+			return ErrRateLimitExceeded
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	reservation := r.limiter.Reserve()
+	delay := reservation.Delay()
+	if !reservation.OK() || delay > 0 && delay > time.Until(deadline) {
+		reservation.Cancel()
+		return ErrRateLimitExceeded
+	}
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
+
+func (r *RateLimitedProvider) enqueue(ctx context.Context) (*queueWaiter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client := queueClient(ctx)
+	if client != "" && slices.ContainsFunc(r.waiters, func(w *queueWaiter) bool { return w.client == client }) {
+		return nil, ErrAlreadyQueued
+	}
+	// The request first in line is not counted, it is only waiting for the limiter
+	if len(r.waiters) > r.maxQueue {
+		return nil, ErrRateLimitExceeded
+	}
+
+	w := &queueWaiter{client: client, turn: make(chan struct{})}
+	if p, ok := ctx.Value(queuePositionKey{}).(*atomic.Int64); ok {
+		w.position = p
+	}
+	r.waiters = append(r.waiters, w)
+	if len(r.waiters) == 1 {
+		close(w.turn)
+	}
+	w.setPosition(len(r.waiters))
+	return w, nil
+}
+
+// leave removes a request from the queue, and lets the next one in line go when it was first
+func (r *RateLimitedProvider) leave(w *queueWaiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := slices.Index(r.waiters, w)
+	r.waiters = slices.Delete(r.waiters, i, i+1)
+	w.setPosition(0)
+	for j, other := range r.waiters {
+		other.setPosition(j + 1)
+	}
+	if i == 0 && len(r.waiters) > 0 {
+		close(r.waiters[0].turn)
+	}
+}
+
+func (w *queueWaiter) setPosition(position int) {
+	if w.position != nil {
+		w.position.Store(int64(position))
+	}
+}
+
+type queueClientKey struct{}
+
+type queuePositionKey struct{}
+
+// WithQueueClient names the client inferences made with the returned context are made for. Only
+// one request of a client waits in the queue of a RateLimitedProvider at a time.
+func WithQueueClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, queueClientKey{}, client)
+}
+
+func queueClient(ctx context.Context) string {
+	client, _ := ctx.Value(queueClientKey{}).(string)
+	return client
+}
+
+// WithQueuePosition reports the place in the queue of a RateLimitedProvider of inferences made with
+// the returned context to position, 1 being first in line. It is 0 when they are not waiting.
+func WithQueuePosition(ctx context.Context, position *atomic.Int64) context.Context {
+	return context.WithValue(ctx, queuePositionKey{}, position)
+}
+
+// Proxies, such as the ingress, whose X-Forwarded-For and X-Real-IP headers name the client. Set
+// from TRUSTED_PROXIES, see ParseTrustedProxies.
+var trustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses a comma separated list of addresses and CIDR ranges
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return slices.ContainsFunc(trustedProxies, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// clientAddress returns the address of the client of a request, without its port. When the request
+// comes from a trusted proxy, the client is the last address of X-Forwarded-For which is not a
+// trusted proxy, or else X-Real-IP. Addresses before it may be made up by the client.
+func clientAddress(r *http.Request) string {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		host = h
+	}
+	if addr, err := netip.ParseAddr(host); err != nil || !trustedProxy(addr) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		if !trustedProxy(addr) {
+			return addr.Unmap().String()
+		}
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// queueByClient makes the inferences of a handler queue as its client
+func queueByClient(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(WithQueueClient(r.Context(), clientAddress(r))))
 	}
+}
+
+// ClientLimiter limits the requests of each client to routes which do not run inference, and so
+// are not limited by a RateLimitedProvider
+type ClientLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*rate.Limiter
+	lastPrune time.Time
+}
 
-	return r.provider.Infer(ctx, input)
+func NewClientLimiter(limit rate.Limit, burst int) *ClientLimiter {
+	return &ClientLimiter{limit: limit, burst: burst, clients: make(map[string]*rate.Limiter)}
+}
+
+// Allow reports whether the client may make a request now
+func (l *ClientLimiter) Allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A client whose tokens are all back is no different from a new one, so it is forgotten
+	now := time.Now()
+	if now.Sub(l.lastPrune) > time.Minute {
+		for c, limiter := range l.clients {
+			if limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.clients, c)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	limiter, ok := l.clients[client]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.clients[client] = limiter
+	}
+	return limiter.AllowN(now, 1)
+}
+
+// Wrap responds with 429 to clients over the limit
+func (l *ClientLimiter) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow(clientAddress(r)) {
+			w.Header().Set("Content-Type", "application/json")
+			writeRateLimited(w, ErrRateLimitExceeded)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeRateLimited responds with 429 when an inference was refused by the rate limit, and with 503
+// when the daily budget is spent. It returns false for other errors, which are left to the caller.
+func writeRateLimited(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, ErrOverBudget) {
+		w.Header().Set("Retry-After", strconv.Itoa(budgetRetryAfter(time.Now())))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+		return true
+	}
+	if !errors.Is(err, ErrRateLimitExceeded) && !errors.Is(err, ErrAlreadyQueued) {
+		return false
+	}
+	w.Header().Set("Retry-After", "30")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+	return true
 }
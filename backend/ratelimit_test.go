@@ -2,30 +2,48 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/synctest"
+	"time"
 )
 
+func newTestRateLimitedProvider() *RateLimitedProvider {
+	provider := NewMockInferenceProvider()
+	provider.sleepDuration = 0 // No sleep for rate limit tests
+	return NewRateLimitedProvider(provider)
+}
+
 func TestRateLimitedProvider(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
-		provider := NewMockInferenceProvider()
-		provider.sleepDuration = 0 // No sleep for rate limit tests
-		rateLimitedProvider := NewRateLimitedProvider(provider)
+		rateLimitedProvider := newTestRateLimitedProvider()
 
 		ctx := context.Background()
+		start := time.Now()
 
-		// First 3 requests should succeed (burst = 3)
+		// First 3 requests should succeed at once (burst = 3)
 		for i := 0; i < 3; i++ {
-			_, err := rateLimitedProvider.Infer(ctx, "test")
+			_, _, err := rateLimitedProvider.Infer(ctx, NewConversation("system", "test"))
 			if err != nil {
 				t.Fatalf("Request %d should succeed, got error: %v", i+1, err)
 			}
 		}
+		if time.Since(start) != 0 {
+			t.Fatalf("expected the burst not to wait, waited %s", time.Since(start))
+		}
 
-		// 4th request should be rate limited
-		_, err := rateLimitedProvider.Infer(ctx, "test")
-		if err != ErrRateLimitExceeded {
-			t.Errorf("Request 4 should be rate limited, got: %v", err)
+		// 4th request should wait for the limiter rather than fail
+		_, _, err := rateLimitedProvider.Infer(ctx, NewConversation("system", "test"))
+		if err != nil {
+			t.Fatalf("Request 4 should wait and succeed, got: %v", err)
+		}
+		if time.Since(start) != time.Second {
+			t.Errorf("expected request 4 to wait a second, waited %s", time.Since(start))
 		}
 	})
 }
@@ -34,25 +52,207 @@ func TestRateLimitedProviderCustomConfig(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		t.Setenv("RATE_LIMIT_REQUESTS_PER_SECOND", "10")
 		t.Setenv("RATE_LIMIT_BURST", "5")
+		t.Setenv("RATE_LIMIT_MAX_WAIT", "0s")
 
-		provider := NewMockInferenceProvider()
-		provider.sleepDuration = 0 // No sleep for rate limit tests
-		rateLimitedProvider := NewRateLimitedProvider(provider)
+		rateLimitedProvider := newTestRateLimitedProvider()
 
 		ctx := context.Background()
 
 		// First 5 requests should succeed (burst = 5)
 		for i := 0; i < 5; i++ {
-			_, err := rateLimitedProvider.Infer(ctx, "test")
+			_, _, err := rateLimitedProvider.Infer(ctx, NewConversation("system", "test"))
 			if err != nil {
 				t.Fatalf("Request %d should succeed, got error: %v", i+1, err)
 			}
 		}
 
-		// 6th request should be rate limited
-		_, err := rateLimitedProvider.Infer(ctx, "test")
+		// 6th request should be rate limited, as it may not wait
+		_, _, err := rateLimitedProvider.Infer(ctx, NewConversation("system", "test"))
 		if err != ErrRateLimitExceeded {
 			t.Errorf("Request 6 should be rate limited, got: %v", err)
 		}
 	})
 }
+
+func TestRateLimitedProviderQueue(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		t.Setenv("RATE_LIMIT_BURST", "1")
+		rateLimitedProvider := newTestRateLimitedProvider()
+		if _, _, err := rateLimitedProvider.Infer(context.Background(), NewConversation("system", "test")); err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			mu    sync.Mutex
+			order []string
+			wg    sync.WaitGroup
+		)
+		clients := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+		positions := make([]atomic.Int64, len(clients))
+		for i, client := range clients {
+			ctx := WithQueuePosition(WithQueueClient(context.Background(), client), &positions[i])
+			wg.Go(func() {
+				if _, _, err := rateLimitedProvider.Infer(ctx, NewConversation("system", "test")); err != nil {
+					t.Errorf("%s: %v", client, err)
+				}
+				mu.Lock()
+				order = append(order, client)
+				mu.Unlock()
+			})
+			synctest.Wait()
+		}
+		for i := range positions {
+			if positions[i].Load() != int64(i+1) {
+				t.Fatalf("expected %s to be at %d, got %d", clients[i], i+1, positions[i].Load())
+			}
+		}
+
+		// A client may not take a second place in the queue
+		ctx := WithQueueClient(context.Background(), clients[2])
+		if _, _, err := rateLimitedProvider.Infer(ctx, NewConversation("system", "test")); !errors.Is(err, ErrAlreadyQueued) {
+			t.Fatalf("expected ErrAlreadyQueued, got %v", err)
+		}
+
+		time.Sleep(time.Second)
+		synctest.Wait()
+		if positions[0].Load() != 0 || positions[1].Load() != 1 || positions[2].Load() != 2 {
+			t.Fatalf("expected the queue to move up, got %d %d %d", positions[0].Load(), positions[1].Load(), positions[2].Load())
+		}
+
+		wg.Wait()
+		for i, client := range clients {
+			if order[i] != client {
+				t.Fatalf("expected the clients to be served in order, got %v", order)
+			}
+		}
+	})
+}
+
+func TestRateLimitedProviderMaxWait(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		t.Setenv("RATE_LIMIT_BURST", "1")
+		t.Setenv("RATE_LIMIT_MAX_WAIT", "1500ms")
+		rateLimitedProvider := newTestRateLimitedProvider()
+		if _, _, err := rateLimitedProvider.Infer(context.Background(), NewConversation("system", "test")); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make([]error, 2)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Go(func() {
+				_, _, errs[i] = rateLimitedProvider.Infer(context.Background(), NewConversation("system", "test"))
+			})
+			synctest.Wait()
+		}
+		wg.Wait()
+
+		// The second request would only be allowed after two seconds
+		if errs[0] != nil || !errors.Is(errs[1], ErrRateLimitExceeded) {
+			t.Fatalf("expected only the first request to be admitted in time, got %v", errs)
+		}
+	})
+}
+
+func TestRateLimitedProviderQueueFull(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		t.Setenv("RATE_LIMIT_BURST", "1")
+		t.Setenv("RATE_LIMIT_MAX_QUEUE", "1")
+		rateLimitedProvider := newTestRateLimitedProvider()
+		if _, _, err := rateLimitedProvider.Infer(context.Background(), NewConversation("system", "test")); err != nil {
+			t.Fatal(err)
+		}
+
+		// One request first in line and one waiting behind it
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		for range 2 {
+			wg.Go(func() {
+				_, _, _ = rateLimitedProvider.Infer(ctx, NewConversation("system", "test"))
+			})
+			synctest.Wait()
+		}
+		if _, _, err := rateLimitedProvider.Infer(context.Background(), NewConversation("system", "test")); !errors.Is(err, ErrRateLimitExceeded) {
+			t.Fatalf("expected ErrRateLimitExceeded, got %v", err)
+		}
+
+		// Canceled requests leave the queue
+		cancel()
+		wg.Wait()
+		if len(rateLimitedProvider.waiters) != 0 {
+			t.Fatalf("expected an empty queue, got %d waiting", len(rateLimitedProvider.waiters))
+		}
+	})
+}
+
+func TestWriteRateLimited(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		handled bool
+	}{
+		{ErrRateLimitExceeded, true},
+		{ErrAlreadyQueued, true},
+		{ErrTooManyInputTokens, false},
+		{nil, false},
+	} {
+		w := httptest.NewRecorder()
+		if handled := writeRateLimited(w, test.err); handled != test.handled {
+			t.Fatalf("%v: expected %v, got %v", test.err, test.handled, handled)
+		}
+		if test.handled && (w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "") {
+			t.Fatalf("%v: expected %d with Retry-After, got %d", test.err, http.StatusTooManyRequests, w.Code)
+		}
+	}
+}
+
+func TestClientAddressThroughProxy(t *testing.T) {
+	defer func(p []netip.Prefix) { trustedProxies = p }(trustedProxies)
+	var err error
+	if trustedProxies, err = ParseTrustedProxies("10.0.0.0/8, 192.0.2.10"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatal("expected an error for an invalid range")
+	}
+
+	for _, test := range []struct {
+		remote, forwarded, realIP, want string
+	}{
+		{"10.1.2.3:1234", "198.51.100.7", "", "198.51.100.7"},
+		// Addresses a client puts before its own are not trusted
+		{"10.1.2.3:1234", "203.0.113.9, 198.51.100.7", "", "198.51.100.7"},
+		{"10.1.2.3:1234", "198.51.100.7, 10.4.5.6", "", "198.51.100.7"},
+		{"10.1.2.3:1234", "", "198.51.100.8", "198.51.100.8"},
+		{"192.0.2.10:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"10.1.2.3:1234", "", "", "10.1.2.3"},
+		// Headers of clients connecting directly are ignored
+		{"198.51.100.9:1234", "203.0.113.9", "203.0.113.10", "198.51.100.9"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/text", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if got := clientAddress(r); got != test.want {
+			t.Errorf("%s %q %q: expected %s, got %s", test.remote, test.forwarded, test.realIP, test.want, got)
+		}
+	}
+
+	// Clients behind the proxy queue on their own
+	var clients []string
+	handler := queueByClient(func(_ http.ResponseWriter, r *http.Request) {
+		clients = append(clients, queueClient(r.Context()))
+	})
+	for _, forwarded := range []string{"198.51.100.7", "198.51.100.8"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/text", nil)
+		r.RemoteAddr = "10.1.2.3:1234"
+		r.Header.Set("X-Forwarded-For", forwarded)
+		handler(httptest.NewRecorder(), r)
+	}
+	if clients[0] == clients[1] {
+		t.Fatalf("expected clients behind the proxy to queue separately, got %v", clients)
+	}
+}
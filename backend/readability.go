@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Sentences longer than this are counted as long, they are the first thing to split when
+// simplifying a letter
+const longSentenceWords = 25
+
+// Readability holds sentence statistics and the Flesch-Kincaid grade of a text
+type Readability struct {
+	Words     int `json:"words"`
+	Sentences int `json:"sentences"`
+	Syllables int `json:"syllables"`
+	// Sentences of more than 25 words
+	LongSentences    int     `json:"longSentences"`
+	WordsPerSentence float64 `json:"wordsPerSentence"`
+	SyllablesPerWord float64 `json:"syllablesPerWord"`
+	// US school grade needed to understand the text
+	FleschKincaidGrade float64 `json:"fleschKincaidGrade"`
+}
+
+// Sentences end with punctuation, or with the end of a line since list items and placeholders such
+// as "[Landlord Name]" often have none
+var sentenceEndPattern = regexp.MustCompile(`[.!?]+(\s|$)|\n`)
+
+// MeasureReadability computes the statistics of a text. Markdown markers are ignored.
+func MeasureReadability(text string) Readability {
+	var r Readability
+	for _, sentence := range sentenceEndPattern.Split(text, -1) {
+		words := 0
+		for _, word := range strings.Fields(sentence) {
+			word = strings.TrimFunc(word, func(c rune) bool { return !unicode.IsLetter(c) && !unicode.IsDigit(c) })
+			if word == "" {
+				continue
+			}
+			words++
+			r.Syllables += countSyllables(word)
+		}
+		if words == 0 {
+			continue
+		}
+		r.Words += words
+		r.Sentences++
+		if words > longSentenceWords {
+			r.LongSentences++
+		}
+	}
+	if r.Words == 0 {
+		return r
+	}
+
+	r.WordsPerSentence = round2(float64(r.Words) / float64(r.Sentences))
+	r.SyllablesPerWord = round2(float64(r.Syllables) / float64(r.Words))
+	grade := 0.39*float64(r.Words)/float64(r.Sentences) + 11.8*float64(r.Syllables)/float64(r.Words) - 15.59
+	r.FleschKincaidGrade = round2(math.Max(grade, 0))
+	return r
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// countSyllables estimates the syllables of an English word from its groups of vowels
+func countSyllables(word string) int {
+	word = strings.ToLower(word)
+	if strings.IndexFunc(word, unicode.IsLetter) < 0 {
+		// Numbers such as "2026" are read as a word or two
+		return 1
+	}
+
+	isVowel := func(c rune) bool { return strings.ContainsRune("aeiouy", c) }
+	count := 0
+	previousVowel := false
+	for _, c := range word {
+		v := isVowel(c)
+		if v && !previousVowel {
+			count++
+		}
+		previousVowel = v
+	}
+
+	// A silent final "e" as in "leave", but not "le" as in "table"
+	if strings.HasSuffix(word, "e") && !strings.HasSuffix(word, "le") && count > 1 {
+		count--
+	}
+	// "-ed" is usually not a syllable, as in "repaired", except after "t" or "d" as in "needed"
+	if strings.HasSuffix(word, "ed") && len(word) > 3 && !strings.ContainsRune("td", rune(word[len(word)-3])) && count > 1 {
+		count--
+	}
+	return max(count, 1)
+}
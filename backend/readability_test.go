@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCountSyllables(t *testing.T) {
+	tests := map[string]int{
+		"the":         1,
+		"leave":       1,
+		"table":       2,
+		"repaired":    2,
+		"needed":      2,
+		"landlord":    2,
+		"immediately": 5,
+		"apartment":   3,
+		"2026":        1,
+		"rhythm":      1,
+	}
+
+	for word, want := range tests {
+		if got := countSyllables(word); got != want {
+			t.Errorf("%s: expected %d syllables, got %d", word, want, got)
+		}
+	}
+}
+
+func TestMeasureReadability(t *testing.T) {
+	r := MeasureReadability("The sink leaks. It has leaked for a week!\n- the **kitchen** window\n\n[Landlord Name]")
+
+	if r.Sentences != 4 || r.Words != 14 {
+		t.Fatalf("expected 4 sentences and 14 words, got %+v", r)
+	}
+	if r.LongSentences != 0 || r.WordsPerSentence != 3.5 {
+		t.Errorf("unexpected sentence statistics %+v", r)
+	}
+	if r.FleschKincaidGrade > 3 {
+		t.Errorf("expected short sentences of short words to be an easy read, got grade %.2f", r.FleschKincaidGrade)
+	}
+}
+
+func TestMeasureReadabilityHarderText(t *testing.T) {
+	simple := MeasureReadability("Please fix the heat. It is cold. My kids are sick.")
+	complex := MeasureReadability("I am writing to formally notify you regarding the persistent malfunctioning of the heating apparatus, which has consequently necessitated the utilization of supplementary electrical equipment throughout the residential unit during considerably extended periods of inclement weather.")
+
+	if complex.FleschKincaidGrade <= simple.FleschKincaidGrade+8 {
+		t.Fatalf("expected the complex text to be much harder, got %.2f and %.2f", simple.FleschKincaidGrade, complex.FleschKincaidGrade)
+	}
+	if complex.LongSentences != 1 {
+		t.Errorf("expected one long sentence, got %d", complex.LongSentences)
+	}
+}
+
+func TestMeasureReadabilityEmpty(t *testing.T) {
+	if r := MeasureReadability(" \n** **"); r != (Readability{}) {
+		t.Fatalf("expected no statistics, got %+v", r)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The first user message of a revision, which the draft answers. The form answers are not
+// resubmitted, the draft already holds everything the letter says.
+const revisionOpening = "Write the body of my letter."
+
+// Earlier revisions beyond this are left out of the conversation
+const maxRevisionHistory = 5
+
+// RevisionTurn is an earlier revision of a letter: a draft and the instruction it was revised with
+type RevisionTurn struct {
+	Draft       string `json:"draft"`
+	Instruction string `json:"instruction"`
+}
+
+type ReviseRequest struct {
+	Altcha string `json:"altcha"`
+	// The current draft, including any edits by the tenant
+	Draft string `json:"draft"`
+	// How to revise the draft, such as "make it shorter" or "mention the broken window first"
+	Instruction string `json:"instruction"`
+	// Optional earlier revisions of the draft, oldest first, so instructions such as "undo that"
+	// can be followed
+	History []RevisionTurn `json:"history"`
+	// Optional code of a language to also translate the letter into for the tenant, such as "es"
+	TenantLanguage string `json:"tenantLanguage"`
+	// Select the rule pack of the jurisdiction, see SelectRulePack
+	ReceiverState string `json:"receiverState"`
+	ReceiverCity  string `json:"receiverCity"`
+	// Optional promptVersion returned with the draft, so the revision uses the same system prompt.
+	// Otherwise the version is assigned from clientId as in /api/text.
+	PromptVersion string `json:"promptVersion"`
+	ClientID      string `json:"clientId"`
+}
+
+// RevisionConversation returns the conversation revising a draft. Each draft is an assistant
+// message answered by the instruction it was revised with, ending with the current draft and
+// instruction.
+func RevisionConversation(systemPrompt string, req ReviseRequest) []Message {
+	history := req.History
+	if len(history) > maxRevisionHistory {
+		history = history[len(history)-maxRevisionHistory:]
+	}
+
+	messages := []Message{
+		{Role: RoleSystem, Content: systemPrompt + "\n" + form.Inference.RevisionPrompt},
+		{Role: RoleUser, Content: revisionOpening},
+	}
+	for _, turn := range append(history, RevisionTurn{Draft: req.Draft, Instruction: req.Instruction}) {
+		messages = append(messages,
+			Message{Role: RoleAssistant, Content: turn.Draft},
+			Message{Role: RoleUser, Content: turn.Instruction},
+		)
+	}
+	return messages
+}
+
+// Revises a draft from /api/text or /api/text/followup following an instruction from the tenant.
+// The response is the same as /api/text.
+func (rt *router) revise(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ReviseRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to decode body"})
+		slog.ErrorContext(r.Context(), "failed to decode body", "err", err)
+		return
+	}
+	if strings.TrimSpace(req.Draft) == "" || strings.TrimSpace(req.Instruction) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "draft and instruction are required"})
+		return
+	}
+	var lang TenantLanguage
+	if req.TenantLanguage != "" {
+		lang, err = LookupTenantLanguage(req.TenantLanguage)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+			return
+		}
+	}
+	ok, err := rt.altcha.Verify(req.Altcha)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to verify altcha"})
+		slog.ErrorContext(r.Context(), "failed to verify altcha", "err", err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "invalid altcha"})
+		return
+	}
+
+	version, err := promptExperiment.Select(r, req.PromptVersion, req.ClientID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: err.Error()})
+		return
+	}
+	prompt, err := version.SystemPrompt(time.Now(), req.ReceiverState)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to template system prompt"})
+		slog.ErrorContext(r.Context(), "failed to template system prompt", "err", err, "promptVersion", version.Name)
+		return
+	}
+	if pack := SelectRulePack(rulePacks, req.ReceiverState, req.ReceiverCity); pack != nil {
+		prompt += "\n" + pack.PromptContext()
+	}
+
+	// The drafts may have been edited by the tenant, so they are screened and delimited like the
+	// instructions
+	fields := map[string]string{"draft": req.Draft, "instruction": req.Instruction}
+	for i, turn := range req.History {
+		fields[fmt.Sprintf("history[%d].draft", i)] = turn.Draft
+		fields[fmt.Sprintf("history[%d].instruction", i)] = turn.Instruction
+	}
+	fields, flagged, ok := rt.screenAnswers(w, r, fields)
+	if !ok {
+		return
+	}
+	if strings.TrimSpace(fields["instruction"]) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "instruction must describe a change to the letter"})
+		return
+	}
+
+	boundary, err := NewAnswerBoundary()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to template revision"})
+		slog.ErrorContext(r.Context(), "failed to create answer boundary", "err", err)
+		return
+	}
+
+	// Personal information in the drafts and instructions is not sent to the inference provider
+	pii := NewPseudonymizer()
+	field := func(name string) string {
+		return boundary.Wrap(pii.Scrub(fields[name]))
+	}
+	req.Draft, req.Instruction = field("draft"), field("instruction")
+	history := make([]RevisionTurn, len(req.History))
+	for i := range req.History {
+		history[i] = RevisionTurn{
+			Draft:       field(fmt.Sprintf("history[%d].draft", i)),
+			Instruction: field(fmt.Sprintf("history[%d].instruction", i)),
+		}
+	}
+	req.History = history
+
+	prompt += "\n" + boundary.RevisionPromptInstruction()
+	if len(flagged) > 0 && rt.injectionAction != InjectionStrip {
+		prompt += "\n" + injectionFlagInstruction
+	}
+	if pii.Len() > 0 {
+		prompt += "\n" + piiPromptInstruction
+	}
+
+	resp, _, err := rt.ip.Infer(r.Context(), RevisionConversation(prompt, req))
+	if errors.Is(err, ErrTooManyInputTokens) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "draft and history are too long"})
+		return
+	}
+	if writeRateLimited(w, err) {
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TextResponseError{Status: statusError, Message: "failed to run inference"})
+		slog.ErrorContext(r.Context(), "failed to run inference", "err", err)
+		return
+	}
+	result, ok := rt.finishLetter(w, r, pii, boundary.Strip(resp), lang)
+	if !ok {
+		return
+	}
+
+	analytics.IncrementInferences()
+
+	result.PromptVersion = version.Name
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRevisionConversation(t *testing.T) {
+	req := ReviseRequest{
+		Draft:       "second draft",
+		Instruction: "less formal",
+		History:     []RevisionTurn{{Draft: "first draft", Instruction: "make it shorter"}},
+	}
+
+	got := RevisionConversation("system", req)
+
+	want := []Message{
+		{Role: RoleSystem, Content: "system\n" + form.Inference.RevisionPrompt},
+		{Role: RoleUser, Content: revisionOpening},
+		{Role: RoleAssistant, Content: "first draft"},
+		{Role: RoleUser, Content: "make it shorter"},
+		{Role: RoleAssistant, Content: "second draft"},
+		{Role: RoleUser, Content: "less formal"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestRevisionConversationLimitsHistory(t *testing.T) {
+	req := ReviseRequest{Draft: "draft", Instruction: "shorter"}
+	for i := range maxRevisionHistory + 3 {
+		req.History = append(req.History, RevisionTurn{Draft: fmt.Sprintf("draft %d", i), Instruction: "again"})
+	}
+
+	got := RevisionConversation("system", req)
+
+	if len(got) != 2+2*(maxRevisionHistory+1) {
+		t.Fatalf("expected %d revisions, got %d messages", maxRevisionHistory+1, len(got))
+	}
+	if got[2].Content != "draft 3" {
+		t.Fatalf("expected the oldest revisions to be dropped, got %q", got[2].Content)
+	}
+}
+
+func TestReviseHandler(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	ip := &promptRecordingProvider{}
+	r := router{ip: ip, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(ReviseRequest{
+		Altcha:        altchaToken,
+		Draft:         "The sink leaks. The window is broken.",
+		Instruction:   "mention the broken window first",
+		ReceiverState: "OH",
+	})
+	w := httptest.NewRecorder()
+
+	r.revise(w, httptest.NewRequest(http.MethodPost, "/api/text/revise", bytes.NewReader(body)))
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Result().StatusCode, w.Body.String())
+	}
+	var result TextResponseSuccess
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Text != "reply to: mention the broken window first" {
+		t.Errorf("unexpected revision %q", result.Text)
+	}
+
+	conversation := ip.conversations[0]
+	if len(conversation) != 4 || conversation[2].Role != RoleAssistant || !strings.Contains(conversation[2].Content, ">The sink leaks. The window is broken.</answer-") {
+		t.Errorf("expected the draft as the assistant's answer, got %+v", conversation)
+	}
+	if !strings.Contains(ip.prompts[0], form.Inference.RevisionPrompt) || !strings.Contains(ip.prompts[0], "5321.04") {
+		t.Error("expected the revision prompt and the rule pack in the system prompt")
+	}
+}
+
+func TestReviseHandlerBadRequest(t *testing.T) {
+	tests := map[string]string{
+		"invalid json":        `{"draft": `,
+		"missing draft":       `{"instruction": "shorter"}`,
+		"missing instruction": `{"draft": "letter", "instruction": "  "}`,
+		"unknown language":    `{"draft": "letter", "instruction": "shorter", "tenantLanguage": "xx"}`,
+	}
+
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			(&router{}).revise(w, httptest.NewRequest(http.MethodPost, "/api/text/revise", strings.NewReader(body)))
+
+			if w.Result().StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Result().StatusCode)
+			}
+		})
+	}
+}
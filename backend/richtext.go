@@ -0,0 +1,215 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The letter body supports a small subset of markdown: paragraphs, bullet and numbered lists, bold
+// and italics. Anything else, including headings, links and raw typst markup, is kept as literal
+// text. The template only ever places the text of a span with text(), so no user input is
+// interpreted as typst markup.
+
+const (
+	RichParagraph    = "paragraph"
+	RichBulletList   = "bullet_list"
+	RichNumberedList = "numbered_list"
+)
+
+type RichBlock struct {
+	// One of RichParagraph, RichBulletList or RichNumberedList
+	Kind string `json:"kind"`
+	// Content of a paragraph. The template reads spans and start directly, so they are always
+	// encoded, even when a paragraph has no text or a list starts at 0.
+	Spans []RichSpan `json:"spans"`
+	// Content of each list item
+	Items [][]RichSpan `json:"items,omitempty"`
+	// Number of the first item of a numbered list
+	Start int `json:"start"`
+}
+
+// RichSpan is a run of text with the same emphasis, or a line break within a paragraph.
+type RichSpan struct {
+	Text      string `json:"text,omitempty"`
+	Bold      bool   `json:"bold,omitempty"`
+	Italic    bool   `json:"italic,omitempty"`
+	LineBreak bool   `json:"linebreak,omitempty"`
+}
+
+var (
+	bulletItemPattern   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	numberedItemPattern = regexp.MustCompile(`^\s*(\d{1,9})[.)]\s+(.*)$`)
+)
+
+// ParseRichText parses the letter body into blocks. Blank lines separate paragraphs, single line
+// breaks are kept. A line which does not start a list item continues the previous item.
+func ParseRichText(s string) []RichBlock {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+
+	blocks := []RichBlock{}
+	var paragraph []string
+	var list *RichBlock
+	var item []string
+
+	endItem := func() {
+		if list != nil && item != nil {
+			list.Items = append(list.Items, parseInline(strings.Join(item, " ")))
+		}
+		item = nil
+	}
+	endBlock := func() {
+		endItem()
+		if list != nil {
+			blocks = append(blocks, *list)
+			list = nil
+		}
+		if paragraph != nil {
+			spans := []RichSpan{}
+			for i, line := range paragraph {
+				if i > 0 {
+					spans = append(spans, RichSpan{LineBreak: true})
+				}
+				spans = append(spans, parseInline(line)...)
+			}
+			blocks = append(blocks, RichBlock{Kind: RichParagraph, Spans: spans})
+			paragraph = nil
+		}
+	}
+	startItem := func(kind string, start int, text string) {
+		if list == nil || list.Kind != kind {
+			endBlock()
+			list = &RichBlock{Kind: kind, Start: start}
+		}
+		endItem()
+		item = []string{text}
+	}
+
+	for line := range strings.SplitSeq(s, "\n") {
+		if strings.TrimSpace(line) == "" {
+			endBlock()
+			continue
+		}
+
+		if m := bulletItemPattern.FindStringSubmatch(line); m != nil {
+			startItem(RichBulletList, 0, m[1])
+		} else if m := numberedItemPattern.FindStringSubmatch(line); m != nil {
+			start, _ := strconv.Atoi(m[1])
+			startItem(RichNumberedList, start, m[2])
+		} else if list != nil {
+			item = append(item, strings.TrimSpace(line))
+		} else {
+			paragraph = append(paragraph, strings.TrimSpace(line))
+		}
+	}
+	endBlock()
+
+	return blocks
+}
+
+// parseInline splits a line into spans of bold and italic text. "**" and "__" delimit bold text,
+// "*" and "_" italics. A delimiter without a matching closing delimiter is kept as text, as is any
+// delimiter escaped with a backslash.
+func parseInline(s string) []RichSpan {
+	spans := []RichSpan{}
+	var bold, italic string
+	var buf strings.Builder
+
+	flush := func() {
+		if buf.Len() > 0 {
+			spans = append(spans, RichSpan{Text: buf.String(), Bold: bold != "", Italic: italic != ""})
+			buf.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`\*_`, s[i+1]) >= 0 {
+			buf.WriteByte(s[i+1])
+			i += 2
+			continue
+		}
+
+		if d := delimiterAt(s, i); d != "" {
+			current := &italic
+			if len(d) == 2 {
+				current = &bold
+			}
+			if *current == d && canCloseEmphasis(s, i, d) {
+				flush()
+				*current = ""
+				i += len(d)
+				continue
+			}
+			if *current == "" && canOpenEmphasis(s, i, d) && hasEmphasisCloser(s, i+len(d), d) {
+				flush()
+				*current = d
+				i += len(d)
+				continue
+			}
+		}
+
+		buf.WriteByte(s[i])
+		i++
+	}
+	flush()
+
+	return spans
+}
+
+func delimiterAt(s string, i int) string {
+	if s[i] != '*' && s[i] != '_' {
+		return ""
+	}
+	if i+1 < len(s) && s[i+1] == s[i] {
+		return s[i : i+2]
+	}
+	return s[i : i+1]
+}
+
+// Emphasis opens before non-space text, and underscores do not open inside words like snake_case
+func canOpenEmphasis(s string, i int, d string) bool {
+	next, _ := utf8.DecodeRuneInString(s[i+len(d):])
+	if i+len(d) >= len(s) || unicode.IsSpace(next) {
+		return false
+	}
+	if d[0] == '_' && i > 0 {
+		prev, _ := utf8.DecodeLastRuneInString(s[:i])
+		return !unicode.IsLetter(prev) && !unicode.IsDigit(prev)
+	}
+	return true
+}
+
+func canCloseEmphasis(s string, i int, d string) bool {
+	if i == 0 {
+		return false
+	}
+	prev, _ := utf8.DecodeLastRuneInString(s[:i])
+	if unicode.IsSpace(prev) {
+		return false
+	}
+	if d[0] == '_' && i+len(d) < len(s) {
+		next, _ := utf8.DecodeRuneInString(s[i+len(d):])
+		return !unicode.IsLetter(next) && !unicode.IsDigit(next)
+	}
+	return true
+}
+
+func hasEmphasisCloser(s string, from int, d string) bool {
+	for j := from; j < len(s); {
+		if s[j] == '\\' {
+			j += 2
+			continue
+		}
+		if c := delimiterAt(s, j); c != "" {
+			if c == d && canCloseEmphasis(s, j, d) {
+				return true
+			}
+			j += len(c)
+			continue
+		}
+		j++
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseRichTextBlocks(t *testing.T) {
+	input := "Dear landlord,\r\n\r\nThe following needs repair:\n- the **front** door\n- the sink,\n  which leaks\n\n3. First\n4) Second\nnot an item start\n\nThanks,\nJane"
+
+	want := []RichBlock{
+		{Kind: RichParagraph, Spans: []RichSpan{{Text: "Dear landlord,"}}},
+		{Kind: RichParagraph, Spans: []RichSpan{{Text: "The following needs repair:"}}},
+		{Kind: RichBulletList, Items: [][]RichSpan{
+			{{Text: "the "}, {Text: "front", Bold: true}, {Text: " door"}},
+			{{Text: "the sink, which leaks"}},
+		}},
+		{Kind: RichNumberedList, Start: 3, Items: [][]RichSpan{
+			{{Text: "First"}},
+			{{Text: "Second not an item start"}},
+		}},
+		{Kind: RichParagraph, Spans: []RichSpan{{Text: "Thanks,"}, {LineBreak: true}, {Text: "Jane"}}},
+	}
+
+	got := ParseRichText(input)
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		t.Fatalf("unexpected blocks: %s", gotJSON)
+	}
+}
+
+func TestParseRichTextParagraphFollowedByList(t *testing.T) {
+	got := ParseRichText("Issues:\n- mold\n* heat")
+	if len(got) != 2 || got[0].Kind != RichParagraph || got[1].Kind != RichBulletList || len(got[1].Items) != 2 {
+		gotJSON, _ := json.Marshal(got)
+		t.Fatalf("unexpected blocks: %s", gotJSON)
+	}
+}
+
+func TestParseInline(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []RichSpan
+	}{
+		{"plain", []RichSpan{{Text: "plain"}}},
+		{"**bold** and *italic*", []RichSpan{{Text: "bold", Bold: true}, {Text: " and "}, {Text: "italic", Italic: true}}},
+		{"__bold__ _italic_", []RichSpan{{Text: "bold", Bold: true}, {Text: " "}, {Text: "italic", Italic: true}}},
+		{"***both***", []RichSpan{{Text: "both", Bold: true, Italic: true}}},
+		{"**bold *and italic***", []RichSpan{{Text: "bold ", Bold: true}, {Text: "and italic", Bold: true, Italic: true}}},
+		{"5 * 3 * 2", []RichSpan{{Text: "5 * 3 * 2"}}},
+		{"unclosed **bold", []RichSpan{{Text: "unclosed **bold"}}},
+		{"snake_case_name", []RichSpan{{Text: "snake_case_name"}}},
+		{`\*not italic\*`, []RichSpan{{Text: "*not italic*"}}},
+		{"**mixed__", []RichSpan{{Text: "**mixed__"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := parseInline(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseRichTextKeepsMarkupLiteral(t *testing.T) {
+	inputs := []string{
+		`#set text(1000pt)`,
+		`] #set page(paper: "a0") [`,
+		`# Heading`,
+		`[link](https://example.com)`,
+		"`raw`",
+	}
+
+	for _, in := range inputs {
+		got := ParseRichText(in)
+		want := []RichBlock{{Kind: RichParagraph, Spans: []RichSpan{{Text: in}}}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be kept as literal text, got %+v", in, got)
+		}
+	}
+}
+
+func TestRichTextJSONKeepsEmptySpansAndZeroStart(t *testing.T) {
+	for _, input := range []string{"****", "0. First\n1. Second"} {
+		b, err := json.Marshal(ParseRichText(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var blocks []map[string]any
+		if err := json.Unmarshal(b, &blocks); err != nil {
+			t.Fatal(err)
+		}
+		if len(blocks) != 1 {
+			t.Fatalf("%q: expected one block, got %s", input, b)
+		}
+		key := "spans"
+		if blocks[0]["kind"] == RichNumberedList {
+			key = "start"
+		}
+		if v, ok := blocks[0][key]; !ok || v == nil {
+			t.Fatalf("%q: expected %s to be encoded, got %s", input, key, b)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidRulePack = errors.New("invalid rule pack")
+)
+
+// RulePack holds the law of one jurisdiction which letters may reference: verbatim citations,
+// notice periods and recommended wording. A state pack applies to the whole state, and a pack with
+// a city adds to the pack of its state.
+type RulePack struct {
+	// USPS state code
+	State string `yaml:"state"`
+	// Empty for a state-wide pack
+	City string `yaml:"city"`
+	Name string `yaml:"name"`
+
+	Citations          []Citation     `yaml:"citations"`
+	NoticePeriods      []NoticePeriod `yaml:"noticePeriods"`
+	RecommendedWording []string       `yaml:"recommendedWording"`
+}
+
+// Citation is a verbatim excerpt of a statute or ordinance
+type Citation struct {
+	Reference string `yaml:"reference" json:"reference"`
+	Title     string `yaml:"title" json:"title"`
+	Text      string `yaml:"text" json:"text"`
+	Source    string `yaml:"source" json:"-"`
+}
+
+// NoticePeriod is a period of time the law sets for a purpose, such as the most time a landlord may
+// take to make repairs
+type NoticePeriod struct {
+	Purpose string `yaml:"purpose"`
+	Days    int    `yaml:"days"`
+	Hours   int    `yaml:"hours"`
+	// Count the days as business days, skipping weekends and holidays
+	BusinessDays bool   `yaml:"businessDays"`
+	Citation     string `yaml:"citation"`
+	Description  string `yaml:"description"`
+}
+
+//go:embed rulepacks/*.yaml
+var rulePackFiles embed.FS
+
+var rulePacks []RulePack
+
+func init() {
+	var err error
+	rulePacks, err = LoadRulePacks(rulePackFiles)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// LoadRulePacks reads every .yaml file of the rulepacks directory
+func LoadRulePacks(fsys fs.FS) ([]RulePack, error) {
+	files, err := fs.Glob(fsys, "rulepacks/*.yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	var packs []RulePack
+	seen := make(map[string]string)
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		var pack RulePack
+		d := yaml.NewDecoder(bytes.NewReader(data))
+		d.KnownFields(true)
+		if err := d.Decode(&pack); err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrInvalidRulePack, path.Base(file), err)
+		}
+		if err := pack.validate(); err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrInvalidRulePack, path.Base(file), err)
+		}
+
+		key := pack.State + "/" + strings.ToUpper(pack.City)
+		if other, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%w %s: same jurisdiction as %s", ErrInvalidRulePack, path.Base(file), other)
+		}
+		seen[key] = path.Base(file)
+		packs = append(packs, pack)
+	}
+
+	return packs, nil
+}
+
+func (p RulePack) validate() error {
+	if _, ok := usStates[p.State]; !ok {
+		return fmt.Errorf("%q is not a USPS state code", p.State)
+	}
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	for _, c := range p.Citations {
+		if c.Reference == "" || strings.TrimSpace(c.Text) == "" {
+			return errors.New("citations require a reference and text")
+		}
+	}
+	for _, n := range p.NoticePeriods {
+		if n.Purpose == "" || (n.Days <= 0) == (n.Hours <= 0) {
+			return fmt.Errorf("notice period %q requires a purpose and either days or hours", n.Purpose)
+		}
+		if n.BusinessDays && n.Days <= 0 {
+			return fmt.Errorf("notice period %q can only count days as business days", n.Purpose)
+		}
+	}
+	return nil
+}
+
+// SelectRulePack returns the rule pack for a state and city, or nil when there is none. The pack of
+// a city includes the citations and wording of its state, and overrides its notice periods.
+func SelectRulePack(packs []RulePack, state, city string) *RulePack {
+	state = NormalizeAddress(LetterAddress{State: state}).State
+	city = strings.ToUpper(strings.TrimSpace(city))
+
+	var statePack, cityPack *RulePack
+	for i := range packs {
+		if packs[i].State != state {
+			continue
+		}
+		switch strings.ToUpper(packs[i].City) {
+		case "":
+			statePack = &packs[i]
+		case city:
+			cityPack = &packs[i]
+		}
+	}
+
+	switch {
+	case cityPack == nil && statePack == nil:
+		return nil
+	case cityPack == nil:
+		p := *statePack
+		return &p
+	case statePack == nil:
+		p := *cityPack
+		return &p
+	}
+
+	p := *cityPack
+	p.Citations = append(append([]Citation{}, statePack.Citations...), cityPack.Citations...)
+	p.RecommendedWording = append(append([]string{}, statePack.RecommendedWording...), cityPack.RecommendedWording...)
+	p.NoticePeriods = append([]NoticePeriod{}, cityPack.NoticePeriods...)
+	for _, n := range statePack.NoticePeriods {
+		if p.NoticePeriod(n.Purpose) == nil {
+			p.NoticePeriods = append(p.NoticePeriods, n)
+		}
+	}
+	return &p
+}
+
+// NoticePeriod returns the notice period for a purpose, or nil
+func (p *RulePack) NoticePeriod(purpose string) *NoticePeriod {
+	for i := range p.NoticePeriods {
+		if p.NoticePeriods[i].Purpose == purpose {
+			return &p.NoticePeriods[i]
+		}
+	}
+	return nil
+}
+
+// PromptContext describes the pack for the system prompt, which allows quoting laws verbatim
+func (p *RulePack) PromptContext() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "The letter is subject to the law of %s. ", p.Name)
+	b.WriteString("If the tenant's concerns relate to the following laws, you may quote them verbatim, without elaboration and only if relevant:\n")
+	for _, c := range p.Citations {
+		fmt.Fprintf(&b, "%s (%s):\n%s\n", c.Reference, c.Title, strings.TrimSpace(c.Text))
+	}
+	if len(p.RecommendedWording) > 0 {
+		b.WriteString("You may use the following wording as written:\n")
+		for _, w := range p.RecommendedWording {
+			fmt.Fprintf(&b, "- %s\n", w)
+		}
+	}
+	return b.String()
+}
+
+// GroundingText is the text of the pack the model is told it may quote: the references and text of
+// the citations, the recommended wording and the notice periods. Their numbers, such as "5321.07"
+// or "30 days", are supported in letters, see VerifyGrounding.
+func (p *RulePack) GroundingText() string {
+	var b strings.Builder
+	for _, c := range p.Citations {
+		fmt.Fprintf(&b, "%s\n%s\n%s\n", c.Reference, c.Title, c.Text)
+	}
+	for _, w := range p.RecommendedWording {
+		b.WriteString(w + "\n")
+	}
+	for _, n := range p.NoticePeriods {
+		fmt.Fprintf(&b, "%d days %d hours %s\n%s\n", n.Days, n.Hours, n.Citation, n.Description)
+	}
+	return b.String()
+}
+
+// LetterJurisdiction is the part of a rule pack shown in the letter
+type LetterJurisdiction struct {
+	Name      string     `json:"name"`
+	Wording   []string   `json:"wording"`
+	Citations []Citation `json:"citations"`
+}
+
+func (p *RulePack) Letter() *LetterJurisdiction {
+	// The template iterates over both lists, so they are never null
+	return &LetterJurisdiction{
+		Name:      p.Name,
+		Wording:   append([]string{}, p.RecommendedWording...),
+		Citations: append([]Citation{}, p.Citations...),
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedRulePacksAreValid(t *testing.T) {
+	if len(rulePacks) == 0 {
+		t.Fatal("expected embedded rule packs")
+	}
+	for _, p := range rulePacks {
+		for _, c := range p.Citations {
+			if !strings.HasPrefix(c.Source, "https://") {
+				t.Errorf("%s: citation %s should link to its source", p.Name, c.Reference)
+			}
+		}
+		if !strings.Contains(p.PromptContext(), p.Name) {
+			t.Errorf("%s: expected the prompt context to name the jurisdiction", p.Name)
+		}
+	}
+}
+
+func TestOhioRulePack(t *testing.T) {
+	p := SelectRulePack(rulePacks, "Ohio", "Columbus")
+	if p == nil || p.State != "OH" {
+		t.Fatal("expected the Ohio rule pack")
+	}
+
+	references := make([]string, 0, len(p.Citations))
+	for _, c := range p.Citations {
+		references = append(references, c.Reference)
+	}
+	if got := strings.Join(references, ", "); got != "Ohio Revised Code 5321.04(A), Ohio Revised Code 5321.07(A)" {
+		t.Fatalf("unexpected citations %s", got)
+	}
+	if !strings.Contains(p.Citations[0].Text, "fit and habitable condition") {
+		t.Error("expected 5321.04 to include the habitability obligation")
+	}
+	if !strings.Contains(p.Citations[1].Text, "The notice shall be sent to the person or place where rent is normally paid.") {
+		t.Error("expected 5321.07 to include where the notice is sent")
+	}
+
+	if n := p.NoticePeriod("repair"); n == nil || n.Days != 30 {
+		t.Errorf("expected a 30 day repair notice period, got %+v", n)
+	}
+	if n := p.NoticePeriod("entry"); n == nil || n.Hours != 24 {
+		t.Errorf("expected a 24 hour entry notice period, got %+v", n)
+	}
+
+	if SelectRulePack(rulePacks, "CA", "Los Angeles") != nil {
+		t.Error("expected no rule pack for California")
+	}
+}
+
+func TestSelectRulePackCityExtendsState(t *testing.T) {
+	fsys := fstest.MapFS{
+		"rulepacks/state.yaml": {Data: []byte(`
+state: OH
+name: Ohio
+citations:
+  - {reference: State law, title: State, text: state text}
+noticePeriods:
+  - {purpose: repair, days: 30}
+  - {purpose: entry, hours: 24}
+recommendedWording: [state wording]
+`)},
+		"rulepacks/city.yaml": {Data: []byte(`
+state: OH
+city: Columbus
+name: Columbus, Ohio
+citations:
+  - {reference: City code, title: City, text: city text}
+noticePeriods:
+  - {purpose: repair, days: 14}
+`)},
+	}
+	packs, err := LoadRulePacks(fsys)
+	if err != nil {
+		t.Fatalf("failed to load packs: %v", err)
+	}
+
+	p := SelectRulePack(packs, "oh", " columbus ")
+	if p == nil || p.Name != "Columbus, Ohio" {
+		t.Fatalf("expected the Columbus pack, got %+v", p)
+	}
+	if len(p.Citations) != 2 || p.Citations[0].Reference != "State law" || p.Citations[1].Reference != "City code" {
+		t.Errorf("expected state and city citations, got %+v", p.Citations)
+	}
+	if len(p.RecommendedWording) != 1 {
+		t.Errorf("expected the state wording, got %v", p.RecommendedWording)
+	}
+	if p.NoticePeriod("repair").Days != 14 || p.NoticePeriod("entry").Hours != 24 {
+		t.Errorf("expected the city repair period and the state entry period, got %+v", p.NoticePeriods)
+	}
+
+	if p := SelectRulePack(packs, "OH", "Dayton"); p == nil || p.Name != "Ohio" {
+		t.Fatalf("expected the state pack for other cities, got %+v", p)
+	}
+}
+
+func TestLoadRulePacksRejectsInvalid(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"unknown field":                {"rulepacks/a.yaml": {Data: []byte("state: OH\nname: Ohio\nstatute: x\n")}},
+		"unknown state":                {"rulepacks/a.yaml": {Data: []byte("state: XX\nname: Nowhere\n")}},
+		"empty citation":               {"rulepacks/a.yaml": {Data: []byte("state: OH\nname: Ohio\ncitations: [{reference: ORC}]\n")}},
+		"notice period without length": {"rulepacks/a.yaml": {Data: []byte("state: OH\nname: Ohio\nnoticePeriods: [{purpose: repair}]\n")}},
+		"duplicate jurisdiction": {
+			"rulepacks/a.yaml": {Data: []byte("state: OH\nname: Ohio\n")},
+			"rulepacks/b.yaml": {Data: []byte("state: OH\nname: Ohio again\n")},
+		},
+	}
+
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadRulePacks(fsys); !errors.Is(err, ErrInvalidRulePack) {
+				t.Fatalf("expected ErrInvalidRulePack, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTextHandlerIncludesRulePack(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	for _, state := range []string{"OH", "CA"} {
+		ip := &promptRecordingProvider{}
+		r := router{ip: ip, altcha: altchaService}
+
+		altchaToken, err := createValidAltcha(altchaService.secret)
+		if err != nil {
+			t.Fatalf("failed to create altcha token: %v", err)
+		}
+		body, _ := json.Marshal(map[string]any{
+			"altcha":        altchaToken,
+			"answers":       map[string]string{"mainProblem": "no heat"},
+			"receiverState": state,
+		})
+		w := httptest.NewRecorder()
+
+		r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, w.Result().StatusCode)
+		}
+		if got := strings.Contains(ip.prompts[0], "5321.04"); got != (state == "OH") {
+			t.Errorf("%s: expected the prompt to include Ohio law: %v", state, state == "OH")
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"strings"
+)
+
+var (
+	ErrSignatureImageTooLarge = errors.New("signature image is too large")
+	ErrInvalidSignatureImage  = errors.New("signature image is not a valid png")
+)
+
+// Signatures are drawn on a small canvas, so these limits are generous while keeping the image well
+// within MaxRequestBodySize once base64 encoded.
+const (
+	MaxSignatureImageSize   = 32 * 1024
+	MaxSignatureImageWidth  = 1200
+	MaxSignatureImageHeight = 600
+)
+
+// Name of the signature image in the letter assets directory
+const signatureImageAsset = "signature.png"
+
+// DecodeSignatureImage validates a base64 encoded png, optionally given as a data URL, and
+// re-encodes it. Re-encoding drops every ancillary chunk so no metadata from the user's device
+// reaches the letter.
+func DecodeSignatureImage(encoded string) ([]byte, error) {
+	encoded = strings.TrimPrefix(encoded, "data:image/png;base64,")
+	if base64.StdEncoding.DecodedLen(len(encoded)) > MaxSignatureImageSize {
+		return nil, ErrSignatureImageTooLarge
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidSignatureImage
+	}
+
+	// Check the dimensions before decoding so a small file cannot expand into a huge image
+	cfg, err := png.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrInvalidSignatureImage
+	}
+	if cfg.Width > MaxSignatureImageWidth || cfg.Height > MaxSignatureImageHeight {
+		return nil, ErrSignatureImageTooLarge
+	}
+
+	img, err := png.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrInvalidSignatureImage
+	}
+
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
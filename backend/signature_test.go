@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func encodeTestPng(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := range width {
+		img.Set(x, height/2, color.Black)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// withTextChunk inserts a tEXt chunk after the IHDR chunk of a png.
+func withTextChunk(p []byte, text string) []byte {
+	data := []byte("Comment\x00" + text)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// 8 byte signature followed by the 25 byte IHDR chunk
+	out := append([]byte{}, p[:33]...)
+	out = append(out, chunk...)
+	return append(out, p[33:]...)
+}
+
+func TestDecodeSignatureImageStripsMetadata(t *testing.T) {
+	original := withTextChunk(encodeTestPng(t, 300, 100), "GPS 40.0,-83.0")
+	if _, err := png.Decode(bytes.NewReader(original)); err != nil {
+		t.Fatalf("test png is invalid: %v", err)
+	}
+
+	for _, encoded := range []string{
+		base64.StdEncoding.EncodeToString(original),
+		"data:image/png;base64," + base64.StdEncoding.EncodeToString(original),
+	} {
+		out, err := DecodeSignatureImage(encoded)
+		if err != nil {
+			t.Fatalf("expected valid signature, got %v", err)
+		}
+		if bytes.Contains(out, []byte("tEXt")) || bytes.Contains(out, []byte("GPS")) {
+			t.Fatal("expected metadata to be stripped")
+		}
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("expected re-encoded png to decode, got %v", err)
+		}
+		if img.Bounds().Dx() != 300 || img.Bounds().Dy() != 100 {
+			t.Fatalf("expected 300x100 image, got %v", img.Bounds())
+		}
+	}
+}
+
+func TestDecodeSignatureImageRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		want    error
+	}{
+		{"not base64", "not base64!", ErrInvalidSignatureImage},
+		{"not png", base64.StdEncoding.EncodeToString([]byte("GIF89a")), ErrInvalidSignatureImage},
+		{"too wide", base64.StdEncoding.EncodeToString(encodeTestPng(t, MaxSignatureImageWidth+1, 10)), ErrSignatureImageTooLarge},
+		{"too many bytes", base64.StdEncoding.EncodeToString(make([]byte, MaxSignatureImageSize+1)), ErrSignatureImageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeSignatureImage(tt.encoded)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestPdfHandlerInvalidSignatureImage(t *testing.T) {
+	r := router{}
+
+	reqBodyBytes, _ := json.Marshal(map[string]string{
+		"senderName":      "someone",
+		"senderAddress":   "1 Main St",
+		"senderCity":      "Columbus",
+		"senderState":     "OH",
+		"senderZip":       "43215",
+		"receiverName":    "someone else",
+		"receiverAddress": "2 High St",
+		"receiverCity":    "Columbus",
+		"receiverState":   "OH",
+		"receiverZip":     "43215",
+		"body":            "Lorem ipsum dolor sit amet.",
+		"signatureImage":  base64.StdEncoding.EncodeToString([]byte("not a png")),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/pdf", bytes.NewReader(reqBodyBytes))
+	w := httptest.NewRecorder()
+
+	r.pdf(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	ErrPdfSigningKeyNotDefined = errors.New("environment variable PDF_SIGNING_KEY is not defined")
+	ErrUnsupportedSigningKey   = errors.New("unsupported signing key type")
+	ErrSigningKeyMismatch      = errors.New("signing key does not match the signing certificate")
+	ErrUnsupportedPdf          = errors.New("pdf structure is not supported for signing")
+	ErrPdfNotSigned            = errors.New("pdf does not contain a signature")
+	ErrMalformedPdfSignature   = errors.New("pdf signature is malformed")
+)
+
+// Number of bytes reserved in the PDF for the DER encoded CMS signature. It is written as hex so
+// the placeholder in the file is twice this size. A certificate chain of a few certificates fits
+// comfortably.
+const pdfSignatureReservedSize = 16 * 1024
+
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidAttrContentType      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningCertV2    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidSHA256               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidRSAEncryption        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384      = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512      = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidECPublicKey          = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	signatureAlgorithmsByID = map[string]x509.SignatureAlgorithm{
+		oidSHA256WithRSA.String():   x509.SHA256WithRSA,
+		oidSHA384WithRSA.String():   x509.SHA384WithRSA,
+		oidSHA512WithRSA.String():   x509.SHA512WithRSA,
+		oidECDSAWithSHA256.String(): x509.ECDSAWithSHA256,
+		oidECDSAWithSHA384.String(): x509.ECDSAWithSHA384,
+		oidECDSAWithSHA512.String(): x509.ECDSAWithSHA512,
+	}
+)
+
+// CMS structures from RFC 5652. Only the subset needed for a detached PAdES signature is modelled.
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	Sid                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// PdfSigner adds a PAdES baseline (ETSI.CAdES.detached) signature to rendered letters so that
+// tenants can later prove a letter has not been altered since it was generated.
+type PdfSigner struct {
+	key   crypto.Signer
+	chain []*x509.Certificate
+}
+
+// NewPdfSignerFromEnv loads the server signing certificate. Configure it using environment variables:
+//   - PDF_SIGNING_CERT: Path to a PEM file containing the certificate followed by any intermediates
+//   - PDF_SIGNING_KEY: Path to a PEM file containing the private key of the certificate
+//
+// A nil signer is returned without an error when PDF_SIGNING_CERT is not defined.
+func NewPdfSignerFromEnv() (*PdfSigner, error) {
+	certPath := os.Getenv("PDF_SIGNING_CERT")
+	if certPath == "" {
+		return nil, nil
+	}
+
+	keyPath := os.Getenv("PDF_SIGNING_KEY")
+	if keyPath == "" {
+		return nil, ErrPdfSigningKeyNotDefined
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	return NewPdfSigner(certPEM, keyPEM)
+}
+
+// NewPdfSigner creates a signer from a PEM encoded certificate chain and private key.
+func NewPdfSigner(certPEM, keyPEM []byte) (*PdfSigner, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate found in signing certificate file")
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no private key found in signing key file")
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPdfSigner(key, chain)
+}
+
+// NewPdfSignerFromPKCS12 creates a signer from a PKCS#12 bundle, such as one supplied with a request
+// by a legal aid partner who wants letters signed with their own certificate.
+func NewPdfSignerFromPKCS12(data []byte, password string) (*PdfSigner, error) {
+	key, cert, intermediates, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pkcs12: %w", err)
+	}
+
+	return newPdfSigner(key, append([]*x509.Certificate{cert}, intermediates...))
+}
+
+func newPdfSigner(key any, chain []*x509.Certificate) (*PdfSigner, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedSigningKey
+	}
+	switch signer.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, ErrUnsupportedSigningKey
+	}
+	// Signatures made with a key which does not belong to the leaf certificate never verify
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(chain[0].PublicKey) {
+		return nil, ErrSigningKeyMismatch
+	}
+
+	return &PdfSigner{key: signer, chain: chain}, nil
+}
+
+func parsePrivateKey(der []byte) (any, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("failed to parse signing key")
+}
+
+// Roots returns a pool trusting the root of the signer's certificate chain.
+func (s *PdfSigner) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.chain[len(s.chain)-1])
+	return pool
+}
+
+// loadTrustedCerts builds the pool used when verifying uploaded letters. It trusts the server
+// signing certificate and any certificates in the PEM file at PDF_TRUSTED_CERTS, which is where the
+// certificates of legal aid partners signing with their own keys belong. A nil pool is returned
+// when neither is configured.
+func loadTrustedCerts(signer *PdfSigner) (*x509.CertPool, error) {
+	var pool *x509.CertPool
+	if signer != nil {
+		pool = signer.Roots()
+	}
+
+	path := os.Getenv("PDF_TRUSTED_CERTS")
+	if path == "" {
+		return pool, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted certificates: %w", err)
+	}
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in trusted certificates file")
+	}
+
+	return pool, nil
+}
+
+// Sign appends an incremental update to the pdf containing an invisible signature field covering
+// the whole original document.
+func (s *PdfSigner) Sign(pdf []byte, signingTime time.Time) ([]byte, error) {
+	return s.sign(pdf, signingTime, "")
+}
+
+// SignLetter signs a letter like Sign and records the digest of its addresses in the signature
+// dictionary, so that the letter can only be mailed between the addresses it was rendered for.
+func (s *PdfSigner) SignLetter(pdf []byte, signingTime time.Time, sender, receiver LetterAddress) ([]byte, error) {
+	return s.sign(pdf, signingTime, mailingDigest(sender, receiver))
+}
+
+func (s *PdfSigner) sign(pdf []byte, signingTime time.Time, mailing string) ([]byte, error) {
+	trailer, err := readPdfTrailer(pdf)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, err := findPdfObject(pdf, trailer.root)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(catalog.dict, []byte("/AcroForm")) {
+		return nil, fmt.Errorf("%w: document already has a form", ErrUnsupportedPdf)
+	}
+
+	page, err := findFirstPdfPage(pdf, catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldRef := pdfRef{num: trailer.size}
+	sigRef := pdfRef{num: trailer.size + 1}
+
+	pageDict, err := addPdfAnnotation(page.dict, fieldRef)
+	if err != nil {
+		return nil, err
+	}
+	catalogDict := insertIntoPdfDict(catalog.dict, fmt.Sprintf(" /AcroForm << /Fields [%s] /SigFlags 3 >>", fieldRef))
+
+	byteRangePlaceholder := "[0 0000000000 0000000000 0000000000]"
+	contentsPlaceholder := "<" + string(bytes.Repeat([]byte("0"), pdfSignatureReservedSize*2)) + ">"
+	// The signature dictionary is covered by the signature except for its contents
+	var mailingEntry string
+	if mailing != "" {
+		mailingEntry = fmt.Sprintf(" /BetterSaidMailing <%s>", mailing)
+	}
+
+	objects := []struct {
+		ref  pdfRef
+		body string
+	}{
+		{catalog.ref, string(catalogDict)},
+		{page.ref, string(pageDict)},
+		{fieldRef, fmt.Sprintf("<< /Type /Annot /Subtype /Widget /FT /Sig /T (Signature1) /Rect [0 0 0 0] /F 132 /P %s /V %s >>", page.ref, sigRef)},
+		{sigRef, fmt.Sprintf("<< /Type /Sig /Filter /Adobe.PPKLite /SubFilter /ETSI.CAdES.detached /M (D:%s)%s /ByteRange %s /Contents %s >>",
+			signingTime.UTC().Format("20060102150405Z"), mailingEntry, byteRangePlaceholder, contentsPlaceholder)},
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].ref.num < objects[j].ref.num })
+
+	out := bytes.NewBuffer(make([]byte, 0, len(pdf)+len(contentsPlaceholder)+4096))
+	out.Write(pdf)
+	if !bytes.HasSuffix(pdf, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+
+	offsets := make([]int, len(objects))
+	for i, o := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(out, "%d %d obj\n%s\nendobj\n", o.ref.num, o.ref.gen, o.body)
+	}
+
+	xrefOffset := out.Len()
+	out.WriteString("xref\n")
+	for i := 0; i < len(objects); {
+		j := i + 1
+		for j < len(objects) && objects[j].ref.num == objects[j-1].ref.num+1 {
+			j++
+		}
+		fmt.Fprintf(out, "%d %d\n", objects[i].ref.num, j-i)
+		for k := i; k < j; k++ {
+			fmt.Fprintf(out, "%010d %05d n\r\n", offsets[k], objects[k].ref.gen)
+		}
+		i = j
+	}
+	fmt.Fprintf(out, "trailer\n<< /Size %d /Root %s /Prev %d", sigRef.num+1, trailer.root, trailer.startXref)
+	if trailer.id != "" {
+		fmt.Fprintf(out, " /ID %s", trailer.id)
+	}
+	fmt.Fprintf(out, " >>\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+
+	signed := out.Bytes()
+
+	contentsStart := bytes.LastIndex(signed, []byte(contentsPlaceholder))
+	contentsEnd := contentsStart + len(contentsPlaceholder)
+	byteRange := fmt.Sprintf("[0 %d %d %d]", contentsStart, contentsEnd, len(signed)-contentsEnd)
+	byteRange += string(bytes.Repeat([]byte(" "), len(byteRangePlaceholder)-len(byteRange)))
+	byteRangeStart := bytes.LastIndex(signed[:contentsStart], []byte(byteRangePlaceholder))
+	copy(signed[byteRangeStart:], byteRange)
+
+	digest := sha256.New()
+	digest.Write(signed[:contentsStart])
+	digest.Write(signed[contentsEnd:])
+
+	cms, err := s.signDigest(digest.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(cms) > pdfSignatureReservedSize {
+		return nil, fmt.Errorf("signature of %d bytes does not fit in reserved space", len(cms))
+	}
+	hex.Encode(signed[contentsStart+1:], cms)
+
+	return signed, nil
+}
+
+// signDigest builds a detached CMS SignedData structure over the given SHA-256 digest.
+func (s *PdfSigner) signDigest(digest []byte) ([]byte, error) {
+	leaf := s.chain[0]
+	certHash := sha256.Sum256(leaf.Raw)
+
+	attrs := make([][]byte, 0, 3)
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value any
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrMessageDigest, digest},
+		{oidAttrSigningCertV2, signingCertificateV2{Certs: []essCertIDv2{{CertHash: certHash[:]}}}},
+	} {
+		value, err := asn1.Marshal(a.value)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(cmsAttribute{
+			Type:   a.oid,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	// DER requires the members of a SET OF to be sorted by their encoding
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	attrBytes := bytes.Join(attrs, nil)
+
+	signedAttrs, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attrBytes})
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(signedAttrs)
+
+	var sigAlg asn1.ObjectIdentifier
+	switch s.key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = oidSHA256WithRSA
+	case *ecdsa.PublicKey:
+		sigAlg = oidECDSAWithSHA256
+	default:
+		return nil, ErrUnsupportedSigningKey
+	}
+
+	signature, err := s.key.Sign(nil, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+
+	var certs []byte
+	for _, c := range s.chain {
+		certs = append(certs, c.Raw...)
+	}
+
+	signedData, err := asn1.Marshal(cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: cmsEncapContentInfo{EContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			Sid:                cmsIssuerAndSerial{Issuer: asn1.RawValue{FullBytes: leaf.RawIssuer}, SerialNumber: leaf.SerialNumber},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrBytes},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg},
+			Signature:          signature,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+}
+
+// PdfSignatureInfo describes the last signature found in a pdf.
+type PdfSignatureInfo struct {
+	// The signature matches the signed bytes of the document
+	Valid bool `json:"valid"`
+	// The signature covers the whole file, i.e. nothing was appended after signing
+	CoversWholeDocument bool `json:"coversWholeDocument"`
+	// The signing certificate chains to a trusted root
+	Trusted bool `json:"trusted"`
+	// Subject of the signing certificate
+	Signer string `json:"signer"`
+	// Signing time claimed by the signer, as written in the signature dictionary
+	SignedAt string `json:"signedAt,omitempty"`
+	// Digest of the addresses a letter signed with SignLetter was rendered for
+	MailingDigest string `json:"-"`
+}
+
+var (
+	byteRangePattern = regexp.MustCompile(`/ByteRange\s*\[\s*(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s*\]`)
+	signedAtPattern  = regexp.MustCompile(`/M\s*\(D:(\d{14})`)
+	mailingPattern   = regexp.MustCompile(`/BetterSaidMailing\s*<([0-9a-f]{64})>`)
+)
+
+// VerifyPdfSignature checks the integrity of the last signature in the pdf. Certificates are
+// checked against roots when it is not nil.
+func VerifyPdfSignature(pdf []byte, roots *x509.CertPool) (*PdfSignatureInfo, error) {
+	matches := byteRangePattern.FindAllSubmatchIndex(pdf, -1)
+	if len(matches) == 0 {
+		return nil, ErrPdfNotSigned
+	}
+	m := matches[len(matches)-1]
+
+	var byteRange [4]int
+	for i := range byteRange {
+		n, err := strconv.Atoi(string(pdf[m[2+2*i]:m[3+2*i]]))
+		if err != nil {
+			return nil, ErrMalformedPdfSignature
+		}
+		byteRange[i] = n
+	}
+	// Each offset and length is checked on its own since their sum can overflow
+	if byteRange[0] != 0 || byteRange[1] < 0 || byteRange[3] < 0 || byteRange[1] >= byteRange[2] ||
+		byteRange[2] > len(pdf) || byteRange[3] > len(pdf)-byteRange[2] {
+		return nil, ErrMalformedPdfSignature
+	}
+
+	contents := bytes.Trim(pdf[byteRange[1]:byteRange[2]], "<>")
+	der := make([]byte, hex.DecodedLen(len(contents)))
+	if _, err := hex.Decode(der, contents); err != nil {
+		return nil, ErrMalformedPdfSignature
+	}
+
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		return nil, ErrMalformedPdfSignature
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil || len(sd.SignerInfos) == 0 {
+		return nil, ErrMalformedPdfSignature
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, ErrMalformedPdfSignature
+	}
+
+	si := sd.SignerInfos[0]
+	var leaf *x509.Certificate
+	for _, c := range certs {
+		if c.SerialNumber.Cmp(si.Sid.SerialNumber) == 0 && bytes.Equal(c.RawIssuer, si.Sid.Issuer.FullBytes) {
+			leaf = c
+		}
+	}
+	if leaf == nil {
+		return nil, ErrMalformedPdfSignature
+	}
+
+	info := &PdfSignatureInfo{
+		CoversWholeDocument: byteRange[2]+byteRange[3] == len(pdf),
+		Signer:              leaf.Subject.String(),
+	}
+	// The signing time may be on either side of the contents in the signature dictionary
+	sigObjStart := max(bytes.LastIndex(pdf[:m[0]], []byte("obj")), 0)
+	sigObjEnd := bytes.Index(pdf[byteRange[2]:], []byte("endobj"))
+	if sigObjEnd < 0 {
+		sigObjEnd = len(pdf)
+	} else {
+		sigObjEnd += byteRange[2]
+	}
+	sigObj := append(bytes.Clone(pdf[sigObjStart:byteRange[1]]), pdf[byteRange[2]:sigObjEnd]...)
+	if sm := signedAtPattern.FindSubmatch(sigObj); sm != nil {
+		if t, err := time.Parse("20060102150405", string(sm[1])); err == nil {
+			info.SignedAt = t.Format(time.RFC3339)
+		}
+	}
+	if mm := mailingPattern.FindSubmatch(sigObj); mm != nil {
+		info.MailingDigest = string(mm[1])
+	}
+
+	h, err := cmsHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(pdf[:byteRange[1]])
+	h.Write(pdf[byteRange[2] : byteRange[2]+byteRange[3]])
+	digest := h.Sum(nil)
+
+	var messageDigest []byte
+	rest := si.SignedAttrs.Bytes
+	for len(rest) > 0 {
+		var attr cmsAttribute
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			return nil, ErrMalformedPdfSignature
+		}
+		if attr.Type.Equal(oidAttrMessageDigest) {
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &messageDigest); err != nil {
+				return nil, ErrMalformedPdfSignature
+			}
+		}
+	}
+
+	signedAttrs, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	if err != nil {
+		return nil, err
+	}
+
+	sigAlg, err := cmsSignatureAlgorithm(si.SignatureAlgorithm.Algorithm, si.DigestAlgorithm.Algorithm, leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Valid = bytes.Equal(messageDigest, digest) && leaf.CheckSignature(sigAlg, signedAttrs, si.Signature) == nil
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, c := range certs {
+			if c != leaf {
+				intermediates.AddCert(c)
+			}
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		info.Trusted = err == nil
+	}
+
+	return info, nil
+}
+
+func cmsHash(oid asn1.ObjectIdentifier) (hash.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return sha256.New(), nil
+	case oid.Equal(oidSHA384):
+		return sha512.New384(), nil
+	case oid.Equal(oidSHA512):
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported digest algorithm %s", ErrMalformedPdfSignature, oid)
+}
+
+func cmsSignatureAlgorithm(sigOID, digestOID asn1.ObjectIdentifier, cert *x509.Certificate) (x509.SignatureAlgorithm, error) {
+	if alg, ok := signatureAlgorithmsByID[sigOID.String()]; ok {
+		return alg, nil
+	}
+
+	// Some signers only name the key algorithm and rely on the digest algorithm for the hash
+	if sigOID.Equal(oidRSAEncryption) || sigOID.Equal(oidECPublicKey) {
+		rsaKey := cert.PublicKeyAlgorithm == x509.RSA
+		switch {
+		case digestOID.Equal(oidSHA256) && rsaKey:
+			return x509.SHA256WithRSA, nil
+		case digestOID.Equal(oidSHA384) && rsaKey:
+			return x509.SHA384WithRSA, nil
+		case digestOID.Equal(oidSHA512) && rsaKey:
+			return x509.SHA512WithRSA, nil
+		case digestOID.Equal(oidSHA256):
+			return x509.ECDSAWithSHA256, nil
+		case digestOID.Equal(oidSHA384):
+			return x509.ECDSAWithSHA384, nil
+		case digestOID.Equal(oidSHA512):
+			return x509.ECDSAWithSHA512, nil
+		}
+	}
+
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("%w: unsupported signature algorithm %s", ErrMalformedPdfSignature, sigOID)
+}
+
+// Minimal pdf object model used to append an incremental update. Typst writes uncompressed objects
+// with a classic cross reference table which is all that is supported here.
+
+type pdfRef struct {
+	num int
+	gen int
+}
+
+func (r pdfRef) String() string {
+	return fmt.Sprintf("%d %d R", r.num, r.gen)
+}
+
+type pdfObject struct {
+	ref  pdfRef
+	dict []byte
+}
+
+type pdfTrailer struct {
+	root      pdfRef
+	size      int
+	startXref int
+	id        string
+}
+
+var (
+	startXrefPattern = regexp.MustCompile(`startxref\s+(\d+)`)
+	rootPattern      = regexp.MustCompile(`/Root\s+(\d+)\s+(\d+)\s+R`)
+	sizePattern      = regexp.MustCompile(`/Size\s+(\d+)`)
+	idPattern        = regexp.MustCompile(`/ID\s*\[\s*<[0-9A-Fa-f]*>\s*<[0-9A-Fa-f]*>\s*\]`)
+	pagesPattern     = regexp.MustCompile(`/Pages\s+(\d+)\s+(\d+)\s+R`)
+	kidsPattern      = regexp.MustCompile(`/Kids\s*\[\s*(\d+)\s+(\d+)\s+R`)
+	pageTypePattern  = regexp.MustCompile(`/Type\s*/Page[\s/>]`)
+	annotsPattern    = regexp.MustCompile(`/Annots\s*(\[)?`)
+)
+
+func readPdfTrailer(pdf []byte) (pdfTrailer, error) {
+	matches := startXrefPattern.FindAllSubmatch(pdf, -1)
+	if len(matches) == 0 {
+		return pdfTrailer{}, fmt.Errorf("%w: missing startxref", ErrUnsupportedPdf)
+	}
+	startXref, err := strconv.Atoi(string(matches[len(matches)-1][1]))
+	if err != nil || startXref >= len(pdf) {
+		return pdfTrailer{}, fmt.Errorf("%w: invalid startxref", ErrUnsupportedPdf)
+	}
+
+	// Both classic trailers and cross reference streams carry /Root and /Size after the offset
+	tail := pdf[startXref:]
+	root := rootPattern.FindSubmatch(tail)
+	size := sizePattern.FindSubmatch(tail)
+	if root == nil || size == nil {
+		return pdfTrailer{}, fmt.Errorf("%w: missing trailer", ErrUnsupportedPdf)
+	}
+
+	t := pdfTrailer{startXref: startXref, id: string(idPattern.Find(tail))}
+	t.root.num, _ = strconv.Atoi(string(root[1]))
+	t.root.gen, _ = strconv.Atoi(string(root[2]))
+	t.size, _ = strconv.Atoi(string(size[1]))
+
+	return t, nil
+}
+
+// findPdfObject returns the dictionary of the last definition of an uncompressed object.
+func findPdfObject(pdf []byte, ref pdfRef) (pdfObject, error) {
+	pattern := regexp.MustCompile(fmt.Sprintf(`(?:^|\s)%d\s+%d\s+obj\s*<<`, ref.num, ref.gen))
+	matches := pattern.FindAllIndex(pdf, -1)
+	if len(matches) == 0 {
+		return pdfObject{}, fmt.Errorf("%w: object %s not found", ErrUnsupportedPdf, ref)
+	}
+	start := matches[len(matches)-1][1] - 2
+
+	end := pdfDictEnd(pdf, start)
+	if end < 0 {
+		return pdfObject{}, fmt.Errorf("%w: unterminated object %s", ErrUnsupportedPdf, ref)
+	}
+
+	return pdfObject{ref: ref, dict: pdf[start:end]}, nil
+}
+
+// pdfDictEnd returns the index just past the dictionary starting at start, skipping over strings
+// which may contain unbalanced delimiters.
+func pdfDictEnd(b []byte, start int) int {
+	depth := 0
+	for i := start; i < len(b); i++ {
+		switch {
+		case b[i] == '(':
+			parens := 0
+			for ; i < len(b); i++ {
+				if b[i] == '\\' {
+					i++
+				} else if b[i] == '(' {
+					parens++
+				} else if b[i] == ')' {
+					parens--
+					if parens == 0 {
+						break
+					}
+				}
+			}
+		case i+1 < len(b) && b[i] == '<' && b[i+1] == '<':
+			depth++
+			i++
+		case i+1 < len(b) && b[i] == '>' && b[i+1] == '>':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+func findFirstPdfPage(pdf []byte, catalog pdfObject) (pdfObject, error) {
+	m := pagesPattern.FindSubmatch(catalog.dict)
+	if m == nil {
+		return pdfObject{}, fmt.Errorf("%w: catalog has no pages", ErrUnsupportedPdf)
+	}
+
+	node := catalog
+	node.ref.num, _ = strconv.Atoi(string(m[1]))
+	node.ref.gen, _ = strconv.Atoi(string(m[2]))
+
+	// Walk down the first branch of the page tree. The depth is bounded to avoid reference loops
+	for range 32 {
+		obj, err := findPdfObject(pdf, node.ref)
+		if err != nil {
+			return pdfObject{}, err
+		}
+		if pageTypePattern.Match(obj.dict) {
+			return obj, nil
+		}
+
+		kid := kidsPattern.FindSubmatch(obj.dict)
+		if kid == nil {
+			return pdfObject{}, fmt.Errorf("%w: page tree has no kids", ErrUnsupportedPdf)
+		}
+		node.ref.num, _ = strconv.Atoi(string(kid[1]))
+		node.ref.gen, _ = strconv.Atoi(string(kid[2]))
+	}
+
+	return pdfObject{}, fmt.Errorf("%w: page tree is too deep", ErrUnsupportedPdf)
+}
+
+func addPdfAnnotation(pageDict []byte, annot pdfRef) ([]byte, error) {
+	m := annotsPattern.FindSubmatchIndex(pageDict)
+	if m == nil {
+		return insertIntoPdfDict(pageDict, fmt.Sprintf(" /Annots [%s]", annot)), nil
+	}
+	if m[2] < 0 {
+		return nil, fmt.Errorf("%w: indirect annotation arrays", ErrUnsupportedPdf)
+	}
+
+	out := make([]byte, 0, len(pageDict)+16)
+	out = append(out, pageDict[:m[3]]...)
+	out = append(out, annot.String()+" "...)
+	return append(out, pageDict[m[3]:]...), nil
+}
+
+// insertIntoPdfDict appends entries before the closing delimiter of a dictionary.
+func insertIntoPdfDict(dict []byte, entries string) []byte {
+	out := make([]byte, 0, len(dict)+len(entries))
+	out = append(out, dict[:len(dict)-2]...)
+	out = append(out, entries...)
+	return append(out, " >>"...)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// minimalPdf builds a single page pdf with a classic cross reference table, like the ones typst writes.
+func minimalPdf() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R >>",
+		"<< /Length 0 >>\nstream\n\nendstream",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n")
+	offsets := make([]int, len(objects))
+	for i, o := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f\r\n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n\r\n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return buf.Bytes()
+}
+
+func newTestSigner(t *testing.T) *PdfSigner {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Legal Aid"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	signer, err := NewPdfSigner(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return signer
+}
+
+func newTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestNewPdfSignerRejectsMismatchedKey(t *testing.T) {
+	cert, _ := newTestCertificate(t, "Test Legal Aid", nil, nil)
+	_, otherKey := newTestCertificate(t, "Someone Else", nil, nil)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(otherKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	_, err = NewPdfSigner(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+	)
+	if !errors.Is(err, ErrSigningKeyMismatch) {
+		t.Fatalf("expected ErrSigningKeyMismatch, got %v", err)
+	}
+}
+
+func TestPdfSignerFromPKCS12KeepsIntermediates(t *testing.T) {
+	root, rootKey := newTestCertificate(t, "Test Root", nil, nil)
+	intermediate, intermediateKey := newTestCertificate(t, "Test Intermediate", root, rootKey)
+	leaf, leafKey := newTestCertificate(t, "Test Legal Aid", intermediate, intermediateKey)
+
+	p12, err := pkcs12.Modern.Encode(leafKey, leaf, []*x509.Certificate{intermediate}, "secret")
+	if err != nil {
+		t.Fatalf("failed to encode pkcs12: %v", err)
+	}
+	signer, err := NewPdfSignerFromPKCS12(p12, "secret")
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	signed, err := signer.Sign(minimalPdf(), time.Now())
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+
+	// Only the root is trusted so the intermediate must be embedded in the signature
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	info, err := VerifyPdfSignature(signed, roots)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !info.Valid || !info.Trusted {
+		t.Fatalf("expected a valid trusted signature, got %+v", info)
+	}
+}
+
+func TestSignAndVerifyPdf(t *testing.T) {
+	signer := newTestSigner(t)
+
+	signed, err := signer.Sign(minimalPdf(), time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	if !bytes.HasPrefix(signed, minimalPdf()) {
+		t.Fatal("signing must only append to the original pdf")
+	}
+
+	info, err := VerifyPdfSignature(signed, signer.Roots())
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !info.Valid || !info.CoversWholeDocument || !info.Trusted {
+		t.Fatalf("expected a valid, complete and trusted signature, got %+v", info)
+	}
+	if info.Signer != "CN=Test Legal Aid" {
+		t.Errorf("expected signer %q, got %q", "CN=Test Legal Aid", info.Signer)
+	}
+	if info.SignedAt != "2025-10-01T12:00:00Z" {
+		t.Errorf("expected signing time %q, got %q", "2025-10-01T12:00:00Z", info.SignedAt)
+	}
+
+	untrusted, err := VerifyPdfSignature(signed, newTestSigner(t).Roots())
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !untrusted.Valid || untrusted.Trusted {
+		t.Fatalf("expected a valid but untrusted signature, got %+v", untrusted)
+	}
+}
+
+func TestVerifyPdfDetectsTampering(t *testing.T) {
+	signer := newTestSigner(t)
+
+	signed, err := signer.Sign(minimalPdf(), time.Now())
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+
+	tampered := bytes.Clone(signed)
+	i := bytes.Index(tampered, []byte("612 792"))
+	tampered[i] = '9'
+
+	info, err := VerifyPdfSignature(tampered, nil)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if info.Valid {
+		t.Fatal("expected tampered pdf to be invalid")
+	}
+
+	appended := append(bytes.Clone(signed), []byte("1 0 obj\n<< >>\nendobj\n")...)
+	info, err = VerifyPdfSignature(appended, nil)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !info.Valid || info.CoversWholeDocument {
+		t.Fatalf("expected signature to be valid but not cover appended content, got %+v", info)
+	}
+}
+
+func TestVerifyPdfUnsigned(t *testing.T) {
+	_, err := VerifyPdfSignature(minimalPdf(), nil)
+	if !errors.Is(err, ErrPdfNotSigned) {
+		t.Fatalf("expected ErrPdfNotSigned, got %v", err)
+	}
+}
+
+func TestVerifyPdfRejectsOverflowingByteRange(t *testing.T) {
+	pdf := append(minimalPdf(), []byte("5 0 obj\n<< /Type /Sig /ByteRange [0 1 9223372036854775000 9223372036854775000] /Contents <00> >>\nendobj\n")...)
+
+	_, err := VerifyPdfSignature(pdf, nil)
+	if !errors.Is(err, ErrMalformedPdfSignature) {
+		t.Fatalf("expected ErrMalformedPdfSignature, got %v", err)
+	}
+}
+
+func TestVerifyPdfHandler(t *testing.T) {
+	signer := newTestSigner(t)
+	r := router{
+		signer:       signer,
+		trustedCerts: signer.Roots(),
+	}
+
+	signed, err := signer.Sign(minimalPdf(), time.Now())
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/pdf/verify", bytes.NewReader(signed))
+	w := httptest.NewRecorder()
+
+	r.verifyPdf(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var result PdfVerifyResponseSuccess
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Status != statusSuccess || !result.Valid || !result.Trusted {
+		t.Fatalf("expected a valid trusted signature, got %+v", result)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/pdf/verify", bytes.NewReader(minimalPdf()))
+	w = httptest.NewRecorder()
+
+	r.verifyPdf(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidLetterStyle = errors.New("invalid letter style")
+)
+
+// A letter is written again when its grade is more than this above the target grade
+const readingGradeTolerance = 2
+
+// LetterStyle holds the options of /api/text which adjust how the letter is written. Empty options
+// leave the prompt as configured.
+type LetterStyle struct {
+	// cordial, neutral or firm
+	Tone string `json:"tone"`
+	// short, standard or detailed
+	Length string `json:"length"`
+	// simple, plain or standard
+	ReadingLevel string `json:"readingLevel"`
+}
+
+var letterTones = map[string]string{
+	"cordial": "Write in a cordial tone: warm and cooperative, assuming the landlord wants to help.",
+	"neutral": "Write in a neutral tone: factual and matter-of-fact.",
+	"firm":    "Write in a firm tone: direct and specific about what needs to be done and by when, as the problems may have been raised before. Remain polite, never hostile or threatening.",
+}
+
+type letterLength struct {
+	Instruction string
+	// Zero keeps the limit of the provider. Lengths can only lower it, see MaxOutputTokens.
+	MaxOutputTokens int
+}
+
+var letterLengths = map[string]letterLength{
+	"short":    {Instruction: "Keep the letter short: one or two brief paragraphs.", MaxOutputTokens: 300},
+	"standard": {},
+	// Detailed letters use the whole limit of the provider, MAX_OUTPUT_TOKENS
+	"detailed": {Instruction: "Write a detailed letter, describing each problem, where it is and how it affects the tenant in its own paragraph."},
+}
+
+type readingLevel struct {
+	Instruction string
+	// Flesch-Kincaid grade the letter should not exceed, zero for no target
+	TargetGrade int
+}
+
+var readingLevels = map[string]readingLevel{
+	"simple":   {Instruction: "Write in plain language a sixth grader can read: short sentences, common words and no jargon.", TargetGrade: 6},
+	"plain":    {Instruction: "Write in plain language an eighth grader can read: mostly short sentences and common words.", TargetGrade: 8},
+	"standard": {},
+}
+
+func (s LetterStyle) Validate() error {
+	if _, ok := letterTones[s.Tone]; s.Tone != "" && !ok {
+		return fmt.Errorf("%w: unknown tone %q", ErrInvalidLetterStyle, s.Tone)
+	}
+	if _, ok := letterLengths[s.Length]; s.Length != "" && !ok {
+		return fmt.Errorf("%w: unknown length %q", ErrInvalidLetterStyle, s.Length)
+	}
+	if _, ok := readingLevels[s.ReadingLevel]; s.ReadingLevel != "" && !ok {
+		return fmt.Errorf("%w: unknown readingLevel %q", ErrInvalidLetterStyle, s.ReadingLevel)
+	}
+	return nil
+}
+
+// PromptInstructions returns the sentences added to the system prompt, or an empty string
+func (s LetterStyle) PromptInstructions() string {
+	var lines []string
+	for _, line := range []string{letterTones[s.Tone], letterLengths[s.Length].Instruction, readingLevels[s.ReadingLevel].Instruction} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MaxOutputTokens returns the output token cap of the length, or zero for the provider's limit
+func (s LetterStyle) MaxOutputTokens() int {
+	return letterLengths[s.Length].MaxOutputTokens
+}
+
+// TargetGrade returns the highest Flesch-Kincaid grade of the reading level, or zero
+func (s LetterStyle) TargetGrade() int {
+	return readingLevels[s.ReadingLevel].TargetGrade
+}
+
+// LetterReadability is the readability of a letter written by InferLetter
+type LetterReadability struct {
+	Readability
+	// The target grade of the reading level, if any
+	TargetGrade int `json:"targetGrade,omitempty"`
+	// Set when the first letter missed the target grade and was written again
+	Retried bool `json:"retried"`
+}
+
+// InferLetter runs the conversation with the output token cap of the style and measures the
+// readability of the letter. When the letter misses the target grade of the style by more than two
+// grades, the model is asked once to simplify it, and the easier of the two letters is kept.
+func InferLetter(ctx context.Context, ip InferenceProvider, messages []Message, style LetterStyle) (string, LetterReadability, error) {
+	if n := style.MaxOutputTokens(); n > 0 {
+		ctx = WithMaxOutputTokens(ctx, n)
+	}
+
+	letter, _, err := ip.Infer(ctx, messages)
+	if err != nil {
+		return "", LetterReadability{}, err
+	}
+	result := LetterReadability{Readability: MeasureReadability(letter), TargetGrade: style.TargetGrade()}
+
+	if result.TargetGrade == 0 || result.FleschKincaidGrade <= float64(result.TargetGrade+readingGradeTolerance) {
+		return letter, result, nil
+	}
+
+	retry := append(messages[:len(messages):len(messages)],
+		Message{Role: RoleAssistant, Content: letter},
+		Message{Role: RoleUser, Content: fmt.Sprintf(
+			"This letter reads at grade %.1f. Rewrite it to read at grade %d or below: split long sentences and use common words. Keep everything it says and follow all of the instructions above.",
+			result.FleschKincaidGrade, result.TargetGrade)},
+	)
+	simpler, _, err := ip.Infer(ctx, retry)
+	if err != nil {
+		// The first letter is still usable
+		return letter, result, nil
+	}
+	result.Retried = true
+	if r := MeasureReadability(simpler); r.FleschKincaidGrade < result.FleschKincaidGrade {
+		letter, result.Readability = simpler, r
+	}
+	return letter, result, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const complexTestLetter = "I am writing to formally notify you regarding the persistent malfunctioning of the heating apparatus, which has consequently necessitated the utilization of supplementary electrical equipment throughout the residential unit."
+
+// scriptedProvider answers with its replies in order, and records the conversations and output
+// token caps it was called with
+type scriptedProvider struct {
+	replies         []string
+	conversations   [][]Message
+	maxOutputTokens []int
+}
+
+func (p *scriptedProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	p.conversations = append(p.conversations, messages)
+	p.maxOutputTokens = append(p.maxOutputTokens, MaxOutputTokens(ctx, 1000))
+	reply := p.replies[0]
+	p.replies = p.replies[1:]
+	return reply, nil, nil
+}
+
+func TestLetterStyleValidate(t *testing.T) {
+	if err := (LetterStyle{}).Validate(); err != nil {
+		t.Fatalf("expected no options to be valid, got %v", err)
+	}
+	if err := (LetterStyle{Tone: "firm", Length: "short", ReadingLevel: "simple"}).Validate(); err != nil {
+		t.Fatalf("expected valid options, got %v", err)
+	}
+	for _, s := range []LetterStyle{{Tone: "angry"}, {Length: "long"}, {ReadingLevel: "3"}} {
+		if err := s.Validate(); !errors.Is(err, ErrInvalidLetterStyle) {
+			t.Errorf("%+v: expected ErrInvalidLetterStyle, got %v", s, err)
+		}
+	}
+}
+
+func TestLetterStylePromptInstructions(t *testing.T) {
+	if got := (LetterStyle{Length: "standard", ReadingLevel: "standard"}).PromptInstructions(); got != "" {
+		t.Fatalf("expected no instructions for the standard options, got %q", got)
+	}
+
+	got := LetterStyle{Tone: "firm", ReadingLevel: "simple"}.PromptInstructions()
+	if !strings.Contains(got, "firm tone") || !strings.Contains(got, "sixth grader") {
+		t.Fatalf("unexpected instructions %q", got)
+	}
+}
+
+func TestMaxOutputTokens(t *testing.T) {
+	ctx := context.Background()
+	if got := MaxOutputTokens(ctx, 1000); got != 1000 {
+		t.Fatalf("expected the provider limit, got %d", got)
+	}
+	if got := MaxOutputTokens(WithMaxOutputTokens(ctx, 300), 1000); got != 300 {
+		t.Fatalf("expected the lower request limit, got %d", got)
+	}
+	if got := MaxOutputTokens(WithMaxOutputTokens(ctx, 1200), 1000); got != 1000 {
+		t.Fatalf("expected the request limit not to raise the provider limit, got %d", got)
+	}
+	if got := MaxOutputTokens(WithMaxOutputTokens(ctx, 300), 0); got != 300 {
+		t.Fatalf("expected the request limit for providers without one, got %d", got)
+	}
+}
+
+func TestInferLetterRetriesMissedGrade(t *testing.T) {
+	ip := &scriptedProvider{replies: []string{complexTestLetter, "The heat is broken. Please fix it."}}
+
+	letter, readability, err := InferLetter(context.Background(), ip, NewConversation("system", "input"), LetterStyle{ReadingLevel: "simple", Length: "short"})
+	if err != nil {
+		t.Fatalf("inference failed: %v", err)
+	}
+
+	if letter != "The heat is broken. Please fix it." || !readability.Retried || readability.TargetGrade != 6 {
+		t.Fatalf("expected the simpler retry, got %q %+v", letter, readability)
+	}
+	retry := ip.conversations[1]
+	if len(retry) != 4 || retry[2].Content != complexTestLetter || !strings.Contains(retry[3].Content, "grade 6 or below") {
+		t.Errorf("expected the retry to continue the conversation, got %+v", retry)
+	}
+	if ip.maxOutputTokens[0] != 300 || ip.maxOutputTokens[1] != 300 {
+		t.Errorf("expected the short output cap, got %v", ip.maxOutputTokens)
+	}
+}
+
+func TestInferLetterWithinTarget(t *testing.T) {
+	for _, style := range []LetterStyle{{ReadingLevel: "plain"}, {}} {
+		ip := &scriptedProvider{replies: []string{"The heat is broken. Please fix it."}}
+
+		_, readability, err := InferLetter(context.Background(), ip, NewConversation("system", "input"), style)
+		if err != nil {
+			t.Fatalf("inference failed: %v", err)
+		}
+		if readability.Retried || len(ip.conversations) != 1 || readability.Words != 7 {
+			t.Errorf("%+v: expected a single inference, got %+v", style, readability)
+		}
+	}
+
+	// Without a reading level, hard letters are measured but not written again
+	ip := &scriptedProvider{replies: []string{complexTestLetter}}
+	if _, readability, _ := InferLetter(context.Background(), ip, NewConversation("system", "input"), LetterStyle{}); readability.Retried {
+		t.Error("expected no retry without a target grade")
+	}
+}
+
+func TestTextHandlerStyle(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	ip := &scriptedProvider{replies: []string{"The heat is broken. Please fix it."}}
+	r := router{ip: ip, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"altcha":       altchaToken,
+		"answers":      map[string]string{"mainProblem": "no heat"},
+		"tone":         "firm",
+		"length":       "detailed",
+		"readingLevel": "plain",
+	})
+	w := httptest.NewRecorder()
+
+	r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+	var result TextResponseSuccess
+	if err := json.NewDecoder(w.Result().Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Readability == nil || result.Readability.Sentences != 2 || result.Readability.TargetGrade != 8 {
+		t.Fatalf("unexpected readability %+v", result.Readability)
+	}
+	if system, _ := SplitSystemPrompt(ip.conversations[0]); !strings.Contains(system, "firm tone") {
+		t.Error("expected the tone in the system prompt")
+	}
+	if ip.maxOutputTokens[0] != 1000 {
+		t.Errorf("expected detailed letters to use the limit of the provider, got %d", ip.maxOutputTokens[0])
+	}
+}
+
+func TestTextHandlerInvalidStyle(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	(&router{}).text(w, httptest.NewRequest(http.MethodPost, "/api/text", strings.NewReader(`{"tone": "angry"}`)))
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
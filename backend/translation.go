@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrUnsupportedTenantLanguage = errors.New("unsupported tenant language")
+)
+
+// TenantLanguage is a language the letter can be translated into for the tenant. The letter sent
+// to the landlord is always in English.
+type TenantLanguage struct {
+	// ISO 639-1 code, used in requests and to set the language of the translated page
+	Code string
+	// English name of the language, used in the translation prompt
+	Name string
+	// Label of the translated page, in the language itself
+	Notice string
+}
+
+var tenantLanguages = map[string]TenantLanguage{
+	"es": {
+		Code:   "es",
+		Name:   "Spanish",
+		Notice: "Traducción para sus registros. Esta página no se envía al arrendador.",
+	},
+	"so": {
+		Code:   "so",
+		Name:   "Somali",
+		Notice: "Tarjumaad loogu talagalay diiwaankaaga. Boggan looma dirayo mulkiilaha guriga.",
+	},
+	"ar": {
+		Code:   "ar",
+		Name:   "Arabic",
+		Notice: "ترجمة لسجلاتك. لا تُرسل هذه الصفحة إلى المالك.",
+	},
+}
+
+// LookupTenantLanguage returns the tenant language with the given code
+func LookupTenantLanguage(code string) (TenantLanguage, error) {
+	lang, ok := tenantLanguages[code]
+	if !ok {
+		return TenantLanguage{}, ErrUnsupportedTenantLanguage
+	}
+	return lang, nil
+}
+
+// TranslateLetter translates the body of a letter into the tenant's language
+func TranslateLetter(ctx context.Context, ip InferenceProvider, lang TenantLanguage, letter string) (string, error) {
+	translation, _, err := ip.Infer(ctx, NewConversation(RenderTranslationPrompt(lang.Name), letter))
+	return translation, err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// promptRecordingProvider records the conversations it was called with, and answers with the last
+// message
+type promptRecordingProvider struct {
+	prompts       []string
+	conversations [][]Message
+}
+
+func (p *promptRecordingProvider) Infer(ctx context.Context, messages []Message) (string, []Usage, error) {
+	system, _ := SplitSystemPrompt(messages)
+	p.prompts = append(p.prompts, system)
+	p.conversations = append(p.conversations, messages)
+	return "reply to: " + messages[len(messages)-1].Content, nil, nil
+}
+
+func TestRenderTranslationPrompt(t *testing.T) {
+	if prompt := RenderTranslationPrompt("Somali"); !strings.Contains(prompt, "Somali") {
+		t.Fatalf("expected the prompt to name the language, got %q", prompt)
+	}
+}
+
+func TestTextHandlerTranslation(t *testing.T) {
+	altchaService := NewAltchaService()
+	defer altchaService.usedStore.Stop()
+
+	ip := &promptRecordingProvider{}
+	r := router{ip: ip, altcha: altchaService}
+
+	altchaToken, err := createValidAltcha(altchaService.secret)
+	if err != nil {
+		t.Fatalf("failed to create altcha token: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"altcha":         altchaToken,
+		"answers":        map[string]string{"mainProblem": "no heat"},
+		"tenantLanguage": "es",
+	})
+	w := httptest.NewRecorder()
+
+	r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var result TextResponseSuccess
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(ip.prompts) != 2 || ip.prompts[1] != RenderTranslationPrompt("Spanish") {
+		t.Fatalf("expected a second inference with the translation prompt, got %q", ip.prompts)
+	}
+	if result.Translation != "reply to: "+result.Text {
+		t.Fatalf("expected the translation of the letter, got %q", result.Translation)
+	}
+}
+
+func TestTextHandlerUnsupportedTenantLanguage(t *testing.T) {
+	r := router{ip: &promptRecordingProvider{}}
+
+	body, _ := json.Marshal(map[string]any{"tenantLanguage": "xx"})
+	w := httptest.NewRecorder()
+
+	r.text(w, httptest.NewRequest(http.MethodPost, "/api/text", bytes.NewReader(body)))
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, w.Result().StatusCode)
+	}
+}
+
+func TestPdfHandlerUnsupportedTranslationLanguage(t *testing.T) {
+	r := router{}
+
+	body, _ := json.Marshal(PdfRequestV2{
+		Sender:            validTestAddress(),
+		Receiver:          validTestAddress(),
+		Body:              "Lorem ipsum",
+		TenantLanguage:    "xx",
+		TenantTranslation: "Lorem ipsum",
+	})
+	w := httptest.NewRecorder()
+
+	r.pdfV2(w, httptest.NewRequest(http.MethodPost, "/api/v2/pdf", bytes.NewReader(body)))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	var result PdfResponseError
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if result.Message != ErrUnsupportedTenantLanguage.Error() {
+		t.Fatalf("expected message %q, got %q", ErrUnsupportedTenantLanguage.Error(), result.Message)
+	}
+}
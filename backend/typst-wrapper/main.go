@@ -8,14 +8,27 @@ import (
 	"github.com/landlock-lsm/go-landlock/landlock"
 )
 
+const fontDir = "/usr/share/fonts"
+
 func main() {
 	// BestEffort is used because Docker running on a non-linux host will not have
 	// landlock support (see https://github.com/docker/roadmap/issues/835)
 
-	// only allow Typst to access its binary and libc
-	err := landlock.V5.BestEffort().RestrictPaths(
-		landlock.ROFiles("/bin/typst"),
-	)
+	// only allow Typst to access its binary and libc, plus the optional read-only directory of
+	// assets (such as a signature image) passed in argv[2]
+	rules := []landlock.Rule{landlock.ROFiles("/bin/typst")}
+	args := []string{"compile"}
+	// system fonts cover scripts the fonts embedded in typst do not, such as Arabic for translated
+	// letters
+	if _, err := os.Stat(fontDir); err == nil {
+		rules = append(rules, landlock.RODirs(fontDir))
+		args = append(args, "--font-path", fontDir)
+	}
+	if len(os.Args) > 2 {
+		rules = append(rules, landlock.RODirs(os.Args[2]))
+		args = append(args, "--root", os.Args[2])
+	}
+	err := landlock.V5.BestEffort().RestrictPaths(rules...)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -27,7 +40,8 @@ func main() {
 		os.Exit(1)
 	}
 	// the passes in parameters in argv[1]
-	cmd := exec.Command("typst", "compile", "-", "-", "--input=params="+os.Args[1])
+	args = append(args, "-", "-", "--input=params="+os.Args[1])
+	cmd := exec.Command("typst", args...)
 	cmd.Env = make([]string, 0)
 
 	// connect Typst's stdio to the wrapper's
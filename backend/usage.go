@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidPrices = errors.New("invalid prices")
+)
+
+// Usage is the number of tokens an inference took, returned by the provider which ran it. Providers
+// which are not told the number of tokens by their API estimate it.
+type Usage struct {
+	// Name of the provider in inferenceProviders, such as "aws"
+	Provider string
+	// Model id of the provider, such as AWS_BEDROCK_MODEL_ID
+	Model        string
+	InputTokens  int
+	OutputTokens int
+}
+
+// ModelPrice is the price of a model in US dollars, configured in app-config.yaml
+type ModelPrice struct {
+	Provider string `yaml:"provider"`
+	// The price applies to every model of the provider when empty
+	Model                  string  `yaml:"model"`
+	InputPerMillionTokens  float64 `yaml:"inputPerMillionTokens"`
+	OutputPerMillionTokens float64 `yaml:"outputPerMillionTokens"`
+}
+
+// CostLedger estimates the cost of inferences from their usage and the prices of the models, and
+// keeps the spend of the current day, in UTC, for the daily budget.
+type CostLedger struct {
+	prices []ModelPrice
+	// Spend in US dollars per day after which the ledger is over budget, 0 is no budget
+	dailyBudget float64
+	now         func() time.Time
+
+	mu sync.Mutex
+	// The day spent was spent on
+	day time.Time
+	// Includes the reservations of the inferences in progress
+	spent float64
+}
+
+// Reservation is the estimated cost of an inference in progress, held against the daily budget
+// until the inference is settled
+type Reservation struct {
+	day  time.Time
+	cost float64
+}
+
+func NewCostLedger(prices []ModelPrice, dailyBudget float64) (*CostLedger, error) {
+	seen := make(map[[2]string]bool)
+	for _, p := range prices {
+		if p.Provider == "" {
+			return nil, fmt.Errorf("%w: price without provider", ErrInvalidPrices)
+		}
+		if p.InputPerMillionTokens < 0 || p.OutputPerMillionTokens < 0 {
+			return nil, fmt.Errorf("%w: negative price of %s %s", ErrInvalidPrices, p.Provider, p.Model)
+		}
+		if seen[[2]string{p.Provider, p.Model}] {
+			return nil, fmt.Errorf("%w: %s %s is priced twice", ErrInvalidPrices, p.Provider, p.Model)
+		}
+		seen[[2]string{p.Provider, p.Model}] = true
+	}
+	return &CostLedger{prices: prices, dailyBudget: dailyBudget, now: time.Now}, nil
+}
+
+// Cost returns the estimated cost of an inference in US dollars. Models without a price are free,
+// such as the mock provider.
+func (l *CostLedger) Cost(u Usage) float64 {
+	var price *ModelPrice
+	for i, p := range l.prices {
+		if p.Provider != u.Provider {
+			continue
+		}
+		if p.Model == u.Model {
+			price = &l.prices[i]
+			break
+		}
+		if p.Model == "" {
+			price = &l.prices[i]
+		}
+	}
+	if price == nil {
+		return 0
+	}
+	return (float64(u.InputTokens)*price.InputPerMillionTokens + float64(u.OutputTokens)*price.OutputPerMillionTokens) / 1e6
+}
+
+// Estimate returns the highest cost an inference of a conversation can have with any priced model,
+// from the estimated input tokens and the output token limit. A limit of zero is no limit, for
+// which only the input is estimated.
+func (l *CostLedger) Estimate(messages []Message, maxOutputTokens int) float64 {
+	var input, output float64
+	for _, p := range l.prices {
+		input = max(input, p.InputPerMillionTokens)
+		output = max(output, p.OutputPerMillionTokens)
+	}
+	return (float64(EstimateInputTokens(messages))*input + float64(max(maxOutputTokens, 0))*output) / 1e6
+}
+
+// Reserve adds the estimated cost of an inference to the spend of the day before it is made, so
+// that concurrent inferences can not all start below the daily budget and overshoot it together.
+// It reports false without reserving once the spend of the day reached the budget. The reservation
+// must be settled once the inference completed.
+func (l *CostLedger) Reserve(estimate float64) (Reservation, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollOver()
+	if l.dailyBudget > 0 && l.spent >= l.dailyBudget {
+		return Reservation{}, false
+	}
+	l.spent += estimate
+	return Reservation{day: l.day, cost: estimate}, true
+}
+
+// Settle replaces a reservation with the cost of the inference which was made. A reservation of a
+// previous day is only released, it was rolled over with its day.
+func (l *CostLedger) Settle(ctx context.Context, r Reservation, usage []Usage) {
+	l.mu.Lock()
+	if r.day.Equal(l.day) {
+		l.spent -= r.cost
+	}
+	l.mu.Unlock()
+	l.Record(ctx, usage)
+}
+
+// Record adds the cost of the models an inference ran to the spend of the day and to the
+// analytics. Inferences which failed before a provider ran them have no usage.
+func (l *CostLedger) Record(ctx context.Context, usage []Usage) {
+	var cost float64
+	for _, u := range usage {
+		c := l.Cost(u)
+		analytics.RecordUsage(u, c)
+		cost += c
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollOver()
+	before := l.spent
+	l.spent += cost
+	if l.dailyBudget > 0 && before < l.dailyBudget && l.spent >= l.dailyBudget {
+		slog.WarnContext(ctx, "daily budget exceeded, inferences use the budget fallback provider or are refused until the end of the day", "budget", l.dailyBudget, "spent", l.spent)
+	}
+}
+
+// SpentToday returns the estimated spend of the current day in US dollars
+func (l *CostLedger) SpentToday() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollOver()
+	return l.spent
+}
+
+// OverBudget reports whether the spend of the current day reached the daily budget
+func (l *CostLedger) OverBudget() bool {
+	return l.dailyBudget > 0 && l.SpentToday() >= l.dailyBudget
+}
+
+// rollOver starts a new day of spending once the day changed, the lock must be held
+func (l *CostLedger) rollOver() {
+	day := l.now().UTC().Truncate(24 * time.Hour)
+	if !day.Equal(l.day) {
+		l.day = day
+		l.spent = 0
+	}
+}
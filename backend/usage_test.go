@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testPrices = []ModelPrice{
+	{Provider: "aws", InputPerMillionTokens: 3, OutputPerMillionTokens: 15},
+	{Provider: "aws", Model: "haiku", InputPerMillionTokens: 0.25, OutputPerMillionTokens: 1.25},
+}
+
+func TestNewCostLedger(t *testing.T) {
+	for _, prices := range [][]ModelPrice{
+		{{Model: "haiku"}},
+		{{Provider: "aws", InputPerMillionTokens: -1}},
+		{{Provider: "aws", Model: "haiku"}, {Provider: "aws", Model: "haiku"}},
+	} {
+		if _, err := NewCostLedger(prices, 0); !errors.Is(err, ErrInvalidPrices) {
+			t.Errorf("%+v: expected ErrInvalidPrices, got %v", prices, err)
+		}
+	}
+}
+
+func TestCostLedgerCost(t *testing.T) {
+	l, err := NewCostLedger(testPrices, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		usage Usage
+		cost  float64
+	}{
+		{Usage{Provider: "aws", Model: "haiku", InputTokens: 1_000_000, OutputTokens: 1_000_000}, 1.5},
+		// Other models of the provider have the price without a model
+		{Usage{Provider: "aws", Model: "sonnet", InputTokens: 1000, OutputTokens: 100}, 0.0045},
+		{Usage{Provider: "mock", InputTokens: 1000, OutputTokens: 1000}, 0},
+	}
+	for _, test := range tests {
+		if got := l.Cost(test.usage); got != test.cost {
+			t.Errorf("%+v: expected %v, got %v", test.usage, test.cost, got)
+		}
+	}
+}
+
+func TestCostLedgerDailyBudget(t *testing.T) {
+	analytics = &Analytics{}
+	l, err := NewCostLedger(testPrices, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 2, 23, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	l.Record(ctx, []Usage{Usage{Provider: "aws", Model: "haiku", InputTokens: 2_000_000}})
+	if l.SpentToday() != 0.5 || l.OverBudget() {
+		t.Fatalf("expected 0.5 spent within budget, got %v", l.SpentToday())
+	}
+	l.Record(ctx, []Usage{Usage{Provider: "aws", Model: "haiku", OutputTokens: 400_000}})
+	if !l.OverBudget() {
+		t.Fatalf("expected the budget to be spent, got %v", l.SpentToday())
+	}
+
+	// The budget is daily
+	now = now.Add(2 * time.Hour)
+	if l.SpentToday() != 0 || l.OverBudget() {
+		t.Fatalf("expected a new day to start at 0, got %v", l.SpentToday())
+	}
+
+	usage := analytics.GetStats().Usage["aws/haiku"]
+	if usage.Inferences != 2 || usage.InputTokens != 2_000_000 || usage.OutputTokens != 400_000 || usage.Cost != 1 {
+		t.Fatalf("unexpected usage stats %+v", usage)
+	}
+}
+
+func TestCostLedgerReserve(t *testing.T) {
+	analytics = &Analytics{}
+	l, err := NewCostLedger(testPrices, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 2, 23, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	// The estimate uses the highest prices of all models
+	conversation := NewConversation("", "no heat")
+	if got := l.Estimate(conversation, 1000); got != (7*3+1000*15)/1e6 {
+		t.Fatalf("unexpected estimate %v", got)
+	}
+
+	ctx := context.Background()
+	r, ok := l.Reserve(0.6)
+	if !ok || l.SpentToday() != 0.6 {
+		t.Fatalf("expected the reservation to be held, got %v", l.SpentToday())
+	}
+	if _, ok := l.Reserve(0.6); !ok {
+		t.Fatal("expected a reservation below the budget to be made")
+	}
+	if _, ok := l.Reserve(0.1); ok {
+		t.Fatalf("expected the reservations to spend the budget, got %v", l.SpentToday())
+	}
+	l.Settle(ctx, r, []Usage{Usage{Provider: "aws", Model: "haiku", InputTokens: 400_000}})
+	if got := l.SpentToday(); got < 0.699 || got > 0.701 {
+		t.Fatalf("expected the reservation to be replaced by the cost, got %v", got)
+	}
+
+	// A reservation of a previous day does not lower the spend of the next
+	r, _ = l.Reserve(0)
+	now = now.Add(2 * time.Hour)
+	l.Reserve(0.2)
+	l.Settle(ctx, Reservation{day: r.day, cost: 0.5}, nil)
+	if l.SpentToday() != 0.2 {
+		t.Fatalf("expected only the reservation of the day, got %v", l.SpentToday())
+	}
+
+	// Inferences without usage are not recorded
+	if usage := analytics.GetStats().Usage; len(usage) != 1 || usage["aws/haiku"].Inferences != 1 {
+		t.Fatalf("unexpected usage stats %+v", usage)
+	}
+}
+
+func TestMockInferenceProviderUsage(t *testing.T) {
+	provider := NewMockInferenceProvider()
+	provider.sleepDuration = 0
+	_, usage, err := provider.Infer(context.Background(), NewConversation("system", "no heat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].Provider != "mock" || usage[0].InputTokens == 0 || usage[0].OutputTokens == 0 {
+		t.Fatalf("expected the mock provider to return estimated usage, got %+v", usage)
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 )
@@ -92,8 +94,28 @@ func SendAnalyticsToTeams(ctx context.Context, stats AnalyticsStats) error {
 									Title: "PDFs Generated",
 									Value: fmt.Sprintf("%d", stats.PDFsGenerated),
 								},
+								{
+									Title: "Injection Attempts Detected",
+									Value: fmt.Sprintf("%d", stats.InjectionsDetected),
+								},
+								{
+									Title: "Estimated Inference Cost",
+									Value: fmt.Sprintf("$%.2f", stats.Cost()),
+								},
+								{
+									Title: "Inferences Over Daily Budget",
+									Value: fmt.Sprintf("%d", stats.BudgetFallbacks),
+								},
 							},
 						},
+						FactSet{
+							Type:  "FactSet",
+							Facts: promptVersionFacts(stats.PromptVersions),
+						},
+						FactSet{
+							Type:  "FactSet",
+							Facts: usageFacts(stats.Usage),
+						},
 					},
 				},
 			},
@@ -134,10 +156,40 @@ func SendAnalyticsToTeams(ctx context.Context, stats AnalyticsStats) error {
 		return fmt.Errorf("webhook returned unexpected status %d: %s", resp.StatusCode, resp.Status)
 	}
 
-	slog.InfoContext(ctx, "Successfully sent analytics to Teams", "inferences", stats.InferencesRun, "pdfs", stats.PDFsGenerated)
+	slog.InfoContext(ctx, "Successfully sent analytics to Teams", "inferences", stats.InferencesRun, "pdfs", stats.PDFsGenerated, "injections", stats.InjectionsDetected, "cost", stats.Cost())
 	return nil
 }
 
+// promptVersionFacts summarizes the outcomes of each prompt version, so versions can be compared
+func promptVersionFacts(versions map[string]PromptVersionStats) []Fact {
+	facts := []Fact{}
+	for _, name := range slices.Sorted(maps.Keys(versions)) {
+		s := versions[name]
+		value := fmt.Sprintf("%d letters", s.Letters)
+		if ratings := s.Helpful + s.Unhelpful; ratings > 0 {
+			value += fmt.Sprintf(", %d%% of %d ratings helpful", s.Helpful*100/ratings, ratings)
+		}
+		if s.Edited > 0 {
+			value += fmt.Sprintf(", mean edit distance %.2f of %d edited", s.MeanEditDistance(), s.Edited)
+		}
+		facts = append(facts, Fact{Title: "Prompt Version " + name, Value: value})
+	}
+	return facts
+}
+
+// usageFacts returns a fact per model with the tokens it used and their estimated cost
+func usageFacts(usage map[string]UsageStats) []Fact {
+	facts := []Fact{}
+	for _, name := range slices.Sorted(maps.Keys(usage)) {
+		s := usage[name]
+		facts = append(facts, Fact{
+			Title: "Model " + name,
+			Value: fmt.Sprintf("%d inferences, %d input and %d output tokens, $%.2f", s.Inferences, s.InputTokens, s.OutputTokens, s.Cost),
+		})
+	}
+	return facts
+}
+
 // StartAnalyticsWebhookScheduler starts a goroutine that periodically sends analytics to Teams
 func StartAnalyticsWebhookScheduler(interval time.Duration) {
 	if os.Getenv("TEAMS_WEBHOOK_URL") == "" {
@@ -180,7 +232,7 @@ func setupGracefulShutdown(server *http.Server) {
 			stats := analytics.GetStats()
 			slog.Info("Sending final analytics report before shutdown",
 				"inferences", stats.InferencesRun,
-				"pdfs", stats.PDFsGenerated)
+				"pdfs", stats.PDFsGenerated, "injections", stats.InjectionsDetected)
 
 			if err := SendAnalyticsToTeams(ctx, stats); err != nil {
 				slog.Error("Failed to send final analytics to Teams", "err", err)
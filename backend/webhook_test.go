@@ -39,3 +39,32 @@ func TestSendAnalyticsToTeamsNoWebhookURL(t *testing.T) {
 		t.Error("Expected error when TEAMS_WEBHOOK_URL is not set")
 	}
 }
+
+func TestPromptVersionFacts(t *testing.T) {
+	facts := promptVersionFacts(map[string]PromptVersionStats{
+		"short":    {Letters: 2},
+		"baseline": {Letters: 10, Helpful: 3, Unhelpful: 1, Edited: 2, EditDistanceTotal: 0.5},
+	})
+	if len(facts) != 2 || facts[0].Title != "Prompt Version baseline" || facts[1].Title != "Prompt Version short" {
+		t.Fatalf("expected a fact per version sorted by name, got %+v", facts)
+	}
+	if want := "10 letters, 75% of 4 ratings helpful, mean edit distance 0.25 of 2 edited"; facts[0].Value != want {
+		t.Fatalf("expected %q, got %q", want, facts[0].Value)
+	}
+	if facts[1].Value != "2 letters" {
+		t.Fatalf("unexpected fact %q", facts[1].Value)
+	}
+}
+
+func TestUsageFacts(t *testing.T) {
+	facts := usageFacts(map[string]UsageStats{
+		"mock":      {Inferences: 1, InputTokens: 10, OutputTokens: 20},
+		"aws/haiku": {Inferences: 3, InputTokens: 1500, OutputTokens: 600, Cost: 0.0123},
+	})
+	if len(facts) != 2 || facts[0].Title != "Model aws/haiku" || facts[1].Title != "Model mock" {
+		t.Fatalf("expected a fact per model sorted by name, got %+v", facts)
+	}
+	if want := "3 inferences, 1500 input and 600 output tokens, $0.01"; facts[0].Value != want {
+		t.Fatalf("expected %q, got %q", want, facts[0].Value)
+	}
+}
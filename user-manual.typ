@@ -18,7 +18,19 @@ The primary app configuration which is agnostic to the environment is done throu
     [*Environment Variable*], [*Default Value*], [*Description*],
   ),
   `MAX_INPUT_TOKENS`, `2000`, [Instructs the inference provider to not allow more than `MAX_INPUT_TOKENS` number of input tokens. Useful to bound the cost of inference and malicious requests],
-  `MAX_OUTPUT_TOKENS`, `800`, [Instructs the inference provider to not output more than `MAX_OUTPUT_TOKENS` number of output tokens. Useful to bound the cost of inference],
+  `MAX_OUTPUT_TOKENS`, `800`, [Instructs the inference provider to not output more than `MAX_OUTPUT_TOKENS` number of output tokens. Useful to bound the cost of inference. Letters of the `detailed` length use the whole limit, and `short` letters at most 300 tokens],
+  `INJECTION_ACTION`, `flag`, [What to do with answers, revision instructions and follow-up details which look like instructions to the model, such as "ignore previous instructions". `strip` removes the sentences, `flag` warns the model about them and `reject` refuses to write the letter. Detections are counted in the analytics report],
+  `GROUNDING_REGENERATE`, `false`, [Write a letter once more when it mentions dates, amounts, numbers or fixtures which are not in the tenant's answers or the laws of the rule pack, asking the model to leave them out. The unsupported claims are returned with the letter either way],
+  `IDEMPOTENCY_TTL`, `10m`, [How long responses of `/api/text`, `/api/pdf` and `/api/v2/pdf` requests with an `Idempotency-Key` header are kept to replay to retries, as a Go duration such as `5m`. Responses are kept encrypted in memory only, up to 64MiB in total. While that is full, responses are not kept and a retry runs the request again],
+  `RATE_LIMIT_REQUESTS_PER_SECOND`, `1`, [Number of inferences started per second, across all clients],
+  `RATE_LIMIT_BURST`, `3`, [Number of inferences which may start at once before `RATE_LIMIT_REQUESTS_PER_SECOND` applies],
+  `RATE_LIMIT_MAX_WAIT`, `20s`, [How long a request over the rate limit waits in line before it is refused with `429 Too Many Requests`, as a Go duration. Requests are served in the order they arrived, and each client address may only have one request waiting. `0s` refuses requests over the rate limit at once],
+  `RATE_LIMIT_MAX_QUEUE`, `50`, [Number of requests which may wait in line for the rate limit],
+  `TRUSTED_PROXIES`, `""`, [Comma separated addresses and CIDR ranges of the proxies in front of the server, such as the ingress. For requests from them, the client address used by the rate limits, jobs and prompt versions is the last address of `X-Forwarded-For` which is not a trusted proxy, or else `X-Real-IP`. Without it every request behind a proxy counts as the same client],
+  `FEEDBACK_RATE_LIMIT_PER_MINUTE`, `10`, [Number of requests to `/api/text/feedback` each client address may send per minute],
+  `DAILY_BUDGET`, `0`, [Estimated spend on inference in US dollars per day, in UTC, after which inferences are made by `BUDGET_FALLBACK_PROVIDER`, or refused without one, until the next day. The cost is estimated from the tokens each provider reports and the `prices` in `app-config.yaml`. Inferences in progress count with their highest possible cost until they complete, so that concurrent requests do not overshoot the budget. `0` is no budget],
+  `BUDGET_FALLBACK_PROVIDER`, `""`, [Inference provider used once `DAILY_BUDGET` is spent, such as a cheaper `ollama` model. Without one, requests which need inference are refused with `503 Service Unavailable` and a `Retry-After` until midnight UTC, when the budget of the next day starts],
+  `JOB_WORKERS`, `2`, [Number of `/api/jobs/text` jobs run at once. Jobs let slow inference providers, such as small Ollama models on a CPU, take longer than the 60 second request timeout],
 )
 
 === `app-config.yaml`
@@ -34,6 +46,30 @@ inference:
   userPrompt: |
     The tenant's main problems are {{.mainProblem}}.
 ```
+
+To try new prompts on part of the traffic, list prompt versions under `promptVersions`. Each request to `/api/text` is assigned a version in proportion to the weights, by a hash of the `clientId` of the request or of the client's address, so a tenant keeps the same version. Versions use `systemPrompt` and `userPrompt` unless they set their own. A request may name a version in `promptVersion`, but only one with a weight above zero, so a version with a weight of zero is never used by `/api/text` and can be tried before rolling it out with the evaluation harness. The version which wrote a letter is returned with it, logged, and counted in the analytics report together with the feedback sent to `/api/text/feedback`: how many tenants found the letter helpful and how much they edited it. Compare versions offline first with the #link(<evalprompts>)[evaluation harness], using `-candidate app-config.yaml#name` to select a version.
+
+```yaml
+inference:
+  promptVersions:
+    - name: baseline
+      weight: 90
+    - name: plain-language
+      weight: 10
+      systemPrompt: |
+        Rewrite the input into plain language a sixth grader can read.
+```
+
+The cost of inference is estimated from the tokens each provider reports and the `prices` of the models, in US dollars per million tokens. A price without a `model` applies to every model of the provider, and models without a price, such as the mock provider, are free. The tokens and estimated cost of each model, and the number of inferences made over `DAILY_BUDGET`, are included in the analytics report.
+
+```yaml
+inference:
+  prices:
+    - provider: aws
+      model: anthropic.claude-3-haiku-20240307-v1:0
+      inputPerMillionTokens: 0.25
+      outputPerMillionTokens: 1.25
+```
 The frontend UI elements are defined in app-config.yaml as well. This configuration file should act as an easy place for the administrator to update any text they want on the frontend including the title, the landing page of the website (and all elements within it), the button text, the questions, the terms of service, the tips, and any other text elements on the frontend. This allows for easy testing as well, as the tests read from this configuration file, so updates to text on the site do not break the CI pipeline. 
 === Inference <inference>
 
@@ -162,7 +198,7 @@ The website will then be available at #link("https://letter-generator.nrp-nautil
 - #item(`https://github.com/capstone-au2025/project`, [Project root directory])
   - #item(`backend/`, [Directory containing all backend code])
     - #item(`typst-wrapper/`, [Directory containing sandboxed #link("https://typst.app")[Typst] wrapper])
-      - #item(`main.go`, [Executable using #link("https://docs.kernel.org/userspace-api/landlock.html")[Landlock] to sandbox Typst])
+      - #item(`main.go`, [Executable using #link("https://docs.kernel.org/userspace-api/landlock.html")[Landlock] to sandbox Typst. Exhibit photos are decoded by the backend before rendering, outside of the sandbox])
     - #item(`analytics.go`, [Implementation of analytics])
     - #item(`analytics_test.go`, [Tests for analytics implementation])
     - #item(`aws.go`, [Implementation of #link(<bedrock>)[Amazon Bedrock inference provider]])
@@ -324,6 +360,32 @@ npm run coverage
 
 The frontend uses Vitest as its testing framework paired with React Testing Library for component testing. This test suite covers all major components and utilities, including routing logic, form submission flows, and state management. Tests are configured with happy-dom as the dom environment and utilize a shared setup file for consistent test configuration. The project includes npm scripts for running tests and generating coverage reports shown above, which helps ensure code quality and prevent regressions as the application evolves in the future. 
 
+== Prompt Evaluation <evalprompts>
+
+Before changing the prompts in `app-config.yaml`, compare the letters they write with the current ones. Copy `app-config.yaml`, edit `inference.systemPrompt` and `inference.userPrompt` in the copy, and run the following from the backend directory:
+
+```
+go run . evalprompts -candidate candidate.yaml -provider ollama -cassette eval/cassette.jsonl
+```
+
+Both versions write a letter for every answer set in `eval/dataset.jsonl`, one JSON object per line with an `id`, a `title`, the `answers` keyed by question name, and `missingDetails` when the letter should use placeholders such as `[Landlord Name]`. A case may also set the `receiverState`, `receiverCity`, `tone`, `length` and `readingLevel` of `/api/text`. The conversations are built as `/api/text` builds them, with the rule pack, style, answer markers and personal information placeholders. The letters are scored with deterministic checks:
+
+#table(
+  columns: 2,
+  table.header([*Check*], [*Fails when the letter*]),
+  `no-salutation`, [Starts with a salutation or ends with a sign-off, which the letter template adds],
+  `no-pii`, [Contains an email address, phone number, Social Security number or street address],
+  `no-legal-claims`, [Claims a violation, liability or legal action],
+  `placeholders`, [Uses a placeholder other than `[...]`, or has none when the case has `missingDetails`],
+  `length`, [Has fewer than `-min-words` or more than `-max-words` words],
+  `grounded`, [Mentions dates, amounts, numbers or fixtures which are not in the answers],
+  `content-policy`, [Violates the content policy],
+)
+
+A Markdown report of how many letters pass each check for both versions, their mean reading grade and the cases which pass or fail differently is written to standard output, or to `-out`. With `-strict` the command exits with status 1 when the candidate passes a check less often than the baseline, so it can gate prompt changes in CI.
+
+The replies of the provider are recorded in the cassette, keyed by conversation. Later runs replay them instead of calling the provider, and without `-provider` a run only replays, failing the cases which were not recorded. The prompts are rendered at the fixed time given by `-now` so recordings keep matching. Run `go run . evalprompts -h` for all options.
+
 = API Consumer Manual
 
 == `/healthz`